@@ -1,30 +1,166 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/camptocamp/terraboard/auth"
+	"github.com/camptocamp/terraboard/backup"
 	"github.com/camptocamp/terraboard/compare"
+	"github.com/camptocamp/terraboard/config"
 	"github.com/camptocamp/terraboard/db"
+	"github.com/camptocamp/terraboard/internal/terraform/states/statefile"
+	"github.com/camptocamp/terraboard/metrics"
 	"github.com/camptocamp/terraboard/state"
+	"github.com/camptocamp/terraboard/types"
+	"github.com/camptocamp/terraboard/util"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 )
 
-// JSONError is a wrapper function for errors
-// which prints them to the http.ResponseWriter as a JSON response
-func JSONError(w http.ResponseWriter, message string, err error) {
-	errObj := make(map[string]string)
-	errObj["error"] = message
-	errObj["details"] = fmt.Sprintf("%v", err)
-	j, _ := json.Marshal(errObj)
-	if _, err := io.WriteString(w, string(j)); err != nil {
-		log.Error(err.Error())
+// Envelope styles of paginated responses
+const (
+	// EnvelopeLegacy wraps items as {<key>, page, total}
+	EnvelopeLegacy = "legacy"
+	// EnvelopeJSONAPI wraps items as {data, meta: {page, total}}
+	EnvelopeJSONAPI = "jsonapi"
+)
+
+var responseEnvelope = EnvelopeLegacy
+
+// planInsertRetries is the number of retries of a plan insertion
+// failing on a transient error
+var planInsertRetries uint
+
+// planInsertBackoff is the delay before the first retry of a plan insertion,
+// doubled on each retry
+var planInsertBackoff = 500 * time.Millisecond
+
+// compareTimeout is the maximum duration of a State comparison
+var compareTimeout = 30 * time.Second
+
+// changelogMaxCount is the maximum number of versions compared in a changelog
+var changelogMaxCount = 20
+
+// changelogDefaultCount is the number of versions compared in a changelog
+// without count parameter
+const changelogDefaultCount = 10
+
+// quotaGroups are the configured resource quota groups
+var quotaGroups []config.QuotaConfig
+
+// namingPattern is the default naming convention of Resource names
+var namingPattern string
+
+// accountAttributes are the attribute keys holding the cloud account
+// of resources, by cloud
+var accountAttributes map[string][]string
+
+// pathFilter selects the state files ingested from providers
+var pathFilter state.PathFilter
+
+// maskedLockFields are the LockInfo fields masked in lock responses
+var maskedLockFields []string
+
+// allowRestore enables the restore of the database from a backup
+var allowRestore bool
+
+// locksPageSize is the number of locks per page returned by ListLocks
+const locksPageSize = 20
+
+// Setup sets up the API handlers configuration
+func Setup(c *config.Config) {
+	switch c.Web.ResponseEnvelope {
+	case EnvelopeLegacy, EnvelopeJSONAPI:
+		responseEnvelope = c.Web.ResponseEnvelope
+	default:
+		log.Warnf("Unknown response envelope '%s', using '%s'", c.Web.ResponseEnvelope, EnvelopeLegacy)
+		responseEnvelope = EnvelopeLegacy
+	}
+	planInsertRetries = c.DB.PlanInsertRetries
+	allowRestore = c.Backup.AllowRestore
+	namingPattern = c.Web.NamingPattern
+	quotaGroups = c.Quotas
+	pathFilter = state.PathFilter{Allow: c.Provider.AllowedPaths, Exclude: c.Provider.ExcludedPaths}
+	setupAttributeMasking(c.AttributeMasking)
+	accountAttributes = make(map[string][]string)
+	for _, a := range c.Web.AccountAttributes {
+		parts := strings.SplitN(a, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Warnf("Invalid account attribute '%s', expected '<cloud>:<key>'", a)
+			continue
+		}
+		accountAttributes[parts[0]] = append(accountAttributes[parts[0]], parts[1])
+	}
+	maskedLockFields = nil
+	for _, f := range c.Web.MaskLockFields {
+		switch f := strings.ToLower(f); f {
+		case "who", "info", "operation":
+			maskedLockFields = append(maskedLockFields, f)
+		default:
+			log.Warnf("Unknown lock field '%s', not masking it", f)
+		}
+	}
+	if c.Web.StreamThreshold > 0 {
+		streamThreshold = int(c.Web.StreamThreshold)
+	}
+	if c.Web.CompareTimeout > 0 {
+		compareTimeout = time.Duration(c.Web.CompareTimeout) * time.Second
+	}
+	if c.Web.ChangelogMaxCount > 0 {
+		changelogMaxCount = int(c.Web.ChangelogMaxCount)
+	}
+	if c.Web.ComparePageSize > 0 {
+		comparePageSize = int(c.Web.ComparePageSize)
+	}
+	if c.Web.CompareCacheTTL > 0 {
+		compareCacheTTL = time.Duration(c.Web.CompareCacheTTL) * time.Minute
+	}
+}
+
+// paginatedResponse builds the response object of a paginated endpoint
+// according to the configured envelope style
+func paginatedResponse(key string, items interface{}, page, total int) map[string]interface{} {
+	response := make(map[string]interface{})
+	if responseEnvelope == EnvelopeJSONAPI {
+		response["data"] = items
+		response["meta"] = map[string]int{
+			"page":  page,
+			"total": total,
+		}
+		return response
+	}
+
+	response[key] = items
+	response["page"] = page
+	response["total"] = total
+	return response
+}
+
+// requireAdmin checks that the user of a request has one of the admin roles
+// before performing an action, writing the error response otherwise
+func requireAdmin(w http.ResponseWriter, r *http.Request, action string) bool {
+	if !auth.IsAuthenticated(r) {
+		JSONErrorCode(w, CodeUnauthorized, "Authentication required to "+action, fmt.Errorf("missing user headers"))
+		return false
+	}
+	if !auth.IsAdmin(r) {
+		JSONErrorCode(w, CodeForbidden, "Admin role required to "+action, fmt.Errorf("user is not an admin"))
+		return false
 	}
+	return true
 }
 
 // ListTerraformVersionsWithCount lists Terraform versions with their associated
@@ -43,19 +179,56 @@ func ListTerraformVersionsWithCount(w http.ResponseWriter, r *http.Request, d *d
 	}
 }
 
-// ListStateStats returns State information for a given path as parameter
-func ListStateStats(w http.ResponseWriter, r *http.Request, d *db.Database) {
-	query := r.URL.Query()
-	states, page, total := d.ListStateStats(query)
+// ListResourcesByTFVersion lists Terraform versions with the count of
+// lineages on them and the total count of resources these lineages manage
+func ListResourcesByTFVersion(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	versions, err := d.ListResourcesByTFVersion()
+	if err != nil {
+		JSONError(w, "Failed to retrieve resources by terraform version", err)
+		return
+	}
 
-	// Build response object
-	response := make(map[string]interface{})
-	response["states"] = states
-	response["page"] = page
-	response["total"] = total
-	j, err := json.Marshal(response)
+	writeList(w, r, versions, versions)
+}
+
+// GetLatestVersionAdoption returns the share of lineages and resources
+// on the most recent Terraform version, along with the laggard count
+func GetLatestVersionAdoption(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	adoption, err := d.GetLatestVersionAdoption()
 	if err != nil {
-		JSONError(w, "Failed to marshal states", err)
+		JSONError(w, "Failed to retrieve latest version adoption", err)
+		return
+	}
+
+	j, err := json.Marshal(adoption)
+	if err != nil {
+		JSONError(w, "Failed to marshal latest version adoption", err)
+		return
+	}
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// GetAttributeVolatility ranks the attribute keys of the Resource type given
+// by the "resource_type" parameter by how often their values changed
+// across the versions of the lineages
+func GetAttributeVolatility(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	resourceType := r.URL.Query().Get("resource_type")
+	if resourceType == "" {
+		JSONErrorCode(w, CodeInvalidParameter, "Missing resource_type parameter", fmt.Errorf("resource_type parameter is required"))
+		return
+	}
+
+	results, err := d.GetAttributeVolatility(resourceType)
+	if err != nil {
+		JSONError(w, "Failed to retrieve attribute volatility", err)
+		return
+	}
+
+	j, err := json.Marshal(results)
+	if err != nil {
+		JSONError(w, "Failed to marshal attribute volatility", err)
 		return
 	}
 	if _, err := io.WriteString(w, string(j)); err != nil {
@@ -63,6 +236,42 @@ func ListStateStats(w http.ResponseWriter, r *http.Request, d *db.Database) {
 	}
 }
 
+// ListCloudAccounts lists the distinct cloud accounts used across
+// the lineages, with the count of lineages using each of them
+func ListCloudAccounts(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	accounts, err := d.ListCloudAccounts(accountAttributes)
+	if err != nil {
+		JSONError(w, "Failed to retrieve cloud accounts", err)
+		return
+	}
+
+	writeList(w, r, accounts, accounts)
+}
+
+// ListStateStats returns State information for a given path as parameter
+// Optional "&show_all_versions=true" parameter to include hidden Terraform versions.
+// Optional "&show_empty=true" parameter to include hidden empty States.
+// Optional "&all=true" parameter to list all States, regardless of the page.
+func ListStateStats(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	listStateStats(w, r, d)
+}
+
+// stateStatsStore lists the latest State of each Lineage
+type stateStatsStore interface {
+	ListStateStats(query url.Values) ([]types.StateStat, int, int)
+}
+
+func listStateStats(w http.ResponseWriter, r *http.Request, ss stateStatsStore) {
+	query := r.URL.Query()
+	if query.Get("all") == "true" {
+		// States are listed without paging when no page is given
+		query.Del("page")
+	}
+	states, page, total := ss.ListStateStats(query)
+
+	writeList(w, r, paginatedResponse("states", states, page, total), states)
+}
+
 // GetState provides information on a State
 func GetState(w http.ResponseWriter, r *http.Request, d *db.Database) {
 	params := mux.Vars(r)
@@ -75,11 +284,1630 @@ func GetState(w http.ResponseWriter, r *http.Request, d *db.Database) {
 			return
 		}
 	}
-	state := d.GetState(params["lineage"], versionID)
+	state := d.GetState(params["lineage"], versionID)
+	maskAttributes(&state, attributeMask(r))
+
+	writeJSON(w, state, "Failed to marshal state")
+}
+
+// stateStore retrieves State versions from the database
+type stateStore interface {
+	DefaultVersion(lineage string) (string, error)
+	GetState(lineage, versionID string) types.State
+}
+
+// GetStateRaw returns the Terraform State file of a State version,
+// as stored on its provider or reconstructed from the database
+func GetStateRaw(w http.ResponseWriter, r *http.Request, d *db.Database, sps []state.Provider) {
+	stateRaw(w, r, d, sps)
+}
+
+func stateRaw(w http.ResponseWriter, r *http.Request, ss stateStore, sps []state.Provider) {
+	lineage := mux.Vars(r)["lineage"]
+	versionID := r.URL.Query().Get("versionid")
+	var err error
+	if versionID == "" {
+		versionID, err = ss.DefaultVersion(lineage)
+		if err != nil {
+			JSONError(w, "Failed to retrieve default version", err)
+			return
+		}
+	}
+	st := ss.GetState(lineage, versionID)
+	if st.Path == "" {
+		JSONError(w, "Failed to retrieve state", db.ErrUnknownVersion)
+		return
+	}
+
+	// Masked attributes can only be hidden from the reconstructed State
+	var raw []byte
+	masked := attributeMask(r)
+	if masked == nil {
+		raw = providerStateRaw(sps, st.Provider, st.Path, versionID)
+	}
+	if raw == nil {
+		maskAttributes(&st, masked)
+		if raw, err = db.RawState(st, lineage); err != nil {
+			JSONError(w, "Failed to reconstruct state", err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", "attachment; filename=terraform.tfstate")
+	if _, err := w.Write(raw); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// providerStateRaw returns the State file of a State version from the
+// provider it was ingested from, or nil if the provider no longer has it
+func providerStateRaw(sps []state.Provider, provider, path, versionID string) []byte {
+	for _, sp := range sps {
+		if sp.Name() != provider {
+			continue
+		}
+		raw, err := sp.GetStateRaw(path, versionID)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"provider":   provider,
+				"path":       path,
+				"version_id": versionID,
+				"error":      err,
+			}).Warn("Failed to retrieve state from provider, reconstructing it")
+			return nil
+		}
+		return raw
+	}
+	return nil
+}
+
+// redactAttributes masks the values of the State attributes with the given keys
+func redactAttributes(st *types.State, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	redacted := make(map[string]bool)
+	for _, k := range keys {
+		redacted[k] = true
+	}
+	maskAttributes(st, func(key string) bool { return redacted[key] })
+}
+
+// CreateShareLink creates a time-limited signed link to a State version.
+// /api/share POST endpoint callback
+func CreateShareLink(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+
+	var req struct {
+		Lineage   string   `json:"lineage"`
+		VersionID string   `json:"version_id"`
+		Redact    []string `json:"redact"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONErrorCode(w, CodeInvalidParameter, "Failed to decode share request", err)
+		return
+	}
+
+	if req.VersionID == "" {
+		var err error
+		req.VersionID, err = d.DefaultVersion(req.Lineage)
+		if err != nil {
+			JSONError(w, "Failed to retrieve default version", err)
+			return
+		}
+	}
+
+	token, expires, err := auth.NewShareToken(req.Lineage, req.VersionID, req.Redact, time.Now())
+	if err != nil {
+		JSONError(w, "Failed to create share token", err)
+		return
+	}
+
+	j, err := json.Marshal(map[string]interface{}{
+		"token":   token,
+		"url":     "/api" + util.GetFullPath("shared/"+token),
+		"expires": expires,
+	})
+	if err != nil {
+		JSONError(w, "Failed to marshal json", err)
+		return
+	}
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// GetSharedState returns the State version granted by a signed share token,
+// with its redacted attributes masked
+func GetSharedState(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	st, err := auth.ParseShareToken(mux.Vars(r)["token"], time.Now())
+	if err != nil {
+		JSONError(w, "Invalid shared link", err)
+		return
+	}
+
+	state := d.GetState(st.Lineage, st.VersionID)
+	redactAttributes(&state, st.Redact)
+	maskAttributes(&state, attributeMask(r))
+
+	j, err := json.Marshal(state)
+	if err != nil {
+		JSONError(w, "Failed to marshal state", err)
+		return
+	}
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// GetResourceAddresses lists the resource addresses of a State version
+// (the default one unless 'versionid' is given), optionally restricted
+// to a 'resource_type' and a 'module'. Rendered as a JSON array or,
+// with the text format, one address per line.
+func GetResourceAddresses(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	params := mux.Vars(r)
+	query := r.URL.Query()
+	versionID := query.Get("versionid")
+	var err error
+	if versionID == "" {
+		if versionID, err = d.DefaultVersion(params["lineage"]); err != nil {
+			JSONError(w, "Failed to retrieve default version", err)
+			return
+		}
+	}
+
+	addresses, err := d.GetResourceAddresses(params["lineage"], versionID, query.Get("resource_type"), query.Get("module"))
+	if err != nil {
+		JSONError(w, "Failed to retrieve resource addresses", err)
+		return
+	}
+
+	writeList(w, r, addresses, addresses)
+}
+
+// GetStateFingerprint returns the fingerprint of a State version
+func GetStateFingerprint(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	params := mux.Vars(r)
+	fingerprint, err := d.GetStateFingerprint(params["lineage"], params["versionid"])
+	if err != nil {
+		JSONError(w, "Failed to retrieve state fingerprint", err)
+		return
+	}
+
+	response := make(map[string]interface{})
+	response["lineage"] = params["lineage"]
+	response["version_id"] = params["versionid"]
+	response["fingerprint"] = fingerprint
+	j, err := json.Marshal(response)
+	if err != nil {
+		JSONError(w, "Failed to marshal state fingerprint", err)
+		return
+	}
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// GetVersionProvenance returns everything known about how a State version
+// came to be: its provider and path, its ingestion, the metadata reported
+// by its provider, the Plan correlated to it and its previous version.
+// /api/lineages/{lineage}/versions/{versionid}/provenance GET endpoint callback
+func GetVersionProvenance(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	params := mux.Vars(r)
+	provenance, err := d.GetVersionProvenance(params["lineage"], params["versionid"])
+	if err != nil {
+		JSONError(w, "Failed to retrieve version provenance", err)
+		return
+	}
+
+	writeJSON(w, provenance, "Failed to marshal version provenance")
+}
+
+// GetChangedLineages returns the lineages which ingested new versions
+// between the "from" and "to" parameters (RFC 3339 dates, "to" defaults to now)
+func GetChangedLineages(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	query := r.URL.Query()
+	from, err := time.Parse(time.RFC3339, query.Get("from"))
+	if err != nil {
+		JSONErrorCode(w, CodeInvalidParameter, "Invalid from parameter", err)
+		return
+	}
+	to := time.Now()
+	if v := query.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			JSONErrorCode(w, CodeInvalidParameter, "Invalid to parameter", err)
+			return
+		}
+	}
+
+	changes, err := d.GetChangedLineages(from, to)
+	if err != nil {
+		JSONError(w, "Failed to retrieve changed lineages", err)
+		return
+	}
+
+	writeList(w, r, changes, changes)
+}
+
+// GetChangelog returns the changelog of a Lineage: with 'from', and
+// optionally 'to', the net created, updated and deleted resources over
+// the versions modified in between, otherwise the summary of each of the
+// most recent versions, see lineageChangelog.
+// /api/lineages/{lineage}/changelog GET endpoint callback
+func GetChangelog(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	query := r.URL.Query()
+	if query.Get("from") == "" && query.Get("to") == "" {
+		lineageChangelog(w, r, d)
+		return
+	}
+	if query.Get("count") != "" {
+		JSONErrorCode(w, CodeInvalidParameter, "Invalid count parameter", fmt.Errorf("count can't be combined with from and to"))
+		return
+	}
+
+	from, err := time.Parse(time.RFC3339, query.Get("from"))
+	if err != nil {
+		JSONErrorCode(w, CodeInvalidParameter, "Invalid from parameter", err)
+		return
+	}
+	to := time.Now()
+	if v := query.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			JSONErrorCode(w, CodeInvalidParameter, "Invalid to parameter", err)
+			return
+		}
+	}
+
+	changelog, err := d.GetChangelog(mux.Vars(r)["lineage"], from, to)
+	if err != nil {
+		JSONError(w, "Failed to retrieve changelog", err)
+		return
+	}
+
+	writeJSON(w, changelog, "Failed to marshal changelog")
+}
+
+// AuditResourceNames returns the compliance of Resource names with
+// a naming convention, given as 'pattern' or configured
+func AuditResourceNames(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	query := r.URL.Query()
+	pattern := query.Get("pattern")
+	if pattern == "" {
+		pattern = namingPattern
+	}
+	if pattern == "" {
+		JSONErrorCode(w, CodeInvalidParameter, "Missing pattern parameter", fmt.Errorf("no naming pattern given nor configured"))
+		return
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		JSONErrorCode(w, CodeInvalidParameter, "Invalid pattern parameter", err)
+		return
+	}
+
+	audit, err := d.AuditResourceNames(re, query.Get("resource_type"))
+	if err != nil {
+		JSONError(w, "Failed to audit resource names", err)
+		return
+	}
+
+	j, err := json.Marshal(audit)
+	if err != nil {
+		JSONError(w, "Failed to marshal naming audit", err)
+		return
+	}
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// GetMissingTags returns, by pages of lineages, the resources
+// missing any of the required tag keys
+func GetMissingTags(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	query := r.URL.Query()
+	var required []string
+	for _, t := range strings.Split(query.Get("required"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			required = append(required, t)
+		}
+	}
+	if len(required) == 0 {
+		JSONErrorCode(w, CodeInvalidParameter, "Missing required parameter", fmt.Errorf("no required tag given"))
+		return
+	}
+
+	page := 1
+	if v := query.Get("page"); v != "" {
+		var err error
+		if page, err = strconv.Atoi(v); err != nil {
+			JSONErrorCode(w, CodeInvalidParameter, "Invalid page parameter", err)
+			return
+		}
+		if page < 1 {
+			page = 1
+		}
+	}
+
+	lineages, total, err := d.GetMissingTags(required, query.Get("resource_type"), page)
+	if err != nil {
+		JSONError(w, "Failed to audit resource tags", err)
+		return
+	}
+
+	writeList(w, r, paginatedResponse("lineages", lineages, page, total), lineages)
+}
+
+// GetPlanStateGaps returns, by pages, the time elapsed between the most recent
+// Plan and State version of each Lineage, sorted by gap descending.
+// Optional "threshold" parameter (as a duration, 24h by default) above which
+// lineages are flagged.
+// /api/audit/plan-state-gap GET endpoint callback
+func GetPlanStateGaps(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	query := r.URL.Query()
+
+	threshold := 24 * time.Hour
+	if v := query.Get("threshold"); v != "" {
+		var err error
+		if threshold, err = time.ParseDuration(v); err != nil {
+			JSONErrorCode(w, CodeInvalidParameter, "Invalid threshold parameter", err)
+			return
+		}
+	}
+
+	page := 1
+	if v := query.Get("page"); v != "" {
+		var err error
+		if page, err = strconv.Atoi(v); err != nil {
+			JSONErrorCode(w, CodeInvalidParameter, "Invalid page parameter", err)
+			return
+		}
+		if page < 1 {
+			page = 1
+		}
+	}
+
+	gaps, total, err := d.GetPlanStateGaps(threshold, page)
+	if err != nil {
+		JSONError(w, "Failed to audit plan and state gaps", err)
+		return
+	}
+
+	writeList(w, r, paginatedResponse("lineages", gaps, page, total), gaps)
+}
+
+// GetQuotas returns the resource count of each configured quota group
+// and whether it exceeds its quota
+func GetQuotas(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	usages, err := d.GetQuotaUsage(quotaGroups)
+	if err != nil {
+		JSONError(w, "Failed to retrieve quotas", err)
+		return
+	}
+
+	writeList(w, r, usages, usages)
+}
+
+// GetLockHolders returns the holders of the locks recorded on a Lineage
+// within the last 'days' days (30 by default)
+func GetLockHolders(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	params := mux.Vars(r)
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		var err error
+		if days, err = strconv.Atoi(v); err != nil || days < 1 {
+			JSONErrorCode(w, CodeInvalidParameter, "Invalid days parameter", err)
+			return
+		}
+	}
+
+	holders, err := d.GetLockHolders(params["lineage"], days, time.Now())
+	if err != nil {
+		JSONError(w, "Failed to retrieve lock holders", err)
+		return
+	}
+
+	writeList(w, r, holders, holders)
+}
+
+// GetNewResources returns, by pages, the resources which first appeared
+// in a version modified between 'from' and 'to' (now by default)
+func GetNewResources(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	query := r.URL.Query()
+	from, err := time.Parse(time.RFC3339, query.Get("from"))
+	if err != nil {
+		JSONErrorCode(w, CodeInvalidParameter, "Invalid from parameter", err)
+		return
+	}
+	to := time.Now()
+	if v := query.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			JSONErrorCode(w, CodeInvalidParameter, "Invalid to parameter", err)
+			return
+		}
+	}
+	page := 1
+	if v := query.Get("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil {
+			JSONErrorCode(w, CodeInvalidParameter, "Invalid page parameter", err)
+			return
+		}
+		if page < 1 {
+			page = 1
+		}
+	}
+
+	resources, total, err := d.GetNewResources(from, to, page)
+	if err != nil {
+		JSONError(w, "Failed to retrieve new resources", err)
+		return
+	}
+
+	writeList(w, r, paginatedResponse("resources", resources, page, total), resources)
+}
+
+// SetReferenceVersion pins the 'versionid' version of a Lineage
+// as its known-good reference
+func SetReferenceVersion(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+
+	params := mux.Vars(r)
+	versionID := r.URL.Query().Get("versionid")
+	if err := d.SetReferenceVersion(params["lineage"], versionID); err != nil {
+		JSONError(w, "Failed to set reference version", err)
+		return
+	}
+
+	j, err := json.Marshal(map[string]string{
+		"lineage":           params["lineage"],
+		"reference_version": versionID,
+	})
+	if err != nil {
+		JSONError(w, "Failed to marshal reference version", err)
+		return
+	}
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// DeleteLineage removes a Lineage along with all its versions and plans.
+// The States of the Lineage are ignored from then on when the providers
+// are synchronized, even though they're still stored there.
+// Only admins may delete lineages.
+func DeleteLineage(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	if !requireAdmin(w, r, "delete lineages") {
+		return
+	}
+
+	lineage := mux.Vars(r)["lineage"]
+	deleted, err := d.RemoveLineage(lineage, r.Header.Get("X-Forwarded-User"))
+	if err != nil {
+		JSONError(w, "Failed to delete lineage", err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"lineage":  lineage,
+		"versions": deleted,
+		"user":     r.Header.Get("X-Forwarded-User"),
+		"email":    r.Header.Get("X-Forwarded-Email"),
+	}).Warn("Deleted lineage")
+
+	j, err := json.Marshal(map[string]interface{}{
+		"lineage":          lineage,
+		"deleted_versions": deleted,
+	})
+	if err != nil {
+		JSONError(w, "Failed to marshal deleted lineage", err)
+		return
+	}
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// referenceStore retrieves the States compared by the drift from reference
+type referenceStore interface {
+	GetReferenceVersion(lineage string) (string, error)
+	stateStore
+}
+
+// GetDriftFromReference compares the default version of a Lineage
+// with its reference version
+func GetDriftFromReference(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	driftFromReference(w, r, d)
+}
+
+func driftFromReference(w http.ResponseWriter, r *http.Request, rs referenceStore) {
+	lineage := mux.Vars(r)["lineage"]
+	reference, err := rs.GetReferenceVersion(lineage)
+	if err != nil {
+		JSONError(w, "Failed to retrieve reference version", err)
+		return
+	}
+	current, err := rs.DefaultVersion(lineage)
+	if err != nil {
+		JSONError(w, "Failed to retrieve default version", err)
+		return
+	}
+
+	masked := attributeMask(r)
+	from, to := rs.GetState(lineage, reference), rs.GetState(lineage, current)
+	maskAttributes(&from, masked)
+	maskAttributes(&to, masked)
+
+	ctx, cancel := context.WithTimeout(r.Context(), compareTimeout)
+	defer cancel()
+	drift, err := compare.Compare(ctx, from, to)
+	if err != nil {
+		JSONError(w, "Failed to compare with reference version", err)
+		return
+	}
+
+	j, err := json.Marshal(drift)
+	if err != nil {
+		JSONError(w, "Failed to marshal drift from reference", err)
+		return
+	}
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// ListEmptyLineages returns the lineages whose most recent State holds
+// at most max_resources managed resources (0 by default), optionally only
+// those without activity for stale_days, as candidates for cleanup
+// /api/maintenance/empty-lineages GET endpoint callback
+func ListEmptyLineages(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	query := r.URL.Query()
+	maxResources := 0
+	if v := query.Get("max_resources"); v != "" {
+		var err error
+		if maxResources, err = strconv.Atoi(v); err != nil || maxResources < 0 {
+			JSONErrorCode(w, CodeInvalidParameter, "Invalid max_resources parameter", fmt.Errorf("invalid resource count %s", v))
+			return
+		}
+	}
+	var staleBefore time.Time
+	if v := query.Get("stale_days"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			JSONErrorCode(w, CodeInvalidParameter, "Invalid stale_days parameter", fmt.Errorf("invalid day count %s", v))
+			return
+		}
+		staleBefore = time.Now().AddDate(0, 0, -days)
+	}
+
+	lineages, err := d.ListSmallLineages(maxResources, staleBefore)
+	if err != nil {
+		JSONError(w, "Failed to list empty lineages", err)
+		return
+	}
+
+	writeJSON(w, lineages, "Failed to marshal empty lineages")
+}
+
+// GetDrift returns the resources the most recent Plan of a Lineage
+// intends to change on its most recent State version
+// /api/lineages/{lineage}/drift GET endpoint callback
+func GetDrift(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	drift, err := d.GetDrift(mux.Vars(r)["lineage"])
+	if err != nil {
+		JSONError(w, "Failed to retrieve drift", err)
+		return
+	}
+
+	writeJSON(w, drift, "Failed to marshal drift")
+}
+
+// GetLineageTimeline returns, by pages, the Plans and State versions
+// of a Lineage merged chronologically
+func GetLineageTimeline(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	params := mux.Vars(r)
+	page := 1
+	if v := r.URL.Query().Get("page"); v != "" {
+		var err error
+		if page, err = strconv.Atoi(v); err != nil {
+			JSONErrorCode(w, CodeInvalidParameter, "Invalid page parameter", err)
+			return
+		}
+		if page < 1 {
+			page = 1
+		}
+	}
+
+	timeline, total, err := d.GetLineageTimeline(params["lineage"], page)
+	if err != nil {
+		JSONError(w, "Failed to retrieve lineage timeline", err)
+		return
+	}
+
+	writeList(w, r, paginatedResponse("timeline", timeline, page, total), timeline)
+}
+
+// GetLineageActivity returns the activity (version history) of a Lineage
+func GetLineageActivity(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	params := mux.Vars(r)
+	activity := d.GetLineageActivity(params["lineage"])
+
+	j, err := json.Marshal(activity)
+	if err != nil {
+		JSONError(w, "Failed to marshal state activity", err)
+		return
+	}
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// ListStateVersions lists the stored versions of a Lineage, the most recent first.
+// Optional "&limit=X" parameter to limit requested quantity of versions.
+// Optional "&page=X" parameter to add an offset to the query and enable pagination.
+// /api/lineages/{lineage}/versions GET endpoint callback
+func ListStateVersions(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	params := mux.Vars(r)
+	query := r.URL.Query()
+	versions, page, total := d.ListStateVersions(params["lineage"], query.Get("limit"), query.Get("page"))
+
+	writeList(w, r, paginatedResponse("versions", versions, page, total), versions)
+}
+
+// GetStateGraph returns the dependency graph of the Resources of a State version,
+// as nodes and edges.
+// Optional "&versionid=X" parameter, the default version being used without it.
+// /api/lineages/{lineage}/graph GET endpoint callback
+func GetStateGraph(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	params := mux.Vars(r)
+	versionID := r.URL.Query().Get("versionid")
+	var err error
+	if versionID == "" {
+		versionID, err = d.DefaultVersion(params["lineage"])
+		if err != nil {
+			JSONError(w, "Failed to retrieve default version", err)
+			return
+		}
+	}
+
+	graph, err := d.GetStateGraph(params["lineage"], versionID)
+	if err != nil {
+		JSONError(w, "Failed to retrieve state graph", err)
+		return
+	}
+
+	writeJSON(w, graph, "Failed to marshal state graph")
+}
+
+// GetTFVersionHistory returns the Terraform version changes of a Lineage
+func GetTFVersionHistory(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	params := mux.Vars(r)
+	history := d.GetTFVersionHistory(params["lineage"])
+
+	j, err := json.Marshal(history)
+	if err != nil {
+		JSONError(w, "Failed to marshal terraform version history", err)
+		return
+	}
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// GetVersionTree returns the version history of a Lineage as a tree
+func GetVersionTree(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	params := mux.Vars(r)
+	tree := d.GetVersionTree(params["lineage"])
+
+	j, err := json.Marshal(tree)
+	if err != nil {
+		JSONError(w, "Failed to marshal version tree", err)
+		return
+	}
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// StateCompare compares two versions ('from' and 'to') of a State.
+// With paginate=true, the comparison is kept server-side and its first
+// page is returned along with the token retrieving the others.
+func StateCompare(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	params := mux.Vars(r)
+	query := r.URL.Query()
+	fromVersion := query.Get("from")
+	toVersion := query.Get("to")
+
+	start := time.Now()
+	from := d.GetState(params["lineage"], fromVersion)
+	to := d.GetState(params["lineage"], toVersion)
+	masked := attributeMask(r)
+	maskAttributes(&from, masked)
+	maskAttributes(&to, masked)
+	ctx, cancel := context.WithTimeout(r.Context(), compareTimeout)
+	defer cancel()
+	compare, err := compare.Compare(ctx, from, to)
+	metrics.ObserveCompare(params["lineage"], time.Since(start))
+	if err != nil {
+		JSONError(w, "Failed to compare state versions", err)
+		return
+	}
+
+	// Large comparisons are kept server-side and served by pages
+	if query.Get("paginate") == "true" {
+		now := time.Now()
+		user := r.Header.Get("X-Forwarded-User")
+		token, err := compareCache.keep(compare, params["lineage"], user, now)
+		if err != nil {
+			JSONError(w, "Failed to keep state compare", err)
+			return
+		}
+		page, err := compareCache.page(token, user, 1, now)
+		if err != nil {
+			JSONError(w, "Failed to paginate state compare", err)
+			return
+		}
+		writeJSON(w, page, "Failed to marshal state compare")
+		return
+	}
+
+	writeJSON(w, compare, "Failed to marshal state compare")
+}
+
+// changelogStore retrieves the most recent State versions of a Lineage
+type changelogStore interface {
+	ListStateVersions(lineage, limitStr, pageStr string) ([]types.LineageVersion, int, int)
+	GetState(lineage, versionID string) types.State
+}
+
+// lineageChangelog compares the most recent versions of a Lineage with
+// their previous version, returning the summary of each step, the most
+// recent first.
+// Optional "&count=N" parameter, the number of versions compared,
+// capped to the configured maximum.
+func lineageChangelog(w http.ResponseWriter, r *http.Request, cs changelogStore) {
+	lineage := mux.Vars(r)["lineage"]
+	count := changelogDefaultCount
+	if v := r.URL.Query().Get("count"); v != "" {
+		var err error
+		if count, err = strconv.Atoi(v); err != nil || count < 2 {
+			JSONErrorCode(w, CodeInvalidParameter, "Invalid count parameter", fmt.Errorf("count must be a number of at least 2 versions, got '%s'", v))
+			return
+		}
+	}
+	if count > changelogMaxCount {
+		count = changelogMaxCount
+	}
+
+	versions, _, _ := cs.ListStateVersions(lineage, strconv.Itoa(count), "")
+	masked := attributeMask(r)
+	states := make([]types.State, len(versions))
+	for i, v := range versions {
+		states[i] = cs.GetState(lineage, v.VersionID)
+		maskAttributes(&states[i], masked)
+	}
+
+	changelog := []types.ChangelogEntry{}
+	for i := 0; i+1 < len(states); i++ {
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(r.Context(), compareTimeout)
+		comp, err := compare.Compare(ctx, states[i+1], states[i])
+		cancel()
+		metrics.ObserveCompare(lineage, time.Since(start))
+		if err != nil {
+			JSONError(w, "Failed to compare state versions", err)
+			return
+		}
+		changelog = append(changelog, types.ChangelogEntry{
+			FromVersionID: versions[i+1].VersionID,
+			ToVersionID:   versions[i].VersionID,
+			LastModified:  versions[i].LastModified,
+			Stats:         comp.Stats,
+		})
+	}
+
+	writeJSON(w, changelog, "Failed to marshal lineage changelog")
+}
+
+// CrossLineageCompare compares a version ('from') of a State with a version
+// ('to') of the State of another lineage ('toLineage'), the most recent
+// versions being compared by default
+func CrossLineageCompare(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	params := mux.Vars(r)
+	query := r.URL.Query()
+	toLineage := query.Get("toLineage")
+	if toLineage == "" {
+		JSONErrorCode(w, CodeInvalidParameter, "Missing toLineage parameter", fmt.Errorf("no lineage to compare with"))
+		return
+	}
+
+	var err error
+	fromVersion := query.Get("from")
+	if fromVersion == "" {
+		if fromVersion, err = d.DefaultVersion(params["lineage"]); err != nil {
+			JSONError(w, "Failed to retrieve default version", err)
+			return
+		}
+	}
+	toVersion := query.Get("to")
+	if toVersion == "" {
+		if toVersion, err = d.DefaultVersion(toLineage); err != nil {
+			JSONError(w, "Failed to retrieve default version", err)
+			return
+		}
+	}
+
+	start := time.Now()
+	from := d.GetState(params["lineage"], fromVersion)
+	to := d.GetState(toLineage, toVersion)
+	masked := attributeMask(r)
+	maskAttributes(&from, masked)
+	maskAttributes(&to, masked)
+	ctx, cancel := context.WithTimeout(r.Context(), compareTimeout)
+	defer cancel()
+	compare, err := compare.Compare(ctx, from, to)
+	metrics.ObserveCompare(params["lineage"], time.Since(start))
+	if err != nil {
+		JSONError(w, "Failed to compare state versions", err)
+		return
+	}
+	compare.Stats.From.Lineage = params["lineage"]
+	compare.Stats.To.Lineage = toLineage
+
+	writeJSON(w, compare, "Failed to marshal state compare")
+}
+
+// maskLockInfo masks the given fields ('who', 'info', 'operation') of a lock
+func maskLockInfo(l state.LockInfo, fields []string) state.LockInfo {
+	for _, f := range fields {
+		switch f {
+		case "who":
+			l.Who = "(redacted)"
+		case "info":
+			l.Info = "(redacted)"
+		case "operation":
+			l.Operation = "(redacted)"
+		}
+	}
+	return l
+}
+
+// collectLocks gathers locks from all providers. A provider failing to
+// return its locks doesn't prevent the others from being reported: its
+// error is added to the returned warnings instead
+func collectLocks(sps []state.Provider) (allLocks map[string]state.LockInfo, warnings []string) {
+	allLocks = make(map[string]state.LockInfo)
+	warnings = []string{}
+	for _, sp := range sps {
+		locks, err := sp.GetLocks()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"provider": fmt.Sprintf("%T", sp),
+				"error":    err,
+			}).Warn("Failed to get locks on a provider")
+			warnings = append(warnings, fmt.Sprintf("Failed to get locks on a provider (%T): %v", sp, err))
+			continue
+		}
+		for k, v := range locks {
+			allLocks[k] = maskLockInfo(v, maskedLockFields)
+		}
+	}
+	return
+}
+
+// collectLockEntries gathers locks from all providers as a list sorted by path,
+// recording the provider holding each lock and its age
+func collectLockEntries(sps []state.Provider, now time.Time) (entries []types.LockEntry, warnings []string) {
+	entries = []types.LockEntry{}
+	warnings = []string{}
+	for _, sp := range sps {
+		locks, err := sp.GetLocks()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"provider": sp.Name(),
+				"error":    err,
+			}).Warn("Failed to get locks on a provider")
+			warnings = append(warnings, fmt.Sprintf("Failed to get locks on a provider (%s): %v", sp.Name(), err))
+			continue
+		}
+		for path, l := range locks {
+			l = maskLockInfo(l, maskedLockFields)
+			entry := types.LockEntry{
+				Path:      path,
+				Provider:  sp.Name(),
+				ID:        l.ID,
+				Operation: l.Operation,
+				Info:      l.Info,
+				Who:       l.Who,
+				Version:   l.Version,
+				Created:   l.Created,
+			}
+			if l.Created != nil {
+				entry.AgeSeconds = int64(now.Sub(*l.Created).Seconds())
+			}
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return
+}
+
+// filterLockEntries keeps the locks whose owner and path contain the given
+// strings and which are older than the given duration
+func filterLockEntries(entries []types.LockEntry, who, path string, olderThan time.Duration) []types.LockEntry {
+	filtered := []types.LockEntry{}
+	for _, e := range entries {
+		if who != "" && !strings.Contains(e.Who, who) {
+			continue
+		}
+		if path != "" && !strings.Contains(e.Path, path) {
+			continue
+		}
+		if olderThan > 0 && time.Duration(e.AgeSeconds)*time.Second < olderThan {
+			continue
+		}
+		filtered = append(filtered, e)
+	}
+	return filtered
+}
+
+// pageLockEntries returns the given page of locks, starting at 1
+func pageLockEntries(entries []types.LockEntry, page int) []types.LockEntry {
+	start := (page - 1) * locksPageSize
+	if start >= len(entries) {
+		return []types.LockEntry{}
+	}
+	end := start + locksPageSize
+	if end > len(entries) {
+		end = len(entries)
+	}
+	return entries[start:end]
+}
+
+// ListLocks returns a paginated list of locks from all providers, enriched
+// with the lineage of the locked States.
+// Optional "who", "path" and "older_than" (as a duration, e.g. "2h")
+// parameters filter the locks.
+func ListLocks(w http.ResponseWriter, r *http.Request, d *db.Database, sps []state.Provider) {
+	query := r.URL.Query()
+
+	var olderThan time.Duration
+	if v := query.Get("older_than"); v != "" {
+		var err error
+		if olderThan, err = time.ParseDuration(v); err != nil {
+			JSONErrorCode(w, CodeInvalidParameter, "Invalid older_than parameter", err)
+			return
+		}
+	}
+
+	page := 1
+	if v := query.Get("page"); v != "" {
+		var err error
+		if page, err = strconv.Atoi(v); err != nil {
+			JSONErrorCode(w, CodeInvalidParameter, "Invalid page parameter", err)
+			return
+		}
+		if page < 1 {
+			page = 1
+		}
+	}
+
+	entries, warnings := collectLockEntries(sps, time.Now())
+	if len(sps) > 0 && len(warnings) == len(sps) {
+		JSONErrorCode(w, CodeProviderUnavailable, "Failed to get locks on all providers", fmt.Errorf("%s", strings.Join(warnings, "; ")))
+		return
+	}
+	entries = filterLockEntries(entries, query.Get("who"), query.Get("path"), olderThan)
+	items := pageLockEntries(entries, page)
+
+	paths := make([]string, len(items))
+	for i, e := range items {
+		paths[i] = e.Path
+	}
+	lineages, err := d.GetLineagesByPaths(paths)
+	if err != nil {
+		JSONError(w, "Failed to retrieve lineages of locked states", err)
+		return
+	}
+	for i := range items {
+		items[i].LineageValue = lineages[items[i].Path]
+	}
+
+	response := paginatedResponse("locks", items, page, len(entries))
+	response["warnings"] = warnings
+	writeList(w, r, response, items)
+}
+
+// collectVersionGaps counts, for each state file ingested from the providers,
+// the versions available and the ones known by Terraboard, given the paths
+// of the known versions. Backup versions are counted with their state.
+// A provider failing to return its states or versions is reported in the
+// returned warnings.
+func collectVersionGaps(sps []state.Provider, filter state.PathFilter, known map[string][]string) (gaps []types.VersionGap, warnings []string) {
+	warnings = []string{}
+	for _, sp := range sps {
+		states, err := sp.GetStates()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"provider": sp.Name(),
+				"error":    err,
+			}).Warn("Failed to get states on a provider")
+			warnings = append(warnings, fmt.Sprintf("Failed to get states on a provider (%s): %v", sp.Name(), err))
+			continue
+		}
+
+		byPath := make(map[string]*types.VersionGap)
+		var paths []string
+		for _, st := range filter.Filter(states) {
+			versions, err := sp.GetVersions(st)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("Failed to get versions of %s (%s): %v", st, sp.Name(), err))
+				continue
+			}
+
+			path, _ := state.BackupStatePath(st)
+			gap, ok := byPath[path]
+			if !ok {
+				gap = &types.VersionGap{Provider: sp.Name(), Paths: []string{path}}
+				byPath[path] = gap
+				paths = append(paths, path)
+			}
+			for _, v := range versions {
+				gap.AvailableVersions++
+				if isKnownVersion(known, v.ID, path) {
+					gap.IngestedVersions++
+				}
+			}
+		}
+		for _, path := range paths {
+			gaps = append(gaps, *byPath[path])
+		}
+	}
+	return
+}
+
+// mergeVersionGaps merges the version counts of the state files of each
+// lineage, state files never ingested being reported on their own, and
+// returns the lineages with missing versions, sorted by decreasing gap
+func mergeVersionGaps(gaps []types.VersionGap, lineages map[string]string) []types.VersionGap {
+	merged := make(map[string]*types.VersionGap)
+	var keys []string
+	for _, g := range gaps {
+		g.LineageValue = lineages[g.Paths[0]]
+		key := g.Provider + "/" + g.LineageValue
+		if g.LineageValue == "" {
+			key += "/" + g.Paths[0]
+		}
+		m, ok := merged[key]
+		if !ok {
+			m = &types.VersionGap{LineageValue: g.LineageValue, Provider: g.Provider}
+			merged[key] = m
+			keys = append(keys, key)
+		}
+		m.Paths = append(m.Paths, g.Paths...)
+		m.AvailableVersions += g.AvailableVersions
+		m.IngestedVersions += g.IngestedVersions
+	}
+
+	results := []types.VersionGap{}
+	for _, key := range keys {
+		m := merged[key]
+		m.MissingVersions = m.AvailableVersions - m.IngestedVersions
+		if m.MissingVersions > 0 {
+			sort.Strings(m.Paths)
+			results = append(results, *m)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].MissingVersions != results[j].MissingVersions {
+			return results[i].MissingVersions > results[j].MissingVersions
+		}
+		if results[i].LineageValue != results[j].LineageValue {
+			return results[i].LineageValue < results[j].LineageValue
+		}
+		return results[i].Paths[0] < results[j].Paths[0]
+	})
+	return results
+}
+
+// GetVersionReconciliation compares, for each lineage, the versions available
+// on its provider with the versions ingested by Terraboard, and lists the
+// lineages with missing versions
+func GetVersionReconciliation(w http.ResponseWriter, r *http.Request, d *db.Database, sps []state.Provider) {
+	gaps, warnings := collectVersionGaps(sps, pathFilter, d.ListStatesVersions())
+	if len(gaps) == 0 && len(warnings) > 0 {
+		JSONErrorCode(w, CodeProviderUnavailable, "Failed to get versions on all providers", fmt.Errorf("%s", strings.Join(warnings, "; ")))
+		return
+	}
+
+	var paths []string
+	for _, g := range gaps {
+		paths = append(paths, g.Paths...)
+	}
+	lineages, err := d.GetLineagesByPaths(paths)
+	if err != nil {
+		JSONError(w, "Failed to retrieve lineages of states", err)
+		return
+	}
+	results := mergeVersionGaps(gaps, lineages)
+
+	writeList(w, r, map[string]interface{}{
+		"lineages": results,
+		"warnings": warnings,
+	}, results)
+}
+
+// backfills are the lineages being backfilled
+var backfills = struct {
+	sync.Mutex
+	lineages map[string]bool
+}{lineages: make(map[string]bool)}
+
+// startBackfill marks a lineage as being backfilled, or returns false
+// if it already is
+func startBackfill(lineage string) bool {
+	backfills.Lock()
+	defer backfills.Unlock()
+	if backfills.lineages[lineage] {
+		return false
+	}
+	backfills.lineages[lineage] = true
+	return true
+}
+
+// endBackfill marks the backfill of a lineage as done
+func endBackfill(lineage string) {
+	backfills.Lock()
+	defer backfills.Unlock()
+	delete(backfills.lineages, lineage)
+}
+
+// stateInserter inserts State versions
+type stateInserter interface {
+	InsertVersion(version *state.Version) error
+	InsertState(path, versionID, provider string, sf *statefile.File) error
+}
+
+// isKnownVersion returns true if a version of a State path is known
+func isKnownVersion(known map[string][]string, versionID, path string) bool {
+	for _, p := range known[versionID] {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// missingVersion is a version of a state file missing from the database,
+// recorded at the path of its State
+type missingVersion struct {
+	file, path string
+	version    state.Version
+}
+
+// backfillVersions ingests, in chronological order, the versions of the
+// given State paths available on a provider and missing from the known
+// versions, which are updated as versions are ingested.
+// Backups are ingested as prior versions of their State.
+func backfillVersions(sp state.Provider, filter state.PathFilter, paths []string, known map[string][]string, si stateInserter) (backfilled int, err error) {
+	wanted := make(map[string]bool)
+	for _, p := range paths {
+		wanted[p] = true
+	}
+
+	states, err := sp.GetStates()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get states: %w", err)
+	}
+	var missing []missingVersion
+	for _, st := range filter.Filter(states) {
+		path, _ := state.BackupStatePath(st)
+		if !wanted[path] {
+			continue
+		}
+		versions, err := sp.GetVersions(st)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get versions of %s: %w", st, err)
+		}
+		for _, v := range versions {
+			if !isKnownVersion(known, v.ID, path) {
+				missing = append(missing, missingVersion{file: st, path: path, version: v})
+			}
+		}
+	}
+	sort.SliceStable(missing, func(i, j int) bool {
+		return missing[i].version.LastModified.Before(missing[j].version.LastModified)
+	})
+
+	for _, m := range missing {
+		if isKnownVersion(known, m.version.ID, m.path) {
+			continue
+		}
+		if err = si.InsertVersion(&m.version); err != nil {
+			return
+		}
+		var sf *statefile.File
+		if sf, err = sp.GetState(m.file, m.version.ID); err != nil {
+			return backfilled, fmt.Errorf("failed to fetch %s at version %s: %w", m.file, m.version.ID, err)
+		}
+		if err = si.InsertState(m.path, m.version.ID, sp.Name(), sf); err != nil {
+			return
+		}
+		known[m.version.ID] = append(known[m.version.ID], m.path)
+		backfilled++
+	}
+	return
+}
+
+// BackfillLineage ingests the versions of a lineage available on its
+// providers and missing from the database, in chronological order.
+// Only admins may backfill lineages.
+// /api/admin/backfill/{lineage} POST endpoint callback
+func BackfillLineage(w http.ResponseWriter, r *http.Request, d *db.Database, sps []state.Provider) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	if !requireAdmin(w, r, "backfill lineages") {
+		return
+	}
+
+	lineage := mux.Vars(r)["lineage"]
+	if !startBackfill(lineage) {
+		JSONErrorCode(w, CodeBackfillInProgress, "Lineage is already being backfilled", fmt.Errorf("backfill of %s in progress", lineage))
+		return
+	}
+	defer endBackfill(lineage)
+
+	paths, err := d.GetLineagePaths(lineage)
+	if err != nil {
+		JSONError(w, "Failed to retrieve states of lineage", err)
+		return
+	}
+	known := d.ListStatesVersions()
+
+	backfilled := 0
+	for _, sp := range sps {
+		if len(paths[sp.Name()]) == 0 {
+			continue
+		}
+		count, err := backfillVersions(sp, pathFilter, paths[sp.Name()], known, d)
+		backfilled += count
+		if err != nil {
+			log.WithContext(r.Context()).WithFields(log.Fields{
+				"lineage":    lineage,
+				"provider":   sp.Name(),
+				"backfilled": backfilled,
+			}).Error(err.Error())
+			JSONError(w, fmt.Sprintf("Failed to backfill lineage after %d versions", backfilled), err)
+			return
+		}
+	}
+	log.WithContext(r.Context()).WithFields(log.Fields{
+		"lineage":    lineage,
+		"backfilled": backfilled,
+		"user":       r.Header.Get("X-Forwarded-User"),
+	}).Info("Backfilled lineage")
+
+	writeJSON(w, map[string]interface{}{
+		"lineage":    lineage,
+		"backfilled": backfilled,
+	}, "Failed to marshal backfill result")
+}
+
+// BackupDatabase backs up the database to the configured object store
+// and returns the backup manifest and location. Only admins may back up
+// the database.
+// /api/admin/backup POST endpoint callback
+func BackupDatabase(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	if !requireAdmin(w, r, "back up the database") {
+		return
+	}
+
+	start := time.Now()
+	res, err := backup.Backup(d, start)
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to back up the database")
+		JSONError(w, "Failed to back up the database", err)
+		return
+	}
+	log.WithContext(r.Context()).WithFields(log.Fields{
+		"id":       res.ID,
+		"location": res.Location,
+		"duration": time.Since(start),
+		"user":     r.Header.Get("X-Forwarded-User"),
+	}).Info("Backed up the database")
+
+	writeJSON(w, res, "Failed to marshal backup")
+}
+
+// RestoreDatabase replaces the data of the database with a backup archive,
+// either uploaded as the request body or read from the object store
+// by its key, and reports the restored rows of each table.
+// With dry_run=true, the archive is checked without changing the database.
+// Restores must be enabled in the configuration, and only admins may run them.
+// /api/admin/restore POST endpoint callback
+func RestoreDatabase(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	if !allowRestore {
+		JSONErrorCode(w, CodeForbidden, "Restoring the database is disabled", fmt.Errorf("restore is not enabled in the configuration"))
+		return
+	}
+	if !requireAdmin(w, r, "restore the database") {
+		return
+	}
+
+	query := r.URL.Query()
+	dryRun := query.Get("dry_run") == "true"
+	archive := r.Body
+	if key := query.Get("key"); key != "" {
+		var err error
+		if archive, err = backup.Open(key); err != nil {
+			JSONError(w, "Failed to open backup archive", err)
+			return
+		}
+		defer archive.Close()
+	}
+
+	start := time.Now()
+	res, err := backup.RestoreDatabase(d, archive, dryRun)
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{
+			"dry_run": dryRun,
+			"error":   err,
+		}).Error("Failed to restore the database")
+		JSONError(w, "Failed to restore the database", err)
+		return
+	}
+	log.WithContext(r.Context()).WithFields(log.Fields{
+		"id":       res.Manifest.ID,
+		"dry_run":  dryRun,
+		"duration": time.Since(start),
+		"user":     r.Header.Get("X-Forwarded-User"),
+	}).Info("Restored the database")
+
+	writeJSON(w, res, "Failed to marshal restore")
+}
+
+// readinessTimeout is the maximum duration of each readiness check
+var readinessTimeout = 5 * time.Second
+
+// pinger checks the connection to a dependency
+type pinger interface {
+	Ping() error
+}
+
+// runCheck runs a readiness check, failing it when it doesn't complete
+// before the context is done. The check keeps running in the background
+// since providers don't support cancellation.
+func runCheck(ctx context.Context, check func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- check() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// checkReadiness checks concurrently the database and each State provider,
+// and returns the error of each failed dependency by name
+func checkReadiness(ctx context.Context, d pinger, sps []state.Provider) map[string]string {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	checks := map[string]func() error{"database": d.Ping}
+	for _, sp := range sps {
+		sp := sp
+		checks["provider "+sp.Name()] = func() error {
+			_, err := sp.GetStates()
+			return err
+		}
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	failures := make(map[string]string)
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func() error) {
+			defer wg.Done()
+			if err := runCheck(ctx, check); err != nil {
+				mutex.Lock()
+				failures[name] = err.Error()
+				mutex.Unlock()
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	return failures
+}
+
+// Healthz responds with a 200 status as long as the process is up
+func Healthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := io.WriteString(w, `{"status":"ok"}`); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// Readyz responds with a 200 status when the database and all State
+// providers are reachable, or else a 503 status listing the failed ones
+func Readyz(w http.ResponseWriter, r *http.Request, d *db.Database, sps []state.Provider) {
+	writeReadiness(w, checkReadiness(r.Context(), d, sps))
+}
+
+// writeReadiness writes the readiness response given the failed dependencies
+func writeReadiness(w http.ResponseWriter, failures map[string]string) {
+	response := map[string]interface{}{"status": "ok"}
+	w.Header().Set("Content-Type", "application/json")
+	if len(failures) > 0 {
+		response = map[string]interface{}{"status": "unavailable", "failures": failures}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	j, err := json.Marshal(response)
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// GetAttributeValuesByLineage returns, for each lineage, the values used
+// for the attribute given by the "key" parameter.
+// Optional "resource_type" parameter to restrict the Resource type.
+func GetAttributeValuesByLineage(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	query := r.URL.Query()
+	if query.Get("key") == "" {
+		JSONErrorCode(w, CodeInvalidParameter, "Missing key parameter", fmt.Errorf("key parameter is required"))
+		return
+	}
+
+	result, err := d.GetAttributeValuesByLineage(query.Get("key"), query.Get("resource_type"))
+	if err != nil {
+		JSONError(w, "Failed to retrieve attribute values", err)
+		return
+	}
+	if masked := attributeMask(r); masked != nil && masked(query.Get("key")) {
+		for lineage := range result {
+			result[lineage] = []string{redactedValue}
+		}
+	}
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		JSONError(w, "Failed to marshal json", err)
+		return
+	}
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// consistencyAuditor audits the consistency of attribute values across lineages
+type consistencyAuditor interface {
+	AuditAttributeConsistency(key, expected, resourceType string) (types.ConsistencyAudit, error)
+}
+
+// AuditAttributeConsistency returns the lineages whose value for the attribute
+// given by the "key" parameter deviates from the "expected" parameter, or else
+// from the value used by most lineages.
+// Optional "resource_type" parameter to restrict the Resource type.
+// The values of masked attributes are redacted, and can't be expected.
+func AuditAttributeConsistency(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	auditAttributeConsistency(w, r, d)
+}
+
+func auditAttributeConsistency(w http.ResponseWriter, r *http.Request, ca consistencyAuditor) {
+	query := r.URL.Query()
+	key := query.Get("key")
+	if key == "" {
+		JSONErrorCode(w, CodeInvalidParameter, "Missing key parameter", fmt.Errorf("key parameter is required"))
+		return
+	}
+	masked := attributeMask(r)
+	isMasked := masked != nil && masked(key)
+	if isMasked && query.Get("expected") != "" {
+		JSONErrorCode(w, CodeForbidden, "Invalid expected parameter", errMaskedValueFilter)
+		return
+	}
+
+	audit, err := ca.AuditAttributeConsistency(key, query.Get("expected"), query.Get("resource_type"))
+	if err != nil {
+		JSONError(w, "Failed to audit attribute consistency", err)
+		return
+	}
+	if isMasked {
+		audit.Expected = redactedValue
+		for i := range audit.Violations {
+			audit.Violations[i].Values = []string{redactedValue}
+		}
+	}
+
+	j, err := json.Marshal(audit)
+	if err != nil {
+		JSONError(w, "Failed to marshal json", err)
+		return
+	}
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// GetAttributeOutliers returns the resources whose numeric value for the attribute
+// given by the "key" parameter is a statistical outlier.
+// Optional "resource_type" parameter to restrict the Resource type.
+func GetAttributeOutliers(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	query := r.URL.Query()
+	if query.Get("key") == "" {
+		JSONErrorCode(w, CodeInvalidParameter, "Missing key parameter", fmt.Errorf("key parameter is required"))
+		return
+	}
+
+	result, err := d.GetAttributeOutliers(query.Get("key"), query.Get("resource_type"))
+	if err != nil {
+		JSONError(w, "Failed to retrieve attribute outliers", err)
+		return
+	}
+	maskSearchResults(result.Outliers, attributeMask(r))
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		JSONError(w, "Failed to marshal json", err)
+		return
+	}
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// GetCommonResources returns the resources common to a set of lineages.
+// /api/compare/common POST endpoint callback
+func GetCommonResources(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+
+	var req struct {
+		Lineages  []string `json:"lineages"`
+		Threshold int      `json:"threshold"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONErrorCode(w, CodeInvalidParameter, "Failed to decode common resources request", err)
+		return
+	}
+	if len(req.Lineages) == 0 {
+		JSONErrorCode(w, CodeInvalidParameter, "Missing lineages", fmt.Errorf("at least one lineage is required"))
+		return
+	}
+
+	result, err := d.GetCommonResources(req.Lineages, req.Threshold)
+	if err != nil {
+		JSONError(w, "Failed to compute common resources", err)
+		return
+	}
 
-	j, err := json.Marshal(state)
+	j, err := json.Marshal(result)
 	if err != nil {
-		JSONError(w, "Failed to marshal state", err)
+		JSONError(w, "Failed to marshal json", err)
 		return
 	}
 	if _, err := io.WriteString(w, string(j)); err != nil {
@@ -87,14 +1915,19 @@ func GetState(w http.ResponseWriter, r *http.Request, d *db.Database) {
 	}
 }
 
-// GetLineageActivity returns the activity (version history) of a Lineage
-func GetLineageActivity(w http.ResponseWriter, r *http.Request, d *db.Database) {
-	params := mux.Vars(r)
-	activity := d.GetLineageActivity(params["lineage"])
+// CompareResourceTypeCounts compares the count of resources per type
+// between two lineages ('a' and 'b')
+func CompareResourceTypeCounts(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	query := r.URL.Query()
+	result, err := d.CompareResourceTypeCounts(query.Get("a"), query.Get("b"))
+	if err != nil {
+		JSONError(w, "Failed to compare resource type counts", err)
+		return
+	}
 
-	j, err := json.Marshal(activity)
+	j, err := json.Marshal(result)
 	if err != nil {
-		JSONError(w, "Failed to marshal state activity", err)
+		JSONError(w, "Failed to marshal json", err)
 		return
 	}
 	if _, err := io.WriteString(w, string(j)); err != nil {
@@ -102,24 +1935,27 @@ func GetLineageActivity(w http.ResponseWriter, r *http.Request, d *db.Database)
 	}
 }
 
-// StateCompare compares two versions ('from' and 'to') of a State
-func StateCompare(w http.ResponseWriter, r *http.Request, d *db.Database) {
-	params := mux.Vars(r)
-	query := r.URL.Query()
-	fromVersion := query.Get("from")
-	toVersion := query.Get("to")
-
-	from := d.GetState(params["lineage"], fromVersion)
-	to := d.GetState(params["lineage"], toVersion)
-	compare, err := compare.Compare(from, to)
-	if err != nil {
-		JSONError(w, "Failed to compare state versions", err)
+// GetLocks returns information on locked States, as a map by State path.
+// The locks of the providers which failed to return them are left out,
+// with "with_warnings=true" the map is returned as "locks" along with the
+// "warnings" about these providers.
+func GetLocks(w http.ResponseWriter, r *http.Request, sps []state.Provider) {
+	allLocks, warnings := collectLocks(sps)
+	if len(sps) > 0 && len(warnings) == len(sps) {
+		JSONErrorCode(w, CodeProviderUnavailable, "Failed to get locks on all providers", fmt.Errorf("%s", strings.Join(warnings, "; ")))
 		return
 	}
 
-	j, err := json.Marshal(compare)
+	var response interface{} = allLocks
+	if r.URL.Query().Get("with_warnings") == "true" {
+		response = map[string]interface{}{
+			"locks":    allLocks,
+			"warnings": warnings,
+		}
+	}
+	j, err := json.Marshal(response)
 	if err != nil {
-		JSONError(w, "Failed to marshal state compare", err)
+		JSONError(w, "Failed to marshal locks", err)
 		return
 	}
 	if _, err := io.WriteString(w, string(j)); err != nil {
@@ -127,50 +1963,202 @@ func StateCompare(w http.ResponseWriter, r *http.Request, d *db.Database) {
 	}
 }
 
-// GetLocks returns information on locked States
-func GetLocks(w http.ResponseWriter, _ *http.Request, sps []state.Provider) {
-	allLocks := make(map[string]state.LockInfo)
+// ForceUnlock releases the lock with the given ID on the provider holding it,
+// returning the removed lock. Only admins may release locks.
+func ForceUnlock(w http.ResponseWriter, r *http.Request, sps []state.Provider) {
+	if !requireAdmin(w, r, "release locks") {
+		return
+	}
+
+	lockID := mux.Vars(r)["lockID"]
 	for _, sp := range sps {
 		locks, err := sp.GetLocks()
 		if err != nil {
-			JSONError(w, "Failed to get locks on a provider", err)
+			log.WithFields(log.Fields{
+				"provider": sp.Name(),
+				"error":    err,
+			}).Warn("Failed to get locks on a provider")
+			continue
+		}
+		for _, lock := range locks {
+			if lock.ID != lockID {
+				continue
+			}
+			if err := sp.Unlock(lockID); err != nil {
+				JSONError(w, "Failed to release lock", err)
+				return
+			}
+			log.WithFields(log.Fields{
+				"provider": sp.Name(),
+				"lock_id":  lockID,
+				"path":     lock.Path,
+				"user":     r.Header.Get("X-Forwarded-User"),
+				"email":    r.Header.Get("X-Forwarded-Email"),
+			}).Warn("Force-released lock")
+
+			j, err := json.Marshal(maskLockInfo(lock, maskedLockFields))
+			if err != nil {
+				JSONError(w, "Failed to marshal lock", err)
+				return
+			}
+			if _, err := io.WriteString(w, string(j)); err != nil {
+				log.Error(err.Error())
+			}
 			return
 		}
-		for k, v := range locks {
-			allLocks[k] = v
+	}
+
+	JSONError(w, "No provider holds this lock", state.ErrLockNotFound)
+}
+
+// SearchAttribute performs a search on Resource Attributes
+// by various parameters.
+// With "regex=true", the "name" and "value" parameters are regular expressions.
+// With "all=true", all the results are streamed as CSV, regardless of the page.
+func SearchAttribute(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	searchAttribute(w, r, d)
+}
+
+// searchStore searches Resource Attributes in the database
+type searchStore interface {
+	SearchAttribute(query url.Values) ([]types.SearchResult, int, int)
+	EachSearchResult(query url.Values, fn func(types.SearchResult) error) error
+}
+
+func searchAttribute(w http.ResponseWriter, r *http.Request, ss searchStore) {
+	query := r.URL.Query()
+	if query.Get("regex") == "true" {
+		for _, param := range []string{"name", "value"} {
+			if _, err := regexp.Compile(query.Get(param)); err != nil {
+				JSONErrorCode(w, CodeInvalidParameter, fmt.Sprintf("Invalid %s regular expression", param), err)
+				return
+			}
 		}
 	}
+	if _, err := db.SearchOrderBy(query.Get("orderBy"), query.Get("order")); err != nil {
+		JSONError(w, "Invalid sort order", err)
+		return
+	}
+	if err := maskSearchQuery(r, query); err != nil {
+		JSONErrorCode(w, CodeForbidden, "Invalid value filter", err)
+		return
+	}
+	if query.Get("all") == "true" && negotiateFormat(r) == FormatCSV {
+		exportSearchResults(w, query, ss, attributeMask(r))
+		return
+	}
+	result, page, total := ss.SearchAttribute(query)
+	maskSearchResults(result, attributeMask(r))
 
-	j, err := json.Marshal(allLocks)
+	writeList(w, r, paginatedResponse("results", result, page, total), result)
+}
+
+// exportSearchResults streams all the results of an attribute search as CSV,
+// as they are read from the database. Errors occurring before the first rows
+// are sent still turn into an error response.
+func exportSearchResults(w http.ResponseWriter, query url.Values, ss searchStore, masked func(key string) bool) {
+	w.Header().Set("Content-Type", formatContentTypes[FormatCSV])
+	tw := &thresholdWriter{w: w}
+	enc, err := newCSVEncoder(tw, reflect.TypeOf(types.SearchResult{}))
+	if err == nil {
+		err = ss.EachSearchResult(query, func(result types.SearchResult) error {
+			if masked != nil && masked(result.AttributeKey) {
+				result.AttributeValue = redactedValue
+			}
+			return enc.encode(reflect.ValueOf(result))
+		})
+	}
+	if err == nil {
+		err = enc.flush()
+	}
 	if err != nil {
-		JSONError(w, "Failed to marshal locks", err)
+		if tw.streaming {
+			log.Error(err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", formatContentTypes[FormatJSON])
+		JSONError(w, "Failed to export search results", err)
+	}
+}
+
+// SearchFullText searches the Attribute values of the Resources for
+// the terms of the "q" parameter, ranking the results by relevance.
+// /api/search/fulltext GET endpoint callback
+func SearchFullText(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	query := r.URL.Query()
+	search := query.Get("q")
+	if search == "" {
+		JSONErrorCode(w, CodeInvalidParameter, "Missing search query", fmt.Errorf("the q parameter is required"))
 		return
 	}
-	if _, err := io.WriteString(w, string(j)); err != nil {
-		log.Error(err.Error())
+	page := 1
+	if v := query.Get("page"); v != "" {
+		var err error
+		if page, err = strconv.Atoi(v); err != nil {
+			JSONErrorCode(w, CodeInvalidParameter, "Invalid page parameter", err)
+			return
+		}
+		if page < 1 {
+			page = 1
+		}
 	}
+
+	result, total, err := d.SearchFullText(search, page)
+	if err != nil {
+		JSONError(w, "Failed to search attributes", err)
+		return
+	}
+
+	writeList(w, r, paginatedResponse("results", result, page, total), result)
 }
 
-// SearchAttribute performs a search on Resource Attributes
-// by various parameters
-func SearchAttribute(w http.ResponseWriter, r *http.Request, d *db.Database) {
-	query := r.URL.Query()
-	result, page, total := d.SearchAttribute(query)
+// QueryResources returns the Resources matching a set of Attribute
+// conditions, combined with AND or OR.
+// /api/resources/query POST endpoint callback
+func QueryResources(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
 
-	// Build response object
-	response := make(map[string]interface{})
-	response["results"] = result
-	response["page"] = page
-	response["total"] = total
+	var query types.ResourceQuery
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		JSONErrorCode(w, CodeInvalidParameter, "Failed to decode resource query", err)
+		return
+	}
 
-	j, err := json.Marshal(response)
+	result, page, total, err := d.QueryResources(query)
 	if err != nil {
-		JSONError(w, "Failed to marshal json", err)
+		JSONError(w, "Failed to query resources", err)
 		return
 	}
-	if _, err := io.WriteString(w, string(j)); err != nil {
-		log.Error(err.Error())
+
+	writeList(w, r, paginatedResponse("results", result, page, total), result)
+}
+
+// ListCrossLineageDependencies returns the Resources referencing, in their
+// attributes, the id of a Resource of another lineage.
+// /api/dependencies/cross-lineage GET endpoint callback
+func ListCrossLineageDependencies(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	page := 1
+	if v := r.URL.Query().Get("page"); v != "" {
+		var err error
+		if page, err = strconv.Atoi(v); err != nil {
+			JSONErrorCode(w, CodeInvalidParameter, "Invalid page parameter", err)
+			return
+		}
+		if page < 1 {
+			page = 1
+		}
+	}
+
+	edges, total, err := d.ListCrossLineageDependencies(page)
+	if err != nil {
+		JSONError(w, "Failed to retrieve cross-lineage dependencies", err)
+		return
 	}
+
+	writeList(w, r, paginatedResponse("edges", edges, page, total), edges)
 }
 
 // ListResourceTypes lists all Resource types
@@ -199,6 +2187,58 @@ func ListResourceTypesWithCount(w http.ResponseWriter, _ *http.Request, d *db.Da
 	}
 }
 
+// ListProviderPlugins lists all provider plugins with the count of lineages
+// using them, per Terraform version
+func ListProviderPlugins(w http.ResponseWriter, _ *http.Request, d *db.Database) {
+	result, err := d.ListProviderPlugins()
+	if err != nil {
+		JSONError(w, "Failed to list provider plugins", err)
+		return
+	}
+	j, err := json.Marshal(result)
+	if err != nil {
+		JSONError(w, "Failed to marshal json", err)
+		return
+	}
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// GetPluginUsage lists the lineages and resource types managed by a provider plugin.
+// State files don't record provider plugin versions, so filtering by version isn't supported.
+func GetPluginUsage(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	getPluginUsage(w, r, d)
+}
+
+// pluginUsageStore retrieves the usage of provider plugins
+type pluginUsageStore interface {
+	GetPluginUsage(plugin string) ([]types.PluginUsage, error)
+}
+
+func getPluginUsage(w http.ResponseWriter, r *http.Request, ps pluginUsageStore) {
+	query := r.URL.Query()
+	if query.Get("version") != "" {
+		JSONErrorCode(w, CodeInvalidParameter, "Invalid version parameter",
+			fmt.Errorf("filtering by plugin version is not supported, state files don't record provider plugin versions"))
+		return
+	}
+
+	result, err := ps.GetPluginUsage(query.Get("plugin"))
+	if err != nil {
+		JSONError(w, "Failed to retrieve plugin usage", err)
+		return
+	}
+	j, err := json.Marshal(result)
+	if err != nil {
+		JSONError(w, "Failed to marshal json", err)
+		return
+	}
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
+
 // ListResourceNames lists all Resource names
 func ListResourceNames(w http.ResponseWriter, _ *http.Request, d *db.Database) {
 	result, _ := d.ListResourceNames()
@@ -257,26 +2297,101 @@ func GetUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// planInserter inserts Terraform plans
+type planInserter interface {
+	InsertPlan(plan []byte, submitter string) error
+}
+
+// insertPlanWithRetry inserts a plan, retrying with an increasing delay
+// as long as the insertion fails on a transient error
+func insertPlanWithRetry(pi planInserter, plan []byte, submitter string) (err error) {
+	delay := planInsertBackoff
+	for i := uint(0); ; i++ {
+		err = pi.InsertPlan(plan, submitter)
+		if err == nil || !db.IsTransientError(err) || i >= planInsertRetries {
+			return
+		}
+		log.WithFields(log.Fields{
+			"attempt": i + 1,
+			"error":   err,
+		}).Warn("Transient error on plan insertion, retrying")
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
 // SubmitPlan inserts a new Terraform plan in the database.
 // /api/plans POST endpoint callback
-func SubmitPlan(w http.ResponseWriter, r *http.Request, db *db.Database) {
+func SubmitPlan(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	submitPlan(w, r, d)
+}
+
+func submitPlan(w http.ResponseWriter, r *http.Request, pi planInserter) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Errorf("Failed to read body: %v", err)
+		log.WithContext(r.Context()).Errorf("Failed to read body: %v", err)
 		JSONError(w, "Failed to read body during plan submit", err)
 		return
 	}
 
-	if err = db.InsertPlan(body); err != nil {
-		log.Errorf("Failed to insert plan to db: %v", err)
+	submitter := r.Header.Get("X-Forwarded-User")
+	if submitter == "" {
+		submitter = r.Header.Get("X-Forwarded-Email")
+	}
+	if err = insertPlanWithRetry(pi, body, submitter); err != nil {
+		log.WithContext(r.Context()).Errorf("Failed to insert plan to db: %v", err)
 		JSONError(w, "Failed to insert plan to db", err)
 		return
 	}
 }
 
+// planDeleter soft-deletes and restores Terraform plans
+type planDeleter interface {
+	DeletePlan(id string) error
+	RestorePlan(id string) error
+}
+
+// DeletePlan soft-deletes a Terraform plan, hiding it from the plan listings.
+// /api/plans DELETE endpoint callback on request with ?planid=X parameter
+func DeletePlan(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	deletePlan(w, r, d)
+}
+
+func deletePlan(w http.ResponseWriter, r *http.Request, pd planDeleter) {
+	id := r.URL.Query().Get("planid")
+	if id == "" {
+		JSONErrorCode(w, CodeInvalidParameter, "Missing planid parameter", fmt.Errorf("planid parameter is required"))
+		return
+	}
+
+	if err := pd.DeletePlan(id); err != nil {
+		JSONError(w, "Failed to delete plan", err)
+		return
+	}
+}
+
+// RestorePlan restores a soft-deleted Terraform plan.
+// /api/plans/{planid}/restore POST endpoint callback
+func RestorePlan(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	restorePlan(w, r, d)
+}
+
+func restorePlan(w http.ResponseWriter, r *http.Request, pd planDeleter) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+
+	if err := pd.RestorePlan(mux.Vars(r)["planid"]); err != nil {
+		JSONError(w, "Failed to restore plan", err)
+		return
+	}
+}
+
 // GetPlansSummary provides summary of all Plan by lineage (only metadata added by the wrapper).
 // Optional "&limit=X" parameter to limit requested quantity of plans.
 // Optional "&page=X" parameter to add an offset to the query and enable pagination.
+// Optional "&include_deleted=true" parameter to include soft-deleted plans.
 // Sorted by most recent to oldest.
 // /api/plans/summary GET endpoint callback
 // Also return pagination informations (current page ans total items count in database)
@@ -284,15 +2399,12 @@ func GetPlansSummary(w http.ResponseWriter, r *http.Request, db *db.Database) {
 	lineage := r.URL.Query().Get("lineage")
 	limit := r.URL.Query().Get("limit")
 	page := r.URL.Query().Get("page")
-	plans, currentPage, total := db.GetPlansSummary(lineage, limit, page)
+	includeDeleted := r.URL.Query().Get("include_deleted") == "true"
+	plans, currentPage, total := db.GetPlansSummary(lineage, limit, page, includeDeleted)
 
-	response := make(map[string]interface{})
-	response["plans"] = plans
-	response["page"] = currentPage
-	response["total"] = total
-	j, err := json.Marshal(response)
+	j, err := json.Marshal(paginatedResponse("plans", plans, currentPage, total))
 	if err != nil {
-		log.Errorf("Failed to marshal plans: %v", err)
+		log.WithContext(r.Context()).Errorf("Failed to marshal plans: %v", err)
 		JSONError(w, "Failed to marshal plans", err)
 		return
 	}
@@ -301,7 +2413,7 @@ func GetPlansSummary(w http.ResponseWriter, r *http.Request, db *db.Database) {
 	}
 }
 
-// GetPlan provides a specific Plan of a lineage using ID.
+// GetPlan provides a specific Plan of a lineage using ID, even if soft-deleted.
 // /api/plans GET endpoint callback on request with ?plan_id=X parameter
 func GetPlan(w http.ResponseWriter, r *http.Request, db *db.Database) {
 	id := r.URL.Query().Get("planid")
@@ -309,7 +2421,7 @@ func GetPlan(w http.ResponseWriter, r *http.Request, db *db.Database) {
 
 	j, err := json.Marshal(plan)
 	if err != nil {
-		log.Errorf("Failed to marshal plan: %v", err)
+		log.WithContext(r.Context()).Errorf("Failed to marshal plan: %v", err)
 		JSONError(w, "Failed to marshal plan", err)
 		return
 	}
@@ -318,9 +2430,53 @@ func GetPlan(w http.ResponseWriter, r *http.Request, db *db.Database) {
 	}
 }
 
+// GetPriorStateDrift compares the prior state embedded in a Plan with the
+// State version recorded when it was made, flagging stale Plans.
+// /api/plans/{planid}/prior-state-drift GET endpoint callback
+func GetPriorStateDrift(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	drift, err := d.GetPriorStateDrift(mux.Vars(r)["planid"])
+	if err != nil {
+		JSONError(w, "Failed to compare plan prior state", err)
+		return
+	}
+
+	writeJSON(w, drift, "Failed to marshal prior state drift")
+}
+
+// GetPlanSummary provides the headline numbers of a Plan, without its content.
+// /api/plans/{planid}/summary GET endpoint callback
+func GetPlanSummary(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	plan, err := d.GetPlanSummary(mux.Vars(r)["planid"])
+	if err != nil {
+		JSONError(w, "Failed to retrieve plan summary", err)
+		return
+	}
+
+	terraformVersion := plan.Summary.TerraformVersion
+	if terraformVersion == "" {
+		terraformVersion = plan.TFVersion
+	}
+	j, err := json.Marshal(map[string]interface{}{
+		"plan_id":           plan.ID,
+		"terraform_version": terraformVersion,
+		"created_at":        plan.CreatedAt,
+		"add":               plan.Summary.Add,
+		"change":            plan.Summary.Change,
+		"destroy":           plan.Summary.Destroy,
+	})
+	if err != nil {
+		JSONError(w, "Failed to marshal plan summary", err)
+		return
+	}
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
+
 // GetPlans provides all Plan by lineage.
 // Optional "&limit=X" parameter to limit requested quantity of plans.
 // Optional "&page=X" parameter to add an offset to the query and enable pagination.
+// Optional "&include_deleted=true" parameter to include soft-deleted plans.
 // Sorted by most recent to oldest.
 // /api/plans GET endpoint callback
 // Also return pagination informations (current page ans total items count in database)
@@ -328,15 +2484,12 @@ func GetPlans(w http.ResponseWriter, r *http.Request, db *db.Database) {
 	lineage := r.URL.Query().Get("lineage")
 	limit := r.URL.Query().Get("limit")
 	page := r.URL.Query().Get("page")
-	plans, currentPage, total := db.GetPlans(lineage, limit, page)
+	includeDeleted := r.URL.Query().Get("include_deleted") == "true"
+	plans, currentPage, total := db.GetPlans(lineage, limit, page, includeDeleted)
 
-	response := make(map[string]interface{})
-	response["plans"] = plans
-	response["page"] = currentPage
-	response["total"] = total
-	j, err := json.Marshal(response)
+	j, err := json.Marshal(paginatedResponse("plans", plans, currentPage, total))
 	if err != nil {
-		log.Errorf("Failed to marshal plans: %v", err)
+		log.WithContext(r.Context()).Errorf("Failed to marshal plans: %v", err)
 		JSONError(w, "Failed to marshal plans", err)
 		return
 	}
@@ -356,6 +2509,8 @@ func ManagePlans(w http.ResponseWriter, r *http.Request, db *db.Database) {
 		}
 	} else if r.Method == "POST" {
 		SubmitPlan(w, r, db)
+	} else if r.Method == "DELETE" {
+		DeletePlan(w, r, db)
 	} else {
 		http.Error(w, "Invalid request method.", 405)
 	}
@@ -363,14 +2518,33 @@ func ManagePlans(w http.ResponseWriter, r *http.Request, db *db.Database) {
 
 // GetLineages recover all Lineage from db.
 // Optional "&limit=X" parameter to limit requested quantity of them.
+// Optional "&show_all_versions=true" parameter to include hidden Terraform versions.
+// Optional "&show_empty=true" parameter to include hidden empty States.
 // Sorted by most recent to oldest.
 func GetLineages(w http.ResponseWriter, r *http.Request, db *db.Database) {
-	limit := r.URL.Query().Get("limit")
-	lineages := db.GetLineages(limit)
+	lineages := db.GetLineages(r.URL.Query())
+
+	j, err := json.Marshal(lineages)
+	if err != nil {
+		log.WithContext(r.Context()).Errorf("Failed to marshal lineages: %v", err)
+		JSONError(w, "Failed to marshal lineages", err)
+		return
+	}
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// GetLineagesByProvider recover all Lineage ingested from the provider
+// given by the "provider" parameter (e.g. "aws:my-bucket"),
+// or from all the providers of a type (e.g. "aws")
+func GetLineagesByProvider(w http.ResponseWriter, r *http.Request, db *db.Database) {
+	provider := r.URL.Query().Get("provider")
+	lineages := db.GetLineagesByProvider(provider)
 
 	j, err := json.Marshal(lineages)
 	if err != nil {
-		log.Errorf("Failed to marshal lineages: %v", err)
+		log.WithContext(r.Context()).Errorf("Failed to marshal lineages: %v", err)
 		JSONError(w, "Failed to marshal lineages", err)
 		return
 	}
@@ -378,3 +2552,97 @@ func GetLineages(w http.ResponseWriter, r *http.Request, db *db.Database) {
 		log.Error(err.Error())
 	}
 }
+
+// LineageTags lists the tags of a Lineage, or attaches free-form tags
+// to it on POST, either keys or key=value pairs.
+// /api/lineages/{lineage}/tags GET and POST endpoint callback
+func LineageTags(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	lineage := mux.Vars(r)["lineage"]
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req struct {
+			Tags []string `json:"tags"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			JSONErrorCode(w, CodeInvalidParameter, "Failed to decode tags request", err)
+			return
+		}
+		if err := d.AddLineageTags(lineage, req.Tags); err != nil {
+			JSONError(w, "Failed to tag lineage", err)
+			return
+		}
+	default:
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+
+	tags, err := d.GetLineageTags(lineage)
+	if err != nil {
+		JSONError(w, "Failed to retrieve lineage tags", err)
+		return
+	}
+	writeJSON(w, tags, "Failed to marshal lineage tags")
+}
+
+// RemoveLineageTag detaches a tag from a Lineage.
+// /api/lineages/{lineage}/tags/{tag} DELETE endpoint callback
+func RemoveLineageTag(w http.ResponseWriter, r *http.Request, d *db.Database) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+
+	params := mux.Vars(r)
+	if err := d.RemoveLineageTag(params["lineage"], params["tag"]); err != nil {
+		JSONError(w, "Failed to remove lineage tag", err)
+		return
+	}
+
+	tags, err := d.GetLineageTags(params["lineage"])
+	if err != nil {
+		JSONError(w, "Failed to retrieve lineage tags", err)
+		return
+	}
+	writeJSON(w, tags, "Failed to marshal lineage tags")
+}
+
+// BulkTagLineages applies tags to all Lineages matching a pattern.
+// /api/lineages/tags/bulk POST endpoint callback
+func BulkTagLineages(w http.ResponseWriter, r *http.Request, db *db.Database) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+
+	var req struct {
+		Pattern     string            `json:"pattern"`
+		PatternType string            `json:"pattern_type"`
+		Tags        map[string]string `json:"tags"`
+		Mode        string            `json:"mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONErrorCode(w, CodeInvalidParameter, "Failed to decode bulk tag request", err)
+		return
+	}
+	if req.Mode != "" && req.Mode != "merge" && req.Mode != "overwrite" {
+		JSONErrorCode(w, CodeInvalidParameter, "Invalid bulk tag mode", fmt.Errorf("mode must be 'merge' or 'overwrite', got '%s'", req.Mode))
+		return
+	}
+
+	count, err := db.BulkTagLineages(req.Pattern, req.PatternType, req.Tags, req.Mode == "overwrite")
+	if err != nil {
+		log.WithContext(r.Context()).Errorf("Failed to tag lineages: %v", err)
+		JSONError(w, "Failed to tag lineages", err)
+		return
+	}
+
+	j, err := json.Marshal(map[string]int{"tagged": count})
+	if err != nil {
+		JSONError(w, "Failed to marshal json", err)
+		return
+	}
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
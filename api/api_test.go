@@ -1,3 +1,1288 @@
 package api
 
-// TODO: test api package
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/terraboard/auth"
+	"github.com/camptocamp/terraboard/config"
+	"github.com/camptocamp/terraboard/db"
+	"github.com/camptocamp/terraboard/internal/terraform/states/statefile"
+	"github.com/camptocamp/terraboard/state"
+	"github.com/camptocamp/terraboard/types"
+	"github.com/gorilla/mux"
+)
+
+// fakeProvider is a state.Provider returning static locks and versions
+// and raw states by State path or an error, recording the IDs of the locks
+// it releases
+type fakeProvider struct {
+	locks    map[string]state.LockInfo
+	versions map[string][]state.Version
+	raw      map[string][]byte
+	err      error
+	unlocked *[]string
+}
+
+func (f fakeProvider) Name() string {
+	return "fake"
+}
+
+func (f fakeProvider) GetLocks() (map[string]state.LockInfo, error) {
+	return f.locks, f.err
+}
+
+func (f fakeProvider) GetVersions(path string) ([]state.Version, error) {
+	return f.versions[path], nil
+}
+
+func (f fakeProvider) GetStates() (states []string, err error) {
+	for path := range f.versions {
+		states = append(states, path)
+	}
+	sort.Strings(states)
+	return states, f.err
+}
+
+func (f fakeProvider) GetState(string, string) (*statefile.File, error) {
+	return nil, nil
+}
+
+func (f fakeProvider) GetStateRaw(path, versionID string) ([]byte, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	raw, ok := f.raw[path+"@"+versionID]
+	if !ok {
+		return nil, fmt.Errorf("state %s not found at version %s", path, versionID)
+	}
+	return raw, nil
+}
+
+func (f fakeProvider) Unlock(lockID string) error {
+	if f.unlocked != nil {
+		*f.unlocked = append(*f.unlocked, lockID)
+	}
+	return nil
+}
+
+func TestCollectLocks_PartialFailure(t *testing.T) {
+	expected := map[string]state.LockInfo{
+		"myfakepath/terraform.tfstate": {
+			ID:   "fakeLockID",
+			Path: "myfakepath/terraform.tfstate",
+		},
+	}
+
+	sps := []state.Provider{
+		fakeProvider{err: fmt.Errorf("access denied")},
+		fakeProvider{locks: expected},
+	}
+
+	locks, warnings := collectLocks(sps)
+
+	if !reflect.DeepEqual(locks, expected) {
+		t.Fatalf("Expected %v, got %v", expected, locks)
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("Expected %d warning, got %d", 1, len(warnings))
+	}
+}
+
+func TestGetLocks_Response(t *testing.T) {
+	lock := state.LockInfo{ID: "fakeLockID", Path: "myfakepath/terraform.tfstate"}
+	sps := []state.Provider{
+		fakeProvider{err: fmt.Errorf("access denied")},
+		fakeProvider{locks: map[string]state.LockInfo{lock.Path: lock}},
+	}
+
+	// Locks are returned as a map by State path
+	rr := httptest.NewRecorder()
+	GetLocks(rr, httptest.NewRequest("GET", "/api/locks", nil), sps)
+	var locks map[string]state.LockInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &locks); err != nil {
+		t.Fatalf("Expected a map of locks, got %v", err)
+	}
+	if !reflect.DeepEqual(locks, map[string]state.LockInfo{lock.Path: lock}) {
+		t.Fatalf("Expected %v, got %v", lock, locks)
+	}
+
+	rr = httptest.NewRecorder()
+	GetLocks(rr, httptest.NewRequest("GET", "/api/locks?with_warnings=true", nil), sps)
+	var withWarnings struct {
+		Locks    map[string]state.LockInfo `json:"locks"`
+		Warnings []string                  `json:"warnings"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &withWarnings); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(withWarnings.Locks) != 1 || len(withWarnings.Warnings) != 1 {
+		t.Fatalf("Expected 1 lock and 1 warning, got %+v", withWarnings)
+	}
+}
+
+func TestCollectLocks_Masking(t *testing.T) {
+	locks := map[string]state.LockInfo{
+		"myfakepath/terraform.tfstate": {
+			ID:        "fakeLockID",
+			Operation: "OperationTypeApply",
+			Info:      "internal info",
+			Who:       "alice@internal-host",
+		},
+	}
+	sps := []state.Provider{fakeProvider{locks: locks}}
+
+	defer func() { maskedLockFields = nil }()
+
+	maskedLockFields = nil
+	unmasked, _ := collectLocks(sps)
+	if !reflect.DeepEqual(unmasked, locks) {
+		t.Fatalf("Expected %v, got %v", locks, unmasked)
+	}
+
+	maskedLockFields = []string{"who", "info"}
+	expected := state.LockInfo{
+		ID:        "fakeLockID",
+		Operation: "OperationTypeApply",
+		Info:      "(redacted)",
+		Who:       "(redacted)",
+	}
+	masked, _ := collectLocks(sps)
+	if l := masked["myfakepath/terraform.tfstate"]; !reflect.DeepEqual(l, expected) {
+		t.Fatalf("Expected %v, got %v", expected, l)
+	}
+	entries, _ := collectLockEntries(sps, time.Now())
+	if entries[0].Who != "(redacted)" || entries[0].Info != "(redacted)" {
+		t.Fatalf("Expected masked lock entry, got %v", entries[0])
+	}
+}
+
+func TestPaginatedResponse_Legacy(t *testing.T) {
+	expected := `{"page":2,"plans":["foo","bar"],"total":22}`
+
+	c := config.Config{}
+	c.Web.ResponseEnvelope = EnvelopeLegacy
+	Setup(&c)
+
+	j, err := json.Marshal(paginatedResponse("plans", []string{"foo", "bar"}, 2, 22))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if string(j) != expected {
+		t.Fatalf("Expected %s, got %s", expected, string(j))
+	}
+}
+
+func TestPaginatedResponse_JSONAPI(t *testing.T) {
+	expected := `{"data":["foo","bar"],"meta":{"page":2,"total":22}}`
+
+	c := config.Config{}
+	c.Web.ResponseEnvelope = EnvelopeJSONAPI
+	Setup(&c)
+	defer func() { responseEnvelope = EnvelopeLegacy }()
+
+	j, err := json.Marshal(paginatedResponse("plans", []string{"foo", "bar"}, 2, 22))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if string(j) != expected {
+		t.Fatalf("Expected %s, got %s", expected, string(j))
+	}
+}
+
+func TestLockEntries_FilterAndPaginate(t *testing.T) {
+	now := time.Now()
+	created := func(age time.Duration) *time.Time {
+		c := now.Add(-age)
+		return &c
+	}
+
+	locks := map[string]state.LockInfo{}
+	for i := 0; i < locksPageSize+2; i++ {
+		path := fmt.Sprintf("team-a/%02d.tfstate", i)
+		locks[path] = state.LockInfo{ID: path, Who: "alice@host", Created: created(3 * time.Hour)}
+	}
+	locks["team-b/old.tfstate"] = state.LockInfo{ID: "old", Who: "bob@host", Created: created(48 * time.Hour)}
+	locks["team-b/new.tfstate"] = state.LockInfo{ID: "new", Who: "bob@host", Created: created(time.Minute)}
+
+	sps := []state.Provider{fakeProvider{locks: locks}}
+	entries, warnings := collectLockEntries(sps, now)
+	if len(warnings) != 0 {
+		t.Fatalf("Expected no warnings, got %v", warnings)
+	}
+	if len(entries) != len(locks) {
+		t.Fatalf("Expected %d locks, got %d", len(locks), len(entries))
+	}
+
+	filtered := filterLockEntries(entries, "bob", "", 24*time.Hour)
+	if len(filtered) != 1 {
+		t.Fatalf("Expected %d lock, got %d", 1, len(filtered))
+	}
+	e := filtered[0]
+	if e.Path != "team-b/old.tfstate" || e.Provider != "fake" || e.AgeSeconds != int64((48*time.Hour).Seconds()) {
+		t.Fatalf("Expected enriched team-b/old.tfstate lock, got %v", e)
+	}
+
+	filtered = filterLockEntries(entries, "", "team-a/", 0)
+	if len(filtered) != locksPageSize+2 {
+		t.Fatalf("Expected %d locks, got %d", locksPageSize+2, len(filtered))
+	}
+	if p := pageLockEntries(filtered, 1); len(p) != locksPageSize {
+		t.Fatalf("Expected %d locks, got %d", locksPageSize, len(p))
+	}
+	expected := []types.LockEntry{filtered[locksPageSize], filtered[locksPageSize+1]}
+	if p := pageLockEntries(filtered, 2); !reflect.DeepEqual(p, expected) {
+		t.Fatalf("Expected %v, got %v", expected, p)
+	}
+	if p := pageLockEntries(filtered, 3); len(p) != 0 {
+		t.Fatalf("Expected no locks, got %v", p)
+	}
+}
+
+func TestRedactAttributes(t *testing.T) {
+	st := types.State{
+		Modules: []types.Module{{
+			Resources: []types.Resource{{
+				Attributes: []types.Attribute{
+					{Key: "id", Value: "i-123"},
+					{Key: "password", Value: "hunter2"},
+				},
+			}},
+		}},
+	}
+
+	redactAttributes(&st, []string{"password"})
+
+	expected := []types.Attribute{
+		{Key: "id", Value: "i-123"},
+		{Key: "password", Value: "(redacted)"},
+	}
+	attrs := st.Modules[0].Resources[0].Attributes
+	if !reflect.DeepEqual(attrs, expected) {
+		t.Fatalf("Expected %v, got %v", expected, attrs)
+	}
+}
+
+func TestGetSharedState_InvalidToken(t *testing.T) {
+	c := config.Config{}
+	c.Web.ShareSecret = "s3cr3t"
+	auth.Setup(&c)
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/api/shared/foo.bar", nil), map[string]string{"token": "foo.bar"})
+	rr := httptest.NewRecorder()
+	GetSharedState(rr, req, nil)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected %v, got %v", http.StatusForbidden, rr.Code)
+	}
+}
+
+func TestSearchAttribute_InvalidSortOrder(t *testing.T) {
+	for _, query := range []string{"orderBy=attributes.value", "orderBy=lineage&order=random", "orderBy=path%3BDROP%20TABLE%20states"} {
+		store := &fakeSearchStore{results: searchCSVResults}
+		rr := httptest.NewRecorder()
+		searchAttribute(rr, httptest.NewRequest("GET", "/api/search/attribute?"+query, nil), store)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %v for %s, got %v", http.StatusBadRequest, query, rr.Code)
+		}
+		if store.paged != nil {
+			t.Fatalf("Expected no search for %s, got %v", query, store.paged)
+		}
+	}
+}
+
+func TestSearchAttribute_InvalidRegex(t *testing.T) {
+	for _, query := range []string{"name=web-(\\d%2B&regex=true", "value=[a-&regex=true"} {
+		rr := httptest.NewRecorder()
+		SearchAttribute(rr, httptest.NewRequest("GET", "/api/search/attribute?"+query, nil), nil)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %v for %s, got %v", http.StatusBadRequest, query, rr.Code)
+		}
+	}
+}
+
+// fakeSearchStore serves search results from memory, recording the query
+// of paged searches
+type fakeSearchStore struct {
+	results []types.SearchResult
+	paged   url.Values
+	err     error
+}
+
+func (f *fakeSearchStore) SearchAttribute(query url.Values) ([]types.SearchResult, int, int) {
+	f.paged = query
+	return append([]types.SearchResult{}, f.results[:1]...), 1, len(f.results)
+}
+
+func (f *fakeSearchStore) EachSearchResult(query url.Values, fn func(types.SearchResult) error) error {
+	if f.err != nil {
+		return f.err
+	}
+	for _, r := range f.results {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var searchCSVResults = []types.SearchResult{
+	{
+		Path: "env/prod/terraform.tfstate", VersionID: "v2", TFVersion: "1.0.2", Serial: 7,
+		LineageValue: "prod", ModulePath: "root", ResourceType: "azurerm_sql_database",
+		ResourceName: "main", AttributeKey: "id", AttributeValue: "db-123",
+	},
+	{
+		Path: "env/prod/terraform.tfstate", VersionID: "v2", TFVersion: "1.0.2", Serial: 7,
+		LineageValue: "prod", ModulePath: "root", ResourceType: "azurerm_sql_database",
+		ResourceName: "main", AttributeKey: "admin_password", AttributeValue: "hunter2, \"quoted\"",
+	},
+}
+
+const searchCSVHeader = "path,version_id,tf_version,serial,lineage_value,module_path," +
+	"resource_type,resource_name,resource_index,attribute_key,attribute_value\n"
+
+func TestSearchAttribute_CSV(t *testing.T) {
+	store := &fakeSearchStore{results: searchCSVResults}
+	rr := httptest.NewRecorder()
+	searchAttribute(rr, httptest.NewRequest("GET", "/api/search/attribute?format=csv&page=1", nil), store)
+
+	if rr.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("Expected %s, got %s", "text/csv", rr.Header().Get("Content-Type"))
+	}
+	expected := searchCSVHeader +
+		"env/prod/terraform.tfstate,v2,1.0.2,7,prod,root,azurerm_sql_database,main,,id,db-123\n"
+	if rr.Body.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, rr.Body.String())
+	}
+	if store.paged.Get("page") != "1" {
+		t.Fatalf("Expected a paged search, got %v", store.paged)
+	}
+}
+
+func TestSearchAttribute_CSVAll(t *testing.T) {
+	setupMaskingTest()
+	defer setupAttributeMasking(nil)
+
+	store := &fakeSearchStore{results: searchCSVResults}
+	rr := httptest.NewRecorder()
+	searchAttribute(rr, httptest.NewRequest("GET", "/api/search/attribute?format=csv&all=true&page=1", nil), store)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	expected := searchCSVHeader +
+		"env/prod/terraform.tfstate,v2,1.0.2,7,prod,root,azurerm_sql_database,main,,id,db-123\n" +
+		"env/prod/terraform.tfstate,v2,1.0.2,7,prod,root,azurerm_sql_database,main,,admin_password," + redactedValue + "\n"
+	if rr.Body.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, rr.Body.String())
+	}
+	if store.paged != nil {
+		t.Fatalf("Expected no paged search, got %v", store.paged)
+	}
+
+	// Values are quoted as needed
+	setupAttributeMasking(nil)
+	rr = httptest.NewRecorder()
+	searchAttribute(rr, httptest.NewRequest("GET", "/api/search/attribute?format=csv&all=true", nil), store)
+	if !strings.HasSuffix(rr.Body.String(), `,admin_password,"hunter2, ""quoted"""`+"\n") {
+		t.Fatalf("Expected a quoted value, got %q", rr.Body.String())
+	}
+
+	// Errors before any row is sent are reported as JSON
+	store.err = fmt.Errorf("connection refused")
+	rr = httptest.NewRecorder()
+	searchAttribute(rr, httptest.NewRequest("GET", "/api/search/attribute?format=csv&all=true", nil), store)
+	if rr.Code != http.StatusInternalServerError || rr.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected a JSON error, got %v %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+}
+
+// fakeStateStatsStore serves State stats from memory, recording the query
+type fakeStateStatsStore struct {
+	states []types.StateStat
+	query  url.Values
+}
+
+func (f *fakeStateStatsStore) ListStateStats(query url.Values) ([]types.StateStat, int, int) {
+	f.query = query
+	if query.Get("page") == "" {
+		return f.states, -1, len(f.states)
+	}
+	return f.states[:1], 1, len(f.states)
+}
+
+func TestListStateStats_CSV(t *testing.T) {
+	store := &fakeStateStatsStore{states: []types.StateStat{
+		{
+			Path: "env/prod/terraform.tfstate", LineageValue: "prod", Provider: "aws", TFVersion: "1.0.2",
+			Serial: 7, VersionID: "v2", LastModified: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), ResourceCount: 12,
+		},
+		{
+			Path: "env/dev/terraform.tfstate", LineageValue: "dev", DisplayName: "Development", Provider: "aws",
+			TFVersion: "1.0.1", Serial: 3, VersionID: "v1", LastModified: time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC),
+			ResourceCount: 4, ComputedFields: map[string]string{"team": "a"},
+		},
+	}}
+	header := "path,lineage_value,display_name,provider,terraform_version,serial,version_id," +
+		"last_modified,resource_count,empty,computed_fields\n"
+	prod := "env/prod/terraform.tfstate,prod,,aws,1.0.2,7,v2,2021-06-01T12:00:00Z,12,false,null\n"
+	dev := `env/dev/terraform.tfstate,dev,Development,aws,1.0.1,3,v1,2021-05-01T12:00:00Z,4,false,"{""team"":""a""}"` + "\n"
+
+	rr := httptest.NewRecorder()
+	listStateStats(rr, httptest.NewRequest("GET", "/api/lineages/stats?format=csv&page=1", nil), store)
+	if rr.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("Expected %s, got %s", "text/csv", rr.Header().Get("Content-Type"))
+	}
+	if rr.Body.String() != header+prod {
+		t.Fatalf("Expected %q, got %q", header+prod, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	listStateStats(rr, httptest.NewRequest("GET", "/api/lineages/stats?format=csv&page=1&all=true", nil), store)
+	if rr.Body.String() != header+prod+dev {
+		t.Fatalf("Expected %q, got %q", header+prod+dev, rr.Body.String())
+	}
+	if store.query.Get("page") != "" {
+		t.Fatalf("Expected no page, got %s", store.query.Get("page"))
+	}
+}
+
+// fakePlanInserter fails inserting plans with the given errors before succeeding
+type fakePlanInserter struct {
+	errs      []error
+	attempts  int
+	inserted  []byte
+	submitter string
+}
+
+func (f *fakePlanInserter) InsertPlan(plan []byte, submitter string) error {
+	f.attempts++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return err
+	}
+	f.inserted = plan
+	f.submitter = submitter
+	return nil
+}
+
+func TestSubmitPlan_TransientErrors(t *testing.T) {
+	planInsertRetries = 3
+	planInsertBackoff = time.Millisecond
+
+	pi := &fakePlanInserter{errs: []error{io.ErrUnexpectedEOF, driver.ErrBadConn}}
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/plans", strings.NewReader(`{"plan_json": {}}`))
+	req.Header.Set("X-Forwarded-Email", "ci@example.com")
+	submitPlan(rr, req, pi)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	if pi.attempts != 3 {
+		t.Fatalf("Expected %d attempts, got %d", 3, pi.attempts)
+	}
+	if string(pi.inserted) != `{"plan_json": {}}` {
+		t.Fatalf("Expected the plan to be inserted, got %s", pi.inserted)
+	}
+	if pi.submitter != "ci@example.com" {
+		t.Fatalf("Expected the plan to be submitted by ci@example.com, got %q", pi.submitter)
+	}
+}
+
+func TestSubmitPlan_PermanentError(t *testing.T) {
+	planInsertRetries = 3
+	planInsertBackoff = time.Millisecond
+
+	pi := &fakePlanInserter{errs: []error{fmt.Errorf("duplicate key value violates unique constraint")}}
+	rr := httptest.NewRecorder()
+	submitPlan(rr, httptest.NewRequest("POST", "/api/plans", strings.NewReader(`{}`)), pi)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected %v, got %v", http.StatusInternalServerError, rr.Code)
+	}
+	if pi.attempts != 1 {
+		t.Fatalf("Expected %d attempt, got %d", 1, pi.attempts)
+	}
+}
+
+// fakePlanDeleter soft-deletes plans in memory
+type fakePlanDeleter struct {
+	deleted map[string]bool
+}
+
+func (f fakePlanDeleter) DeletePlan(id string) error {
+	if _, ok := f.deleted[id]; !ok {
+		return db.ErrPlanNotFound
+	}
+	f.deleted[id] = true
+	return nil
+}
+
+func (f fakePlanDeleter) RestorePlan(id string) error {
+	if _, ok := f.deleted[id]; !ok {
+		return db.ErrPlanNotFound
+	}
+	f.deleted[id] = false
+	return nil
+}
+
+func TestDeleteAndRestorePlan(t *testing.T) {
+	pd := fakePlanDeleter{deleted: map[string]bool{"1": false, "2": false}}
+
+	rr := httptest.NewRecorder()
+	deletePlan(rr, httptest.NewRequest("DELETE", "/api/plans?planid=1", nil), pd)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	if !pd.deleted["1"] || pd.deleted["2"] {
+		t.Fatalf("Expected only plan 1 to be deleted, got %v", pd.deleted)
+	}
+
+	rr = httptest.NewRecorder()
+	req := mux.SetURLVars(httptest.NewRequest("POST", "/api/plans/1/restore", nil), map[string]string{"planid": "1"})
+	restorePlan(rr, req, pd)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	if pd.deleted["1"] {
+		t.Fatalf("Expected plan 1 to be restored")
+	}
+}
+
+func TestDeletePlan_Errors(t *testing.T) {
+	pd := fakePlanDeleter{deleted: map[string]bool{}}
+
+	rr := httptest.NewRecorder()
+	deletePlan(rr, httptest.NewRequest("DELETE", "/api/plans", nil), pd)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected %v, got %v", http.StatusBadRequest, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	deletePlan(rr, httptest.NewRequest("DELETE", "/api/plans?planid=3", nil), pd)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("Expected %v, got %v", http.StatusNotFound, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/api/plans/3/restore", nil), map[string]string{"planid": "3"})
+	restorePlan(rr, req, pd)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected %v, got %v", http.StatusMethodNotAllowed, rr.Code)
+	}
+}
+
+// fakeReferenceStore serves States from memory, keyed by version
+type fakeReferenceStore struct {
+	reference string
+	current   string
+	states    map[string]types.State
+}
+
+func (f fakeReferenceStore) GetReferenceVersion(string) (string, error) {
+	if f.reference == "" {
+		return "", db.ErrNoReference
+	}
+	return f.reference, nil
+}
+
+func (f fakeReferenceStore) DefaultVersion(string) (string, error) {
+	return f.current, nil
+}
+
+func (f fakeReferenceStore) GetState(_, versionID string) types.State {
+	return f.states[versionID]
+}
+
+func TestDriftFromReference(t *testing.T) {
+	vpc := types.Resource{Type: "aws_vpc", Name: "main"}
+	instance := types.Resource{Type: "aws_instance", Name: "web"}
+	rs := fakeReferenceStore{
+		reference: "v1",
+		current:   "v2",
+		states: map[string]types.State{
+			"v1": {
+				Path:    "fake.tfstate",
+				Version: types.Version{VersionID: "v1"},
+				Modules: []types.Module{{Path: "root", Resources: []types.Resource{vpc}}},
+			},
+			"v2": {
+				Path:    "fake.tfstate",
+				Version: types.Version{VersionID: "v2"},
+				Modules: []types.Module{{Path: "root", Resources: []types.Resource{vpc, instance}}},
+			},
+		},
+	}
+
+	rr := httptest.NewRecorder()
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/api/lineages/fake/drift-from-reference", nil),
+		map[string]string{"lineage": "fake"})
+	driftFromReference(rr, req, rs)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	var drift types.StateCompare
+	if err := json.Unmarshal(rr.Body.Bytes(), &drift); err != nil {
+		t.Fatalf("Failed to decode drift: %v", err)
+	}
+	if drift.Stats.From.VersionID != "v1" || drift.Stats.To.VersionID != "v2" {
+		t.Fatalf("Expected drift from %s to %s, got %v", "v1", "v2", drift.Stats)
+	}
+	if _, ok := drift.Differences.OnlyInNew["root.aws_instance.web"]; !ok || len(drift.Differences.OnlyInNew) != 1 {
+		t.Fatalf("Expected %s only in current version, got %v", "root.aws_instance.web", drift.Differences.OnlyInNew)
+	}
+}
+
+func TestDriftFromReference_NoReference(t *testing.T) {
+	rr := httptest.NewRecorder()
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/api/lineages/fake/drift-from-reference", nil),
+		map[string]string{"lineage": "fake"})
+	driftFromReference(rr, req, fakeReferenceStore{})
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("Expected %v, got %v", http.StatusNotFound, rr.Code)
+	}
+}
+
+// fakeChangelogStore serves the versions of a Lineage from memory,
+// the most recent first
+type fakeChangelogStore struct {
+	versions []types.LineageVersion
+	states   map[string]types.State
+	limit    string
+}
+
+func (f *fakeChangelogStore) ListStateVersions(_, limitStr, _ string) ([]types.LineageVersion, int, int) {
+	f.limit = limitStr
+	limit, _ := strconv.Atoi(limitStr)
+	if limit > len(f.versions) {
+		limit = len(f.versions)
+	}
+	return f.versions[:limit], 1, len(f.versions)
+}
+
+func (f *fakeChangelogStore) GetState(_, versionID string) types.State {
+	return f.states[versionID]
+}
+
+func newFakeChangelogStore() *fakeChangelogStore {
+	day := func(d int) time.Time { return time.Date(2021, 6, d, 12, 0, 0, 0, time.UTC) }
+	vpc := types.Resource{Type: "aws_vpc", Name: "main", Attributes: []types.Attribute{{Key: "cidr_block", Value: `"10.0.0.0/16"`}}}
+	resized := types.Resource{Type: "aws_vpc", Name: "main", Attributes: []types.Attribute{{Key: "cidr_block", Value: `"10.0.0.0/8"`}}}
+	instance := types.Resource{Type: "aws_instance", Name: "web", Attributes: []types.Attribute{{Key: "ami", Value: `"ami-1"`}}}
+	bucket := types.Resource{Type: "aws_s3_bucket", Name: "logs", Attributes: []types.Attribute{{Key: "bucket", Value: `"logs"`}}}
+	state := func(id string, resources ...types.Resource) types.State {
+		return types.State{
+			Path:    "fake.tfstate",
+			Version: types.Version{VersionID: id},
+			Modules: []types.Module{{Path: "root", Resources: resources}},
+		}
+	}
+	return &fakeChangelogStore{
+		versions: []types.LineageVersion{
+			{VersionID: "v3", Serial: 3, LastModified: day(3)},
+			{VersionID: "v2", Serial: 2, LastModified: day(2)},
+			{VersionID: "v1", Serial: 1, LastModified: day(1)},
+		},
+		states: map[string]types.State{
+			// v2 adds the instance, v3 resizes the VPC and replaces the instance by a bucket
+			"v1": state("v1", vpc),
+			"v2": state("v2", vpc, instance),
+			"v3": state("v3", resized, bucket),
+		},
+	}
+}
+
+func TestGetChangelog_CountAndRange(t *testing.T) {
+	rr := httptest.NewRecorder()
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/api/lineages/fake/changelog?count=3&from=2021-06-01T00:00:00Z", nil),
+		map[string]string{"lineage": "fake"})
+	// The database is never reached
+	GetChangelog(rr, req, nil)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected %v, got %v", http.StatusBadRequest, rr.Code)
+	}
+	if code := responseCode(t, rr); code != CodeInvalidParameter {
+		t.Fatalf("Expected %s, got %s", CodeInvalidParameter, code)
+	}
+}
+
+func TestLineageChangelog(t *testing.T) {
+	cs := newFakeChangelogStore()
+	rr := httptest.NewRecorder()
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/api/lineages/fake/changelog?count=3", nil),
+		map[string]string{"lineage": "fake"})
+	lineageChangelog(rr, req, cs)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	var changelog []types.ChangelogEntry
+	if err := json.Unmarshal(rr.Body.Bytes(), &changelog); err != nil {
+		t.Fatalf("Failed to decode changelog: %v", err)
+	}
+	if len(changelog) != 2 {
+		t.Fatalf("Expected 2 entries, got %v", changelog)
+	}
+
+	expected := []struct {
+		from, to   string
+		modified   time.Time
+		resources  types.DiffCount
+		attributes types.DiffCount
+	}{
+		{"v2", "v3", cs.versions[0].LastModified, types.DiffCount{Added: 1, Removed: 1, Changed: 1}, types.DiffCount{Changed: 1}},
+		{"v1", "v2", cs.versions[1].LastModified, types.DiffCount{Added: 1}, types.DiffCount{}},
+	}
+	for i, e := range expected {
+		entry := changelog[i]
+		if entry.FromVersionID != e.from || entry.ToVersionID != e.to || !entry.LastModified.Equal(e.modified) {
+			t.Fatalf("Expected step %s -> %s at %v, got %+v", e.from, e.to, e.modified, entry)
+		}
+		if entry.Stats.From.VersionID != e.from || entry.Stats.To.VersionID != e.to {
+			t.Fatalf("Expected stats of %s -> %s, got %+v", e.from, e.to, entry.Stats)
+		}
+		if entry.Stats.Resources != e.resources || entry.Stats.Attributes != e.attributes {
+			t.Fatalf("Expected %+v and %+v for %s -> %s, got %+v and %+v",
+				e.resources, e.attributes, e.from, e.to, entry.Stats.Resources, entry.Stats.Attributes)
+		}
+	}
+}
+
+func TestLineageChangelog_Count(t *testing.T) {
+	defer func(max int) { changelogMaxCount = max }(changelogMaxCount)
+	changelogMaxCount = 2
+
+	cs := newFakeChangelogStore()
+	rr := httptest.NewRecorder()
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/api/lineages/fake/changelog?count=50", nil),
+		map[string]string{"lineage": "fake"})
+	lineageChangelog(rr, req, cs)
+
+	var changelog []types.ChangelogEntry
+	if err := json.Unmarshal(rr.Body.Bytes(), &changelog); err != nil {
+		t.Fatalf("Failed to decode changelog: %v", err)
+	}
+	if cs.limit != "2" || len(changelog) != 1 || changelog[0].ToVersionID != "v3" {
+		t.Fatalf("Expected the count to be capped to 2 versions, got limit %s and %v", cs.limit, changelog)
+	}
+
+	for _, count := range []string{"1", "many"} {
+		rr := httptest.NewRecorder()
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/api/lineages/fake/changelog?count="+count, nil),
+			map[string]string{"lineage": "fake"})
+		lineageChangelog(rr, req, cs)
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %v for count %s, got %v", http.StatusBadRequest, count, rr.Code)
+		}
+	}
+}
+
+func rawStateRequest() *http.Request {
+	return mux.SetURLVars(httptest.NewRequest("GET", "/api/lineages/fake/raw?versionid=v1", nil),
+		map[string]string{"lineage": "fake"})
+}
+
+func TestStateRaw(t *testing.T) {
+	rs := fakeReferenceStore{
+		states: map[string]types.State{
+			"v1": {Path: "fake.tfstate", Provider: "fake", Serial: 2},
+		},
+	}
+	original := []byte(`{"version":4,"serial":2,"lineage":"fake"}`)
+	sps := []state.Provider{fakeProvider{raw: map[string][]byte{"fake.tfstate@v1": original}}}
+
+	rr := httptest.NewRecorder()
+	stateRaw(rr, rawStateRequest(), rs, sps)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Expected %s, got %s", "application/json", ct)
+	}
+	if cd := rr.Header().Get("Content-Disposition"); cd != "attachment; filename=terraform.tfstate" {
+		t.Fatalf("Expected %s, got %s", "attachment; filename=terraform.tfstate", cd)
+	}
+	if rr.Body.String() != string(original) {
+		t.Fatalf("Expected %s, got %s", original, rr.Body.String())
+	}
+}
+
+func TestStateRaw_Reconstructed(t *testing.T) {
+	rs := fakeReferenceStore{
+		states: map[string]types.State{
+			"v1": {Path: "fake.tfstate", Provider: "fake", Serial: 2},
+		},
+	}
+	sps := []state.Provider{fakeProvider{}}
+
+	rr := httptest.NewRecorder()
+	stateRaw(rr, rawStateRequest(), rs, sps)
+
+	if cd := rr.Header().Get("Content-Disposition"); cd != "attachment; filename=terraform.tfstate" {
+		t.Fatalf("Expected %s, got %s", "attachment; filename=terraform.tfstate", cd)
+	}
+	var sf struct {
+		Lineage string `json:"lineage"`
+		Serial  int64  `json:"serial"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &sf); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if sf.Lineage != "fake" || sf.Serial != 2 {
+		t.Fatalf("Expected lineage fake at serial 2, got %s at serial %d", sf.Lineage, sf.Serial)
+	}
+}
+
+func TestStateRaw_UnknownVersion(t *testing.T) {
+	rr := httptest.NewRecorder()
+	stateRaw(rr, rawStateRequest(), fakeReferenceStore{}, nil)
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("Expected %v, got %v", http.StatusNotFound, rr.Code)
+	}
+}
+
+// setupAdminTest sets up the roles of the users allowed to administrate Terraboard
+func setupAdminTest() {
+	c := config.Config{}
+	c.Web.RolesHeader = "X-Forwarded-Groups"
+	c.Web.AdminRoles = []string{"admin"}
+	auth.Setup(&c)
+}
+
+// asUser sets the user headers of a request, with the given roles
+func asUser(req *http.Request, user, roles string) *http.Request {
+	if user != "" {
+		req.Header.Set("X-Forwarded-User", user)
+	}
+	if roles != "" {
+		req.Header.Set("X-Forwarded-Groups", roles)
+	}
+	return req
+}
+
+func forceUnlockRequest(lockID, user, roles string) *http.Request {
+	req := asUser(httptest.NewRequest("DELETE", "/api/locks/"+lockID, nil), user, roles)
+	return mux.SetURLVars(req, map[string]string{"lockID": lockID})
+}
+
+func TestForceUnlock(t *testing.T) {
+	setupAdminTest()
+	lock := state.LockInfo{ID: "fakeLockID", Who: "foo@bar", Path: "myfakepath/terraform.tfstate"}
+	var idle, holding []string
+	sps := []state.Provider{
+		fakeProvider{err: fmt.Errorf("access denied")},
+		fakeProvider{locks: map[string]state.LockInfo{}, unlocked: &idle},
+		fakeProvider{locks: map[string]state.LockInfo{lock.Path: lock}, unlocked: &holding},
+	}
+
+	rr := httptest.NewRecorder()
+	ForceUnlock(rr, forceUnlockRequest("fakeLockID", "foo", "admin"), sps)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	var removed state.LockInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &removed); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if !reflect.DeepEqual(removed, lock) {
+		t.Fatalf("Expected %v, got %v", lock, removed)
+	}
+	if len(idle) != 0 || !reflect.DeepEqual(holding, []string{"fakeLockID"}) {
+		t.Fatalf("Expected only the holding provider to unlock, got %v and %v", idle, holding)
+	}
+}
+
+func TestForceUnlock_NotFound(t *testing.T) {
+	setupAdminTest()
+	var unlocked []string
+	sps := []state.Provider{fakeProvider{locks: map[string]state.LockInfo{}, unlocked: &unlocked}}
+
+	rr := httptest.NewRecorder()
+	ForceUnlock(rr, forceUnlockRequest("unknown", "foo", "admin"), sps)
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("Expected %v, got %v", http.StatusNotFound, rr.Code)
+	}
+	if code := responseCode(t, rr); code != CodeLockNotFound {
+		t.Fatalf("Expected %s, got %s", CodeLockNotFound, code)
+	}
+	if len(unlocked) != 0 {
+		t.Fatalf("Expected no unlock, got %v", unlocked)
+	}
+}
+
+func TestForceUnlock_Anonymous(t *testing.T) {
+	setupAdminTest()
+	lock := state.LockInfo{ID: "fakeLockID", Path: "myfakepath/terraform.tfstate"}
+	var unlocked []string
+	sps := []state.Provider{fakeProvider{locks: map[string]state.LockInfo{lock.Path: lock}, unlocked: &unlocked}}
+
+	rr := httptest.NewRecorder()
+	ForceUnlock(rr, forceUnlockRequest("fakeLockID", "", ""), sps)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected %v, got %v", http.StatusUnauthorized, rr.Code)
+	}
+	if len(unlocked) != 0 {
+		t.Fatalf("Expected no unlock, got %v", unlocked)
+	}
+}
+
+func TestForceUnlock_NotAdmin(t *testing.T) {
+	setupAdminTest()
+	lock := state.LockInfo{ID: "fakeLockID", Path: "myfakepath/terraform.tfstate"}
+	var unlocked []string
+	sps := []state.Provider{fakeProvider{locks: map[string]state.LockInfo{lock.Path: lock}, unlocked: &unlocked}}
+
+	rr := httptest.NewRecorder()
+	ForceUnlock(rr, forceUnlockRequest("fakeLockID", "foo", "dev"), sps)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected %v, got %v", http.StatusForbidden, rr.Code)
+	}
+	if code := responseCode(t, rr); code != CodeForbidden {
+		t.Fatalf("Expected %s, got %s", CodeForbidden, code)
+	}
+	if len(unlocked) != 0 {
+		t.Fatalf("Expected no unlock, got %v", unlocked)
+	}
+}
+
+func TestDeleteLineage_NotAdmin(t *testing.T) {
+	setupAdminTest()
+	for roles, expected := range map[string]int{"": http.StatusUnauthorized, "dev": http.StatusForbidden} {
+		user := "foo"
+		if roles == "" {
+			user = ""
+		}
+		req := asUser(httptest.NewRequest("DELETE", "/api/lineages/fakeLineage", nil), user, roles)
+		req = mux.SetURLVars(req, map[string]string{"lineage": "fakeLineage"})
+		rr := httptest.NewRecorder()
+		// The database is never reached
+		DeleteLineage(rr, req, nil)
+
+		if rr.Code != expected {
+			t.Fatalf("Expected %v, got %v", expected, rr.Code)
+		}
+	}
+}
+
+func TestVersionReconciliation(t *testing.T) {
+	versions := func(ids ...string) (versions []state.Version) {
+		for _, id := range ids {
+			versions = append(versions, state.Version{ID: id})
+		}
+		return
+	}
+	sps := []state.Provider{
+		fakeProvider{versions: map[string][]state.Version{
+			"app.tfstate":        versions("a1", "a2", "a3", "a4"),
+			"app.tfstate.backup": versions("b1"),
+			"db.tfstate":         versions("d1", "d2"),
+			"new.tfstate":        versions("n1"),
+			"excluded.tfstate":   versions("e1"),
+		}},
+		fakeProvider{err: fmt.Errorf("access denied")},
+	}
+	filter := state.PathFilter{Exclude: []string{"excluded.tfstate"}}
+	known := map[string][]string{
+		"a1": {"app.tfstate"},
+		"b1": {"app.tfstate"},
+		"d1": {"db.tfstate"},
+		"d2": {"db.tfstate"},
+	}
+
+	gaps, warnings := collectVersionGaps(sps, filter, known)
+	if len(warnings) != 1 {
+		t.Fatalf("Expected a warning for the failing provider, got %v", warnings)
+	}
+
+	lineages := map[string]string{"app.tfstate": "app-lineage", "db.tfstate": "db-lineage"}
+	expected := []types.VersionGap{
+		{LineageValue: "app-lineage", Provider: "fake", Paths: []string{"app.tfstate"}, AvailableVersions: 5, IngestedVersions: 2, MissingVersions: 3},
+		{LineageValue: "", Provider: "fake", Paths: []string{"new.tfstate"}, AvailableVersions: 1, IngestedVersions: 0, MissingVersions: 1},
+	}
+	results := mergeVersionGaps(gaps, lineages)
+	if !reflect.DeepEqual(results, expected) {
+		t.Fatalf("Expected %v, got %v", expected, results)
+	}
+}
+
+// fakeInserter records the State versions it inserts
+type fakeInserter struct {
+	versions []string
+	states   []string
+}
+
+func (f *fakeInserter) InsertVersion(version *state.Version) error {
+	f.versions = append(f.versions, version.ID)
+	return nil
+}
+
+func (f *fakeInserter) InsertState(path, versionID, provider string, sf *statefile.File) error {
+	f.states = append(f.states, path+"@"+versionID)
+	return nil
+}
+
+func TestBackfillVersions(t *testing.T) {
+	date := func(day int) time.Time {
+		return time.Date(2021, 6, day, 0, 0, 0, 0, time.UTC)
+	}
+	sp := fakeProvider{versions: map[string][]state.Version{
+		"app.tfstate": {
+			{ID: "a3", LastModified: date(3)},
+			{ID: "a1", LastModified: date(1)},
+			{ID: "a4", LastModified: date(4)},
+		},
+		"app.tfstate.backup": {{ID: "b2", LastModified: date(2)}},
+		"other.tfstate":      {{ID: "o1", LastModified: date(1)}},
+	}}
+	known := map[string][]string{"a1": {"app.tfstate"}}
+	inserter := &fakeInserter{}
+
+	for i, expected := range []int{3, 0} {
+		backfilled, err := backfillVersions(sp, state.PathFilter{}, []string{"app.tfstate"}, known, inserter)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if backfilled != expected {
+			t.Fatalf("Expected %d versions backfilled on run %d, got %d", expected, i+1, backfilled)
+		}
+	}
+
+	expected := []string{"app.tfstate@b2", "app.tfstate@a3", "app.tfstate@a4"}
+	if !reflect.DeepEqual(inserter.states, expected) {
+		t.Fatalf("Expected %v, got %v", expected, inserter.states)
+	}
+	if !reflect.DeepEqual(inserter.versions, []string{"b2", "a3", "a4"}) {
+		t.Fatalf("Expected %v, got %v", []string{"b2", "a3", "a4"}, inserter.versions)
+	}
+}
+
+func TestBackfillLineage_NotAdmin(t *testing.T) {
+	setupAdminTest()
+	req := asUser(httptest.NewRequest("POST", "/api/admin/backfill/fakeLineage", nil), "foo", "dev")
+	req = mux.SetURLVars(req, map[string]string{"lineage": "fakeLineage"})
+	rr := httptest.NewRecorder()
+	BackfillLineage(rr, req, nil, nil)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected %v, got %v", http.StatusForbidden, rr.Code)
+	}
+	if code := responseCode(t, rr); code != CodeForbidden {
+		t.Fatalf("Expected %s, got %s", CodeForbidden, code)
+	}
+}
+
+func TestBackupDatabase_NotAdmin(t *testing.T) {
+	setupAdminTest()
+	rr := httptest.NewRecorder()
+	BackupDatabase(rr, asUser(httptest.NewRequest("POST", "/api/admin/backup", nil), "foo", "dev"), nil)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected %v, got %v", http.StatusForbidden, rr.Code)
+	}
+}
+
+func TestRestoreDatabase_Forbidden(t *testing.T) {
+	setupAdminTest()
+	defer func() { allowRestore = false }()
+	tests := []struct {
+		allow    bool
+		roles    string
+		expected int
+	}{
+		{false, "admin", http.StatusForbidden},
+		{true, "dev", http.StatusForbidden},
+		{true, "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		allowRestore = tt.allow
+		rr := httptest.NewRecorder()
+		RestoreDatabase(rr, asUser(httptest.NewRequest("POST", "/api/admin/restore", nil), "foo", tt.roles), nil)
+
+		if rr.Code != tt.expected {
+			t.Fatalf("Expected %v, got %v", tt.expected, rr.Code)
+		}
+		if code := responseCode(t, rr); code != CodeForbidden {
+			t.Fatalf("Expected %s, got %s", CodeForbidden, code)
+		}
+	}
+}
+
+func TestStartBackfill(t *testing.T) {
+	if !startBackfill("fake-lineage") {
+		t.Fatalf("Expected the backfill to start")
+	}
+	if startBackfill("fake-lineage") {
+		t.Fatalf("Expected a concurrent backfill of the same lineage to be refused")
+	}
+	if !startBackfill("other-lineage") {
+		t.Fatalf("Expected the backfill of another lineage to start")
+	}
+	endBackfill("fake-lineage")
+	endBackfill("other-lineage")
+	if !startBackfill("fake-lineage") {
+		t.Fatalf("Expected the backfill to start once the previous one is done")
+	}
+	endBackfill("fake-lineage")
+}
+
+// fakePinger is a database whose connection fails with err
+type fakePinger struct {
+	err error
+}
+
+func (f fakePinger) Ping() error {
+	return f.err
+}
+
+// hungProvider is a state.Provider whose states never come
+type hungProvider struct {
+	fakeProvider
+}
+
+func (h hungProvider) Name() string {
+	return "hung"
+}
+
+func (h hungProvider) GetStates() ([]string, error) {
+	select {}
+}
+
+func TestCheckReadiness_Ready(t *testing.T) {
+	sps := []state.Provider{fakeProvider{}}
+	if failures := checkReadiness(context.Background(), fakePinger{}, sps); len(failures) != 0 {
+		t.Fatalf("Expected no failure, got %v", failures)
+	}
+
+	rr := httptest.NewRecorder()
+	writeReadiness(rr, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, rr.Code)
+	}
+}
+
+func TestCheckReadiness_DatabaseDown(t *testing.T) {
+	failures := checkReadiness(context.Background(), fakePinger{err: driver.ErrBadConn}, nil)
+	expected := map[string]string{"database": driver.ErrBadConn.Error()}
+	if !reflect.DeepEqual(failures, expected) {
+		t.Fatalf("Expected %v, got %v", expected, failures)
+	}
+
+	rr := httptest.NewRecorder()
+	writeReadiness(rr, failures)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected %v, got %v", http.StatusServiceUnavailable, rr.Code)
+	}
+	var body struct {
+		Status   string            `json:"status"`
+		Failures map[string]string `json:"failures"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if body.Status != "unavailable" || !reflect.DeepEqual(body.Failures, expected) {
+		t.Fatalf("Expected unavailable with %v, got %v", expected, body)
+	}
+}
+
+func TestCheckReadiness_UnreachableProvider(t *testing.T) {
+	defer func(timeout time.Duration) { readinessTimeout = timeout }(readinessTimeout)
+	readinessTimeout = 50 * time.Millisecond
+
+	sps := []state.Provider{
+		fakeProvider{err: fmt.Errorf("no such host")},
+		hungProvider{},
+	}
+	start := time.Now()
+	failures := checkReadiness(context.Background(), fakePinger{}, sps)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected the readiness check to time out, took %v", elapsed)
+	}
+
+	expected := map[string]string{
+		"provider fake": "no such host",
+		"provider hung": context.DeadlineExceeded.Error(),
+	}
+	if !reflect.DeepEqual(failures, expected) {
+		t.Fatalf("Expected %v, got %v", expected, failures)
+	}
+}
+
+// fakePluginUsageStore serves the usage of a provider plugin,
+// recording the requested plugin
+type fakePluginUsageStore struct {
+	usages    []types.PluginUsage
+	requested string
+}
+
+func (f *fakePluginUsageStore) GetPluginUsage(plugin string) ([]types.PluginUsage, error) {
+	f.requested = plugin
+	return f.usages, nil
+}
+
+func TestGetPluginUsage(t *testing.T) {
+	ps := &fakePluginUsageStore{usages: []types.PluginUsage{
+		{LineageValue: "network", ResourceTypes: []string{"aws_subnet", "aws_vpc"}},
+	}}
+	rr := httptest.NewRecorder()
+	getPluginUsage(rr, httptest.NewRequest("GET", "/api/stats/plugin-usage?plugin=aws", nil), ps)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	if ps.requested != "aws" {
+		t.Fatalf("Expected %s, got %s", "aws", ps.requested)
+	}
+	var usages []types.PluginUsage
+	if err := json.Unmarshal(rr.Body.Bytes(), &usages); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if !reflect.DeepEqual(usages, ps.usages) {
+		t.Fatalf("Expected %v, got %v", ps.usages, usages)
+	}
+}
+
+func TestGetPluginUsage_Version(t *testing.T) {
+	ps := &fakePluginUsageStore{}
+	rr := httptest.NewRecorder()
+	getPluginUsage(rr, httptest.NewRequest("GET", "/api/stats/plugin-usage?plugin=aws&version=4.67.0", nil), ps)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected %v, got %v", http.StatusBadRequest, rr.Code)
+	}
+	var errObj map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &errObj); err != nil {
+		t.Fatalf("Failed to decode error response: %v", err)
+	}
+	if errObj["code"] != string(CodeInvalidParameter) || errObj["error"] != "Invalid version parameter" {
+		t.Fatalf("Expected an invalid version parameter error, got %v", errObj)
+	}
+	if ps.requested != "" {
+		t.Fatalf("Expected no usage lookup, got %s", ps.requested)
+	}
+}
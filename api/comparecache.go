@@ -0,0 +1,179 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/camptocamp/terraboard/types"
+	"github.com/gorilla/mux"
+)
+
+// comparePageSize is the number of resources per page of paginated comparisons
+var comparePageSize = 100
+
+// compareCacheTTL is the validity of the comparisons kept for pagination
+var compareCacheTTL = 10 * time.Minute
+
+// errCompareNotFound is returned when a paginated comparison is unknown or expired
+var errCompareNotFound = errors.New("compare result not found or expired")
+
+// cachedCompare is a State comparison kept for pagination,
+// along with the sorted addresses of its resources
+type cachedCompare struct {
+	lineage   string
+	user      string
+	compare   types.StateCompare
+	addresses []string
+	expires   time.Time
+}
+
+// compareStore holds the paginated comparisons of a replica by token
+type compareStore struct {
+	sync.Mutex
+	entries map[string]*cachedCompare
+}
+
+func newCompareStore() *compareStore {
+	return &compareStore{entries: make(map[string]*cachedCompare)}
+}
+
+// compareCache holds the paginated comparisons of this replica
+var compareCache = newCompareStore()
+
+// InvalidateCompares drops the comparisons kept of the versions of a
+// lineage, or all of them given an empty lineage, when its data changed.
+// It is called with the invalidations notified by any replica.
+func InvalidateCompares(lineage string) {
+	compareCache.invalidate(lineage)
+}
+
+// invalidate drops the comparisons of a lineage, or all of them
+func (s *compareStore) invalidate(lineage string) {
+	s.Lock()
+	defer s.Unlock()
+	for t, c := range s.entries {
+		if lineage == "" || c.lineage == lineage {
+			delete(s.entries, t)
+		}
+	}
+}
+
+// keep keeps a comparison of the versions of a lineage computed for a user
+// until it expires and returns its token. Expired comparisons are dropped.
+func (s *compareStore) keep(comp types.StateCompare, lineage, user string, now time.Time) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	var addresses []string
+	for a := range comp.Differences.OnlyInOld {
+		addresses = append(addresses, a)
+	}
+	for a := range comp.Differences.OnlyInNew {
+		addresses = append(addresses, a)
+	}
+	addresses = append(addresses, comp.Differences.InBoth...)
+	sort.Strings(addresses)
+
+	s.Lock()
+	defer s.Unlock()
+	for t, c := range s.entries {
+		if !now.Before(c.expires) {
+			delete(s.entries, t)
+		}
+	}
+	s.entries[token] = &cachedCompare{
+		lineage:   lineage,
+		user:      user,
+		compare:   comp,
+		addresses: addresses,
+		expires:   now.Add(compareCacheTTL),
+	}
+	return token, nil
+}
+
+// page returns a page of a comparison kept for a user
+func (s *compareStore) page(token, user string, page int, now time.Time) (p types.StateComparePage, err error) {
+	s.Lock()
+	c, ok := s.entries[token]
+	s.Unlock()
+	// Comparisons may hold attributes masked for other users
+	if !ok || c.user != user || !now.Before(c.expires) {
+		return p, errCompareNotFound
+	}
+
+	p = types.StateComparePage{
+		Token:     token,
+		Page:      page,
+		Pages:     (len(c.addresses) + comparePageSize - 1) / comparePageSize,
+		Total:     len(c.addresses),
+		ExpiresAt: c.expires,
+	}
+	if p.Pages == 0 {
+		p.Pages = 1
+	}
+	if page < 1 || page > p.Pages {
+		return p, fmt.Errorf("page %d out of 1-%d", page, p.Pages)
+	}
+
+	start := (page - 1) * comparePageSize
+	end := start + comparePageSize
+	if end > len(c.addresses) {
+		end = len(c.addresses)
+	}
+
+	p.Compare.Stats = c.compare.Stats
+	diff := &p.Compare.Differences
+	diff.OnlyInOld = make(map[string]string)
+	diff.OnlyInNew = make(map[string]string)
+	diff.InBoth = []string{}
+	diff.ResourceDiff = make(map[string]types.ResourceDiff)
+	for _, a := range c.addresses[start:end] {
+		if r, ok := c.compare.Differences.OnlyInOld[a]; ok {
+			diff.OnlyInOld[a] = r
+			continue
+		}
+		if r, ok := c.compare.Differences.OnlyInNew[a]; ok {
+			diff.OnlyInNew[a] = r
+			continue
+		}
+		diff.InBoth = append(diff.InBoth, a)
+		if r, ok := c.compare.Differences.ResourceDiff[a]; ok {
+			diff.ResourceDiff[a] = r
+		}
+	}
+	return p, nil
+}
+
+// GetCompareResult returns a page of a paginated State comparison
+// /api/compare/result/{token} GET endpoint callback
+func GetCompareResult(w http.ResponseWriter, r *http.Request) {
+	page := 1
+	if v := r.URL.Query().Get("page"); v != "" {
+		var err error
+		if page, err = strconv.Atoi(v); err != nil {
+			JSONErrorCode(w, CodeInvalidParameter, "Invalid page parameter", err)
+			return
+		}
+	}
+
+	p, err := compareCache.page(mux.Vars(r)["token"], r.Header.Get("X-Forwarded-User"), page, time.Now())
+	if errors.Is(err, errCompareNotFound) {
+		JSONError(w, "Failed to retrieve compare result", err)
+		return
+	} else if err != nil {
+		JSONErrorCode(w, CodeInvalidParameter, "Invalid page parameter", err)
+		return
+	}
+
+	writeJSON(w, p, "Failed to marshal compare result")
+}
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/terraboard/compare"
+	"github.com/camptocamp/terraboard/types"
+	"github.com/gorilla/mux"
+)
+
+// largeStates returns two versions of a State of n resources,
+// the first ones being removed, changed and added between them
+func largeStates(n int) (from, to types.State) {
+	var fromResources, toResources []types.Resource
+	for i := 0; i < n; i++ {
+		fromResources = append(fromResources, types.Resource{
+			Type:       "aws_instance",
+			Name:       fmt.Sprintf("web%03d", i),
+			Attributes: []types.Attribute{{Key: "instance_type", Value: "t3.micro"}},
+		})
+		value := "t3.micro"
+		if i%3 == 0 {
+			value = "t3.large"
+		}
+		toResources = append(toResources, types.Resource{
+			Type:       "aws_instance",
+			Name:       fmt.Sprintf("web%03d", i+10),
+			Attributes: []types.Attribute{{Key: "instance_type", Value: value}},
+		})
+	}
+	from = types.State{Path: "large.tfstate", Version: types.Version{VersionID: "v1"},
+		Modules: []types.Module{{Path: "root", Resources: fromResources}}}
+	to = types.State{Path: "large.tfstate", Version: types.Version{VersionID: "v2"},
+		Modules: []types.Module{{Path: "root", Resources: toResources}}}
+	return
+}
+
+func compareResultRequest(token string, page int) *http.Request {
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/compare/result/%s?page=%d", token, page), nil)
+	req.Header.Set("X-Forwarded-User", "alice")
+	return mux.SetURLVars(req, map[string]string{"token": token})
+}
+
+func TestCompareResult_Pages(t *testing.T) {
+	defer func(size int) { comparePageSize = size }(comparePageSize)
+	comparePageSize = 40
+
+	from, to := largeStates(250)
+	comp, err := compare.Compare(context.Background(), from, to)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	token, err := compareCache.keep(comp, "lineage", "alice", time.Now())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	seen := make(map[string]bool)
+	changed := 0
+	var pages []types.StateComparePage
+	for page := 1; ; page++ {
+		rr := httptest.NewRecorder()
+		GetCompareResult(rr, compareResultRequest(token, page))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected %v, got %v", http.StatusOK, rr.Code)
+		}
+		var p types.StateComparePage
+		if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if p.Compare.Stats.Resources != comp.Stats.Resources {
+			t.Fatalf("Expected stats %v on each page, got %v", comp.Stats.Resources, p.Compare.Stats.Resources)
+		}
+
+		d := p.Compare.Differences
+		var addresses []string
+		for a := range d.OnlyInOld {
+			addresses = append(addresses, a)
+		}
+		for a := range d.OnlyInNew {
+			addresses = append(addresses, a)
+		}
+		addresses = append(addresses, d.InBoth...)
+		if len(addresses) > comparePageSize {
+			t.Fatalf("Expected at most %d resources per page, got %d", comparePageSize, len(addresses))
+		}
+		for _, a := range addresses {
+			if seen[a] {
+				t.Fatalf("Expected %s on a single page", a)
+			}
+			seen[a] = true
+		}
+		changed += len(d.ResourceDiff)
+		pages = append(pages, p)
+
+		if page == p.Pages {
+			break
+		}
+	}
+
+	if len(pages) != 7 || len(seen) != 260 {
+		t.Fatalf("Expected 260 resources on 7 pages, got %d on %d", len(seen), len(pages))
+	}
+	if changed != len(comp.Differences.ResourceDiff) {
+		t.Fatalf("Expected %d changed resources, got %d", len(comp.Differences.ResourceDiff), changed)
+	}
+	var addresses []string
+	for a := range seen {
+		addresses = append(addresses, a)
+	}
+	sort.Strings(addresses)
+	if addresses[0] != "root.aws_instance.web000" || addresses[len(addresses)-1] != "root.aws_instance.web259" {
+		t.Fatalf("Expected all resources, got %s to %s", addresses[0], addresses[len(addresses)-1])
+	}
+
+	// Pages are served from the kept comparison, identical when requested again
+	rr := httptest.NewRecorder()
+	GetCompareResult(rr, compareResultRequest(token, 2))
+	var again types.StateComparePage
+	if err := json.Unmarshal(rr.Body.Bytes(), &again); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(again, pages[1]) {
+		t.Fatalf("Expected %v, got %v", pages[1], again)
+	}
+}
+
+func TestCompareResult_Expired(t *testing.T) {
+	from, to := largeStates(5)
+	comp, _ := compare.Compare(context.Background(), from, to)
+	token, err := compareCache.keep(comp, "lineage", "alice", time.Now().Add(-compareCacheTTL))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	GetCompareResult(rr, compareResultRequest(token, 1))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("Expected %v, got %v", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestCompareResult_OtherUser(t *testing.T) {
+	from, to := largeStates(5)
+	comp, _ := compare.Compare(context.Background(), from, to)
+	token, err := compareCache.keep(comp, "lineage", "bob", time.Now())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	GetCompareResult(rr, compareResultRequest(token, 1))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("Expected %v, got %v", http.StatusNotFound, rr.Code)
+	}
+}
+
+// fakeInvalidationChannel delivers the invalidations notified by any
+// replica to all of them, as the PostgreSQL notification channel does
+type fakeInvalidationChannel struct {
+	listeners []func(lineage string)
+}
+
+func (c *fakeInvalidationChannel) notify(lineage string) {
+	for _, invalidate := range c.listeners {
+		invalidate(lineage)
+	}
+}
+
+func TestCompareStore_InvalidationPropagates(t *testing.T) {
+	from, to := largeStates(5)
+	comp, _ := compare.Compare(context.Background(), from, to)
+
+	replicas := []*compareStore{newCompareStore(), newCompareStore()}
+	channel := &fakeInvalidationChannel{}
+	tokens := make(map[*compareStore]map[string]string)
+	for _, s := range replicas {
+		channel.listeners = append(channel.listeners, s.invalidate)
+		tokens[s] = make(map[string]string)
+		for _, lineage := range []string{"lineage1", "lineage2"} {
+			token, err := s.keep(comp, lineage, "alice", time.Now())
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			tokens[s][lineage] = token
+		}
+	}
+
+	// A new version of lineage1 ingested by one of the replicas
+	channel.notify("lineage1")
+	for i, s := range replicas {
+		if _, err := s.page(tokens[s]["lineage1"], "alice", 1, time.Now()); err != errCompareNotFound {
+			t.Fatalf("Expected the lineage1 comparison of replica %d to be dropped, got %v", i, err)
+		}
+		if _, err := s.page(tokens[s]["lineage2"], "alice", 1, time.Now()); err != nil {
+			t.Fatalf("Expected the lineage2 comparison of replica %d to be kept, got %v", i, err)
+		}
+	}
+
+	// Notifications possibly missed, all comparisons are dropped
+	channel.notify("")
+	for i, s := range replicas {
+		if _, err := s.page(tokens[s]["lineage2"], "alice", 1, time.Now()); err != errCompareNotFound {
+			t.Fatalf("Expected the lineage2 comparison of replica %d to be dropped, got %v", i, err)
+		}
+	}
+}
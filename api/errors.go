@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/camptocamp/terraboard/auth"
+	"github.com/camptocamp/terraboard/backup"
+	"github.com/camptocamp/terraboard/db"
+	"github.com/camptocamp/terraboard/state"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrorCode is a stable, machine-readable code of an API error response
+type ErrorCode string
+
+// API error codes
+const (
+	CodeInternal              ErrorCode = "INTERNAL_ERROR"
+	CodeInvalidParameter      ErrorCode = "INVALID_PARAMETER"
+	CodeLineageNotFound       ErrorCode = "LINEAGE_NOT_FOUND"
+	CodeVersionNotFound       ErrorCode = "VERSION_NOT_FOUND"
+	CodeReferenceNotFound     ErrorCode = "REFERENCE_NOT_FOUND"
+	CodePlanNotFound          ErrorCode = "PLAN_NOT_FOUND"
+	CodeUnsupportedPlanFormat ErrorCode = "UNSUPPORTED_PLAN_FORMAT"
+	CodeInvalidToken          ErrorCode = "INVALID_TOKEN"
+	CodeProviderUnavailable   ErrorCode = "PROVIDER_UNAVAILABLE"
+	CodeTimeout               ErrorCode = "TIMEOUT"
+	CodeUnauthorized          ErrorCode = "UNAUTHORIZED"
+	CodeForbidden             ErrorCode = "FORBIDDEN"
+	CodeLockNotFound          ErrorCode = "LOCK_NOT_FOUND"
+	CodeBackfillInProgress    ErrorCode = "BACKFILL_IN_PROGRESS"
+	CodeBackupNotConfigured   ErrorCode = "BACKUP_NOT_CONFIGURED"
+	CodeIncompatibleBackup    ErrorCode = "INCOMPATIBLE_BACKUP"
+	CodeInvalidBackup         ErrorCode = "INVALID_BACKUP"
+	CodeCompareNotFound       ErrorCode = "COMPARE_NOT_FOUND"
+	CodeNoPriorState          ErrorCode = "NO_PRIOR_STATE"
+	CodeTagNotFound           ErrorCode = "TAG_NOT_FOUND"
+	CodeRateLimited           ErrorCode = "RATE_LIMITED"
+)
+
+// errorStatuses maps error codes to the HTTP status of their responses
+var errorStatuses = map[ErrorCode]int{
+	CodeInternal:              http.StatusInternalServerError,
+	CodeInvalidParameter:      http.StatusBadRequest,
+	CodeLineageNotFound:       http.StatusNotFound,
+	CodeVersionNotFound:       http.StatusNotFound,
+	CodeReferenceNotFound:     http.StatusNotFound,
+	CodePlanNotFound:          http.StatusNotFound,
+	CodeUnsupportedPlanFormat: http.StatusBadRequest,
+	CodeInvalidToken:          http.StatusForbidden,
+	CodeProviderUnavailable:   http.StatusBadGateway,
+	CodeTimeout:               http.StatusGatewayTimeout,
+	CodeUnauthorized:          http.StatusUnauthorized,
+	CodeForbidden:             http.StatusForbidden,
+	CodeLockNotFound:          http.StatusNotFound,
+	CodeBackfillInProgress:    http.StatusConflict,
+	CodeBackupNotConfigured:   http.StatusNotImplemented,
+	CodeIncompatibleBackup:    http.StatusConflict,
+	CodeInvalidBackup:         http.StatusBadRequest,
+	CodeCompareNotFound:       http.StatusNotFound,
+	CodeNoPriorState:          http.StatusNotFound,
+	CodeTagNotFound:           http.StatusNotFound,
+	CodeRateLimited:           http.StatusTooManyRequests,
+}
+
+// errorCode returns the error code matching an error, CodeInternal by default
+func errorCode(err error) ErrorCode {
+	switch {
+	case errors.Is(err, db.ErrLineageNotFound):
+		return CodeLineageNotFound
+	case errors.Is(err, db.ErrUnknownVersion):
+		return CodeVersionNotFound
+	case errors.Is(err, db.ErrNoReference):
+		return CodeReferenceNotFound
+	case errors.Is(err, db.ErrPlanNotFound):
+		return CodePlanNotFound
+	case errors.Is(err, db.ErrUnsupportedPlanFormat):
+		return CodeUnsupportedPlanFormat
+	case errors.Is(err, db.ErrNoPriorState):
+		return CodeNoPriorState
+	case errors.Is(err, db.ErrTagNotFound):
+		return CodeTagNotFound
+	case errors.Is(err, db.ErrInvalidTag):
+		return CodeInvalidParameter
+	case errors.Is(err, db.ErrInvalidCondition):
+		return CodeInvalidParameter
+	case errors.Is(err, db.ErrInvalidSortOrder):
+		return CodeInvalidParameter
+	case errors.Is(err, state.ErrLockNotFound):
+		return CodeLockNotFound
+	case errors.Is(err, auth.ErrInvalidShareToken), errors.Is(err, auth.ErrExpiredShareToken):
+		return CodeInvalidToken
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return CodeTimeout
+	case errors.Is(err, backup.ErrNotConfigured):
+		return CodeBackupNotConfigured
+	case errors.Is(err, backup.ErrIncompatibleSchema):
+		return CodeIncompatibleBackup
+	case errors.Is(err, backup.ErrInvalidArchive):
+		return CodeInvalidBackup
+	case errors.Is(err, errCompareNotFound):
+		return CodeCompareNotFound
+	}
+	return CodeInternal
+}
+
+// JSONError is a wrapper function for errors
+// which prints them to the http.ResponseWriter as a JSON response,
+// with the error code and status matching the error
+func JSONError(w http.ResponseWriter, message string, err error) {
+	JSONErrorCode(w, errorCode(err), message, err)
+}
+
+// JSONErrorCode prints an error with the given code, and the matching
+// status, to the http.ResponseWriter as a JSON response
+func JSONErrorCode(w http.ResponseWriter, code ErrorCode, message string, err error) {
+	if status, ok := errorStatuses[code]; ok {
+		w.WriteHeader(status)
+	}
+	errObj := make(map[string]string)
+	errObj["code"] = string(code)
+	errObj["error"] = message
+	errObj["details"] = fmt.Sprintf("%v", err)
+	j, _ := json.Marshal(errObj)
+	if _, err := io.WriteString(w, string(j)); err != nil {
+		log.Error(err.Error())
+	}
+}
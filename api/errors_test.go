@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/camptocamp/terraboard/db"
+	"github.com/camptocamp/terraboard/state"
+	"github.com/gorilla/mux"
+)
+
+// responseCode decodes the error code of a JSON error response
+func responseCode(t *testing.T, rr *httptest.ResponseRecorder) ErrorCode {
+	var errObj map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &errObj); err != nil {
+		t.Fatalf("Failed to decode error response: %v", err)
+	}
+	return ErrorCode(errObj["code"])
+}
+
+func TestErrorCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code ErrorCode
+	}{
+		{db.ErrLineageNotFound, CodeLineageNotFound},
+		{fmt.Errorf("fingerprint: %w", db.ErrUnknownVersion), CodeVersionNotFound},
+		{db.ErrPlanNotFound, CodePlanNotFound},
+		{db.ErrNoPriorState, CodeNoPriorState},
+		{fmt.Errorf("%w: missing key", db.ErrInvalidCondition), CodeInvalidParameter},
+		{context.DeadlineExceeded, CodeTimeout},
+		{fmt.Errorf("connection refused"), CodeInternal},
+	} {
+		if code := errorCode(tc.err); code != tc.code {
+			t.Fatalf("Expected %s for %v, got %s", tc.code, tc.err, code)
+		}
+	}
+}
+
+func TestErrorCodes_Handlers(t *testing.T) {
+	planInsertRetries = 0
+
+	for _, tc := range []struct {
+		name    string
+		handler func(w http.ResponseWriter, r *http.Request)
+		req     *http.Request
+		status  int
+		code    ErrorCode
+	}{
+		{
+			name: "invalid parameter",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				GetChangedLineages(w, r, nil)
+			},
+			req:    httptest.NewRequest("GET", "/api/changes/lineages?from=yesterday", nil),
+			status: http.StatusBadRequest,
+			code:   CodeInvalidParameter,
+		},
+		{
+			name: "invalid share token",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				GetSharedState(w, r, nil)
+			},
+			req:    mux.SetURLVars(httptest.NewRequest("GET", "/api/shared/bogus", nil), map[string]string{"token": "bogus"}),
+			status: http.StatusForbidden,
+			code:   CodeInvalidToken,
+		},
+		{
+			name: "reference not found",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				driftFromReference(w, r, fakeReferenceStore{})
+			},
+			req:    mux.SetURLVars(httptest.NewRequest("GET", "/api/lineages/fake/drift-from-reference", nil), map[string]string{"lineage": "fake"}),
+			status: http.StatusNotFound,
+			code:   CodeReferenceNotFound,
+		},
+		{
+			name: "unsupported plan format",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				submitPlan(w, r, &fakePlanInserter{errs: []error{fmt.Errorf("format 2.0: %w", db.ErrUnsupportedPlanFormat)}})
+			},
+			req:    httptest.NewRequest("POST", "/api/plans", strings.NewReader(`{}`)),
+			status: http.StatusBadRequest,
+			code:   CodeUnsupportedPlanFormat,
+		},
+		{
+			name: "provider unavailable",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				GetLocks(w, r, []state.Provider{fakeProvider{err: fmt.Errorf("access denied")}})
+			},
+			req:    httptest.NewRequest("GET", "/api/locks", nil),
+			status: http.StatusBadGateway,
+			code:   CodeProviderUnavailable,
+		},
+		{
+			name: "internal error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				submitPlan(w, r, &fakePlanInserter{errs: []error{fmt.Errorf("disk full")}})
+			},
+			req:    httptest.NewRequest("POST", "/api/plans", strings.NewReader(`{}`)),
+			status: http.StatusInternalServerError,
+			code:   CodeInternal,
+		},
+	} {
+		rr := httptest.NewRecorder()
+		tc.handler(rr, tc.req)
+
+		if rr.Code != tc.status {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.status, rr.Code)
+		}
+		if code := responseCode(t, rr); code != tc.code {
+			t.Fatalf("%s: expected %s, got %s", tc.name, tc.code, code)
+		}
+	}
+}
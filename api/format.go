@@ -0,0 +1,473 @@
+package api
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Response formats of list endpoints
+const (
+	FormatJSON   = "json"
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+	FormatText   = "text"
+)
+
+// streamThreshold is the size (in bytes) above which JSON responses
+// are streamed instead of buffered
+var streamThreshold = 1 << 20
+
+var formatContentTypes = map[string]string{
+	FormatJSON:   "application/json",
+	FormatCSV:    "text/csv",
+	FormatNDJSON: "application/x-ndjson",
+	FormatText:   "text/plain",
+}
+
+// negotiateFormat returns the response format requested by the "format"
+// parameter, or else by the Accept header, falling back to JSON
+func negotiateFormat(r *http.Request) string {
+	if f := r.URL.Query().Get("format"); f != "" {
+		if _, ok := formatContentTypes[f]; ok {
+			return f
+		}
+		return FormatJSON
+	}
+
+	type mediaRange struct {
+		format string
+		q      float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.TrimSpace(fields[0])
+		q := 1.0
+		for _, param := range fields[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 && kv[0] == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		for f, ct := range formatContentTypes {
+			if mediaType == ct && q > 0 {
+				ranges = append(ranges, mediaRange{f, q})
+			}
+		}
+	}
+	if len(ranges) == 0 {
+		return FormatJSON
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	return ranges[0].format
+}
+
+// writeList writes the response of a list endpoint in the negotiated format.
+// JSON renders the whole response, while CSV, NDJSON and text render only its items.
+func writeList(w http.ResponseWriter, r *http.Request, response, items interface{}) {
+	format := negotiateFormat(r)
+	w.Header().Set("Content-Type", formatContentTypes[format])
+
+	var err error
+	switch format {
+	case FormatCSV:
+		err = writeCSV(w, items)
+	case FormatNDJSON:
+		err = writeNDJSON(w, items)
+	case FormatText:
+		err = writeText(w, items)
+	default:
+		writeJSON(w, response, "Failed to marshal json")
+	}
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// thresholdWriter buffers a response until it exceeds a size threshold,
+// then streams it to the underlying writer
+type thresholdWriter struct {
+	w         io.Writer
+	threshold int
+	buf       bytes.Buffer
+	streaming bool
+}
+
+func (t *thresholdWriter) Write(p []byte) (int, error) {
+	if t.streaming {
+		return t.w.Write(p)
+	}
+	if t.buf.Len()+len(p) <= t.threshold {
+		return t.buf.Write(p)
+	}
+
+	t.streaming = true
+	if _, err := t.w.Write(t.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	t.buf.Reset()
+	return t.w.Write(p)
+}
+
+// writeJSON writes v as a JSON response. Responses up to the stream threshold
+// are buffered, so that an encoding error still turns into an error response,
+// while larger ones are streamed as they are encoded, piece by piece, without
+// holding the whole document in memory.
+func writeJSON(w http.ResponseWriter, v interface{}, errMessage string) {
+	w.Header().Set("Content-Type", formatContentTypes[FormatJSON])
+	tw := &thresholdWriter{w: w, threshold: streamThreshold}
+	if err := encodeJSON(tw, reflect.ValueOf(v)); err != nil {
+		if tw.streaming {
+			log.Error(err.Error())
+			return
+		}
+		JSONError(w, errMessage, err)
+		return
+	}
+	if tw.streaming {
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(tw.buf.Len()))
+	if _, err := w.Write(tw.buf.Bytes()); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// encodeJSON writes v as json.Marshal would, encoding slices and structs
+// element by element and field by field, so that only the leaves of the
+// document are marshalled in memory at once
+func encodeJSON(w io.Writer, v reflect.Value) error {
+	if !v.IsValid() {
+		_, err := io.WriteString(w, "null")
+		return err
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() && implementsMarshaler(reflect.PtrTo(v.Type())) {
+		return marshalJSON(w, v.Addr())
+	}
+	if implementsMarshaler(v.Type()) {
+		return marshalJSON(w, v)
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			_, err := io.WriteString(w, "null")
+			return err
+		}
+		return encodeJSON(w, v.Elem())
+	case reflect.Slice:
+		if v.IsNil() {
+			_, err := io.WriteString(w, "null")
+			return err
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			// Byte slices are base64 encoded strings
+			return marshalJSON(w, v)
+		}
+		return encodeJSONArray(w, v)
+	case reflect.Array:
+		return encodeJSONArray(w, v)
+	case reflect.Struct:
+		fields, ok := jsonFields(v.Type())
+		if !ok {
+			return marshalJSON(w, v)
+		}
+		if fields.flat {
+			return marshalJSON(w, v)
+		}
+		if _, err := io.WriteString(w, "{"); err != nil {
+			return err
+		}
+		first := true
+		for _, f := range fields.fields {
+			fv := v.Field(f.index)
+			if f.omitEmpty && isEmptyJSONValue(fv) {
+				continue
+			}
+			if !first {
+				if _, err := io.WriteString(w, ","); err != nil {
+					return err
+				}
+			}
+			first = false
+			if _, err := w.Write(f.name); err != nil {
+				return err
+			}
+			if err := encodeJSON(w, fv); err != nil {
+				return err
+			}
+		}
+		_, err := io.WriteString(w, "}")
+		return err
+	}
+	return marshalJSON(w, v)
+}
+
+// encodeJSONArray writes the elements of a slice or an array as a JSON array
+func encodeJSONArray(w io.Writer, v reflect.Value) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	for i := 0; i < v.Len(); i++ {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := encodeJSON(w, v.Index(i)); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]")
+	return err
+}
+
+// marshalJSON writes v, marshalled as a whole
+func marshalJSON(w io.Writer, v reflect.Value) error {
+	j, err := json.Marshal(v.Interface())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(j)
+	return err
+}
+
+func implementsMarshaler(t reflect.Type) bool {
+	return t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType)
+}
+
+// jsonField is a field of a struct encoded by encodeJSON
+type jsonField struct {
+	index int
+	// name is the quoted name of the field, followed by a colon
+	name      []byte
+	omitEmpty bool
+}
+
+// jsonStruct is the encoding of a struct type by encodeJSON
+type jsonStruct struct {
+	fields []jsonField
+	// flat is set when no field holds a slice, a struct or a reference,
+	// the struct being small enough to be marshalled as a whole
+	flat bool
+}
+
+// jsonFieldsCache holds the fields of the struct types encoded so far
+var jsonFieldsCache sync.Map
+
+// jsonFields returns the fields of a struct type encoded by encodeJSON,
+// or false when the struct has to be marshalled as a whole, because of
+// embedded structs or fields encoded as strings
+func jsonFields(t reflect.Type) (jsonStruct, bool) {
+	if cached, ok := jsonFieldsCache.Load(t); ok {
+		s := cached.(jsonStruct)
+		return s, s.fields != nil
+	}
+
+	fields := []jsonField{}
+	flat := true
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if f.Anonymous {
+			fields = nil
+			break
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+
+		opts := strings.Split(tag, ",")
+		name := opts[0]
+		if name == "" {
+			name = f.Name
+		}
+		field := jsonField{index: i}
+		for _, opt := range opts[1:] {
+			switch opt {
+			case "omitempty":
+				field.omitEmpty = true
+			case "string":
+				fields = nil
+			}
+		}
+		if fields == nil {
+			break
+		}
+		quoted, err := json.Marshal(name)
+		if err != nil {
+			fields = nil
+			break
+		}
+		field.name = append(quoted, ':')
+		fields = append(fields, field)
+
+		switch f.Type.Kind() {
+		case reflect.Slice, reflect.Array, reflect.Map, reflect.Struct, reflect.Ptr, reflect.Interface:
+			if !implementsMarshaler(f.Type) && !implementsMarshaler(reflect.PtrTo(f.Type)) {
+				flat = false
+			}
+		}
+	}
+	s := jsonStruct{fields: fields, flat: flat}
+	jsonFieldsCache.Store(t, s)
+	return s, fields != nil
+}
+
+// isEmptyJSONValue returns whether a value is omitted by the omitempty option
+func isEmptyJSONValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// writeText writes each item of a slice on its own line,
+// strings as they are and other items as JSON
+func writeText(w io.Writer, items interface{}) error {
+	v := reflect.ValueOf(items)
+	for i := 0; i < v.Len(); i++ {
+		line, ok := v.Index(i).Interface().(string)
+		if !ok {
+			j, err := json.Marshal(v.Index(i).Interface())
+			if err != nil {
+				return err
+			}
+			line = string(j)
+		}
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeNDJSON writes each item of a slice as a JSON line
+func writeNDJSON(w io.Writer, items interface{}) error {
+	v := reflect.ValueOf(items)
+	enc := json.NewEncoder(w)
+	for i := 0; i < v.Len(); i++ {
+		if err := enc.Encode(v.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// csvEncoder writes structs as CSV rows, after a header row made
+// of the JSON names of their fields
+type csvEncoder struct {
+	cw     *csv.Writer
+	fields []int
+}
+
+// newCSVEncoder writes the header row of the structs of type t
+func newCSVEncoder(w io.Writer, t reflect.Type) (*csvEncoder, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot render %v as CSV", t)
+	}
+
+	e := &csvEncoder{cw: csv.NewWriter(w)}
+	var header []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.PkgPath != "" || name == "-" || f.Anonymous {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		e.fields = append(e.fields, i)
+		header = append(header, name)
+	}
+	return e, e.cw.Write(header)
+}
+
+// encode writes a struct as a CSV row
+func (e *csvEncoder) encode(item reflect.Value) error {
+	item = reflect.Indirect(item)
+	record := make([]string, len(e.fields))
+	for k, f := range e.fields {
+		record[k] = csvValue(item.Field(f))
+	}
+	return e.cw.Write(record)
+}
+
+// flush writes the buffered rows
+func (e *csvEncoder) flush() error {
+	e.cw.Flush()
+	return e.cw.Error()
+}
+
+// writeCSV writes a slice of structs as CSV, with a header row made
+// of the JSON names of their fields
+func writeCSV(w io.Writer, items interface{}) error {
+	v := reflect.ValueOf(items)
+	enc, err := newCSVEncoder(w, v.Type().Elem())
+	if err != nil {
+		return err
+	}
+	for i := 0; i < v.Len(); i++ {
+		if err := enc.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return enc.flush()
+}
+
+// csvValue renders a field value as a CSV cell
+func csvValue(v reflect.Value) string {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	if t, ok := v.Interface().(time.Time); ok {
+		return t.Format(time.RFC3339)
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Struct:
+		j, _ := json.Marshal(v.Interface())
+		return string(j)
+	}
+	return fmt.Sprint(v.Interface())
+}
@@ -0,0 +1,254 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/terraboard/types"
+)
+
+type formatItem struct {
+	Name    string    `json:"name"`
+	Count   int       `json:"count"`
+	Created time.Time `json:"created"`
+	Hidden  string    `json:"-"`
+}
+
+var formatItems = []formatItem{
+	{Name: "foo", Count: 1, Created: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)},
+	{Name: "bar", Count: 2, Created: time.Date(2021, 6, 2, 12, 0, 0, 0, time.UTC)},
+}
+
+func TestWriteList_Negotiation(t *testing.T) {
+	for _, tc := range []struct {
+		url, accept, contentType, body string
+	}{
+		{
+			"/api/foo", "application/json", "application/json",
+			`{"items":[{"name":"foo","count":1,"created":"2021-06-01T12:00:00Z"},{"name":"bar","count":2,"created":"2021-06-02T12:00:00Z"}]}`,
+		},
+		{
+			"/api/foo", "text/csv", "text/csv",
+			"name,count,created\nfoo,1,2021-06-01T12:00:00Z\nbar,2,2021-06-02T12:00:00Z\n",
+		},
+		{
+			"/api/foo", "application/x-ndjson", "application/x-ndjson",
+			`{"name":"foo","count":1,"created":"2021-06-01T12:00:00Z"}` + "\n" +
+				`{"name":"bar","count":2,"created":"2021-06-02T12:00:00Z"}` + "\n",
+		},
+		{
+			"/api/foo", "text/csv;q=0.5, application/x-ndjson", "application/x-ndjson",
+			`{"name":"foo","count":1,"created":"2021-06-01T12:00:00Z"}` + "\n" +
+				`{"name":"bar","count":2,"created":"2021-06-02T12:00:00Z"}` + "\n",
+		},
+		{
+			"/api/foo", "text/html", "application/json",
+			`{"items":[{"name":"foo","count":1,"created":"2021-06-01T12:00:00Z"},{"name":"bar","count":2,"created":"2021-06-02T12:00:00Z"}]}`,
+		},
+		{
+			"/api/foo?format=csv", "application/json", "text/csv",
+			"name,count,created\nfoo,1,2021-06-01T12:00:00Z\nbar,2,2021-06-02T12:00:00Z\n",
+		},
+	} {
+		req := httptest.NewRequest("GET", tc.url, nil)
+		req.Header.Set("Accept", tc.accept)
+		rr := httptest.NewRecorder()
+
+		writeList(rr, req, map[string]interface{}{"items": formatItems}, formatItems)
+
+		if ct := rr.Header().Get("Content-Type"); ct != tc.contentType {
+			t.Fatalf("Expected %s, got %s", tc.contentType, ct)
+		}
+		if body := rr.Body.String(); body != tc.body {
+			t.Fatalf("Expected %s, got %s", tc.body, body)
+		}
+	}
+}
+
+func TestWriteJSON_Buffered(t *testing.T) {
+	rr := httptest.NewRecorder()
+	writeJSON(rr, formatItems[0], "Failed to marshal json")
+
+	expected := `{"name":"foo","count":1,"created":"2021-06-01T12:00:00Z"}`
+	if body := rr.Body.String(); body != expected {
+		t.Fatalf("Expected %s, got %s", expected, body)
+	}
+	if cl := rr.Header().Get("Content-Length"); cl != strconv.Itoa(len(expected)) {
+		t.Fatalf("Expected Content-Length %d, got %s", len(expected), cl)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Expected %s, got %s", "application/json", ct)
+	}
+}
+
+func TestWriteJSON_BufferedError(t *testing.T) {
+	rr := httptest.NewRecorder()
+	writeJSON(rr, map[string]float64{"ratio": math.Inf(1)}, "Failed to marshal json")
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected %v, got %v", http.StatusInternalServerError, rr.Code)
+	}
+	if code := responseCode(t, rr); code != CodeInternal {
+		t.Fatalf("Expected %s, got %s", CodeInternal, code)
+	}
+}
+
+func TestWriteJSON_Streamed(t *testing.T) {
+	defer func(threshold int) { streamThreshold = threshold }(streamThreshold)
+	streamThreshold = 64
+
+	var items []formatItem
+	for i := 0; i < 100; i++ {
+		items = append(items, formatItem{Name: fmt.Sprintf("item%d", i), Count: i})
+	}
+	rr := httptest.NewRecorder()
+	writeJSON(rr, items, "Failed to marshal json")
+
+	if cl := rr.Header().Get("Content-Length"); cl != "" {
+		t.Fatalf("Expected a streamed response without Content-Length, got %s", cl)
+	}
+	var decoded []formatItem
+	if err := json.Unmarshal(rr.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("Failed to decode streamed response: %v", err)
+	}
+	if len(decoded) != len(items) {
+		t.Fatalf("Expected %d items, got %d", len(items), len(decoded))
+	}
+}
+
+func TestWriteJSON_StreamedError(t *testing.T) {
+	defer func(threshold int) { streamThreshold = threshold }(streamThreshold)
+	streamThreshold = 64
+
+	var items []interface{}
+	for i := 0; i < 100; i++ {
+		items = append(items, formatItem{Name: fmt.Sprintf("item%d", i), Count: i})
+	}
+	items = append(items, math.Inf(1))
+	rr := httptest.NewRecorder()
+	writeJSON(rr, items, "Failed to marshal json")
+
+	// The items before the error were sent as they were encoded
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	if !strings.HasPrefix(rr.Body.String(), `[{"name":"item0",`) {
+		t.Fatalf("Expected the first items, got %s", rr.Body.String())
+	}
+}
+
+// encodedItem covers the field options handled by encodeJSON
+type encodedItem struct {
+	formatItem
+	Label    string            `json:"label,omitempty"`
+	Tags     map[string]string `json:"tags"`
+	Raw      []byte            `json:"raw"`
+	Parent   *formatItem       `json:"parent"`
+	Children []formatItem      `json:"children,omitempty"`
+	Count    int64             `json:"count,string"`
+}
+
+func TestEncodeJSON_MatchesMarshal(t *testing.T) {
+	for _, v := range []interface{}{
+		formatItems,
+		syntheticState(3),
+		map[string]interface{}{"states": []types.State{syntheticState(1)}, "page": 1},
+		struct {
+			Items   []formatItem  `json:"items"`
+			Label   string        `json:"label,omitempty"`
+			Tags    []string      `json:"tags,omitempty"`
+			Parent  *formatItem   `json:"parent"`
+			Raw     []byte        `json:"raw"`
+			Nested  []interface{} `json:"nested"`
+			private int
+		}{Items: formatItems, Raw: []byte("raw"), Nested: []interface{}{1, "two", nil, formatItems[0]}},
+		encodedItem{formatItem: formatItems[0], Tags: map[string]string{"env": "prod"}, Count: 3},
+		[]*formatItem{&formatItems[0], nil},
+		nil,
+	} {
+		expected, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("Failed to marshal %v: %v", v, err)
+		}
+		var buf bytes.Buffer
+		if err := encodeJSON(&buf, reflect.ValueOf(v)); err != nil {
+			t.Fatalf("Failed to encode %v: %v", v, err)
+		}
+		if buf.String() != string(expected) {
+			t.Fatalf("Expected %s, got %s", expected, buf.String())
+		}
+	}
+}
+
+// discardResponseWriter is an http.ResponseWriter dropping the response body
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d *discardResponseWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardResponseWriter) Write(p []byte) (int, error) {
+	return ioutil.Discard.Write(p)
+}
+
+func (d *discardResponseWriter) WriteHeader(int) {}
+
+// syntheticState returns a State holding the given number of resources
+func syntheticState(resources int) types.State {
+	module := types.Module{Path: "root"}
+	for i := 0; i < resources; i++ {
+		module.Resources = append(module.Resources, types.Resource{
+			Type: "aws_instance",
+			Name: fmt.Sprintf("instance_%d", i),
+			Mode: "managed",
+			Attributes: []types.Attribute{
+				{Key: "id", Value: fmt.Sprintf("\"i-%08d\"", i)},
+				{Key: "instance_type", Value: "\"t3.micro\""},
+				{Key: "tags", Value: `{"Name":"instance","Environment":"production"}`},
+			},
+		})
+	}
+	return types.State{Path: "synthetic.tfstate", TFVersion: "1.0.2", Modules: []types.Module{module}}
+}
+
+// BenchmarkWriteState_Marshal writes a large State the way it was before
+// being streamed, marshalling it into memory first
+func BenchmarkWriteState_Marshal(b *testing.B) {
+	st := syntheticState(10000)
+	w := &discardResponseWriter{header: make(http.Header)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		j, err := json.Marshal(st)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.WriteString(w, string(j)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkWriteState_Streamed writes a large State with writeJSON
+func BenchmarkWriteState_Streamed(b *testing.B) {
+	st := syntheticState(10000)
+	w := &discardResponseWriter{header: make(http.Header)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writeJSON(w, st, "Failed to marshal state")
+	}
+}
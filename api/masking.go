@@ -0,0 +1,141 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/camptocamp/terraboard/auth"
+	"github.com/camptocamp/terraboard/config"
+	"github.com/camptocamp/terraboard/db"
+	"github.com/camptocamp/terraboard/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// redactedValue replaces the value of masked attributes
+const redactedValue = "(redacted)"
+
+// attributeMasking are the rules masking attributes by role
+var attributeMasking []config.AttributeMaskingConfig
+
+// setupAttributeMasking keeps the attribute masking rules
+// whose key patterns are valid
+func setupAttributeMasking(rules []config.AttributeMaskingConfig) {
+	attributeMasking = nil
+	for _, rule := range rules {
+		valid := true
+		for _, key := range rule.Keys {
+			if _, err := path.Match(key, ""); err != nil {
+				log.Warnf("Invalid attribute masking pattern '%s', ignoring its rule", key)
+				valid = false
+			}
+		}
+		if valid {
+			attributeMasking = append(attributeMasking, rule)
+		}
+	}
+}
+
+// errMaskedValueFilter is returned when the values of masked attributes
+// would be revealed by the filters of a query
+var errMaskedValueFilter = errors.New("value filters are not allowed on masked attributes")
+
+// maskedKeys returns the patterns of the attribute keys masked
+// for the user of a request
+func maskedKeys(r *http.Request) (patterns []string) {
+	if len(attributeMasking) == 0 || auth.IsAdmin(r) {
+		return nil
+	}
+
+	for _, rule := range attributeMasking {
+		if !auth.HasRole(r, rule.Roles) {
+			patterns = append(patterns, rule.Keys...)
+		}
+	}
+	return
+}
+
+// attributeMask returns whether an attribute key is masked for the user of
+// a request, or nil when the user sees all attributes
+func attributeMask(r *http.Request) func(key string) bool {
+	patterns := maskedKeys(r)
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	return func(key string) bool {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, key); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// maskAttributes masks the values of the State attributes whose key is masked
+func maskAttributes(st *types.State, masked func(key string) bool) {
+	if masked == nil {
+		return
+	}
+
+	for i := range st.Modules {
+		for j := range st.Modules[i].Resources {
+			attrs := st.Modules[i].Resources[j].Attributes
+			for k := range attrs {
+				if masked(attrs[k].Key) {
+					attrs[k].Value = redactedValue
+				}
+			}
+		}
+	}
+}
+
+// likePattern converts an attribute key pattern to a SQL LIKE pattern,
+// returning false if it holds character classes or escapes
+func likePattern(pattern string) (string, bool) {
+	if strings.ContainsAny(pattern, `[\`) {
+		return "", false
+	}
+	return strings.NewReplacer("%", `\%`, "_", `\_`, "*", "%", "?", "_").Replace(pattern), true
+}
+
+// maskSearchQuery keeps the value filter of an attribute search from
+// revealing the values of masked attributes: it is refused on masked keys,
+// and attributes with a masked key are excluded from the results otherwise.
+func maskSearchQuery(r *http.Request, query url.Values) error {
+	patterns := maskedKeys(r)
+	if query.Get("value") == "" || len(patterns) == 0 {
+		return nil
+	}
+	if key := query.Get("key"); key != "" && attributeMask(r)(key) {
+		return errMaskedValueFilter
+	}
+
+	excluded := make([]string, len(patterns))
+	for i, p := range patterns {
+		like, ok := likePattern(p)
+		if !ok {
+			return errMaskedValueFilter
+		}
+		excluded[i] = like
+	}
+	query[db.SearchExcludedKeys] = excluded
+	return nil
+}
+
+// maskSearchResults masks the attribute values of the search results
+// whose key is masked
+func maskSearchResults(results []types.SearchResult, masked func(key string) bool) {
+	if masked == nil {
+		return
+	}
+
+	for i := range results {
+		if masked(results[i].AttributeKey) {
+			results[i].AttributeValue = redactedValue
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/camptocamp/terraboard/auth"
+	"github.com/camptocamp/terraboard/config"
+	"github.com/camptocamp/terraboard/db"
+	"github.com/camptocamp/terraboard/types"
+	"github.com/gorilla/mux"
+)
+
+func setupMaskingTest() {
+	c := config.Config{}
+	c.Web.RolesHeader = "X-Forwarded-Groups"
+	c.Web.AdminRoles = []string{"admin"}
+	auth.Setup(&c)
+	setupAttributeMasking([]config.AttributeMaskingConfig{
+		{Keys: []string{"connection_string", "*password"}, Roles: []string{"dba"}},
+	})
+}
+
+func maskingTestState() types.State {
+	return types.State{
+		Modules: []types.Module{{
+			Resources: []types.Resource{{
+				Type: "azurerm_sql_database",
+				Name: "main",
+				Attributes: []types.Attribute{
+					{Key: "id", Value: "db-123"},
+					{Key: "connection_string", Value: "Server=db;Password=hunter2"},
+					{Key: "admin_password", Value: "hunter2"},
+				},
+			}},
+		}},
+	}
+}
+
+func TestMaskAttributes_RestrictedRole(t *testing.T) {
+	setupMaskingTest()
+	defer setupAttributeMasking(nil)
+
+	req := httptest.NewRequest("GET", "/api/lineages/foo", nil)
+	req.Header.Set("X-Forwarded-Groups", "support")
+	st := maskingTestState()
+	maskAttributes(&st, attributeMask(req))
+
+	expected := []types.Attribute{
+		{Key: "id", Value: "db-123"},
+		{Key: "connection_string", Value: "(redacted)"},
+		{Key: "admin_password", Value: "(redacted)"},
+	}
+	if attrs := st.Modules[0].Resources[0].Attributes; !reflect.DeepEqual(attrs, expected) {
+		t.Fatalf("Expected %v, got %v", expected, attrs)
+	}
+}
+
+func TestMaskAttributes_PrivilegedRoles(t *testing.T) {
+	setupMaskingTest()
+	defer setupAttributeMasking(nil)
+
+	for _, role := range []string{"admin", "support,dba"} {
+		req := httptest.NewRequest("GET", "/api/lineages/foo", nil)
+		req.Header.Set("X-Forwarded-Groups", role)
+		st := maskingTestState()
+		maskAttributes(&st, attributeMask(req))
+
+		expected := maskingTestState().Modules[0].Resources[0].Attributes
+		if attrs := st.Modules[0].Resources[0].Attributes; !reflect.DeepEqual(attrs, expected) {
+			t.Fatalf("Expected %v for %s, got %v", expected, role, attrs)
+		}
+	}
+}
+
+func TestMaskSearchResults(t *testing.T) {
+	setupMaskingTest()
+	defer setupAttributeMasking(nil)
+
+	req := httptest.NewRequest("GET", "/api/search/attribute", nil)
+	results := []types.SearchResult{
+		{AttributeKey: "id", AttributeValue: "db-123"},
+		{AttributeKey: "connection_string", AttributeValue: "Server=db;Password=hunter2"},
+	}
+	maskSearchResults(results, attributeMask(req))
+
+	expected := []types.SearchResult{
+		{AttributeKey: "id", AttributeValue: "db-123"},
+		{AttributeKey: "connection_string", AttributeValue: "(redacted)"},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Fatalf("Expected %v, got %v", expected, results)
+	}
+}
+
+func TestDriftFromReference_Masked(t *testing.T) {
+	setupMaskingTest()
+	defer setupAttributeMasking(nil)
+
+	reference := maskingTestState()
+	reference.Path = "fake.tfstate"
+	current := maskingTestState()
+	current.Path = "fake.tfstate"
+	current.Modules[0].Resources[0].Attributes[1].Value = "Server=db;Password=swordfish"
+	rs := fakeReferenceStore{
+		reference: "v1",
+		current:   "v2",
+		states: map[string]types.State{
+			"v1": reference,
+			"v2": current,
+		},
+	}
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/api/lineages/fake/drift-from-reference", nil),
+		map[string]string{"lineage": "fake"})
+	req.Header.Set("X-Forwarded-Groups", "support")
+	rr := httptest.NewRecorder()
+	driftFromReference(rr, req, rs)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	for _, secret := range []string{"hunter2", "swordfish"} {
+		if strings.Contains(rr.Body.String(), secret) {
+			t.Fatalf("Expected masked attributes, got %s", rr.Body.String())
+		}
+	}
+}
+
+// fakeConsistencyAuditor returns a fixed audit
+type fakeConsistencyAuditor struct {
+	audit types.ConsistencyAudit
+}
+
+func (f fakeConsistencyAuditor) AuditAttributeConsistency(key, expected, resourceType string) (types.ConsistencyAudit, error) {
+	return f.audit, nil
+}
+
+func TestAuditAttributeConsistency_Masked(t *testing.T) {
+	setupMaskingTest()
+	defer setupAttributeMasking(nil)
+
+	ca := fakeConsistencyAuditor{audit: types.ConsistencyAudit{
+		Key:        "admin_password",
+		Expected:   "hunter2",
+		Majority:   true,
+		Lineages:   2,
+		Violations: []types.ConsistencyViolation{{LineageValue: "prod", Values: []string{"swordfish"}}},
+	}}
+
+	req := httptest.NewRequest("GET", "/api/audit/consistency?key=admin_password", nil)
+	req.Header.Set("X-Forwarded-Groups", "support")
+	rr := httptest.NewRecorder()
+	auditAttributeConsistency(rr, req, ca)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	var audit types.ConsistencyAudit
+	if err := json.Unmarshal(rr.Body.Bytes(), &audit); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	expected := types.ConsistencyAudit{
+		Key:        "admin_password",
+		Expected:   "(redacted)",
+		Majority:   true,
+		Lineages:   2,
+		Violations: []types.ConsistencyViolation{{LineageValue: "prod", Values: []string{"(redacted)"}}},
+	}
+	if !reflect.DeepEqual(audit, expected) {
+		t.Fatalf("Expected %v, got %v", expected, audit)
+	}
+
+	// Masked values can't be guessed through the expected value
+	req = httptest.NewRequest("GET", "/api/audit/consistency?key=admin_password&expected=hunter2", nil)
+	req.Header.Set("X-Forwarded-Groups", "support")
+	rr = httptest.NewRecorder()
+	auditAttributeConsistency(rr, req, ca)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected %v, got %v", http.StatusForbidden, rr.Code)
+	}
+}
+
+func TestSearchAttribute_MaskedValueFilter(t *testing.T) {
+	setupMaskingTest()
+	defer setupAttributeMasking(nil)
+
+	store := &fakeSearchStore{results: searchCSVResults}
+	req := httptest.NewRequest("GET", "/api/search/attribute?key=connection_string&value=hunter2", nil)
+	req.Header.Set("X-Forwarded-Groups", "support")
+	rr := httptest.NewRecorder()
+	searchAttribute(rr, req, store)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected %v, got %v", http.StatusForbidden, rr.Code)
+	}
+	if store.paged != nil {
+		t.Fatalf("Expected no search, got %v", store.paged)
+	}
+
+	// Masked attributes are left out of value searches on other keys
+	req = httptest.NewRequest("GET", "/api/search/attribute?key=connection&value=hunter2", nil)
+	req.Header.Set("X-Forwarded-Groups", "support")
+	rr = httptest.NewRecorder()
+	searchAttribute(rr, req, store)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	expected := []string{`connection\_string`, "%password"}
+	if excluded := store.paged[db.SearchExcludedKeys]; !reflect.DeepEqual(excluded, expected) {
+		t.Fatalf("Expected %v, got %v", expected, excluded)
+	}
+
+	// Admins search all attributes
+	store.paged = nil
+	req = httptest.NewRequest("GET", "/api/search/attribute?key=connection_string&value=hunter2", nil)
+	req.Header.Set("X-Forwarded-Groups", "admin")
+	rr = httptest.NewRecorder()
+	searchAttribute(rr, req, store)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	if excluded := store.paged[db.SearchExcludedKeys]; excluded != nil {
+		t.Fatalf("Expected no excluded keys, got %v", excluded)
+	}
+}
+
+func TestLikePattern(t *testing.T) {
+	for pattern, expected := range map[string]string{
+		"*password":     "%password",
+		"db_?ass":       `db\__ass`,
+		"100%":          `100\%`,
+		"secret_[0-9]":  "",
+		`literal\*star`: "",
+	} {
+		like, ok := likePattern(pattern)
+		if ok != (expected != "") || like != expected {
+			t.Fatalf("Expected %q for %s, got %q", expected, pattern, like)
+		}
+	}
+}
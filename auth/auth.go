@@ -1,13 +1,22 @@
 package auth
 
 import (
+	"context"
 	"crypto/md5"
 	"fmt"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/camptocamp/terraboard/config"
+	"github.com/camptocamp/terraboard/util"
 )
 
 var logoutURL string
+var requireAuth bool
+var exemptPaths []string
+var rolesHeader string
+var adminRoles []string
 
 // User is an authenticated user
 type User struct {
@@ -19,6 +28,13 @@ type User struct {
 // Setup sets up authentication
 func Setup(c *config.Config) {
 	logoutURL = c.Web.LogoutURL
+	requireAuth = c.Web.RequireAuth
+	exemptPaths = c.Web.AuthExemptPaths
+	rolesHeader = c.Web.RolesHeader
+	adminRoles = c.Web.AdminRoles
+	setupTokens(c.APITokens)
+	setupShare(c.Web.ShareSecret, time.Duration(c.Web.ShareLinkTTL)*time.Minute)
+	setupOIDC(c.OIDC)
 }
 
 // UserInfo returns a User given a name and email
@@ -34,3 +50,98 @@ func UserInfo(name, email string) (user User) {
 
 	return
 }
+
+// isExempt returns true if the path matches one of the exempted paths,
+// either exactly or as a prefix when the entry ends with '*'
+func isExempt(path string) bool {
+	for _, p := range exemptPaths {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(path, strings.TrimSuffix(p, "*")) {
+				return true
+			}
+		} else if path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAuthenticated returns true if the request carries the user
+// headers set by the authenticating proxy or from a valid login session
+// or API token
+func IsAuthenticated(r *http.Request) bool {
+	return r.Header.Get("X-Forwarded-User") != "" || r.Header.Get("X-Forwarded-Email") != ""
+}
+
+// UserRoles returns the roles of the user, given by the authenticating
+// proxy as a comma-separated list in the roles header
+func UserRoles(r *http.Request) (roles []string) {
+	if rolesHeader == "" {
+		return nil
+	}
+	for _, role := range strings.Split(r.Header.Get(rolesHeader), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			roles = append(roles, role)
+		}
+	}
+	return
+}
+
+// HasRole returns true if the user has one of the given roles
+func HasRole(r *http.Request, roles []string) bool {
+	for _, role := range UserRoles(r) {
+		for _, allowed := range roles {
+			if role == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifiedKey is the context key marking the requests whose user
+// was authenticated by Terraboard
+type verifiedKey struct{}
+
+// IsVerified returns true if the user of a request was authenticated by
+// Terraboard itself, from an API token or a login session, rather than
+// only given by the user headers, which clients may set
+func IsVerified(r *http.Request) bool {
+	verified, _ := r.Context().Value(verifiedKey{}).(bool)
+	return verified
+}
+
+// IsAdmin returns true if the user has one of the admin roles
+func IsAdmin(r *http.Request) bool {
+	return HasRole(r, adminRoles)
+}
+
+// Middleware authenticates requests carrying a login session or an API token,
+// and rejects unauthenticated requests to API endpoints when authentication
+// is required, except for exempted paths and shared links, which carry their
+// own signed token
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bySession := authenticateSession(r)
+		byToken, err := authenticateToken(r)
+		if err != nil {
+			http.Error(w, "Invalid API token", http.StatusUnauthorized)
+			return
+		}
+		if bySession || byToken {
+			r = r.WithContext(context.WithValue(r.Context(), verifiedKey{}, true))
+		}
+
+		if !requireAuth || isExempt(r.URL.Path) || !strings.HasPrefix(r.URL.Path, "/api/") ||
+			strings.HasPrefix(r.URL.Path, "/api"+util.GetFullPath("shared/")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !IsAuthenticated(r) {
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
 
@@ -33,3 +35,76 @@ func TestUserInfo(t *testing.T) {
 		t.Fatalf("Expected %v, got %v", expected, u)
 	}
 }
+
+func TestMiddleware_exemptPath(t *testing.T) {
+	c := config.Config{}
+	c.Web.RequireAuth = true
+	c.Web.AuthExemptPaths = []string{"/healthz", "/api/version"}
+	Setup(&c)
+
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, path := range []string{"/healthz", "/api/version"} {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected %v, got %v", http.StatusOK, rr.Code)
+		}
+	}
+}
+
+func TestMiddleware_prefixExemptPath(t *testing.T) {
+	c := config.Config{}
+	c.Web.RequireAuth = true
+	c.Web.AuthExemptPaths = []string{"/api/public/*"}
+	Setup(&c)
+
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/api/public/foo", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, rr.Code)
+	}
+}
+
+func TestMiddleware_unauthenticatedAPI(t *testing.T) {
+	c := config.Config{}
+	c.Web.RequireAuth = true
+	c.Web.AuthExemptPaths = []string{"/healthz"}
+	Setup(&c)
+
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/api/lineages", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected %v, got %v", http.StatusUnauthorized, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/lineages", nil)
+	req.Header.Set("X-Forwarded-Email", "foo@example.com")
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, rr.Code)
+	}
+}
+
+func TestUserRoles(t *testing.T) {
+	c := config.Config{}
+	c.Web.RolesHeader = "X-Forwarded-Groups"
+	c.Web.AdminRoles = []string{"admin"}
+	Setup(&c)
+
+	req := httptest.NewRequest("GET", "/api/lineages", nil)
+	req.Header.Set("X-Forwarded-Groups", "support, ops,")
+
+	expected := []string{"support", "ops"}
+	if roles := UserRoles(req); !reflect.DeepEqual(roles, expected) {
+		t.Fatalf("Expected %v, got %v", expected, roles)
+	}
+	if !HasRole(req, []string{"dba", "ops"}) {
+		t.Fatalf("Expected the user to have the ops role")
+	}
+	if IsAdmin(req) {
+		t.Fatalf("Expected the user not to be an admin")
+	}
+}
@@ -0,0 +1,525 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/camptocamp/terraboard/config"
+	"github.com/camptocamp/terraboard/util"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	sessionCookie   = "terraboard_session"
+	oidcStateCookie = "terraboard_oidc_state"
+	oidcStateTTL    = 10 * time.Minute
+)
+
+// ErrInvalidIDToken is returned when an ID token is malformed, not signed
+// by the provider, or not issued for this client and login
+var ErrInvalidIDToken = errors.New("invalid ID token")
+
+// ErrInvalidSession is returned when a session cookie is malformed,
+// its signature doesn't match or it is expired
+var ErrInvalidSession = errors.New("invalid session")
+
+// oidcDiscovery is the part of the OpenID Connect discovery document
+// used to log users in
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider is the OpenID Connect provider users log in with.
+// Its discovery document and keys are retrieved on first use.
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+	client       *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+// session is the signed content of a session cookie
+type session struct {
+	Name    string `json:"name"`
+	Email   string `json:"email"`
+	Expires int64  `json:"expires"`
+}
+
+// oidcState is the signed content of the cookie binding
+// a login to its callback
+type oidcState struct {
+	State   string `json:"state"`
+	Nonce   string `json:"nonce"`
+	Expires int64  `json:"expires"`
+}
+
+// audience is the audience of an ID token,
+// given as a single string or an array
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(b, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+// idTokenClaims are the claims of an ID token checked on login
+// and identifying the user
+type idTokenClaims struct {
+	Issuer            string   `json:"iss"`
+	Audience          audience `json:"aud"`
+	Expiry            int64    `json:"exp"`
+	Nonce             string   `json:"nonce"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+	Email             string   `json:"email"`
+}
+
+var oidc *oidcProvider
+var sessionSecret []byte
+var sessionTTL time.Duration
+
+// setupOIDC enables the OpenID Connect login when an issuer is configured.
+// Without a session secret, a random one is generated, so that sessions
+// don't survive a restart.
+func setupOIDC(c config.OIDCConfig) {
+	oidc = nil
+	if c.IssuerURL == "" {
+		return
+	}
+
+	oidc = &oidcProvider{
+		issuer:       strings.TrimSuffix(c.IssuerURL, "/"),
+		clientID:     c.ClientID,
+		clientSecret: c.ClientSecret,
+		redirectURL:  c.RedirectURL,
+		scopes:       c.Scopes,
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}
+	sessionTTL = time.Duration(c.SessionTTL) * time.Minute
+	if logoutURL == "" {
+		logoutURL = util.GetFullPath("oauth/logout")
+	}
+
+	if c.SessionSecret != "" {
+		sessionSecret = []byte(c.SessionSecret)
+		return
+	}
+	log.Warn("No OIDC session secret configured, sessions will be invalidated on restart")
+	sessionSecret = make([]byte, 32)
+	if _, err := rand.Read(sessionSecret); err != nil {
+		log.Fatalf("Failed to generate session secret: %v", err)
+	}
+}
+
+// OIDCEnabled returns true if users log in with an OpenID Connect provider
+func OIDCEnabled() bool {
+	return oidc != nil
+}
+
+// signCookie returns the signed encoding of the content of a cookie
+func signCookie(v interface{}) (string, error) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(j)
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// parseCookie validates the signature of a cookie and decodes its content
+func parseCookie(value string, v interface{}) error {
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return ErrInvalidSession
+	}
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte(parts[0]))
+	if !hmac.Equal([]byte(parts[1]), []byte(base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))) {
+		return ErrInvalidSession
+	}
+	j, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrInvalidSession
+	}
+	if err := json.Unmarshal(j, v); err != nil {
+		return ErrInvalidSession
+	}
+	return nil
+}
+
+// setCookie sets a cookie readable by the server only,
+// sent over HTTPS only when Terraboard is served over HTTPS
+func setCookie(w http.ResponseWriter, r *http.Request, name, value string, maxAge time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(oidc.redirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// randomString returns a random URL-safe string
+func randomString() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// getJSON decodes the JSON document served on a URL of the provider
+func (p *oidcProvider) getJSON(address string, v interface{}) error {
+	resp, err := p.client.Get(address)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request to %s failed: %s", address, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// getDiscovery returns the discovery document of the provider
+func (p *oidcProvider) getDiscovery() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := p.getJSON(p.issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC provider: %w", err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("OIDC provider issuer '%s' doesn't match '%s'", d.Issuer, p.issuer)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// key returns the public key of the provider identified by kid.
+// Keys are retrieved again on an unknown kid, the provider having
+// possibly rotated them.
+func (p *oidcProvider) key(kid string) (*rsa.PublicKey, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(d.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to retrieve OIDC provider keys: %w", err)
+	}
+	p.keys = make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		p.keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	k, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key '%s'", ErrInvalidIDToken, kid)
+	}
+	return k, nil
+}
+
+// verifyIDToken checks the RS256 signature of an ID token,
+// its issuer, audience, expiry and nonce, and returns its claims
+func (p *oidcProvider) verifyIDToken(token, nonce string, now time.Time) (claims idTokenClaims, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("%w: malformed token", ErrInvalidIDToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	h, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(h, &header) != nil {
+		return claims, fmt.Errorf("%w: malformed header", ErrInvalidIDToken)
+	}
+	if header.Alg != "RS256" {
+		return claims, fmt.Errorf("%w: unsupported algorithm '%s'", ErrInvalidIDToken, header.Alg)
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, fmt.Errorf("%w: malformed signature", ErrInvalidIDToken)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return claims, fmt.Errorf("%w: bad signature", ErrInvalidIDToken)
+	}
+
+	c, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(c, &claims) != nil {
+		return claims, fmt.Errorf("%w: malformed claims", ErrInvalidIDToken)
+	}
+	d, err := p.getDiscovery()
+	if err != nil {
+		return claims, err
+	}
+	if claims.Issuer != d.Issuer {
+		return claims, fmt.Errorf("%w: unexpected issuer '%s'", ErrInvalidIDToken, claims.Issuer)
+	}
+	validAudience := false
+	for _, aud := range claims.Audience {
+		if aud == p.clientID {
+			validAudience = true
+		}
+	}
+	if !validAudience {
+		return claims, fmt.Errorf("%w: not issued for this client", ErrInvalidIDToken)
+	}
+	if now.Unix() >= claims.Expiry {
+		return claims, fmt.Errorf("%w: expired", ErrInvalidIDToken)
+	}
+	if !hmac.Equal([]byte(claims.Nonce), []byte(nonce)) {
+		return claims, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+	return claims, nil
+}
+
+// exchangeCode exchanges an authorization code for an ID token
+// at the token endpoint of the provider
+func (p *oidcProvider) exchangeCode(code string) (string, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.redirectURL},
+	}
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("code exchange failed (%s): %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return "", fmt.Errorf("%w: missing from token response", ErrInvalidIDToken)
+	}
+	return tokens.IDToken, nil
+}
+
+// OIDCLogin redirects the user to the authorization endpoint
+// of the OpenID Connect provider
+func OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	d, err := oidc.getDiscovery()
+	if err != nil {
+		log.WithError(err).Error("Failed to start OIDC login")
+		http.Error(w, "OIDC provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	st := oidcState{Expires: time.Now().Add(oidcStateTTL).Unix()}
+	if st.State, err = randomString(); err == nil {
+		st.Nonce, err = randomString()
+	}
+	if err != nil {
+		log.WithError(err).Error("Failed to generate OIDC state")
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	value, err := signCookie(st)
+	if err != nil {
+		log.WithError(err).Error("Failed to sign OIDC state")
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	setCookie(w, r, oidcStateCookie, value, oidcStateTTL)
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {oidc.clientID},
+		"redirect_uri":  {oidc.redirectURL},
+		"scope":         {strings.Join(oidc.scopes, " ")},
+		"state":         {st.State},
+		"nonce":         {st.Nonce},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+query.Encode(), http.StatusFound)
+}
+
+// OIDCCallback exchanges the authorization code given by the OpenID Connect
+// provider for an ID token, and opens a session for the user it identifies
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		log.WithField("error", e).Warn("OIDC login refused by the provider")
+		http.Error(w, "Login failed: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	var st oidcState
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err == nil {
+		err = parseCookie(cookie.Value, &st)
+	}
+	if err != nil || time.Now().Unix() > st.Expires || query.Get("state") == "" ||
+		!hmac.Equal([]byte(query.Get("state")), []byte(st.State)) {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	setCookie(w, r, oidcStateCookie, "", -time.Second)
+
+	idToken, err := oidc.exchangeCode(query.Get("code"))
+	if err != nil {
+		log.WithError(err).Error("Failed to exchange OIDC authorization code")
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	claims, err := oidc.verifyIDToken(idToken, st.Nonce, time.Now())
+	if err != nil {
+		log.WithError(err).Warn("Rejected OIDC ID token")
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	s := session{
+		Name:    claims.Name,
+		Email:   claims.Email,
+		Expires: time.Now().Add(sessionTTL).Unix(),
+	}
+	if s.Name == "" {
+		s.Name = claims.PreferredUsername
+	}
+	if s.Name == "" {
+		s.Name = claims.Email
+	}
+	value, err := signCookie(s)
+	if err != nil {
+		log.WithError(err).Error("Failed to sign session")
+		http.Error(w, "Login failed", http.StatusInternalServerError)
+		return
+	}
+	setCookie(w, r, sessionCookie, value, sessionTTL)
+	http.Redirect(w, r, util.GetFullPath(""), http.StatusFound)
+}
+
+// OIDCLogout closes the session of the user
+func OIDCLogout(w http.ResponseWriter, r *http.Request) {
+	setCookie(w, r, sessionCookie, "", -time.Second)
+	http.Redirect(w, r, util.GetFullPath(""), http.StatusFound)
+}
+
+// authenticateSession sets, on a request carrying a valid session cookie,
+// the user headers an authenticating proxy would have set.
+// Terraboard being the authenticating party, the user headers
+// given by the client are always dropped.
+// It returns whether the request was authenticated.
+func authenticateSession(r *http.Request) bool {
+	if oidc == nil {
+		return false
+	}
+	r.Header.Del("X-Forwarded-User")
+	r.Header.Del("X-Forwarded-Email")
+	if rolesHeader != "" {
+		r.Header.Del(rolesHeader)
+	}
+
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return false
+	}
+	var s session
+	if err := parseCookie(cookie.Value, &s); err != nil || time.Now().Unix() > s.Expires {
+		return false
+	}
+	r.Header.Set("X-Forwarded-User", s.Name)
+	r.Header.Set("X-Forwarded-Email", s.Email)
+	return true
+}
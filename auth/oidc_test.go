@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/terraboard/config"
+)
+
+// fakeIssuer is an OpenID Connect provider issuing, for the code
+// "good-code", the ID token set by the test
+type fakeIssuer struct {
+	*httptest.Server
+	key     *rsa.PrivateKey
+	idToken string
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	f := &fakeIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.URL,
+			"authorization_endpoint": f.URL + "/authorize",
+			"token_endpoint":         f.URL + "/token",
+			"jwks_uri":               f.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "key-1",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if r.Method != http.MethodPost || !ok || id != "terraboard" || secret != "s3cr3t" ||
+			r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("code") != "good-code" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": f.idToken})
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+// sign returns an RS256 ID token carrying the given claims
+func (f *fakeIssuer) sign(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"key-1","typ":"JWT"}`))
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("Failed to marshal claims: %v", err)
+	}
+	payload := header + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(payload))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (f *fakeIssuer) claims(nonce string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   f.URL,
+		"aud":   "terraboard",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": nonce,
+		"name":  "Jane Doe",
+		"email": "jane@example.com",
+	}
+}
+
+func setupFakeOIDC(f *fakeIssuer) {
+	c := config.Config{}
+	c.OIDC = config.OIDCConfig{
+		IssuerURL:     f.URL,
+		ClientID:      "terraboard",
+		ClientSecret:  "s3cr3t",
+		RedirectURL:   "http://terraboard.example.com/oauth/callback",
+		Scopes:        []string{"openid", "email"},
+		SessionSecret: "session-s3cr3t",
+		SessionTTL:    60,
+	}
+	Setup(&c)
+}
+
+// login starts a login and returns the state and nonce sent
+// to the provider, along with the state cookie
+func login(t *testing.T) (state, nonce string, cookie *http.Cookie) {
+	rr := httptest.NewRecorder()
+	OIDCLogin(rr, httptest.NewRequest("GET", "/oauth/login", nil))
+	if rr.Code != http.StatusFound {
+		t.Fatalf("Expected %d, got %d", http.StatusFound, rr.Code)
+	}
+	location, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	query := location.Query()
+	if query.Get("client_id") != "terraboard" || query.Get("scope") != "openid email" {
+		t.Fatalf("Unexpected authorization request %s", location)
+	}
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatalf("Expected a state cookie")
+	}
+	return query.Get("state"), query.Get("nonce"), cookie
+}
+
+func callback(state string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/oauth/callback?code=good-code&state="+url.QueryEscape(state), nil)
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	OIDCCallback(rr, req)
+	return rr
+}
+
+func sessionCookieOf(rr *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == sessionCookie && c.Value != "" {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestOIDCCallback(t *testing.T) {
+	f := newFakeIssuer(t)
+	defer f.Close()
+	setupFakeOIDC(f)
+
+	state, nonce, cookie := login(t)
+	f.idToken = f.sign(t, f.key, f.claims(nonce))
+	rr := callback(state, cookie)
+	if rr.Code != http.StatusFound {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusFound, rr.Code, rr.Body.String())
+	}
+	sc := sessionCookieOf(rr)
+	if sc == nil {
+		t.Fatalf("Expected a session cookie")
+	}
+
+	// The session provides the user headers, replacing the client's ones
+	var user, email string
+	var verified bool
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user = r.Header.Get("X-Forwarded-User")
+		email = r.Header.Get("X-Forwarded-Email")
+		verified = IsVerified(r)
+	}))
+	req := httptest.NewRequest("GET", "/api/user", nil)
+	req.Header.Set("X-Forwarded-User", "mallory")
+	req.AddCookie(sc)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if user != "Jane Doe" || email != "jane@example.com" || !verified {
+		t.Fatalf("Expected verified %s <%s>, got %s <%s> (verified=%t)", "Jane Doe", "jane@example.com", user, email, verified)
+	}
+
+	req = httptest.NewRequest("GET", "/api/user", nil)
+	req.Header.Set("X-Forwarded-User", "mallory")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if user != "" || verified {
+		t.Fatalf("Expected no user without a session, got %s (verified=%t)", user, verified)
+	}
+}
+
+func TestOIDCCallback_invalidToken(t *testing.T) {
+	f := newFakeIssuer(t)
+	defer f.Close()
+	setupFakeOIDC(f)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	tests := map[string]func(nonce string) string{
+		"bad signature": func(nonce string) string {
+			return f.sign(t, otherKey, f.claims(nonce))
+		},
+		"expired": func(nonce string) string {
+			claims := f.claims(nonce)
+			claims["exp"] = time.Now().Add(-time.Minute).Unix()
+			return f.sign(t, f.key, claims)
+		},
+		"wrong audience": func(nonce string) string {
+			claims := f.claims(nonce)
+			claims["aud"] = []string{"other-client"}
+			return f.sign(t, f.key, claims)
+		},
+		"wrong issuer": func(nonce string) string {
+			claims := f.claims(nonce)
+			claims["iss"] = "https://evil.example.com"
+			return f.sign(t, f.key, claims)
+		},
+		"replayed nonce": func(nonce string) string {
+			return f.sign(t, f.key, f.claims("other-nonce"))
+		},
+	}
+	for name, token := range tests {
+		state, nonce, cookie := login(t)
+		f.idToken = token(nonce)
+		rr := callback(state, cookie)
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: expected %d, got %d", name, http.StatusUnauthorized, rr.Code)
+		}
+		if sessionCookieOf(rr) != nil {
+			t.Fatalf("%s: expected no session cookie", name)
+		}
+	}
+}
+
+func TestOIDCCallback_invalidState(t *testing.T) {
+	f := newFakeIssuer(t)
+	defer f.Close()
+	setupFakeOIDC(f)
+
+	_, nonce, cookie := login(t)
+	f.idToken = f.sign(t, f.key, f.claims(nonce))
+	rr := callback("forged-state", cookie)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+	if sessionCookieOf(rr) != nil {
+		t.Fatalf("Expected no session cookie")
+	}
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var shareSecret []byte
+var shareTTL time.Duration
+
+// ErrInvalidShareToken is returned when a share token is malformed
+// or its signature doesn't match
+var ErrInvalidShareToken = errors.New("invalid share token")
+
+// ErrExpiredShareToken is returned when a share token is past its expiry
+var ErrExpiredShareToken = errors.New("expired share token")
+
+// ShareToken is the signed content of a shareable link to a State version
+type ShareToken struct {
+	Lineage   string   `json:"lineage"`
+	VersionID string   `json:"version_id"`
+	Redact    []string `json:"redact,omitempty"`
+	Expires   int64    `json:"expires"`
+}
+
+// setupShare sets the secret used to sign share tokens and their validity.
+// Without a secret, a random one is generated, so that tokens
+// don't survive a restart.
+func setupShare(secret string, ttl time.Duration) {
+	shareTTL = ttl
+	if secret != "" {
+		shareSecret = []byte(secret)
+		return
+	}
+
+	log.Warn("No share secret configured, shared links will be invalidated on restart")
+	shareSecret = make([]byte, 32)
+	if _, err := rand.Read(shareSecret); err != nil {
+		log.Fatalf("Failed to generate share secret: %v", err)
+	}
+}
+
+func signSharePayload(payload string) string {
+	mac := hmac.New(sha256.New, shareSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewShareToken returns a signed token granting access to a State version
+// until the configured validity expires
+func NewShareToken(lineage, versionID string, redact []string, now time.Time) (token string, expires time.Time, err error) {
+	expires = now.Add(shareTTL)
+	j, err := json.Marshal(ShareToken{
+		Lineage:   lineage,
+		VersionID: versionID,
+		Redact:    redact,
+		Expires:   expires.Unix(),
+	})
+	if err != nil {
+		return
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(j)
+	token = payload + "." + signSharePayload(payload)
+	return
+}
+
+// ParseShareToken validates the signature and expiry of a share token
+// and returns its content
+func ParseShareToken(token string, now time.Time) (st ShareToken, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return st, ErrInvalidShareToken
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(signSharePayload(parts[0]))) {
+		return st, ErrInvalidShareToken
+	}
+
+	j, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return st, ErrInvalidShareToken
+	}
+	if err = json.Unmarshal(j, &st); err != nil {
+		return st, ErrInvalidShareToken
+	}
+
+	if now.Unix() > st.Expires {
+		return st, ErrExpiredShareToken
+	}
+	return st, nil
+}
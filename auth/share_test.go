@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareToken_roundTrip(t *testing.T) {
+	setupShare("s3cr3t", time.Hour)
+	now := time.Now()
+
+	token, expires, err := NewShareToken("lineage-1", "v1", []string{"password"}, now)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if expires.Unix() != now.Add(time.Hour).Unix() {
+		t.Fatalf("Expected %v, got %v", now.Add(time.Hour), expires)
+	}
+
+	expected := ShareToken{
+		Lineage:   "lineage-1",
+		VersionID: "v1",
+		Redact:    []string{"password"},
+		Expires:   expires.Unix(),
+	}
+	st, err := ParseShareToken(token, now.Add(30*time.Minute))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(st, expected) {
+		t.Fatalf("Expected %v, got %v", expected, st)
+	}
+}
+
+func TestShareToken_expired(t *testing.T) {
+	setupShare("s3cr3t", time.Hour)
+	now := time.Now()
+
+	token, _, err := NewShareToken("lineage-1", "v1", nil, now)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := ParseShareToken(token, now.Add(2*time.Hour)); err != ErrExpiredShareToken {
+		t.Fatalf("Expected %v, got %v", ErrExpiredShareToken, err)
+	}
+}
+
+func TestShareToken_tampered(t *testing.T) {
+	setupShare("s3cr3t", time.Hour)
+	now := time.Now()
+
+	token, _, err := NewShareToken("lineage-1", "v1", nil, now)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	other, _, err := NewShareToken("lineage-2", "v1", nil, now)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Payload of another token with the signature of the first one
+	tampered := strings.Split(other, ".")[0] + "." + strings.Split(token, ".")[1]
+	if _, err := ParseShareToken(tampered, now); err != ErrInvalidShareToken {
+		t.Fatalf("Expected %v, got %v", ErrInvalidShareToken, err)
+	}
+
+	// Token signed with another secret
+	setupShare("other-secret", time.Hour)
+	if _, err := ParseShareToken(token, now); err != ErrInvalidShareToken {
+		t.Fatalf("Expected %v, got %v", ErrInvalidShareToken, err)
+	}
+
+	if _, err := ParseShareToken("garbage", now); err != ErrInvalidShareToken {
+		t.Fatalf("Expected %v, got %v", ErrInvalidShareToken, err)
+	}
+}
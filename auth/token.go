@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/camptocamp/terraboard/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrInvalidAPIToken is returned when an API token matches none
+// of the configured ones
+var ErrInvalidAPIToken = errors.New("invalid API token")
+
+// apiToken is a configured API token, identified by its SHA-256 hash
+type apiToken struct {
+	hash  []byte
+	name  string
+	email string
+	roles []string
+}
+
+var apiTokens []apiToken
+
+// setupTokens keeps the API tokens whose hash is a valid SHA-256 hash
+func setupTokens(tokens []config.APITokenConfig) {
+	apiTokens = nil
+	for _, t := range tokens {
+		hash, err := hex.DecodeString(strings.TrimSpace(t.Hash))
+		if err != nil || len(hash) != sha256.Size {
+			log.Warnf("Invalid hash for the API token of '%s', ignoring it", t.Name)
+			continue
+		}
+		apiTokens = append(apiTokens, apiToken{
+			hash:  hash,
+			name:  t.Name,
+			email: t.Email,
+			roles: t.Roles,
+		})
+	}
+}
+
+// findToken returns the configured API token matching a token.
+// All hashes are compared, in constant time, to not leak which one matched.
+func findToken(token string) (match *apiToken, err error) {
+	if token == "" {
+		return nil, ErrInvalidAPIToken
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	for i := range apiTokens {
+		if subtle.ConstantTimeCompare(sum[:], apiTokens[i].hash) == 1 {
+			match = &apiTokens[i]
+		}
+	}
+	if match == nil {
+		return nil, ErrInvalidAPIToken
+	}
+	return
+}
+
+// ValidateToken returns the User authenticated by an API token
+func ValidateToken(token string) (User, error) {
+	t, err := findToken(token)
+	if err != nil {
+		return User{}, err
+	}
+	user := UserInfo(t.name, t.email)
+	user.Name = t.name
+	return user, nil
+}
+
+// bearerToken returns the token of a Bearer Authorization header
+func bearerToken(r *http.Request) (token string, ok bool) {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(parts[1]), true
+}
+
+// authenticateToken sets, on a request carrying a valid API token,
+// the user headers an authenticating proxy would have set,
+// replacing the ones given by the client.
+// Without configured API tokens, the Authorization header is ignored.
+// It returns whether the request was authenticated.
+func authenticateToken(r *http.Request) (bool, error) {
+	token, ok := bearerToken(r)
+	if !ok || len(apiTokens) == 0 {
+		return false, nil
+	}
+	t, err := findToken(token)
+	if err != nil {
+		return false, err
+	}
+
+	r.Header.Set("X-Forwarded-User", t.name)
+	r.Header.Set("X-Forwarded-Email", t.email)
+	if rolesHeader != "" {
+		r.Header.Set(rolesHeader, strings.Join(t.roles, ","))
+	}
+	return true, nil
+}
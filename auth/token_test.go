@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/camptocamp/terraboard/config"
+)
+
+func setupFakeTokens() {
+	sum := sha256.Sum256([]byte("s3cr3t"))
+	c := config.Config{}
+	c.Web.RequireAuth = true
+	c.Web.RolesHeader = "X-Forwarded-Groups"
+	c.APITokens = []config.APITokenConfig{
+		{Name: "ci", Email: "ci@example.com", Hash: hex.EncodeToString(sum[:]), Roles: []string{"admin"}},
+		{Name: "broken", Hash: "not-a-hash"},
+	}
+	Setup(&c)
+}
+
+func TestValidateToken_valid(t *testing.T) {
+	setupFakeTokens()
+
+	u, err := ValidateToken("s3cr3t")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if u.Name != "ci" {
+		t.Fatalf("Expected %s, got %s", "ci", u.Name)
+	}
+}
+
+func TestValidateToken_invalid(t *testing.T) {
+	setupFakeTokens()
+
+	for _, token := range []string{"wrong", "", "not-a-hash"} {
+		if _, err := ValidateToken(token); err != ErrInvalidAPIToken {
+			t.Fatalf("Expected %v, got %v", ErrInvalidAPIToken, err)
+		}
+	}
+}
+
+func TestMiddleware_validToken(t *testing.T) {
+	setupFakeTokens()
+
+	var authenticated, admin, verified bool
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authenticated = IsAuthenticated(r)
+		admin = HasRole(r, []string{"admin"})
+		verified = IsVerified(r)
+	}))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/lineages", nil)
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	req.Header.Set("X-Forwarded-User", "mallory")
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	if !authenticated || !admin || !verified {
+		t.Fatalf("Expected a verified admin, got authenticated=%t admin=%t verified=%t", authenticated, admin, verified)
+	}
+	if user := req.Header.Get("X-Forwarded-User"); user != "ci" {
+		t.Fatalf("Expected %s, got %s", "ci", user)
+	}
+}
+
+func TestMiddleware_unverifiedUser(t *testing.T) {
+	setupFakeTokens()
+
+	var authenticated, verified bool
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authenticated = IsAuthenticated(r)
+		verified = IsVerified(r)
+	}))
+	req := httptest.NewRequest("GET", "/api/lineages", nil)
+	req.Header.Set("X-Forwarded-User", "jane")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !authenticated || verified {
+		t.Fatalf("Expected an unverified user, got authenticated=%t verified=%t", authenticated, verified)
+	}
+}
+
+func TestMiddleware_invalidToken(t *testing.T) {
+	setupFakeTokens()
+
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/lineages", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	req.Header.Set("X-Forwarded-User", "mallory")
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected %v, got %v", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+func TestMiddleware_missingToken(t *testing.T) {
+	setupFakeTokens()
+
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/api/lineages", nil))
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected %v, got %v", http.StatusUnauthorized, rr.Code)
+	}
+}
@@ -0,0 +1,153 @@
+package backup
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/camptocamp/terraboard/config"
+	"github.com/camptocamp/terraboard/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// archiveExtension is the extension of the backup archives,
+// gzip compressed JSON lines
+const archiveExtension = ".jsonl.gz"
+
+// ErrNotConfigured is returned when no backup location is configured
+var ErrNotConfigured = errors.New("no backup location configured")
+
+// Manifest describes the content of a backup archive
+type Manifest struct {
+	ID            string           `json:"id"`
+	SchemaVersion int              `json:"schema_version"`
+	CreatedAt     time.Time        `json:"created_at"`
+	Tables        map[string]int64 `json:"tables"`
+}
+
+// Result is a backup archive uploaded to the object store
+type Result struct {
+	Manifest
+	Location string `json:"location"`
+}
+
+// record is a row of a table in a backup archive
+type record struct {
+	Table string          `json:"table"`
+	Row   json.RawMessage `json:"row"`
+}
+
+// Source is a consistent view of the database tables being backed up
+type Source interface {
+	CountRows(tables []string) (map[string]int64, error)
+	DumpTable(table string, fn func(row json.RawMessage) error) error
+}
+
+var store Store
+
+// Setup sets up the object store of the backups,
+// disabled when no location is configured
+func Setup(c *config.Config) (err error) {
+	store = nil
+	if c.Backup.Location == "" {
+		return nil
+	}
+	store, err = NewStore(c.Backup.Location)
+	return
+}
+
+// Enabled returns true if a backup location is configured
+func Enabled() bool {
+	return store != nil
+}
+
+// Write writes a gzip compressed archive of the tables to w: the manifest
+// on the first line, then a JSON record per row, streamed from src
+func Write(w io.Writer, m Manifest, tables []string, src Source) error {
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	if err := enc.Encode(m); err != nil {
+		return err
+	}
+	for _, table := range tables {
+		var count int64
+		err := src.DumpTable(table, func(row json.RawMessage) error {
+			count++
+			return enc.Encode(record{Table: table, Row: row})
+		})
+		if err != nil {
+			return fmt.Errorf("failed to dump table %s: %w", table, err)
+		}
+		if count != m.Tables[table] {
+			return fmt.Errorf("dumped %d rows of table %s, expected %d", count, table, m.Tables[table])
+		}
+	}
+	return gz.Close()
+}
+
+// Run backs up the tables of src to an object store, streaming the archive
+// while it is written, and returns the uploaded backup
+func Run(src Source, s Store, now time.Time) (res Result, err error) {
+	counts, err := src.CountRows(db.BackupTables)
+	if err != nil {
+		return
+	}
+	res.Manifest = Manifest{
+		ID:            "terraboard-" + now.UTC().Format("20060102T150405Z"),
+		SchemaVersion: db.BackupSchemaVersion,
+		CreatedAt:     now.UTC(),
+		Tables:        counts,
+	}
+
+	pr, pw := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		err := Write(pw, res.Manifest, db.BackupTables, src)
+		pw.CloseWithError(err)
+		written <- err
+	}()
+
+	res.Location, err = s.Put(res.ID+archiveExtension, pr)
+	// Stop the archive writing if the upload ended before its completion
+	pr.CloseWithError(fmt.Errorf("upload of the backup archive ended"))
+	if werr := <-written; err == nil {
+		err = werr
+	}
+	return
+}
+
+// Backup backs up a snapshot of the database to the configured object store
+func Backup(d *db.Database, now time.Time) (res Result, err error) {
+	if store == nil {
+		return res, ErrNotConfigured
+	}
+	err = d.Snapshot(func(s *db.Database) (err error) {
+		res, err = Run(s, store, now)
+		return
+	})
+	return
+}
+
+// BackupPeriodically backs up the database every interval
+func BackupPeriodically(d *db.Database, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		start := time.Now()
+		res, err := Backup(d, start)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to back up the database")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"id":       res.ID,
+			"location": res.Location,
+			"duration": time.Since(start),
+		}).Info("Backed up the database")
+	}
+}
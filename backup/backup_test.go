@@ -0,0 +1,242 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/terraboard/db"
+)
+
+// fakeSource is a database holding JSON rows by table,
+// used both as a backup source and a restore target
+type fakeSource map[string][]string
+
+func (f fakeSource) CountRows(tables []string) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	for _, table := range tables {
+		counts[table] = int64(len(f[table]))
+	}
+	return counts, nil
+}
+
+func (f fakeSource) DumpTable(table string, fn func(row json.RawMessage) error) error {
+	for _, row := range f[table] {
+		if err := fn(json.RawMessage(row)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f fakeSource) ClearTables(tables []string) error {
+	for _, table := range tables {
+		delete(f, table)
+	}
+	return nil
+}
+
+func (f fakeSource) RestoreRow(table string, row json.RawMessage) error {
+	f[table] = append(f[table], string(row))
+	return nil
+}
+
+func (f fakeSource) ResetSequences([]string) error {
+	return nil
+}
+
+// fakeStore is an in-memory object store
+type fakeStore map[string][]byte
+
+func (f fakeStore) Put(key string, body io.Reader) (string, error) {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	f[key] = b
+	return "mem://" + key, nil
+}
+
+func (f fakeStore) Get(key string) (io.ReadCloser, error) {
+	b, ok := f[key]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", key)
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func seededSource() fakeSource {
+	return fakeSource{
+		"lineages": {`{"id":1,"value":"lineage-1","provider":"aws:bucket"}`},
+		"versions": {`{"id":1,"version_id":"v1"}`, `{"id":2,"version_id":"v2"}`},
+		"states": {
+			`{"id":1,"path":"app.tfstate","version_id":1,"lineage_id":1}`,
+			`{"id":2,"path":"app.tfstate","version_id":2,"lineage_id":1}`,
+		},
+		"modules":   {`{"id":1,"state_id":2,"path":"root"}`},
+		"resources": {`{"id":1,"module_id":1,"type":"aws_instance","name":"web"}`},
+		"plans":     {`{"id":1,"lineage_id":1}`},
+	}
+}
+
+// readArchive returns the manifest and the rows by table of a backup archive
+func readArchive(t *testing.T, b []byte) (m Manifest, rows map[string][]string) {
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("Expected a gzip archive, got %v", err)
+	}
+	scanner := bufio.NewScanner(gz)
+	if !scanner.Scan() {
+		t.Fatalf("Expected a manifest, got an empty archive")
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	rows = make(map[string][]string)
+	for scanner.Scan() {
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		rows[r.Table] = append(rows[r.Table], string(r.Row))
+	}
+	return
+}
+
+func TestRun(t *testing.T) {
+	src := seededSource()
+	s := fakeStore{}
+	now := time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC)
+
+	res, err := Run(src, s, now)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	key := "terraboard-20210601T123000Z.jsonl.gz"
+	if res.ID != "terraboard-20210601T123000Z" || res.Location != "mem://"+key {
+		t.Fatalf("Expected backup %s, got %s at %s", key, res.ID, res.Location)
+	}
+
+	m, rows := readArchive(t, s[key])
+	if !reflect.DeepEqual(m, res.Manifest) {
+		t.Fatalf("Expected %v, got %v", res.Manifest, m)
+	}
+	if m.SchemaVersion != db.BackupSchemaVersion || !m.CreatedAt.Equal(now) {
+		t.Fatalf("Expected schema version %d created at %v, got %d at %v", db.BackupSchemaVersion, now, m.SchemaVersion, m.CreatedAt)
+	}
+	for _, table := range db.BackupTables {
+		if m.Tables[table] != int64(len(src[table])) {
+			t.Fatalf("Expected %d rows of %s in the manifest, got %d", len(src[table]), table, m.Tables[table])
+		}
+		if !reflect.DeepEqual(rows[table], src[table]) {
+			t.Fatalf("Expected rows %v of %s, got %v", src[table], table, rows[table])
+		}
+	}
+}
+
+// changingSource is a source whose rows change after they're counted
+type changingSource struct {
+	fakeSource
+}
+
+func (c changingSource) CountRows(tables []string) (map[string]int64, error) {
+	counts, err := c.fakeSource.CountRows(tables)
+	c.fakeSource["lineages"] = append(c.fakeSource["lineages"], `{"id":2}`)
+	return counts, err
+}
+
+func TestRun_inconsistentSource(t *testing.T) {
+	if _, err := Run(changingSource{seededSource()}, fakeStore{}, time.Now()); err == nil {
+		t.Fatalf("Expected an error for rows not matching the manifest")
+	}
+}
+
+func TestDirStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terraboard-backup")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewStore("file://" + dir)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if _, err := s.Put("backup.jsonl.gz", bytes.NewReader([]byte("archive"))); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	r, err := s.Get("backup.jsonl.gz")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer r.Close()
+	if b, _ := ioutil.ReadAll(r); string(b) != "archive" {
+		t.Fatalf("Expected %s, got %s", "archive", b)
+	}
+
+	if _, err := s.Get("../backup.jsonl.gz"); err == nil {
+		t.Fatalf("Expected an error for a key outside of the directory")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	src := seededSource()
+	s := fakeStore{}
+	res, err := Run(src, s, time.Now())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	archive := s[res.ID+archiveExtension]
+
+	dst := fakeSource{}
+	dry, err := Restore(bytes.NewReader(archive), dst, true)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(dst) != 0 {
+		t.Fatalf("Expected no change in dry-run mode, got %v", dst)
+	}
+	if dry.Tables["states"].Restored != 2 || dry.Tables["states"].Current != 0 {
+		t.Fatalf("Expected %d states to restore over %d, got %v", 2, 0, dry.Tables["states"])
+	}
+
+	if _, err := Restore(bytes.NewReader(archive), dst, false); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	counts, _ := dst.CountRows(db.BackupTables)
+	for _, table := range db.BackupTables {
+		if counts[table] != res.Tables[table] {
+			t.Fatalf("Expected %d rows of %s, got %d", res.Tables[table], table, counts[table])
+		}
+		if !reflect.DeepEqual(dst[table], src[table]) {
+			t.Fatalf("Expected rows %v of %s, got %v", src[table], table, dst[table])
+		}
+	}
+}
+
+func TestRestore_incompatibleSchema(t *testing.T) {
+	var b bytes.Buffer
+	m := Manifest{ID: "old", SchemaVersion: db.BackupSchemaVersion + 1, Tables: map[string]int64{}}
+	if err := Write(&b, m, db.BackupTables, fakeSource{}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	dst := seededSource()
+	if _, err := Restore(&b, dst, false); !errors.Is(err, ErrIncompatibleSchema) {
+		t.Fatalf("Expected %v, got %v", ErrIncompatibleSchema, err)
+	}
+	if !reflect.DeepEqual(dst, seededSource()) {
+		t.Fatalf("Expected the target to be left unchanged, got %v", dst)
+	}
+}
@@ -0,0 +1,139 @@
+package backup
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/camptocamp/terraboard/db"
+)
+
+// ErrIncompatibleSchema is returned when restoring a backup archive
+// of another schema version than the database
+var ErrIncompatibleSchema = errors.New("incompatible backup schema version")
+
+// ErrInvalidArchive is returned when restoring a malformed backup archive
+var ErrInvalidArchive = errors.New("invalid backup archive")
+
+// TableRestore reports the rows of a table replaced by a restore
+type TableRestore struct {
+	Current  int64 `json:"current"`
+	Restored int64 `json:"restored"`
+}
+
+// RestoreResult reports a restore of a backup archive,
+// or what it would change in dry-run mode
+type RestoreResult struct {
+	Manifest Manifest                `json:"manifest"`
+	DryRun   bool                    `json:"dry_run"`
+	Tables   map[string]TableRestore `json:"tables"`
+}
+
+// Target is the database a backup archive is restored into
+type Target interface {
+	CountRows(tables []string) (map[string]int64, error)
+	ClearTables(tables []string) error
+	RestoreRow(table string, row json.RawMessage) error
+	ResetSequences(tables []string) error
+}
+
+// ReadManifest reads the manifest of a backup archive read by dec,
+// checking that its schema version is the one of the database
+func ReadManifest(dec *json.Decoder) (m Manifest, err error) {
+	if err = dec.Decode(&m); err != nil {
+		return m, fmt.Errorf("%w: failed to read manifest: %v", ErrInvalidArchive, err)
+	}
+	if m.SchemaVersion != db.BackupSchemaVersion {
+		return m, fmt.Errorf("%w: archive has version %d, database has version %d",
+			ErrIncompatibleSchema, m.SchemaVersion, db.BackupSchemaVersion)
+	}
+	return
+}
+
+// Restore replaces the tables of t with the content of the backup archive
+// read from r. In dry-run mode, the archive is checked but t isn't changed.
+func Restore(r io.Reader, t Target, dryRun bool) (res RestoreResult, err error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return res, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	dec := json.NewDecoder(gz)
+	if res.Manifest, err = ReadManifest(dec); err != nil {
+		return
+	}
+	res.DryRun = dryRun
+
+	current, err := t.CountRows(db.BackupTables)
+	if err != nil {
+		return
+	}
+	known := make(map[string]bool)
+	for _, table := range db.BackupTables {
+		known[table] = true
+	}
+
+	if !dryRun {
+		if err = t.ClearTables(db.BackupTables); err != nil {
+			return
+		}
+	}
+
+	restored := make(map[string]int64)
+	for {
+		var rec record
+		if decErr := dec.Decode(&rec); decErr == io.EOF {
+			break
+		} else if decErr != nil {
+			return res, fmt.Errorf("%w: %v", ErrInvalidArchive, decErr)
+		}
+		if !known[rec.Table] {
+			return res, fmt.Errorf("%w: unknown table %s", ErrInvalidArchive, rec.Table)
+		}
+		restored[rec.Table]++
+		if dryRun {
+			continue
+		}
+		if err = t.RestoreRow(rec.Table, rec.Row); err != nil {
+			return res, fmt.Errorf("failed to restore a row of table %s: %w", rec.Table, err)
+		}
+	}
+
+	res.Tables = make(map[string]TableRestore)
+	for _, table := range db.BackupTables {
+		if restored[table] != res.Manifest.Tables[table] {
+			return res, fmt.Errorf("%w: %d rows of table %s, expected %d",
+				ErrInvalidArchive, restored[table], table, res.Manifest.Tables[table])
+		}
+		res.Tables[table] = TableRestore{Current: current[table], Restored: restored[table]}
+	}
+
+	if !dryRun {
+		err = t.ResetSequences(db.BackupTables)
+	}
+	return
+}
+
+// Open opens a backup archive of the configured object store,
+// by key or by backup ID
+func Open(key string) (io.ReadCloser, error) {
+	if store == nil {
+		return nil, ErrNotConfigured
+	}
+	if !strings.HasSuffix(key, archiveExtension) {
+		key += archiveExtension
+	}
+	return store.Get(key)
+}
+
+// RestoreDatabase restores a backup archive read from r into the database,
+// within a transaction
+func RestoreDatabase(d *db.Database, r io.Reader, dryRun bool) (res RestoreResult, err error) {
+	err = d.Restore(func(t *db.Database) (err error) {
+		res, err = Restore(r, t, dryRun)
+		return
+	})
+	return
+}
@@ -0,0 +1,141 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	aws_sdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+)
+
+// Store is an object store holding backup archives by key
+type Store interface {
+	Put(key string, body io.Reader) (location string, err error)
+	Get(key string) (io.ReadCloser, error)
+}
+
+// NewStore returns the object store of a location, either an S3 URL
+// (s3://bucket/prefix) or a local directory
+func NewStore(location string) (Store, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup location %s: %v", location, err)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		sess, err := session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		return &s3Store{
+			svc:      s3.New(sess),
+			uploader: s3manager.NewUploader(sess),
+			bucket:   u.Host,
+			prefix:   strings.Trim(u.Path, "/"),
+		}, nil
+	case "file":
+		return dirStore(u.Path), nil
+	case "":
+		return dirStore(location), nil
+	}
+	return nil, fmt.Errorf("unsupported backup location scheme %s", u.Scheme)
+}
+
+// checkKey returns an error if a key isn't a plain file name
+func checkKey(key string) error {
+	if key == "" || key != path.Base(key) || key == ".." {
+		return fmt.Errorf("invalid backup key %s", key)
+	}
+	return nil
+}
+
+// s3Store stores backup archives in an S3 bucket, using the default
+// AWS credentials and region
+type s3Store struct {
+	svc      *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+	prefix   string
+}
+
+func (s *s3Store) Put(key string, body io.Reader) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	key = path.Join(s.prefix, key)
+	// The uploader sends the body by parts, without reading it all first
+	_, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws_sdk.String(s.bucket),
+		Key:    aws_sdk.String(key),
+		Body:   body,
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("s3://%s/%s", s.bucket, key), nil
+}
+
+func (s *s3Store) Get(key string) (io.ReadCloser, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	out, err := s.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws_sdk.String(s.bucket),
+		Key:    aws_sdk.String(path.Join(s.prefix, key)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// dirStore stores backup archives in a local directory
+type dirStore string
+
+func (d dirStore) Put(key string, body io.Reader) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(string(d), 0750); err != nil {
+		return "", err
+	}
+
+	// The archive is only visible once complete
+	dest := filepath.Join(string(d), key)
+	tmp, err := os.Create(filepath.Clean(dest + ".tmp"))
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(tmp, body); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dest)
+	}
+	if err != nil {
+		if rerr := os.Remove(tmp.Name()); rerr != nil {
+			log.Warnf("Failed to remove incomplete backup archive: %v", rerr)
+		}
+		return "", err
+	}
+	return dest, nil
+}
+
+func (d dirStore) Get(key string) (io.ReadCloser, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Clean(filepath.Join(string(d), key)))
+}
@@ -1,6 +1,7 @@
 package compare
 
 import (
+	"context"
 	"fmt"
 	"sort"
 	"strings"
@@ -103,8 +104,10 @@ func stateInfo(state types.State) (info string) {
 // Compare a resource in two states
 func compareResource(st1, st2 types.State, key string) (comp types.ResourceDiff) {
 	res1, _ := getResource(st1, key) // TODO: err
+	res1 = comparedAttributes(res1)
 	attrs1 := resourceAttributes(res1)
 	res2, _ := getResource(st2, key) // TODO: err
+	res2 = comparedAttributes(res2)
 	attrs2 := resourceAttributes(res2)
 
 	// Only in old
@@ -136,9 +139,34 @@ func compareResource(st1, st2 types.State, key string) (comp types.ResourceDiff)
 	return
 }
 
-// Compare returns the difference between two versions of a State
-// as a StateCompare structure
-func Compare(from, to types.State) (comp types.StateCompare, err error) {
+// countAttributeChanges adds the attributes added, removed and changed
+// between two versions of a Resource to count
+func countAttributeChanges(count *types.DiffCount, from, to types.Resource) {
+	old := make(map[string]string)
+	for _, a := range from.Attributes {
+		old[a.Key] = a.Value
+	}
+	for _, a := range to.Attributes {
+		v, ok := old[a.Key]
+		if !ok {
+			count.Added++
+			continue
+		}
+		if v != a.Value {
+			count.Changed++
+		}
+		delete(old, a.Key)
+	}
+	count.Removed += len(old)
+}
+
+// Compare returns the differences between two versions of a State.
+// The versions may belong to different lineages, e.g. when a State was
+// split, resources being matched by address only.
+// The attributes of the resources in both versions are compared
+// according to the compare rule of their type, if any.
+// It aborts with the context error when ctx is done before completion.
+func Compare(ctx context.Context, from, to types.State) (comp types.StateCompare, err error) {
 	if from.Path == "" {
 		err = fmt.Errorf("from version is unknown")
 		return
@@ -169,6 +197,9 @@ func Compare(from, to types.State) (comp types.StateCompare, err error) {
 	onlyInOld := sliceDiff(fromResources, toResources)
 	comp.Differences.OnlyInOld = make(map[string]string)
 	for _, r := range onlyInOld {
+		if err = ctx.Err(); err != nil {
+			return
+		}
 		res, _ := getResource(from, r) // TODO: err
 		comp.Differences.OnlyInOld[r] = formatResource(res)
 	}
@@ -177,6 +208,9 @@ func Compare(from, to types.State) (comp types.StateCompare, err error) {
 	onlyInNew := sliceDiff(toResources, fromResources)
 	comp.Differences.OnlyInNew = make(map[string]string)
 	for _, r := range onlyInNew {
+		if err = ctx.Err(); err != nil {
+			return
+		}
 		res, _ := getResource(to, r) // TODO: err
 		comp.Differences.OnlyInNew[r] = formatResource(res)
 	}
@@ -184,15 +218,27 @@ func Compare(from, to types.State) (comp types.StateCompare, err error) {
 	comp.Differences.ResourceDiff = make(map[string]types.ResourceDiff)
 
 	for _, r := range comp.Differences.InBoth {
+		if err = ctx.Err(); err != nil {
+			return
+		}
 		if c := compareResource(to, from, r); c.UnifiedDiff != "" {
 			comp.Differences.ResourceDiff[r] = c
+			res1, _ := getResource(from, r) // TODO: err
+			res2, _ := getResource(to, r)   // TODO: err
+			countAttributeChanges(&comp.Stats.Attributes, comparedAttributes(res1), comparedAttributes(res2))
 		}
 	}
+	comp.Stats.Resources = types.DiffCount{
+		Added:   len(onlyInNew),
+		Removed: len(onlyInOld),
+		Changed: len(comp.Differences.ResourceDiff),
+	}
 
 	log.WithFields(log.Fields{
-		"path": from.Path,
-		"from": from.Version.VersionID,
-		"to":   to.Version.VersionID,
+		"path":    from.Path,
+		"to_path": to.Path,
+		"from":    from.Version.VersionID,
+		"to":      to.Version.VersionID,
 	}).Info("Comparing state versions")
 
 	return
@@ -1,6 +1,10 @@
 package compare
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"reflect"
 	"testing"
 	"time"
@@ -247,11 +251,15 @@ func TestCompare_Result(t *testing.T) {
 
 	expectedResult := types.StateCompare{
 		Stats: struct {
-			From types.StateInfo `json:"from"`
-			To   types.StateInfo `json:"to"`
+			From       types.StateInfo `json:"from"`
+			To         types.StateInfo `json:"to"`
+			Resources  types.DiffCount `json:"resources"`
+			Attributes types.DiffCount `json:"attributes"`
 		}{
-			From: fromStateInfo,
-			To:   fakeStateInfo,
+			From:       fromStateInfo,
+			To:         fakeStateInfo,
+			Resources:  types.DiffCount{Added: 1, Removed: 1, Changed: 1},
+			Attributes: types.DiffCount{Added: 2, Removed: 1},
 		},
 		Differences: struct {
 			OnlyInOld    map[string]string             `json:"only_in_old"`
@@ -332,7 +340,7 @@ func TestCompare_Result(t *testing.T) {
 		Modules:   []types.Module{fakeNewModule},
 	}
 
-	result, err := Compare(fakeNewState, fakeState)
+	result, err := Compare(context.Background(), fakeNewState, fakeState)
 
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
@@ -343,10 +351,138 @@ func TestCompare_Result(t *testing.T) {
 	}
 }
 
+func TestCompare_CrossLineage(t *testing.T) {
+	// The network resource moved to a new lineage when the State was split
+	network := types.Resource{
+		Type:       "aws_vpc",
+		Name:       "main",
+		Attributes: []types.Attribute{{Key: "cidr_block", Value: "10.0.0.0/16"}},
+	}
+	app := types.Resource{
+		Type:       "aws_instance",
+		Name:       "web",
+		Attributes: []types.Attribute{{Key: "instance_type", Value: "t3.micro"}},
+	}
+	from := types.State{
+		Path:      "monolith/terraform.tfstate",
+		LineageID: sql.NullInt64{Int64: 1, Valid: true},
+		Version:   types.Version{VersionID: "v1"},
+		Modules:   []types.Module{{Path: "root", Resources: []types.Resource{network, app}}},
+	}
+	to := types.State{
+		Path:      "network/terraform.tfstate",
+		LineageID: sql.NullInt64{Int64: 2, Valid: true},
+		Version:   types.Version{VersionID: "v7"},
+		Modules:   []types.Module{{Path: "root", Resources: []types.Resource{network}}},
+	}
+
+	result, err := Compare(context.Background(), from, to)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if !reflect.DeepEqual(result.Differences.InBoth, []string{"root.aws_vpc.main"}) {
+		t.Fatalf("Expected the moved resource in both States, got %v", result.Differences.InBoth)
+	}
+	if len(result.Differences.ResourceDiff) != 0 {
+		t.Fatalf("Expected the moved resource to be unchanged, got %v", result.Differences.ResourceDiff)
+	}
+	if _, ok := result.Differences.OnlyInOld["root.aws_instance.web"]; !ok || len(result.Differences.OnlyInOld) != 1 {
+		t.Fatalf("Expected only root.aws_instance.web to be left behind, got %v", result.Differences.OnlyInOld)
+	}
+	if len(result.Differences.OnlyInNew) != 0 {
+		t.Fatalf("Expected no new resource, got %v", result.Differences.OnlyInNew)
+	}
+	if result.Stats.From.Path != from.Path || result.Stats.To.Path != to.Path {
+		t.Fatalf("Expected paths %s and %s, got %s and %s", from.Path, to.Path, result.Stats.From.Path, result.Stats.To.Path)
+	}
+}
+
+func TestCompare_Stats(t *testing.T) {
+	vpc := types.Resource{
+		Type:       "aws_vpc",
+		Name:       "main",
+		Attributes: []types.Attribute{{Key: "cidr_block", Value: "10.0.0.0/16"}},
+	}
+	subnet := types.Resource{
+		Type: "aws_subnet",
+		Name: "a",
+		Attributes: []types.Attribute{
+			{Key: "cidr_block", Value: "10.0.1.0/24"},
+			{Key: "map_public_ip_on_launch", Value: "false"},
+		},
+	}
+	newSubnet := types.Resource{
+		Type: "aws_subnet",
+		Name: "a",
+		Attributes: []types.Attribute{
+			{Key: "cidr_block", Value: "10.0.2.0/24"},
+			{Key: "tags.Name", Value: "a"},
+		},
+	}
+	web := types.Resource{
+		Type:       "aws_instance",
+		Name:       "web",
+		Attributes: []types.Attribute{{Key: "instance_type", Value: "t3.micro"}},
+	}
+	newWeb := types.Resource{
+		Type:       "aws_instance",
+		Name:       "web",
+		Attributes: []types.Attribute{{Key: "instance_type", Value: "t3.large"}},
+	}
+	db := types.Resource{
+		Type:       "aws_db_instance",
+		Name:       "main",
+		Attributes: []types.Attribute{{Key: "engine", Value: "postgres"}},
+	}
+	queue := types.Resource{
+		Type:       "aws_sqs_queue",
+		Name:       "jobs",
+		Attributes: []types.Attribute{{Key: "fifo_queue", Value: "false"}},
+	}
+
+	from := types.State{
+		Path:    "myfakepath/terraform.tfstate",
+		Version: types.Version{VersionID: "v1"},
+		Modules: []types.Module{
+			{Path: "root", Resources: []types.Resource{vpc}},
+			{Path: "root.network", Resources: []types.Resource{subnet}},
+			{Path: "root.app", Resources: []types.Resource{web, db}},
+		},
+	}
+	to := types.State{
+		Path:    "myfakepath/terraform.tfstate",
+		Version: types.Version{VersionID: "v2"},
+		Modules: []types.Module{
+			{Path: "root", Resources: []types.Resource{vpc}},
+			{Path: "root.network", Resources: []types.Resource{newSubnet}},
+			{Path: "root.app", Resources: []types.Resource{newWeb, queue}},
+			{Path: "root.app.workers", Resources: []types.Resource{queue}},
+		},
+	}
+
+	result, err := Compare(context.Background(), from, to)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expectedResources := types.DiffCount{Added: 2, Removed: 1, Changed: 2}
+	if result.Stats.Resources != expectedResources {
+		t.Fatalf("Expected %v, got %v", expectedResources, result.Stats.Resources)
+	}
+	expectedAttributes := types.DiffCount{Added: 1, Removed: 1, Changed: 2}
+	if result.Stats.Attributes != expectedAttributes {
+		t.Fatalf("Expected %v, got %v", expectedAttributes, result.Stats.Attributes)
+	}
+	if len(result.Differences.ResourceDiff) != expectedResources.Changed {
+		t.Fatalf("Expected %d resource diffs, got %v", expectedResources.Changed, result.Differences.ResourceDiff)
+	}
+}
+
 func TestCompare_nofrom(t *testing.T) {
 	expectedError := "from version is unknown"
 
-	_, err := Compare(types.State{}, types.State{})
+	_, err := Compare(context.Background(), types.State{}, types.State{})
 
 	if err == nil {
 		t.Fatalf("Expected error, got nil")
@@ -360,7 +496,7 @@ func TestCompare_nofrom(t *testing.T) {
 func TestCompare_noto(t *testing.T) {
 	expectedError := "to version is unknown"
 
-	_, err := Compare(types.State{Path: "path/to/foo.tfstate"}, types.State{})
+	_, err := Compare(context.Background(), types.State{Path: "path/to/foo.tfstate"}, types.State{})
 
 	if err == nil {
 		t.Fatalf("Expected error, got nil")
@@ -370,3 +506,40 @@ func TestCompare_noto(t *testing.T) {
 		t.Fatalf("Expected %s, got %s", expectedError, err.Error())
 	}
 }
+
+func TestCompare_timeout(t *testing.T) {
+	var fromResources, toResources []types.Resource
+	for i := 0; i < 2000; i++ {
+		fromResources = append(fromResources, types.Resource{
+			Type:       "fakeType",
+			Name:       fmt.Sprintf("fakeName%d", i),
+			Attributes: []types.Attribute{{Key: "fakeKey", Value: "fakeValue"}},
+		})
+		toResources = append(toResources, types.Resource{
+			Type:       "fakeType",
+			Name:       fmt.Sprintf("fakeName%d", i),
+			Attributes: []types.Attribute{{Key: "fakeKey", Value: "fakeNewValue"}},
+		})
+	}
+	from := types.State{
+		Path:    "myfakepath/terraform.tfstate",
+		Modules: []types.Module{{Path: "root", Resources: fromResources}},
+	}
+	to := types.State{
+		Path:    "myfakepath/terraform.tfstate",
+		Modules: []types.Module{{Path: "root", Resources: toResources}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := Compare(ctx, from, to)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected compare to abort early, took %v", elapsed)
+	}
+}
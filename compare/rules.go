@@ -0,0 +1,66 @@
+package compare
+
+import (
+	"path"
+
+	"github.com/camptocamp/terraboard/config"
+	"github.com/camptocamp/terraboard/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// rules are the compare rules by resource type
+var rules map[string]config.CompareRuleConfig
+
+// Setup sets up the compare rules of the resource types
+func Setup(c *config.Config) {
+	setRules(c.CompareRules)
+}
+
+// setRules keeps the compare rules whose key patterns are valid
+func setRules(rs []config.CompareRuleConfig) {
+	rules = make(map[string]config.CompareRuleConfig)
+	for _, rule := range rs {
+		valid := true
+		for _, key := range append(append([]string{}, rule.Significant...), rule.Ignored...) {
+			if _, err := path.Match(key, ""); err != nil {
+				log.Warnf("Invalid compare rule pattern '%s', ignoring the rule of %s", key, rule.ResourceType)
+				valid = false
+			}
+		}
+		if valid {
+			rules[rule.ResourceType] = rule
+		}
+	}
+}
+
+// matchKey returns whether an attribute key matches one of the patterns
+func matchKey(patterns []string, key string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// comparedAttributes returns a Resource with only the attributes compared
+// according to the rule of its type, all of them for types without rules
+func comparedAttributes(res types.Resource) types.Resource {
+	rule, ok := rules[res.Type]
+	if !ok {
+		return res
+	}
+
+	var attrs []types.Attribute
+	for _, a := range res.Attributes {
+		if len(rule.Significant) > 0 && !matchKey(rule.Significant, a.Key) {
+			continue
+		}
+		if matchKey(rule.Ignored, a.Key) {
+			continue
+		}
+		attrs = append(attrs, a)
+	}
+	res.Attributes = attrs
+	return res
+}
@@ -0,0 +1,77 @@
+package compare
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/camptocamp/terraboard/config"
+	"github.com/camptocamp/terraboard/types"
+)
+
+func dbInstance(class, modified string) types.Resource {
+	return types.Resource{
+		Type: "aws_db_instance",
+		Name: "main",
+		Attributes: []types.Attribute{
+			{Key: "instance_class", Value: class},
+			{Key: "latest_restorable_time", Value: modified},
+		},
+	}
+}
+
+func dbState(version string, res types.Resource) types.State {
+	return types.State{
+		Path:    "myfakepath/terraform.tfstate",
+		Version: types.Version{VersionID: version},
+		Modules: []types.Module{{Path: "root", Resources: []types.Resource{res}}},
+	}
+}
+
+func TestCompare_Rules(t *testing.T) {
+	defer setRules(nil)
+	setRules([]config.CompareRuleConfig{
+		{ResourceType: "aws_db_instance", Ignored: []string{"latest_*"}},
+	})
+
+	from := dbState("v1", dbInstance("db.t3.micro", "2021-06-01T12:00:00Z"))
+	ignored, err := Compare(context.Background(), from, dbState("v2", dbInstance("db.t3.micro", "2021-06-02T12:00:00Z")))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(ignored.Differences.ResourceDiff) != 0 || ignored.Stats.Resources.Changed != 0 {
+		t.Fatalf("Expected no diff for an ignored attribute, got %v", ignored.Differences.ResourceDiff)
+	}
+
+	significant, err := Compare(context.Background(), from, dbState("v2", dbInstance("db.t3.large", "2021-06-02T12:00:00Z")))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(significant.Differences.ResourceDiff) != 1 {
+		t.Fatalf("Expected a diff for a significant attribute, got %v", significant.Differences.ResourceDiff)
+	}
+	expected := types.DiffCount{Changed: 1}
+	if significant.Stats.Attributes != expected {
+		t.Fatalf("Expected %v, got %v", expected, significant.Stats.Attributes)
+	}
+}
+
+func TestComparedAttributes(t *testing.T) {
+	defer setRules(nil)
+	setRules([]config.CompareRuleConfig{
+		{ResourceType: "aws_db_instance", Significant: []string{"instance_class"}},
+		{ResourceType: "aws_instance", Ignored: []string{"["}},
+	})
+
+	expected := []types.Attribute{{Key: "instance_class", Value: "db.t3.micro"}}
+	if attrs := comparedAttributes(dbInstance("db.t3.micro", "now")).Attributes; !reflect.DeepEqual(attrs, expected) {
+		t.Fatalf("Expected %v, got %v", expected, attrs)
+	}
+
+	// Types without valid rules compare all attributes
+	res := dbInstance("db.t3.micro", "now")
+	res.Type = "aws_instance"
+	if attrs := comparedAttributes(res).Attributes; !reflect.DeepEqual(attrs, res.Attributes) {
+		t.Fatalf("Expected %v, got %v", res.Attributes, attrs)
+	}
+}
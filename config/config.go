@@ -20,14 +20,30 @@ type LogConfig struct {
 
 // DBConfig stores the database configuration
 type DBConfig struct {
-	Host         string `long:"db-host" env:"DB_HOST" yaml:"host" description:"Database host." default:"db"`
-	Port         uint16 `long:"db-port" env:"DB_PORT" yaml:"port" description:"Database port." default:"5432"`
-	User         string `long:"db-user" env:"DB_USER" yaml:"user" description:"Database user." default:"gorm"`
-	Password     string `long:"db-password" env:"DB_PASSWORD" yaml:"password" description:"Database password."`
-	Name         string `long:"db-name" env:"DB_NAME" yaml:"name" description:"Database name." default:"gorm"`
-	SSLMode      string `long:"db-sslmode" env:"DB_SSLMODE" yaml:"sslmode" description:"Database SSL mode." default:"require"`
-	NoSync       bool   `long:"no-sync" yaml:"no-sync" description:"Do not sync database."`
-	SyncInterval uint16 `long:"sync-interval" yaml:"sync-interval" description:"DB sync interval (in minutes)" default:"1"`
+	Dialect             string   `long:"db-dialect" env:"DB_DIALECT" yaml:"dialect" description:"Database dialect, only 'postgres' being supported." default:"postgres"`
+	Host                string   `long:"db-host" env:"DB_HOST" yaml:"host" description:"Database host." default:"db"`
+	Port                uint16   `long:"db-port" env:"DB_PORT" yaml:"port" description:"Database port." default:"5432"`
+	User                string   `long:"db-user" env:"DB_USER" yaml:"user" description:"Database user." default:"gorm"`
+	Password            string   `long:"db-password" env:"DB_PASSWORD" yaml:"password" description:"Database password."`
+	Name                string   `long:"db-name" env:"DB_NAME" yaml:"name" description:"Database name." default:"gorm"`
+	SSLMode             string   `long:"db-sslmode" env:"DB_SSLMODE" yaml:"sslmode" description:"Database SSL mode." default:"require"`
+	NoSync              bool     `long:"no-sync" yaml:"no-sync" description:"Do not sync database."`
+	SyncInterval        uint16   `long:"sync-interval" yaml:"sync-interval" description:"DB sync interval (in minutes)" default:"1"`
+	Incremental         bool     `long:"incremental-ingestion" env:"TERRABOARD_INCREMENTAL_INGESTION" yaml:"incremental-ingestion" description:"Share the attributes of resources unchanged since the previous version instead of rewriting them."`
+	DedupVersions       bool     `long:"dedup-versions" env:"TERRABOARD_DEDUP_VERSIONS" yaml:"dedup-versions" description:"Skip versions whose content is identical to the previous version of their State."`
+	DuplicateLineages   string   `long:"duplicate-lineages" env:"TERRABOARD_DUPLICATE_LINEAGES" yaml:"duplicate-lineages" description:"Resolution of a lineage found on several providers ('keep', 'merge', 'prefer')." default:"keep"`
+	PreferredProvider   string   `long:"preferred-provider" env:"TERRABOARD_PREFERRED_PROVIDER" yaml:"preferred-provider" description:"Provider (e.g. 'aws:my-bucket') kept for duplicate lineages with the 'prefer' resolution."`
+	StrictPlanFormat    bool     `long:"strict-plan-format" env:"TERRABOARD_STRICT_PLAN_FORMAT" yaml:"strict-plan-format" description:"Reject plans with a format version newer than the latest supported one, instead of only newer major versions."`
+	EmptyStates         string   `long:"empty-states" env:"TERRABOARD_EMPTY_STATES" yaml:"empty-states" description:"Handling of States without managed resources in listings ('include', 'hide', 'tag')." default:"include"`
+	LineageNameRegex    string   `long:"lineage-name-regex" env:"TERRABOARD_LINEAGE_NAME_REGEX" yaml:"lineage-name-regex" description:"Regular expression matched against State paths to compute lineage display names (e.g. '^(?P<env>[^/]+)/(?P<service>[^/]+)/')."`
+	LineageNameTemplate string   `long:"lineage-name-template" env:"TERRABOARD_LINEAGE_NAME_TEMPLATE" yaml:"lineage-name-template" description:"Template of lineage display names, expanded with the groups of the regular expression (e.g. '${env}/${service}')."`
+	PlanInsertRetries   uint     `long:"plan-insert-retries" env:"TERRABOARD_PLAN_INSERT_RETRIES" yaml:"plan-insert-retries" description:"Number of retries of a plan insertion failing on a transient database error." default:"3"`
+	HiddenTFVersions    []string `long:"hidden-tf-version" env:"TERRABOARD_HIDDEN_TF_VERSIONS" env-delim:"," yaml:"hidden-tf-versions" description:"Terraform version(s) of States hidden by default from the dashboard."`
+	MinTFVersion        string   `long:"min-tf-version" env:"TERRABOARD_MIN_TF_VERSION" yaml:"min-tf-version" description:"Hide States on older Terraform versions by default from the dashboard."`
+	ComputedFields      []string `long:"computed-field" env:"TERRABOARD_COMPUTED_FIELDS" env-delim:"," yaml:"computed-fields" description:"Field(s) computed on State ingestion, shown in listings and usable as their filters ('resource_count', 'primary_provider', 'primary_region')."`
+	AutoTags            bool     `long:"auto-tags" env:"TERRABOARD_AUTO_TAGS" yaml:"auto-tags" description:"Tag lineages with the cloud, region and account detected from the resources of their most recent State."`
+	AutoTagAttributes   []string `long:"auto-tag-attribute" env:"TERRABOARD_AUTO_TAG_ATTRIBUTES" env-delim:"," yaml:"auto-tag-attributes" description:"Resource attribute(s) the region and account tags are detected from, as '<tag>:<cloud>:<key>' where the cloud is the resource type prefix." default:"region:aws:region" default:"region:aws:availability_zone" default:"region:aws:arn" default:"account:aws:account_id" default:"account:aws:owner_id" default:"account:aws:arn" default:"region:google:region" default:"region:google:location" default:"account:google:project" default:"region:azurerm:location" default:"account:azurerm:subscription_id"`
+	CompactionInterval  uint     `long:"compaction-interval" env:"TERRABOARD_COMPACTION_INTERVAL" yaml:"compaction-interval" description:"Interval of the removal of orphaned resources and attributes (in hours, 0 to disable)."`
 }
 
 // S3BucketConfig stores the S3 bucket configuration
@@ -36,6 +52,8 @@ type S3BucketConfig struct {
 	KeyPrefix      string   `long:"key-prefix" env:"AWS_KEY_PREFIX" yaml:"key-prefix" description:"AWS Key Prefix."`
 	FileExtension  []string `long:"file-extension" env:"AWS_FILE_EXTENSION" env-delim:"," yaml:"file-extension" description:"File extension(s) of state files." default:".tfstate"`
 	ForcePathStyle bool     `long:"force-path-style" env:"AWS_FORCE_PATH_STYLE" yaml:"force-path-style" description:"Force path style S3 bucket calls."`
+	RoleArn        string   `long:"s3-role-arn" env:"AWS_S3_ROLE_ARN" yaml:"role-arn" description:"Role ARN to Assume to access the bucket, instead of the AWS provider one."`
+	ExternalID     string   `long:"s3-external-id" env:"AWS_S3_EXTERNAL_ID" yaml:"external-id" description:"External ID to use when assuming the bucket role."`
 }
 
 // AWSConfig stores the DynamoDB table and S3 Bucket configuration
@@ -70,17 +88,150 @@ type GitlabConfig struct {
 	Token   string `long:"gitlab-token" env:"GITLAB_TOKEN" yaml:"token" description:"Token to authenticate upon GitLab"`
 }
 
+// AzureConfig stores the Azure Storage Account configuration
+type AzureConfig struct {
+	StorageAccount string   `long:"azure-storage-account" env:"AZURE_STORAGE_ACCOUNT" yaml:"storage-account" description:"Azure Storage Account of the states."`
+	Container      string   `long:"azure-container" env:"AZURE_STORAGE_CONTAINER" yaml:"container" description:"Azure blob container of the states." default:"tfstate"`
+	AccessKey      string   `long:"azure-access-key" env:"AZURE_STORAGE_KEY" yaml:"access-key" description:"Azure Storage Account access key, the managed identity being used without it."`
+	KeyPrefix      string   `long:"azure-key-prefix" env:"AZURE_KEY_PREFIX" yaml:"key-prefix" description:"Azure blob name prefix of the states."`
+	FileExtension  []string `long:"azure-file-extension" env:"AZURE_FILE_EXTENSION" env-delim:"," yaml:"file-extension" description:"File extension(s) of state files." default:".tfstate"`
+	Endpoint       string   `long:"azure-endpoint" env:"AZURE_STORAGE_ENDPOINT" yaml:"endpoint" description:"Azure blob service endpoint (https://<account>.blob.core.windows.net by default)."`
+}
+
+// HTTPConfig stores the configuration of a server of the Terraform http backend
+type HTTPConfig struct {
+	StateURLs []string `long:"http-state-url" env:"HTTP_STATE_URLS" env-delim:"," yaml:"state-urls" description:"URLs of the states, the http backend having no listing."`
+	LockURLs  []string `long:"http-lock-url" env:"HTTP_LOCK_URLS" env-delim:"," yaml:"lock-urls" description:"Lock URLs of the states, in the order of the state URLs."`
+	Username  string   `long:"http-username" env:"HTTP_USERNAME" yaml:"username" description:"Username for the basic authentication to the states."`
+	Password  string   `long:"http-password" env:"HTTP_PASSWORD" yaml:"password" description:"Password for the basic authentication to the states."`
+	Token     string   `long:"http-token" env:"HTTP_TOKEN" yaml:"token" description:"Bearer token to authenticate to the states, instead of the basic authentication."`
+}
+
 // WebConfig stores the UI interface parameters
 type WebConfig struct {
-	Port      uint16 `short:"p" long:"port" env:"TERRABOARD_PORT" yaml:"port" description:"Port to listen on." default:"8080"`
-	BaseURL   string `long:"base-url" env:"TERRABOARD_BASE_URL" yaml:"base-url" description:"Base URL." default:"/"`
-	LogoutURL string `long:"logout-url" env:"TERRABOARD_LOGOUT_URL" yaml:"logout-url" description:"Logout URL."`
+	Port              uint16   `short:"p" long:"port" env:"TERRABOARD_PORT" yaml:"port" description:"Port to listen on." default:"8080"`
+	BaseURL           string   `long:"base-url" env:"TERRABOARD_BASE_URL" yaml:"base-url" description:"Base URL." default:"/"`
+	LogoutURL         string   `long:"logout-url" env:"TERRABOARD_LOGOUT_URL" yaml:"logout-url" description:"Logout URL."`
+	RequestIDHeader   string   `long:"request-id-header" env:"TERRABOARD_REQUEST_ID_HEADER" yaml:"request-id-header" description:"Header used to propagate request IDs." default:"X-Request-ID"`
+	ResponseEnvelope  string   `long:"response-envelope" env:"TERRABOARD_RESPONSE_ENVELOPE" yaml:"response-envelope" description:"Envelope of paginated API responses ('legacy', 'jsonapi')." default:"legacy"`
+	RequireAuth       bool     `long:"require-auth" env:"TERRABOARD_REQUIRE_AUTH" yaml:"require-auth" description:"Reject API requests without X-Forwarded-User or X-Forwarded-Email headers."`
+	AuthExemptPaths   []string `long:"auth-exempt-path" env:"TERRABOARD_AUTH_EXEMPT_PATHS" env-delim:"," yaml:"auth-exempt-paths" description:"Path(s) which never require authentication, a trailing '*' matches a prefix." default:"/healthz" default:"/readyz" default:"/metrics"`
+	ShareSecret       string   `long:"share-secret" env:"TERRABOARD_SHARE_SECRET" yaml:"share-secret" description:"Secret used to sign shared State links (random if not set)."`
+	ShareLinkTTL      uint     `long:"share-link-ttl" env:"TERRABOARD_SHARE_LINK_TTL" yaml:"share-link-ttl" description:"Validity of shared State links (in minutes)." default:"1440"`
+	CompareTimeout    uint     `long:"compare-timeout" env:"TERRABOARD_COMPARE_TIMEOUT" yaml:"compare-timeout" description:"Maximum duration of a State comparison (in seconds)." default:"30"`
+	ChangelogMaxCount uint     `long:"changelog-max-count" env:"TERRABOARD_CHANGELOG_MAX_COUNT" yaml:"changelog-max-count" description:"Maximum number of versions compared in lineage changelogs." default:"20"`
+	ComparePageSize   uint     `long:"compare-page-size" env:"TERRABOARD_COMPARE_PAGE_SIZE" yaml:"compare-page-size" description:"Number of resources per page of paginated State comparisons." default:"100"`
+	CompareCacheTTL   uint     `long:"compare-cache-ttl" env:"TERRABOARD_COMPARE_CACHE_TTL" yaml:"compare-cache-ttl" description:"Validity of the paginated State comparisons kept server-side (in minutes)." default:"10"`
+	MaskLockFields    []string `long:"mask-lock-field" env:"TERRABOARD_MASK_LOCK_FIELDS" env-delim:"," yaml:"mask-lock-fields" description:"Lock field(s) masked in lock responses ('who', 'info', 'operation')."`
+	NamingPattern     string   `long:"naming-pattern" env:"TERRABOARD_NAMING_PATTERN" yaml:"naming-pattern" description:"Default regular expression Resource names are audited against."`
+	AccountAttributes []string `long:"account-attribute" env:"TERRABOARD_ACCOUNT_ATTRIBUTES" env-delim:"," yaml:"account-attributes" description:"Resource attribute(s) holding the cloud account, as '<cloud>:<key>' where the cloud is the resource type prefix." default:"aws:account_id" default:"aws:owner_id" default:"google:project" default:"azurerm:subscription_id"`
+	StreamThreshold   uint     `long:"stream-threshold" env:"TERRABOARD_STREAM_THRESHOLD" yaml:"stream-threshold" description:"Size (in bytes) above which large JSON responses are streamed instead of buffered." default:"1048576"`
+	GzipMinSize       uint     `long:"gzip-min-size" env:"TERRABOARD_GZIP_MIN_SIZE" yaml:"gzip-min-size" description:"Size (in bytes) from which responses are gzip compressed." default:"1024"`
+	GzipLevel         int      `long:"gzip-level" env:"TERRABOARD_GZIP_LEVEL" yaml:"gzip-level" description:"Compression level of gzip responses (1-9, 0 disables compression)." default:"6"`
+	RolesHeader       string   `long:"roles-header" env:"TERRABOARD_ROLES_HEADER" yaml:"roles-header" description:"Header holding the comma-separated roles (groups) of the user." default:"X-Forwarded-Groups"`
+	AdminRoles        []string `long:"admin-role" env:"TERRABOARD_ADMIN_ROLES" env-delim:"," yaml:"admin-roles" description:"Role(s) allowed to see all attributes, regardless of the attribute masking rules, and to perform administrative actions such as releasing locks."`
+	Middlewares       []string `long:"middleware" env:"TERRABOARD_MIDDLEWARES" env-delim:"," yaml:"middlewares" description:"Middleware(s) of the web server, in order from the outermost ('cors', 'gzip', 'request-id', 'auth', 'rate-limit'), left out ones being disabled." default:"cors" default:"gzip" default:"request-id" default:"auth" default:"rate-limit"`
+	RateLimit         float64  `long:"rate-limit" env:"TERRABOARD_RATE_LIMIT" yaml:"rate-limit" description:"Requests per second allowed to each user authenticated by an API token or login session, or else IP address (0 disables rate limiting)." default:"0"`
+	RateLimitBurst    uint     `long:"rate-limit-burst" env:"TERRABOARD_RATE_LIMIT_BURST" yaml:"rate-limit-burst" description:"Requests each user, or IP address, can make at once above the rate limit." default:"20"`
+}
+
+// OIDCConfig stores the configuration of the OpenID Connect login
+type OIDCConfig struct {
+	IssuerURL     string   `long:"oidc-issuer-url" env:"TERRABOARD_OIDC_ISSUER_URL" yaml:"issuer-url" description:"URL of the OpenID Connect provider, enabling the login when set."`
+	ClientID      string   `long:"oidc-client-id" env:"TERRABOARD_OIDC_CLIENT_ID" yaml:"client-id" description:"Client ID registered with the OpenID Connect provider."`
+	ClientSecret  string   `long:"oidc-client-secret" env:"TERRABOARD_OIDC_CLIENT_SECRET" yaml:"client-secret" description:"Client secret registered with the OpenID Connect provider."`
+	RedirectURL   string   `long:"oidc-redirect-url" env:"TERRABOARD_OIDC_REDIRECT_URL" yaml:"redirect-url" description:"Callback URL registered with the OpenID Connect provider (e.g. https://terraboard.example.com/oauth/callback)."`
+	Scopes        []string `long:"oidc-scope" env:"TERRABOARD_OIDC_SCOPES" env-delim:"," yaml:"scopes" description:"Scope(s) requested to the OpenID Connect provider." default:"openid" default:"email" default:"profile"`
+	SessionSecret string   `long:"oidc-session-secret" env:"TERRABOARD_OIDC_SESSION_SECRET" yaml:"session-secret" description:"Secret used to sign session cookies (random if not set)."`
+	SessionTTL    uint     `long:"oidc-session-ttl" env:"TERRABOARD_OIDC_SESSION_TTL" yaml:"session-ttl" description:"Validity of login sessions (in minutes)." default:"480"`
+}
+
+// MetricsConfig stores the metrics configuration
+type MetricsConfig struct {
+	LineageLabelLimit int  `long:"metrics-lineage-label-limit" env:"TERRABOARD_METRICS_LINEAGE_LABEL_LIMIT" yaml:"lineage-label-limit" description:"Maximum number of distinct lineage labels on metrics, others are reported as 'other'." default:"100"`
+	RefreshInterval   uint `long:"metrics-refresh-interval" env:"TERRABOARD_METRICS_REFRESH_INTERVAL" yaml:"refresh-interval" description:"Interval of the refresh of the lineages, versions and locks metrics (in seconds)." default:"60"`
+}
+
+// WebhookConfig stores the webhook notified of new State versions
+type WebhookConfig struct {
+	URL      string   `long:"webhook-url" env:"TERRABOARD_WEBHOOK_URL" yaml:"url" description:"URL notified of each new State version."`
+	Method   string   `long:"webhook-method" env:"TERRABOARD_WEBHOOK_METHOD" yaml:"method" description:"HTTP method of webhook requests." default:"POST"`
+	Headers  []string `long:"webhook-header" env:"TERRABOARD_WEBHOOK_HEADERS" env-delim:"," yaml:"headers" description:"HTTP header(s) of webhook requests, as 'Name: Value'."`
+	Template string   `long:"webhook-template" env:"TERRABOARD_WEBHOOK_TEMPLATE" yaml:"template" description:"Go template of the webhook payload, rendered with the new version event (JSON event by default)."`
+	URLs     []string `long:"webhook-urls" env:"TERRABOARD_WEBHOOK_URLS" env-delim:"," yaml:"urls" description:"Additional URL(s) notified of each new State version."`
+	Lineages []string `long:"webhook-lineage" env:"TERRABOARD_WEBHOOK_LINEAGES" env-delim:"," yaml:"lineages" description:"Lineage(s) notified to the webhook (all lineages by default)."`
+	Retries  uint     `long:"webhook-retries" env:"TERRABOARD_WEBHOOK_RETRIES" yaml:"retries" description:"Number of retries of failed webhook deliveries." default:"3"`
+}
+
+// BackupConfig stores the location and schedule of the database backups,
+// and whether they can be restored
+type BackupConfig struct {
+	Location     string `long:"backup-location" env:"TERRABOARD_BACKUP_LOCATION" yaml:"location" description:"Location of the database backups, as an S3 URL (s3://bucket/prefix) or a local directory."`
+	Interval     uint   `long:"backup-interval" env:"TERRABOARD_BACKUP_INTERVAL" yaml:"interval" description:"Interval of scheduled database backups (in hours, 0 to disable)." default:"0"`
+	AllowRestore bool   `long:"backup-allow-restore" env:"TERRABOARD_BACKUP_ALLOW_RESTORE" yaml:"allow-restore" description:"Allow admins to restore the database from a backup."`
+}
+
+// QuotaConfig stores a group of lineages, selected by their tags,
+// and its resource quota
+type QuotaConfig struct {
+	Name  string            `yaml:"name"`
+	Tags  map[string]string `yaml:"tags"`
+	Quota int               `yaml:"quota"`
+}
+
+// RateLimitConfig overrides the rate limit, in requests per second,
+// of the paths matching Path, exactly or as a prefix when it ends with '*'
+type RateLimitConfig struct {
+	Path  string  `yaml:"path"`
+	Rate  float64 `yaml:"rate"`
+	Burst uint    `yaml:"burst"`
+}
+
+// AttributeMaskingConfig stores the attribute keys, as shell patterns,
+// masked for users without any of the given roles
+type AttributeMaskingConfig struct {
+	Keys  []string `yaml:"keys"`
+	Roles []string `yaml:"roles"`
+}
+
+// CompareRuleConfig stores the attribute keys, as shell patterns, compared
+// between versions of the resources of a type: only the significant ones
+// if any, all but the ignored ones otherwise
+type CompareRuleConfig struct {
+	ResourceType string   `yaml:"resource-type"`
+	Significant  []string `yaml:"significant"`
+	Ignored      []string `yaml:"ignored"`
+}
+
+// APITokenConfig stores the SHA-256 hash, as hexadecimal, of an API token
+// and the user it authenticates
+type APITokenConfig struct {
+	Name  string   `yaml:"name"`
+	Email string   `yaml:"email"`
+	Hash  string   `yaml:"hash"`
+	Roles []string `yaml:"roles"`
+}
+
+// RefreshGroupConfig stores a region group of providers, selected by their
+// names as shell patterns (e.g. 'aws:eu-*'), refreshed concurrently on
+// their own schedule
+type RefreshGroupConfig struct {
+	Name         string   `yaml:"name"`
+	Providers    []string `yaml:"providers"`
+	SyncInterval uint16   `yaml:"sync-interval"`
 }
 
 // ProviderConfig stores genral provider parameters
 type ProviderConfig struct {
-	NoVersioning bool `long:"no-versioning" env:"TERRABOARD_NO_VERSIONING" yaml:"no-versioning" description:"Disable versioning support from Terraboard (useful for S3 compatible providers like MinIO)"`
-	NoLocks      bool `long:"no-locks" env:"TERRABOARD_NO_LOCKS" yaml:"no-locks" description:"Disable locks support from Terraboard (useful for S3 compatible providers like MinIO)"`
+	NoVersioning         bool     `long:"no-versioning" env:"TERRABOARD_NO_VERSIONING" yaml:"no-versioning" description:"Disable versioning support from Terraboard (useful for S3 compatible providers like MinIO)"`
+	NoLocks              bool     `long:"no-locks" env:"TERRABOARD_NO_LOCKS" yaml:"no-locks" description:"Disable locks support from Terraboard (useful for S3 compatible providers like MinIO)"`
+	IncludeBackups       bool     `long:"include-backups" env:"TERRABOARD_INCLUDE_BACKUPS" yaml:"include-backups" description:"Also ingest .tfstate.backup files as prior versions of their matching state"`
+	MaxConcurrency       int      `long:"max-concurrency" env:"TERRABOARD_MAX_CONCURRENCY" yaml:"max-concurrency" description:"Maximum number of concurrent state fetches per provider, reduced automatically when the provider throttles requests" default:"4"`
+	AllowedPaths         []string `long:"allowed-path" env:"TERRABOARD_ALLOWED_PATHS" env-delim:"," yaml:"allowed-paths" description:"Only ingest state files matching one of these paths or shell patterns"`
+	ExcludedPaths        []string `long:"excluded-path" env:"TERRABOARD_EXCLUDED_PATHS" env-delim:"," yaml:"excluded-paths" description:"Never ingest state files matching one of these paths or shell patterns, applied after the allowed paths"`
+	NoCredentialsRefresh bool     `long:"no-credentials-refresh" env:"TERRABOARD_NO_CREDENTIALS_REFRESH" yaml:"no-credentials-refresh" description:"Disable the refresh of AWS and Google Cloud provider credentials when they expire"`
+	RetryMaxAttempts     uint     `long:"retry-max-attempts" env:"TERRABOARD_RETRY_MAX_ATTEMPTS" yaml:"retry-max-attempts" description:"Maximum number of attempts of a state fetch failing on a transient provider error (5xx, network error), 1 to disable retries" default:"3"`
+	RetryBackoff         uint     `long:"retry-backoff" env:"TERRABOARD_RETRY_BACKOFF" yaml:"retry-backoff" description:"Delay before the first retry of a failed state fetch, doubled on each retry with a random jitter (in milliseconds)" default:"500"`
 }
 
 // Config stores the handler's configuration and UI interface parameters
@@ -103,7 +254,31 @@ type Config struct {
 
 	Gitlab []GitlabConfig `group:"GitLab Options" yaml:"gitlab"`
 
+	Azure []AzureConfig `group:"Azure Options" yaml:"azure"`
+
+	HTTP []HTTPConfig `group:"HTTP Backend Options" yaml:"http"`
+
 	Web WebConfig `group:"Web" yaml:"web"`
+
+	OIDC OIDCConfig `group:"OIDC Options" yaml:"oidc"`
+
+	Metrics MetricsConfig `group:"Metrics Options" yaml:"metrics"`
+
+	Webhook WebhookConfig `group:"Webhook Options" yaml:"webhook"`
+
+	Backup BackupConfig `group:"Backup Options" yaml:"backup"`
+
+	Quotas []QuotaConfig `yaml:"quotas"`
+
+	RateLimits []RateLimitConfig `yaml:"rate-limits"`
+
+	AttributeMasking []AttributeMaskingConfig `yaml:"attribute-masking"`
+
+	APITokens []APITokenConfig `yaml:"api-tokens"`
+
+	CompareRules []CompareRuleConfig `yaml:"compare-rules"`
+
+	RefreshGroups []RefreshGroupConfig `yaml:"refresh-groups"`
 }
 
 // LoadConfigFromYaml loads the config from config file
@@ -131,6 +306,8 @@ func initDefaultConfig() Config {
 	var tfeInitialConfig TFEConfig
 	var gcpInitialConfig GCPConfig
 	var gitlabInitialConfig GitlabConfig
+	var azureInitialConfig AzureConfig
+	var httpInitialConfig HTTPConfig
 
 	parseStructFlagsAndEnv(&awsInitialConfig)
 	c.AWS = append(c.AWS, awsInitialConfig)
@@ -147,6 +324,12 @@ func initDefaultConfig() Config {
 	parseStructFlagsAndEnv(&gitlabInitialConfig)
 	c.Gitlab = append(c.Gitlab, gitlabInitialConfig)
 
+	parseStructFlagsAndEnv(&azureInitialConfig)
+	c.Azure = append(c.Azure, azureInitialConfig)
+
+	parseStructFlagsAndEnv(&httpInitialConfig)
+	c.HTTP = append(c.HTTP, httpInitialConfig)
+
 	return c
 }
 
@@ -31,3 +31,17 @@ func (s *GitlabConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	*s = GitlabConfig(raw)
 	return nil
 }
+
+func (s *AzureConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawAzureConfig AzureConfig
+	raw := rawAzureConfig{
+		Container:     "tfstate",
+		FileExtension: []string{".tfstate"},
+	}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*s = AzureConfig(raw)
+	return nil
+}
@@ -0,0 +1,142 @@
+package db
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/camptocamp/terraboard/types"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Keys of the tags set automatically on Lineages
+const (
+	autoTagCloud   = "cloud"
+	autoTagRegion  = "region"
+	autoTagAccount = "account"
+)
+
+// parseAutoTagAttributes returns the attribute keys the region and account
+// tags are detected from, by cloud then tag, given as '<tag>:<cloud>:<key>'
+func parseAutoTagAttributes(attributes []string) map[string]map[string][]string {
+	keys := make(map[string]map[string][]string)
+	for _, a := range attributes {
+		parts := strings.SplitN(a, ":", 3)
+		if len(parts) != 3 || parts[1] == "" || parts[2] == "" ||
+			(parts[0] != autoTagRegion && parts[0] != autoTagAccount) {
+			log.Warnf("Invalid auto-tag attribute '%s', expected '<tag>:<cloud>:<key>' with a region or account tag", a)
+			continue
+		}
+		tag, cloud, key := parts[0], parts[1], parts[2]
+		if keys[cloud] == nil {
+			keys[cloud] = make(map[string][]string)
+		}
+		keys[cloud][tag] = append(keys[cloud][tag], key)
+	}
+	return keys
+}
+
+// autoTagValue returns the value of a tag from an attribute value,
+// taken from the matching part of ARNs and without the zone letter
+// of availability zones
+func autoTagValue(tag, key, value string) string {
+	var v string
+	if err := json.Unmarshal([]byte(value), &v); err != nil {
+		return ""
+	}
+	if parts := strings.Split(v, ":"); len(parts) > 4 && parts[0] == "arn" {
+		if tag == autoTagRegion {
+			return parts[3]
+		}
+		return parts[4]
+	}
+	if tag == autoTagRegion && strings.HasSuffix(key, "availability_zone") {
+		return strings.TrimRight(v, "abcdefghijklmnopqrstuvwxyz")
+	}
+	return v
+}
+
+// autoTags returns the tags detected from the managed resources of a State:
+// the most common cloud, from the resource type prefixes, along with the
+// most common region and account, from the given attribute keys
+func autoTags(keys map[string]map[string][]string, st types.State) (tags []types.LineageTag) {
+	counts := map[string]map[string]int{
+		autoTagCloud:   {},
+		autoTagRegion:  {},
+		autoTagAccount: {},
+	}
+	for _, r := range managedResources(st) {
+		cloud := resourceCloud(r.Type)
+		counts[autoTagCloud][cloud]++
+
+		values := make(map[string]string)
+		for _, a := range r.Attributes {
+			values[a.Key] = a.Value
+		}
+		for _, tag := range []string{autoTagRegion, autoTagAccount} {
+			for _, key := range keys[cloud][tag] {
+				if v := autoTagValue(tag, key, values[key]); v != "" {
+					counts[tag][v]++
+					break
+				}
+			}
+		}
+	}
+
+	for _, tag := range []string{autoTagCloud, autoTagRegion, autoTagAccount} {
+		if v := normalizeTag(mostCommon(counts[tag])); v != "" {
+			tags = append(tags, types.LineageTag{Key: tag, Value: v, Auto: true})
+		}
+	}
+	return
+}
+
+// syncAutoTags replaces the automatic tags of the Lineage of a State with
+// the ones detected from it on its ingestion, when it is the most recent
+// State of its Lineage.
+// The tags set by users are kept.
+func (db *Database) syncAutoTags(st types.State) {
+	if db.autoTagKeys == nil || !st.LineageID.Valid {
+		return
+	}
+	lineageID := uint(st.LineageID.Int64)
+
+	var newer int64
+	if err := db.Table("states").
+		Joins("JOIN versions ON versions.id = states.version_id").
+		Where("states.lineage_id = ? AND versions.last_modified > ?", lineageID, st.Version.LastModified).
+		Count(&newer).Error; err != nil {
+		log.Error(err.Error())
+		return
+	}
+	if newer > 0 {
+		return
+	}
+
+	var keys []string
+	for _, t := range st.AutoTags {
+		keys = append(keys, t.Key)
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		stale := tx.Where("lineage_id = ? AND auto = ?", lineageID, true)
+		if len(keys) > 0 {
+			stale = stale.Where("key NOT IN ?", keys)
+		}
+		if err := stale.Delete(&types.LineageTag{}).Error; err != nil {
+			return err
+		}
+		for _, t := range st.AutoTags {
+			tag := types.LineageTag{LineageID: lineageID, Key: t.Key, Auto: true}
+			if err := tx.Where(tag).Assign(types.LineageTag{Value: t.Value}).FirstOrCreate(&tag).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":  st.Path,
+			"error": err,
+		}).Error("Failed to update the automatic tags of the lineage")
+	}
+}
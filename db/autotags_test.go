@@ -0,0 +1,106 @@
+package db
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/camptocamp/terraboard/internal/terraform/states/statefile"
+	"github.com/camptocamp/terraboard/types"
+)
+
+const awsStateUSEast1 = `{
+  "version": 4,
+  "terraform_version": "1.0.2",
+  "serial": 3,
+  "lineage": "network",
+  "outputs": {},
+  "resources": [
+    {
+      "mode": "managed",
+      "type": "aws_instance",
+      "name": "web",
+      "provider": "provider[\"registry.terraform.io/hashicorp/aws\"]",
+      "instances": [
+        {
+          "schema_version": 1,
+          "attributes": {
+            "availability_zone": "us-east-1a",
+            "arn": "arn:aws:ec2:us-east-1:123456789012:instance/i-0a1b2c3d"
+          }
+        }
+      ]
+    },
+    {
+      "mode": "managed",
+      "type": "aws_s3_bucket",
+      "name": "logs",
+      "provider": "provider[\"registry.terraform.io/hashicorp/aws\"]",
+      "instances": [
+        {
+          "schema_version": 0,
+          "attributes": {
+            "arn": "arn:aws:s3:::logs",
+            "region": "us-east-1"
+          }
+        }
+      ]
+    },
+    {
+      "mode": "data",
+      "type": "aws_caller_identity",
+      "name": "current",
+      "provider": "provider[\"registry.terraform.io/hashicorp/aws\"]",
+      "instances": [
+        {
+          "schema_version": 0,
+          "attributes": {
+            "account_id": "999999999999"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+func TestAutoTags(t *testing.T) {
+	sf, err := statefile.Read(strings.NewReader(awsStateUSEast1))
+	if err != nil {
+		t.Fatalf("Failed to read state: %v", err)
+	}
+	st := types.State{Modules: stateModules(sf)}
+	keys := parseAutoTagAttributes([]string{
+		"region:aws:region", "region:aws:availability_zone", "region:aws:arn",
+		"account:aws:account_id", "account:aws:arn", "invalid:aws:arn", "region:aws",
+	})
+
+	expected := []types.LineageTag{
+		{Key: "cloud", Value: "aws", Auto: true},
+		{Key: "region", Value: "us-east-1", Auto: true},
+		{Key: "account", Value: "123456789012", Auto: true},
+	}
+	tags := autoTags(keys, st)
+	if !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("Expected %v, got %v", expected, tags)
+	}
+
+	// Without attribute keys, only the cloud is detected
+	if tags := autoTags(nil, st); !reflect.DeepEqual(tags, expected[:1]) {
+		t.Fatalf("Expected %v, got %v", expected[:1], tags)
+	}
+}
+
+func TestAutoTagValue(t *testing.T) {
+	for _, c := range []struct{ tag, key, value, expected string }{
+		{"region", "availability_zone", `"eu-west-1b"`, "eu-west-1"},
+		{"region", "arn", `"arn:aws:iam::123456789012:role/web"`, ""},
+		{"account", "arn", `"arn:aws:iam::123456789012:role/web"`, "123456789012"},
+		{"region", "location", `"westeurope"`, "westeurope"},
+		{"account", "project", `["my-project"]`, ""},
+		{"region", "region", "", ""},
+	} {
+		if v := autoTagValue(c.tag, c.key, c.value); v != c.expected {
+			t.Fatalf("Expected %q for %+v, got %q", c.expected, c, v)
+		}
+	}
+}
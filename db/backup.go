@@ -0,0 +1,126 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// BackupSchemaVersion is the version of the layout of the tables in backups.
+// It must be increased whenever the tables change, so that backups
+// of another layout are refused on restore.
+const BackupSchemaVersion = 6
+
+// BackupTables lists the tables saved in backups, each after the tables
+// it references, so that they can be restored in order
+var BackupTables = []string{
+	"lineages",
+	"lineage_tags",
+	"versions",
+	"deduplicated_versions",
+	"lock_events",
+	"deleted_lineages",
+	"states",
+	"computed_fields",
+	"modules",
+	"output_values",
+	"resources",
+	"attributes",
+	"plan_state_modules",
+	"plan_state_resources",
+	"plan_state_resource_attributes",
+	"plan_state_values",
+	"plan_state_outputs",
+	"plan_states",
+	"plan_models",
+	"changes",
+	"plan_outputs",
+	"plan_resource_changes",
+	"plan_model_variables",
+	"plans",
+}
+
+// Snapshot runs fn with a Database reading a consistent snapshot
+// of the data, within a read-only transaction
+func (db *Database) Snapshot(fn func(s *Database) error) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		s := *db
+		s.DB = tx
+		return fn(&s)
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+}
+
+// CountRows returns the number of rows of each of the given tables
+func (db *Database) CountRows(tables []string) (counts map[string]int64, err error) {
+	counts = make(map[string]int64)
+	for _, table := range tables {
+		var count int64
+		if err = db.Table(table).Count(&count).Error; err != nil {
+			return
+		}
+		counts[table] = count
+	}
+	return
+}
+
+// DumpTable calls fn with each row of one of the BackupTables,
+// encoded as JSON, in the order of their ids
+func (db *Database) DumpTable(table string, fn func(row json.RawMessage) error) error {
+	rows, err := db.Raw("SELECT row_to_json(t)::text FROM " + db.Statement.Quote(table) + " t ORDER BY t.id").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row string
+		if err := rows.Scan(&row); err != nil {
+			return err
+		}
+		if err := fn(json.RawMessage(row)); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Restore runs fn with a Database writing within a transaction,
+// rolled back if fn fails
+func (db *Database) Restore(fn func(t *Database) error) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		t := *db
+		t.DB = tx
+		return fn(&t)
+	}, &sql.TxOptions{Isolation: sql.LevelSerializable})
+}
+
+// ClearTables deletes all the rows of the given tables
+func (db *Database) ClearTables(tables []string) error {
+	quoted := make([]string, len(tables))
+	for i, table := range tables {
+		quoted[i] = db.Statement.Quote(table)
+	}
+	return db.Exec("TRUNCATE " + strings.Join(quoted, ", ") + " CASCADE").Error
+}
+
+// RestoreRow inserts a row of one of the BackupTables, encoded as JSON
+// as by DumpTable
+func (db *Database) RestoreRow(table string, row json.RawMessage) error {
+	quoted := db.Statement.Quote(table)
+	return db.Exec("INSERT INTO "+quoted+" SELECT * FROM json_populate_record(NULL::"+quoted+", ?::json)", string(row)).Error
+}
+
+// ResetSequences sets the id sequences of the given tables
+// after their restored rows
+func (db *Database) ResetSequences(tables []string) error {
+	for _, table := range tables {
+		quoted := db.Statement.Quote(table)
+		err := db.Exec("SELECT setval(pg_get_serial_sequence(?, 'id'), COALESCE(MAX(id), 0) + 1, false) FROM "+quoted, table).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// CompactionReport stores the number of rows removed by a compaction
+type CompactionReport struct {
+	Modules    int64
+	Resources  int64
+	Attributes int64
+}
+
+// compactionStatements delete the orphaned rows of each table, in order,
+// the Modules of States which no longer exist, then the Resources of these
+// Modules and the attributes of these Resources. Attributes shared with
+// a remaining Resource are kept even when their owner is removed.
+var compactionStatements = []struct {
+	table string
+	sql   string
+}{
+	{"modules", "DELETE FROM modules" +
+		" WHERE NOT EXISTS (SELECT 1 FROM states WHERE states.id = modules.state_id)"},
+	{"resources", "DELETE FROM resources" +
+		" WHERE NOT EXISTS (SELECT 1 FROM modules WHERE modules.id = resources.module_id)"},
+	{"attributes", "DELETE FROM attributes" +
+		" WHERE attributes.resource_id IS NOT NULL" +
+		" AND NOT EXISTS (SELECT 1 FROM resources WHERE resources.id = attributes.resource_id)" +
+		" AND NOT EXISTS (SELECT 1 FROM resources WHERE resources.attributes_from_id = attributes.resource_id)"},
+}
+
+// compact removes the orphaned rows, reporting the rows removed from each table
+func compact(tx *gorm.DB) (report CompactionReport, err error) {
+	removed := map[string]*int64{
+		"modules":    &report.Modules,
+		"resources":  &report.Resources,
+		"attributes": &report.Attributes,
+	}
+	for _, stmt := range compactionStatements {
+		res := tx.Exec(stmt.sql)
+		if res.Error != nil {
+			return report, fmt.Errorf("failed to remove orphaned %s: %w", stmt.table, res.Error)
+		}
+		*removed[stmt.table] = res.RowsAffected
+	}
+	return
+}
+
+// Compact removes the Modules, Resources and attributes no longer
+// referenced by an existing State, then vacuums and analyzes their tables.
+// Orphans are removed within a single repeatable read transaction, so rows
+// committed by a concurrent ingestion are never seen without the State
+// they belong to.
+func (db *Database) Compact() (report CompactionReport, err error) {
+	err = db.Transaction(func(tx *gorm.DB) (err error) {
+		report, err = compact(tx)
+		return err
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return
+	}
+
+	// VACUUM cannot run inside a transaction
+	for _, table := range []string{"attributes", "resources", "modules"} {
+		if err = db.Exec("VACUUM ANALYZE " + table).Error; err != nil {
+			return
+		}
+	}
+	return
+}
+
+// CompactPeriodically compacts the Database every interval
+func (db *Database) CompactPeriodically(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		start := time.Now()
+		report, err := db.Compact()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to compact the database")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"modules":    report.Modules,
+			"resources":  report.Resources,
+			"attributes": report.Attributes,
+			"duration":   time.Since(start),
+		}).Info("Compacted the database")
+	}
+}
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// compactionTestDB returns an in-memory database holding the tables
+// of the rows removed by compactions
+func compactionTestDB(t *testing.T) *gorm.DB {
+	tx, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	for _, stmt := range []string{
+		"CREATE TABLE states (id integer PRIMARY KEY)",
+		"CREATE TABLE modules (id integer PRIMARY KEY, state_id integer)",
+		"CREATE TABLE resources (id integer PRIMARY KEY, module_id integer, attributes_from_id integer)",
+		"CREATE TABLE attributes (id integer PRIMARY KEY, resource_id integer)",
+	} {
+		if err := tx.Exec(stmt).Error; err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+	}
+	return tx
+}
+
+// remainingIDs returns the ids of the rows of a table
+func remainingIDs(t *testing.T, tx *gorm.DB, table string) (ids []uint) {
+	if err := tx.Table(table).Order("id").Pluck("id", &ids).Error; err != nil {
+		t.Fatalf("Failed to list %s: %v", table, err)
+	}
+	return
+}
+
+func TestCompact(t *testing.T) {
+	tx := compactionTestDB(t)
+	// State 2 was deleted, leaving module 20, resources 200 and 201
+	// and their attributes orphaned, as is module 30 without a State.
+	// Resource 101 shares the attributes of the orphaned resource 201.
+	for _, stmt := range []string{
+		"INSERT INTO states (id) VALUES (1)",
+		"INSERT INTO modules (id, state_id) VALUES (10, 1), (20, 2), (30, NULL)",
+		"INSERT INTO resources (id, module_id, attributes_from_id) VALUES (100, 10, NULL), (101, 10, 201), (200, 20, NULL), (201, 20, NULL), (300, 30, NULL)",
+		"INSERT INTO attributes (id, resource_id) VALUES (1000, 100), (2000, 200), (2001, 200), (2010, 201), (3000, 300), (4000, NULL)",
+	} {
+		if err := tx.Exec(stmt).Error; err != nil {
+			t.Fatalf("Failed to insert rows: %v", err)
+		}
+	}
+
+	report, err := compact(tx)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := CompactionReport{Modules: 2, Resources: 3, Attributes: 3}
+	if report != expected {
+		t.Fatalf("Expected %v, got %v", expected, report)
+	}
+
+	for table, ids := range map[string][]uint{
+		"states":     {1},
+		"modules":    {10},
+		"resources":  {100, 101},
+		"attributes": {1000, 2010, 4000},
+	} {
+		if remaining := remainingIDs(t, tx, table); !reflect.DeepEqual(remaining, ids) {
+			t.Fatalf("Expected %v %s, got %v", ids, table, remaining)
+		}
+	}
+
+	// A second compaction has nothing left to remove
+	if report, err := compact(tx); err != nil || report != (CompactionReport{}) {
+		t.Fatalf("Expected nothing removed, got %v, %v", report, err)
+	}
+}
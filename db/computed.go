@@ -0,0 +1,166 @@
+package db
+
+import (
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/camptocamp/terraboard/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// computedFieldFuncs are the built-in fields which can be computed
+// on the ingestion of a State
+var computedFieldFuncs = map[string]func(st types.State) string{
+	"resource_count":   computedResourceCount,
+	"primary_provider": computedPrimaryProvider,
+	"primary_region":   computedPrimaryRegion,
+}
+
+// validComputedFields returns the known fields among the configured ones
+func validComputedFields(names []string) (fields []string) {
+	for _, name := range names {
+		if _, ok := computedFieldFuncs[name]; !ok {
+			log.Warnf("Unknown computed field '%s', ignoring it", name)
+			continue
+		}
+		fields = append(fields, name)
+	}
+	return
+}
+
+// managedResources returns the managed resources of a State
+func managedResources(st types.State) (resources []types.Resource) {
+	for _, m := range st.Modules {
+		for _, r := range m.Resources {
+			if r.Mode != "data" {
+				resources = append(resources, r)
+			}
+		}
+	}
+	return
+}
+
+// mostCommon returns the value with the highest count,
+// the first one alphabetically in case of a tie
+func mostCommon(counts map[string]int) (value string) {
+	var values []string
+	for v := range counts {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	for _, v := range values {
+		if counts[v] > counts[value] {
+			value = v
+		}
+	}
+	return
+}
+
+// computedResourceCount returns the managed resource count of a State
+func computedResourceCount(st types.State) string {
+	return strconv.Itoa(len(managedResources(st)))
+}
+
+// computedPrimaryProvider returns the provider, e.g. "aws",
+// managing most resources of a State
+func computedPrimaryProvider(st types.State) string {
+	counts := make(map[string]int)
+	for _, r := range managedResources(st) {
+		provider := r.Provider[strings.LastIndex(r.Provider, "/")+1:]
+		if provider = strings.TrimPrefix(provider, "provider."); provider != "" {
+			counts[provider]++
+		}
+	}
+	return mostCommon(counts)
+}
+
+// resourceRegion returns the region of a resource, from its region
+// or location attribute, its ARN or its availability zone
+func resourceRegion(r types.Resource) string {
+	values := make(map[string]string)
+	for _, a := range r.Attributes {
+		var v string
+		if err := json.Unmarshal([]byte(a.Value), &v); err == nil && v != "" {
+			values[a.Key] = v
+		}
+	}
+
+	if v, ok := values["region"]; ok {
+		return v
+	}
+	if v, ok := values["location"]; ok {
+		return v
+	}
+	if parts := strings.Split(values["arn"], ":"); len(parts) > 3 && parts[3] != "" {
+		return parts[3]
+	}
+	if v, ok := values["availability_zone"]; ok {
+		return strings.TrimRight(v, "abcdefghijklmnopqrstuvwxyz")
+	}
+	return ""
+}
+
+// computedPrimaryRegion returns the region holding most resources of a State
+func computedPrimaryRegion(st types.State) string {
+	counts := make(map[string]int)
+	for _, r := range managedResources(st) {
+		if region := resourceRegion(r); region != "" {
+			counts[region]++
+		}
+	}
+	return mostCommon(counts)
+}
+
+// computeFields computes the given fields of a State
+func computeFields(names []string, st types.State) (fields []types.ComputedField) {
+	for _, name := range names {
+		fields = append(fields, types.ComputedField{
+			Name:  name,
+			Value: computedFieldFuncs[name](st),
+		})
+	}
+	return
+}
+
+// computedFieldConditions returns the conditions on the State t of the
+// listing filters set in a query, one per computed field
+func computedFieldConditions(names []string, query url.Values) (conditions []string, params []interface{}) {
+	for _, name := range names {
+		if v := query.Get(name); v != "" {
+			conditions = append(conditions, "EXISTS (SELECT 1 FROM computed_fields"+
+				" WHERE computed_fields.state_id = t.id AND computed_fields.name = ? AND computed_fields.value = ?)")
+			params = append(params, name, v)
+		}
+	}
+	return
+}
+
+// fillComputedFields sets the computed fields of listed States
+func (db *Database) fillComputedFields(states []types.StateStat) {
+	if len(db.computedFields) == 0 || len(states) == 0 {
+		return
+	}
+	var ids []uint
+	for _, s := range states {
+		ids = append(ids, s.StateID)
+	}
+
+	var fields []types.ComputedField
+	if err := db.Where("state_id IN ?", ids).Find(&fields).Error; err != nil {
+		log.Error(err.Error())
+		return
+	}
+	byState := make(map[int64]map[string]string)
+	for _, f := range fields {
+		if byState[f.StateID.Int64] == nil {
+			byState[f.StateID.Int64] = make(map[string]string)
+		}
+		byState[f.StateID.Int64][f.Name] = f.Value
+	}
+	for i, s := range states {
+		states[i].ComputedFields = byState[int64(s.StateID)]
+	}
+}
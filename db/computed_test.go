@@ -0,0 +1,87 @@
+package db
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/camptocamp/terraboard/types"
+)
+
+// computedFixture is a State with resources of two providers,
+// most of them in eu-west-1
+var computedFixture = types.State{
+	Modules: []types.Module{{
+		Path: "root",
+		Resources: []types.Resource{
+			{Mode: "managed", Type: "aws_instance", Name: "web", Provider: "registry.terraform.io/hashicorp/aws",
+				Attributes: []types.Attribute{{Key: "availability_zone", Value: `"eu-west-1a"`}}},
+			{Mode: "managed", Type: "aws_iam_role", Name: "web", Provider: "registry.terraform.io/hashicorp/aws",
+				Attributes: []types.Attribute{{Key: "arn", Value: `"arn:aws:iam::123456789012:role/web"`}}},
+			{Mode: "managed", Type: "aws_s3_bucket", Name: "logs", Provider: "registry.terraform.io/hashicorp/aws",
+				Attributes: []types.Attribute{{Key: "arn", Value: `"arn:aws:s3:eu-west-1:123456789012:logs"`}}},
+			{Mode: "managed", Type: "google_storage_bucket", Name: "backup", Provider: "registry.terraform.io/hashicorp/google",
+				Attributes: []types.Attribute{{Key: "location", Value: `"us-central1"`}}},
+			{Mode: "data", Type: "google_project", Name: "current", Provider: "registry.terraform.io/hashicorp/google",
+				Attributes: []types.Attribute{{Key: "region", Value: `"us-central1"`}}},
+			{Mode: "data", Type: "google_client_config", Name: "current", Provider: "registry.terraform.io/hashicorp/google"},
+		},
+	}},
+}
+
+func TestComputeFields(t *testing.T) {
+	names := validComputedFields([]string{"resource_count", "unknown", "primary_provider", "primary_region"})
+
+	fields := computeFields(names, computedFixture)
+	expected := []types.ComputedField{
+		{Name: "resource_count", Value: "4"},
+		{Name: "primary_provider", Value: "aws"},
+		{Name: "primary_region", Value: "eu-west-1"},
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("Expected %v, got %v", expected, fields)
+	}
+}
+
+func TestComputeFields_EmptyState(t *testing.T) {
+	fields := computeFields([]string{"resource_count", "primary_region"}, types.State{})
+	expected := []types.ComputedField{
+		{Name: "resource_count", Value: "0"},
+		{Name: "primary_region", Value: ""},
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("Expected %v, got %v", expected, fields)
+	}
+}
+
+func TestComputedFieldConditions(t *testing.T) {
+	names := []string{"resource_count", "primary_provider", "primary_region"}
+	query := url.Values{"primary_region": {"eu-west-1"}, "primary_provider": {"aws"}, "page": {"2"}}
+
+	conditions, params := computedFieldConditions(names, query)
+	condition := "EXISTS (SELECT 1 FROM computed_fields" +
+		" WHERE computed_fields.state_id = t.id AND computed_fields.name = ? AND computed_fields.value = ?)"
+	if !reflect.DeepEqual(conditions, []string{condition, condition}) {
+		t.Fatalf("Expected %v, got %v", []string{condition, condition}, conditions)
+	}
+	expectedParams := []interface{}{"primary_provider", "aws", "primary_region", "eu-west-1"}
+	if !reflect.DeepEqual(params, expectedParams) {
+		t.Fatalf("Expected %v, got %v", expectedParams, params)
+	}
+
+	// The fields of the fixture match the filters
+	values := make(map[string]string)
+	for _, f := range computeFields(names, computedFixture) {
+		values[f.Name] = f.Value
+	}
+	for i := 0; i < len(params); i += 2 {
+		if name, value := params[i].(string), params[i+1].(string); values[name] != value {
+			t.Fatalf("Expected %s to be %s, got %s", name, value, values[name])
+		}
+	}
+
+	// Fields which aren't computed aren't filters
+	if conditions, _ := computedFieldConditions(nil, query); len(conditions) != 0 {
+		t.Fatalf("Expected no condition, got %v", conditions)
+	}
+}
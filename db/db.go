@@ -1,13 +1,26 @@
 package db
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net"
 	"net/url"
+	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/camptocamp/terraboard/config"
 	"github.com/camptocamp/terraboard/internal/terraform/addrs"
@@ -15,9 +28,11 @@ import (
 	"github.com/camptocamp/terraboard/internal/terraform/states/statefile"
 	"github.com/camptocamp/terraboard/state"
 	"github.com/camptocamp/terraboard/types"
+	"github.com/hashicorp/go-version"
 	log "github.com/sirupsen/logrus"
 
 	ctyJson "github.com/zclconf/go-cty/cty/json"
+	"gorm.io/datatypes"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -26,14 +41,46 @@ import (
 // Database is a wrapping structure to *gorm.DB
 type Database struct {
 	*gorm.DB
-	lock sync.Mutex
+	// lock serializes the creation of lineages and versions,
+	// it is shared by the Databases returned by WithContext
+	lock              *sync.Mutex
+	duplicateLineages string
+	preferredProvider string
+	incremental       bool
+	dedupVersions     bool
+	hiddenTFVersions  []string
+	minTFVersion      string
+	strictPlanFormat  bool
+	emptyStates       string
+	lineageNameRegex  *regexp.Regexp
+	lineageNameTmpl   string
+	computedFields    []string
+	autoTagKeys       map[string]map[string][]string
 }
 
 var pageSize = 20
 
-// Init setups up the Database and a pointer to it
-func Init(config config.DBConfig, debug bool) *Database {
-	var err error
+// Handling of States without managed resources in listings
+const (
+	// EmptyStatesInclude lists empty States like any other
+	EmptyStatesInclude = "include"
+	// EmptyStatesHide excludes empty States from listings by default
+	EmptyStatesHide = "hide"
+	// EmptyStatesTag flags empty States in listings
+	EmptyStatesTag = "tag"
+)
+
+// DialectPostgres is the SQL dialect of PostgreSQL, the only database
+// supported as queries rely on its features (DISTINCT ON, full-text
+// search, regular expression matching, JSON and array functions)
+const DialectPostgres = "postgres"
+
+// dialector returns the GORM dialector of the configured database,
+// rejecting unsupported dialects
+func dialector(config config.DBConfig) (gorm.Dialector, error) {
+	if config.Dialect != DialectPostgres {
+		return nil, fmt.Errorf("unsupported database dialect '%s', only '%s' is supported", config.Dialect, DialectPostgres)
+	}
 	connString := fmt.Sprintf(
 		"host=%s port=%d user=%s dbname=%s sslmode=%s password=%s",
 		config.Host,
@@ -43,18 +90,35 @@ func Init(config config.DBConfig, debug bool) *Database {
 		config.SSLMode,
 		config.Password,
 	)
-	db, err := gorm.Open(postgres.Open(connString), &gorm.Config{
+	return postgres.Open(connString), nil
+}
+
+// Init setups up the Database and a pointer to it
+func Init(config config.DBConfig, debug bool) *Database {
+	dialect, err := dialector(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := gorm.Open(dialect, &gorm.Config{
 		Logger: &LogrusGormLogger,
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err = registerMetricsCallbacks(db); err != nil {
+		log.Fatalf("Failed to register metrics callbacks: %v\n", err)
+	}
 
 	log.Infof("Automigrate")
 	err = db.AutoMigrate(
 		&types.Lineage{},
+		&types.LineageTag{},
+		&types.LockEvent{},
+		&types.DeduplicatedVersion{},
+		&types.DeletedLineage{},
 		&types.Version{},
 		&types.State{},
+		&types.ComputedField{},
 		&types.Module{},
 		&types.Resource{},
 		&types.Attribute{},
@@ -80,14 +144,80 @@ func Init(config config.DBConfig, debug bool) *Database {
 		db.Config.Logger.LogMode(logger.Info)
 	}
 
-	d := &Database{DB: db}
+	d := &Database{
+		DB:                db,
+		lock:              &sync.Mutex{},
+		duplicateLineages: config.DuplicateLineages,
+		preferredProvider: config.PreferredProvider,
+		incremental:       config.Incremental,
+		dedupVersions:     config.DedupVersions,
+		hiddenTFVersions:  config.HiddenTFVersions,
+		minTFVersion:      config.MinTFVersion,
+		strictPlanFormat:  config.StrictPlanFormat,
+		emptyStates:       config.EmptyStates,
+		lineageNameTmpl:   config.LineageNameTemplate,
+		computedFields:    validComputedFields(config.ComputedFields),
+	}
+	if config.AutoTags {
+		d.autoTagKeys = parseAutoTagAttributes(config.AutoTagAttributes)
+	}
+	if config.LineageNameRegex != "" {
+		if d.lineageNameRegex, err = regexp.Compile(config.LineageNameRegex); err != nil {
+			log.Fatalf("Invalid lineage name regular expression: %v\n", err)
+		}
+	}
+	switch d.emptyStates {
+	case EmptyStatesInclude, EmptyStatesHide, EmptyStatesTag:
+	default:
+		log.Warnf("Unknown empty states handling '%s', using '%s'", d.emptyStates, EmptyStatesInclude)
+		d.emptyStates = EmptyStatesInclude
+	}
 	if err = d.MigrateLineage(); err != nil {
 		log.Fatalf("Lineage migration failed: %v\n", err)
 	}
+	if err = d.MigrateLineageProvider(); err != nil {
+		log.Fatalf("Lineage provider migration failed: %v\n", err)
+	}
+	if err = d.MigrateFullTextIndex(); err != nil {
+		log.Fatalf("Full-text index migration failed: %v\n", err)
+	}
+	if err = d.MigrateLineageTagIndex(); err != nil {
+		log.Fatalf("Lineage tag index migration failed: %v\n", err)
+	}
 
 	return d
 }
 
+// WithContext returns a Database running its queries with ctx,
+// so that they are logged along with the request context
+func (db *Database) WithContext(ctx context.Context) *Database {
+	return &Database{
+		DB:                db.DB.WithContext(ctx),
+		lock:              db.lock,
+		duplicateLineages: db.duplicateLineages,
+		preferredProvider: db.preferredProvider,
+		incremental:       db.incremental,
+		dedupVersions:     db.dedupVersions,
+		hiddenTFVersions:  db.hiddenTFVersions,
+		minTFVersion:      db.minTFVersion,
+		strictPlanFormat:  db.strictPlanFormat,
+		emptyStates:       db.emptyStates,
+		lineageNameRegex:  db.lineageNameRegex,
+		lineageNameTmpl:   db.lineageNameTmpl,
+		computedFields:    db.computedFields,
+		autoTagKeys:       db.autoTagKeys,
+	}
+}
+
+// Ping checks the connection to the database
+func (db *Database) Ping() error {
+	sqlDB, err := db.DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(db.Statement.Context)
+}
+
 // MigrateLineage is a migration function to update db and its data to the
 // new lineage db scheme. It will update State table data, delete "lineage" column
 // and add corresponding Lineage entries
@@ -113,32 +243,161 @@ func (db *Database) MigrateLineage() error {
 	return nil
 }
 
+// MigrateLineageProvider is a migration function dropping the former unique
+// constraint on lineages value, now unique along with the lineage provider
+func (db *Database) MigrateLineageProvider() error {
+	if db.Migrator().HasConstraint(&types.Lineage{}, "lineages_value_key") {
+		if err := db.Migrator().DropConstraint(&types.Lineage{}, "lineages_value_key"); err != nil {
+			return fmt.Errorf("Failed to drop lineages value unique constraint during migration: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// MigrateLineageTagIndex is a migration function dropping the former unique
+// index on lineage tags keys, now unique along with the tag namespace
+func (db *Database) MigrateLineageTagIndex() error {
+	if db.Migrator().HasIndex(&types.LineageTag{}, "idx_lineage_tag") {
+		if err := db.Migrator().DropIndex(&types.LineageTag{}, "idx_lineage_tag"); err != nil {
+			return fmt.Errorf("Failed to drop lineage tags unique index during migration: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Resolutions of a lineage found on several providers
+const (
+	// DuplicateLineagesKeep keeps one lineage per provider
+	DuplicateLineagesKeep = "keep"
+	// DuplicateLineagesMerge merges the versions of all providers in a single lineage
+	DuplicateLineagesMerge = "merge"
+	// DuplicateLineagesPrefer ignores the other providers' states
+	// when the lineage is known from the preferred provider
+	DuplicateLineagesPrefer = "prefer"
+)
+
+// errSkippedLineage is returned when a State is ignored because its lineage
+// is already provided by the preferred provider
+var errSkippedLineage = errors.New("lineage is provided by the preferred provider")
+
+// errDeletedLineage is returned when a State is ignored because its lineage
+// was deleted by a user
+var errDeletedLineage = errors.New("lineage was deleted")
+
+// resolveLineageProvider returns the provider of the lineage to attach a State to,
+// given the provider it was ingested from and the providers already known for
+// its lineage. It returns errSkippedLineage if the State must be ignored.
+func resolveLineageProvider(mode, preferred, incoming string, existing []string) (string, error) {
+	switch mode {
+	case DuplicateLineagesMerge:
+		if len(existing) > 0 {
+			return existing[0], nil
+		}
+	case DuplicateLineagesPrefer:
+		if incoming != preferred && containsString(existing, preferred) {
+			return "", errSkippedLineage
+		}
+	}
+	return incoming, nil
+}
+
+// lineageDisplayName computes the display name of a lineage by expanding the template
+// with the groups of the regular expression matched against the State path.
+// It falls back to the lineage value if the path doesn't match.
+func lineageDisplayName(re *regexp.Regexp, template, path, lineage string) string {
+	if re == nil {
+		return lineage
+	}
+	match := re.FindStringSubmatchIndex(path)
+	if match == nil {
+		return lineage
+	}
+	name := string(re.ExpandString(nil, template, path, match))
+	if name == "" {
+		return lineage
+	}
+	return name
+}
+
 type attributeValues map[string]interface{}
 
-func (db *Database) stateS3toDB(sf *statefile.File, path string, versionID string) (st types.State, err error) {
+func (db *Database) stateS3toDB(sf *statefile.File, path, versionID, provider string) (st types.State, err error) {
 	var version types.Version
 	db.First(&version, types.Version{VersionID: versionID})
 
+	var deleted int64
+	db.Model(&types.DeletedLineage{}).Where("value = ?", sf.Lineage).Count(&deleted)
+	if deleted > 0 {
+		return types.State{}, errDeletedLineage
+	}
+
 	// Check if the associated lineage is already present in lineages table
 	// If so, it recovers its ID otherwise it inserts it at the same time as the state
 	var lineage types.Lineage
 	db.lock.Lock()
-	err = db.FirstOrCreate(&lineage, types.Lineage{Value: sf.Lineage}).Error
+	// Lineages inserted before providers were recorded are claimed by the first provider
+	db.Model(&types.Lineage{}).
+		Where("value = ? AND provider = ''", sf.Lineage).
+		Update("provider", provider)
+
+	var providers []string
+	db.Model(&types.Lineage{}).Where("value = ?", sf.Lineage).Pluck("provider", &providers)
+	lineageProvider, err := resolveLineageProvider(db.duplicateLineages, db.preferredProvider, provider, providers)
+	if err != nil {
+		db.lock.Unlock()
+		return types.State{}, err
+	}
+
+	err = db.FirstOrCreate(&lineage, types.Lineage{Value: sf.Lineage, Provider: lineageProvider}).Error
+	db.lock.Unlock()
 	if err != nil || lineage.ID == 0 {
 		log.WithField("error", err).
 			Error("Unknown error in stateS3toDB during lineage finding", err)
 		return types.State{}, err
 	}
-	db.lock.Unlock()
+
+	if name := lineageDisplayName(db.lineageNameRegex, db.lineageNameTmpl, path, sf.Lineage); name != lineage.DisplayName {
+		db.Model(&lineage).Update("display_name", name)
+	}
+
+	fingerprint, fpErr := stateFingerprint(sf)
+	if fpErr != nil {
+		log.WithFields(log.Fields{
+			"path":       path,
+			"version_id": versionID,
+			"error":      fpErr,
+		}).Warn("Failed to compute state fingerprint")
+	}
 
 	st = types.State{
-		Path:      path,
-		Version:   version,
-		TFVersion: sf.TerraformVersion.String(),
-		Serial:    int64(sf.Serial),
-		LineageID: sql.NullInt64{Int64: int64(lineage.ID), Valid: true},
+		Path:        path,
+		Version:     version,
+		TFVersion:   sf.TerraformVersion.String(),
+		Serial:      int64(sf.Serial),
+		LineageID:   sql.NullInt64{Int64: int64(lineage.ID), Valid: true},
+		Provider:    provider,
+		Fingerprint: fingerprint,
+		Modules:     stateModules(sf),
+	}
+
+	// Fields and tags are computed before attributes are shared with the previous version
+	st.ComputedFields = computeFields(db.computedFields, st)
+	if db.autoTagKeys != nil {
+		st.AutoTags = autoTags(db.autoTagKeys, st)
 	}
 
+	if db.incremental {
+		prev := db.previousState(lineage.ID, path)
+		shareUnchangedAttributes(prev, &st)
+	}
+	return
+}
+
+// stateModules converts the modules of a State file,
+// with their Resources and output values
+func stateModules(sf *statefile.File) (modules []types.Module) {
 	for _, m := range sf.State.Modules {
 		mod := types.Module{
 			Path: m.Addr.String(),
@@ -146,10 +405,13 @@ func (db *Database) stateS3toDB(sf *statefile.File, path string, versionID strin
 		for _, r := range m.Resources {
 			for index, i := range r.Instances {
 				res := types.Resource{
-					Type:       r.Addr.Resource.Type,
-					Name:       r.Addr.Resource.Name,
-					Index:      getResourceIndex(index),
-					Attributes: marshalAttributeValues(i.Current),
+					Type:         r.Addr.Resource.Type,
+					Name:         r.Addr.Resource.Name,
+					Index:        getResourceIndex(index),
+					Mode:         resourceMode(r.Addr.Resource.Mode),
+					Provider:     r.ProviderConfig.Provider.String(),
+					Attributes:   marshalAttributeValues(i.Current),
+					Dependencies: resourceDependencies(i.Current),
 				}
 				mod.Resources = append(mod.Resources, res)
 			}
@@ -169,11 +431,135 @@ func (db *Database) stateS3toDB(sf *statefile.File, path string, versionID strin
 			mod.OutputValues = append(mod.OutputValues, out)
 		}
 
-		st.Modules = append(st.Modules, mod)
+		modules = append(modules, mod)
+	}
+	return
+}
+
+// resourceKey returns a key identifying a Resource of a Module across versions
+func resourceKey(m types.Module, r types.Resource) string {
+	return fmt.Sprintf("%s.%s.%s.%s[%s]", m.Path, r.Mode, r.Type, r.Name, r.Index)
+}
+
+// sameAttributes returns whether two attribute sets hold the same key/value pairs
+func sameAttributes(a1, a2 []types.Attribute) bool {
+	if len(a1) != len(a2) {
+		return false
+	}
+	values := make(map[string]string, len(a1))
+	for _, a := range a1 {
+		values[a.Key] = a.Value
+	}
+	for _, a := range a2 {
+		if v, ok := values[a.Key]; !ok || v != a.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// shareUnchangedAttributes makes the resources of st whose attributes didn't change
+// since prev reference the attributes rows of prev instead of duplicating them
+func shareUnchangedAttributes(prev types.State, st *types.State) {
+	owners := make(map[string]types.Resource)
+	for _, m := range prev.Modules {
+		for _, r := range m.Resources {
+			owners[resourceKey(m, r)] = r
+		}
+	}
+
+	for i, m := range st.Modules {
+		for j, r := range m.Resources {
+			owner, ok := owners[resourceKey(m, r)]
+			if !ok || !sameAttributes(owner.Attributes, r.Attributes) {
+				continue
+			}
+			ownerID := sql.NullInt64{Int64: int64(owner.ID), Valid: true}
+			if owner.AttributesFromID.Valid {
+				ownerID = owner.AttributesFromID
+			}
+			st.Modules[i].Resources[j].AttributesFromID = ownerID
+			st.Modules[i].Resources[j].Attributes = nil
+		}
 	}
+}
+
+// previousState retrieves the most recent State of a lineage for a given path,
+// with its shared attributes resolved
+func (db *Database) previousState(lineageID uint, path string) (state types.State) {
+	db.Preload("Modules").Preload("Modules.Resources").Preload("Modules.Resources.Attributes").
+		Order("serial desc").
+		Limit(1).
+		Find(&state, "lineage_id = ? AND path = ?", lineageID, path)
+	db.resolveSharedAttributes(&state)
 	return
 }
 
+// resolveSharedAttributes loads the attributes of the resources
+// sharing them with a previous version
+func (db *Database) resolveSharedAttributes(st *types.State) {
+	var ownerIDs []int64
+	for _, m := range st.Modules {
+		for _, r := range m.Resources {
+			if r.AttributesFromID.Valid {
+				ownerIDs = append(ownerIDs, r.AttributesFromID.Int64)
+			}
+		}
+	}
+	if len(ownerIDs) == 0 {
+		return
+	}
+
+	var attributes []types.Attribute
+	db.Where("resource_id IN ?", ownerIDs).Find(&attributes)
+	fillSharedAttributes(st, attributes)
+}
+
+// fillSharedAttributes sets the attributes of the resources sharing them,
+// given the attributes rows of their owners
+func fillSharedAttributes(st *types.State, attributes []types.Attribute) {
+	byOwner := make(map[int64][]types.Attribute)
+	for _, a := range attributes {
+		byOwner[a.ResourceID.Int64] = append(byOwner[a.ResourceID.Int64], a)
+	}
+
+	for i, m := range st.Modules {
+		for j, r := range m.Resources {
+			if r.AttributesFromID.Valid {
+				attrs := append([]types.Attribute{}, byOwner[r.AttributesFromID.Int64]...)
+				sort.Slice(attrs, func(a, b int) bool { return attrs[a].Key < attrs[b].Key })
+				st.Modules[i].Resources[j].Attributes = attrs
+			}
+		}
+	}
+}
+
+// stateFingerprint returns a SHA-256 hash of the normalized State content.
+// Lineage and serial are left out, and keys are sorted, so that
+// logically-identical States share the same fingerprint
+func stateFingerprint(sf *statefile.File) (string, error) {
+	var buf bytes.Buffer
+	if err := statefile.Write(sf, &buf); err != nil {
+		return "", err
+	}
+
+	var content map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &content); err != nil {
+		return "", err
+	}
+	delete(content, "lineage")
+	delete(content, "serial")
+
+	// encoding/json marshals map keys in sorted order
+	normalized, err := json.Marshal(content)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(normalized)
+	return hex.EncodeToString(sum[:]), nil
+}
+
 // getResourceIndex transforms an addrs.InstanceKey instance into a string representation
 func getResourceIndex(index addrs.InstanceKey) string {
 	switch index.(type) {
@@ -183,6 +569,27 @@ func getResourceIndex(index addrs.InstanceKey) string {
 	return ""
 }
 
+// resourceMode returns the mode of a resource, either "managed" or "data"
+func resourceMode(mode addrs.ResourceMode) string {
+	if mode == addrs.DataResourceMode {
+		return "data"
+	}
+	return "managed"
+}
+
+// resourceDependencies returns the addresses of the Resources
+// a resource instance depends on, one per line
+func resourceDependencies(src *states.ResourceInstanceObjectSrc) string {
+	if src == nil {
+		return ""
+	}
+	deps := make([]string, len(src.Dependencies))
+	for i, dep := range src.Dependencies {
+		deps[i] = dep.String()
+	}
+	return strings.Join(deps, "\n")
+}
+
 func marshalAttributeValues(src *states.ResourceInstanceObjectSrc) (attrs []types.Attribute) {
 	vals := make(attributeValues)
 	if src == nil {
@@ -210,14 +617,65 @@ func marshalAttributeValues(src *states.ResourceInstanceObjectSrc) (attrs []type
 }
 
 // InsertState inserts a Terraform State in the Database
-func (db *Database) InsertState(path string, versionID string, sf *statefile.File) error {
-	st, err := db.stateS3toDB(sf, path, versionID)
+// The provider is the name of the state provider the State was ingested from
+func (db *Database) InsertState(path, versionID, provider string, sf *statefile.File) error {
+	st, err := db.stateS3toDB(sf, path, versionID, provider)
+	if errors.Is(err, errSkippedLineage) {
+		log.WithFields(log.Fields{
+			"path":       path,
+			"version_id": versionID,
+			"provider":   provider,
+		}).Debug("Lineage is provided by the preferred provider, skipping")
+		return nil
+	}
+	if errors.Is(err, errDeletedLineage) {
+		log.WithFields(log.Fields{
+			"path":       path,
+			"version_id": versionID,
+			"lineage":    sf.Lineage,
+		}).Debug("Lineage was deleted, skipping")
+		return nil
+	}
+	if err == nil && db.dedupVersions && st.Fingerprint != "" && st.Version.ID != 0 {
+		var history []types.VersionNode
+		db.Table("states").
+			Select("versions.version_id, versions.last_modified, states.serial, states.fingerprint").
+			Joins("JOIN versions ON versions.id = states.version_id").
+			Where("states.path = ? AND states.lineage_id = ?", st.Path, st.LineageID).
+			Order("versions.last_modified ASC").
+			Scan(&history)
+		if isDuplicateVersion(history, st.Version.LastModified, st.Fingerprint) {
+			log.WithFields(log.Fields{
+				"path":       path,
+				"version_id": versionID,
+			}).Debug("State is identical to the previous version, skipping")
+			return db.Create(&types.DeduplicatedVersion{
+				VersionID:   sql.NullInt64{Int64: int64(st.Version.ID), Valid: true},
+				Path:        path,
+				Fingerprint: st.Fingerprint,
+			}).Error
+		}
+	}
 	if err == nil {
+		st.PlanID = db.correlatedPlanID(sf.Lineage, st)
 		db.Create(&st)
+		db.syncAutoTags(st)
+		db.notifyInvalidation(sf.Lineage)
 	}
 	return nil
 }
 
+// isDuplicateVersion returns whether a version shares the fingerprint of
+// the version immediately preceding it in a chronologically ordered history
+func isDuplicateVersion(history []types.VersionNode, lastModified time.Time, fingerprint string) bool {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].LastModified.Before(lastModified) {
+			return history[i].Fingerprint == fingerprint
+		}
+	}
+	return false
+}
+
 // UpdateState update a Terraform State in the Database with Lineage foreign constraint
 // It will also insert Lineage entry in the db if needed.
 // This method is only use during the Lineage migration since States are immutable
@@ -269,8 +727,15 @@ func (db *Database) UpdateState(st types.State) error {
 // InsertVersion inserts an AWS S3 Version in the Database
 func (db *Database) InsertVersion(version *state.Version) error {
 	var v types.Version
+	var metadata datatypes.JSON
+	if len(version.Metadata) > 0 {
+		var err error
+		if metadata, err = json.Marshal(version.Metadata); err != nil {
+			return err
+		}
+	}
 	db.lock.Lock()
-	db.FirstOrCreate(&v, types.Version{
+	db.Attrs(types.Version{ProviderMetadata: metadata}).FirstOrCreate(&v, types.Version{
 		VersionID:    version.ID,
 		LastModified: version.LastModified,
 	})
@@ -283,8 +748,134 @@ func (db *Database) GetState(lineage, versionID string) (state types.State) {
 	db.Joins("JOIN lineages on states.lineage_id=lineages.id").
 		Joins("JOIN versions on states.version_id=versions.id").
 		Preload("Version").Preload("Modules").Preload("Modules.Resources").Preload("Modules.Resources.Attributes").
-		Preload("Modules.OutputValues").
+		Preload("Modules.OutputValues").Preload("ComputedFields").
 		Find(&state, "lineages.value = ? AND versions.version_id = ?", lineage, versionID)
+	db.resolveSharedAttributes(&state)
+	return
+}
+
+// ErrLineageNotFound is returned when a Lineage is unknown
+var ErrLineageNotFound = errors.New("lineage not found")
+
+// ErrPlanNotFound is returned when a Plan is unknown
+var ErrPlanNotFound = errors.New("plan not found")
+
+// ErrNoReference is returned when no reference version is set on a Lineage
+var ErrNoReference = errors.New("no reference version set on lineage")
+
+// ErrUnknownVersion is returned when a version is unknown for a Lineage
+var ErrUnknownVersion = errors.New("unknown version for lineage")
+
+// SetReferenceVersion pins a version of a Lineage as its known-good reference
+func (db *Database) SetReferenceVersion(lineage, versionID string) error {
+	var count int64
+	err := db.Table("states").
+		Joins("JOIN lineages ON lineages.id = states.lineage_id").
+		Joins("JOIN versions ON versions.id = states.version_id").
+		Where("lineages.value = ? AND versions.version_id = ?", lineage, versionID).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrUnknownVersion
+	}
+
+	return db.Model(&types.Lineage{}).
+		Where("value = ?", lineage).
+		Update("reference_version", versionID).Error
+}
+
+// GetReferenceVersion returns the reference version pinned on a Lineage
+func (db *Database) GetReferenceVersion(lineage string) (string, error) {
+	var versions []string
+	err := db.Model(&types.Lineage{}).
+		Where("value = ? AND reference_version <> ''", lineage).
+		Pluck("reference_version", &versions).Error
+	if err != nil {
+		return "", err
+	}
+	if len(versions) == 0 {
+		return "", ErrNoReference
+	}
+	return versions[0], nil
+}
+
+// addressedResource is a Resource of a State with its Terraform address
+type addressedResource struct {
+	address, modulePath, resourceType string
+}
+
+// filterAddresses returns the addresses of the resources, optionally
+// restricted to a Resource type and a module (including its child modules)
+func filterAddresses(resources []addressedResource, resourceType, module string) []string {
+	addresses := []string{}
+	for _, r := range resources {
+		if resourceType != "" && r.resourceType != resourceType {
+			continue
+		}
+		if module != "" && r.modulePath != module && !strings.HasPrefix(r.modulePath, module+".") {
+			continue
+		}
+		addresses = append(addresses, r.address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// GetResourceAddresses returns the addresses of the resources of a State
+// version, optionally restricted to a Resource type and a module
+func (db *Database) GetResourceAddresses(lineage, versionID, resourceType, module string) ([]string, error) {
+	var stateIDs []uint
+	err := db.Table("states").
+		Joins("JOIN lineages ON lineages.id = states.lineage_id").
+		Joins("JOIN versions ON versions.id = states.version_id").
+		Where("lineages.value = ? AND versions.version_id = ?", lineage, versionID).
+		Pluck("states.id", &stateIDs).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(stateIDs) == 0 {
+		return nil, ErrUnknownVersion
+	}
+
+	rows, err := db.Table("resources").
+		Select("modules.path, COALESCE(resources.mode, ''), resources.type, resources.name, resources.index").
+		Joins("JOIN modules ON modules.id = resources.module_id").
+		Where("modules.state_id IN ?", stateIDs).
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var resources []addressedResource
+	for rows.Next() {
+		var modulePath, mode, resType, name, index string
+		if err := rows.Scan(&modulePath, &mode, &resType, &name, &index); err != nil {
+			return nil, err
+		}
+		resources = append(resources, addressedResource{
+			address:      resourceAddress(modulePath, mode, resType, name, index),
+			modulePath:   modulePath,
+			resourceType: resType,
+		})
+	}
+	return filterAddresses(resources, resourceType, module), nil
+}
+
+// GetStateFingerprint retrieves the fingerprint of a State from the database
+// by its lineage and versionID
+func (db *Database) GetStateFingerprint(lineage, versionID string) (fingerprint string, err error) {
+	sqlQuery := "SELECT states.fingerprint FROM states" +
+		" JOIN lineages ON lineages.id = states.lineage_id" +
+		" JOIN versions ON versions.id = states.version_id" +
+		" WHERE lineages.value = ? AND versions.version_id = ?"
+
+	row := db.Raw(sqlQuery, lineage, versionID).Row()
+	if err = row.Scan(&fingerprint); errors.Is(err, sql.ErrNoRows) {
+		err = ErrUnknownVersion
+	}
 	return
 }
 
@@ -302,6 +893,171 @@ func (db *Database) GetLineageActivity(lineage string) (states []types.StateStat
 	return
 }
 
+// sortVersionsNewestFirst sorts the versions of a Lineage from the most recent
+// one, the highest serial first among versions modified at the same time
+func sortVersionsNewestFirst(versions []types.LineageVersion) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		if !versions[i].LastModified.Equal(versions[j].LastModified) {
+			return versions[i].LastModified.After(versions[j].LastModified)
+		}
+		return versions[i].Serial > versions[j].Serial
+	})
+}
+
+// pageBounds returns the bounds of a page of limit items among total ones,
+// all of them for a negative limit
+func pageBounds(page, limit, total int) (start, end int) {
+	if limit < 0 {
+		return 0, total
+	}
+	start = (page - 1) * limit
+	if start > total {
+		start = total
+	}
+	end = start + limit
+	if end > total {
+		end = total
+	}
+	return
+}
+
+// ListStateVersions returns the stored versions of a Lineage, the most recent
+// first, with their serial and Terraform version. All versions are returned
+// without limit nor page, a page holding pageSize versions by default.
+func (db *Database) ListStateVersions(lineage, limitStr, pageStr string) (versions []types.LineageVersion, page int, total int) {
+	limit := -1
+	if limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit < 0 {
+			log.Warnf("ListStateVersions limit ignored: %v", limitStr)
+			limit = -1
+		}
+	}
+
+	page = 1
+	if pageStr != "" {
+		var err error
+		if page, err = strconv.Atoi(pageStr); err != nil || page < 1 {
+			log.Warnf("ListStateVersions page ignored: %v", pageStr)
+			page = 1
+		}
+		if limit < 0 {
+			limit = pageSize
+		}
+	}
+
+	sql := "SELECT versions.version_id, states.serial, states.tf_version, versions.last_modified" +
+		" FROM states" +
+		" JOIN lineages ON lineages.id = states.lineage_id" +
+		" JOIN versions ON versions.id = states.version_id" +
+		" WHERE lineages.value = ?"
+
+	var all []types.LineageVersion
+	if err := db.Raw(sql, lineage).Scan(&all).Error; err != nil {
+		log.Error(err.Error())
+	}
+	sortVersionsNewestFirst(all)
+
+	total = len(all)
+	start, end := pageBounds(page, limit, total)
+	versions = append([]types.LineageVersion{}, all[start:end]...)
+	return
+}
+
+// GetTFVersionHistory returns the versions of a given lineage where the
+// Terraform version differs from the one of the previously ingested version
+func (db *Database) GetTFVersionHistory(lineage string) (changes []types.TFVersionChange) {
+	sql := "SELECT versions.version_id, versions.last_modified, states.serial, states.tf_version" +
+		" FROM states" +
+		" JOIN lineages ON lineages.id = states.lineage_id" +
+		" JOIN versions ON versions.id = states.version_id" +
+		" WHERE lineages.value = ?" +
+		" ORDER BY versions.last_modified ASC"
+
+	var history []types.TFVersionChange
+	db.Raw(sql, lineage).Scan(&history)
+	return tfVersionChanges(history)
+}
+
+// GetVersionTree retrieves the version history of a Lineage as a tree,
+// exposing the forks of the lineage
+func (db *Database) GetVersionTree(lineage string) []types.VersionNode {
+	sql := "SELECT versions.version_id, versions.last_modified, states.serial, states.fingerprint" +
+		" FROM states" +
+		" JOIN lineages ON lineages.id = states.lineage_id" +
+		" JOIN versions ON versions.id = states.version_id" +
+		" WHERE lineages.value = ?" +
+		" ORDER BY versions.last_modified ASC"
+
+	var history []types.VersionNode
+	db.Raw(sql, lineage).Scan(&history)
+	return buildVersionTree(history)
+}
+
+// buildVersionTree builds a tree from a chronologically ordered version history.
+// The parent of a version is the most recent earlier version with a lower serial,
+// so that versions sharing a serial with a different content are forks
+// of the same parent. Versions identical to an earlier one are ignored.
+func buildVersionTree(history []types.VersionNode) []types.VersionNode {
+	parents := make([]int, len(history))
+	children := make(map[int][]int)
+	var roots []int
+	seen := make(map[string]bool)
+	for i, v := range history {
+		key := fmt.Sprintf("%d/%s", v.Serial, v.Fingerprint)
+		if seen[key] {
+			parents[i] = -2
+			continue
+		}
+		seen[key] = true
+
+		parents[i] = -1
+		for j := i - 1; j >= 0; j-- {
+			if parents[j] != -2 && history[j].Serial < v.Serial {
+				parents[i] = j
+				break
+			}
+		}
+		if parents[i] == -1 {
+			roots = append(roots, i)
+		} else {
+			children[parents[i]] = append(children[parents[i]], i)
+		}
+	}
+
+	var build func(i int) types.VersionNode
+	build = func(i int) types.VersionNode {
+		node := history[i]
+		node.Children = []types.VersionNode{}
+		for _, c := range children[i] {
+			node.Children = append(node.Children, build(c))
+		}
+		return node
+	}
+
+	tree := []types.VersionNode{}
+	for _, r := range roots {
+		tree = append(tree, build(r))
+	}
+	return tree
+}
+
+// tfVersionChanges filters a chronologically ordered history to keep
+// only the entries where the Terraform version changed
+func tfVersionChanges(history []types.TFVersionChange) (changes []types.TFVersionChange) {
+	changes = []types.TFVersionChange{}
+	previous := ""
+	for i, h := range history {
+		if i > 0 && h.TFVersion == previous {
+			continue
+		}
+		h.PreviousTFVersion = previous
+		changes = append(changes, h)
+		previous = h.TFVersion
+	}
+	return
+}
+
 // KnownVersions returns a slice of all known Versions in the Database
 func (db *Database) KnownVersions() (versions []string) {
 	// TODO: err
@@ -317,37 +1073,22 @@ func (db *Database) KnownVersions() (versions []string) {
 	return
 }
 
-// SearchAttribute returns a slice of SearchResult given a query
-// The query might contain parameters 'type', 'name', 'key', 'value' and 'tf_version'
-// SearchAttribute also returns paging information: the page number and the total results
-func (db *Database) SearchAttribute(query url.Values) (results []types.SearchResult, page int, total int) {
-	log.WithFields(log.Fields{
-		"query": query,
-	}).Info("Searching for attribute with query")
+// SearchExcludedKeys is the attribute search parameter holding the LIKE
+// patterns of the attribute keys left out of the results
+const SearchExcludedKeys = "exclude_key"
 
+// searchConditions returns the conditions, and their parameters, of an
+// attribute search query. With the 'regex' parameter set to true, 'name'
+// and 'value' are matched as regular expressions, 'name' matching either
+// the name or the address (type.name) of resources.
+func searchConditions(query url.Values) (where []string, params []interface{}) {
 	targetVersion := string(query.Get("versionid"))
-
-	sqlQuery := ""
-	if targetVersion == "" {
-		sqlQuery += " FROM (SELECT states.path, max(states.serial) as mx FROM states GROUP BY states.path) t" +
-			" JOIN states ON t.path = states.path AND t.mx = states.serial"
-	} else {
-		sqlQuery += " FROM states"
-	}
-
-	sqlQuery += " JOIN modules ON states.id = modules.state_id" +
-		" JOIN resources ON modules.id = resources.module_id" +
-		" JOIN attributes ON resources.id = attributes.resource_id" +
-		" JOIN lineages ON lineages.id = states.lineage_id" +
-		" JOIN versions ON states.version_id = versions.id"
-
-	var where []string
-	var params []interface{}
 	if targetVersion != "" && targetVersion != "*" {
 		// filter by version unless we want all (*) or most recent ("")
 		where = append(where, "states.version_id = ?")
 		params = append(params, targetVersion)
 	}
+	regex := query.Get("regex") == "true"
 
 	if v := string(query.Get("type")); v != "" {
 		where = append(where, "resources.type LIKE ?")
@@ -355,8 +1096,13 @@ func (db *Database) SearchAttribute(query url.Values) (results []types.SearchRes
 	}
 
 	if v := string(query.Get("name")); v != "" {
-		where = append(where, "resources.name LIKE ?")
-		params = append(params, fmt.Sprintf("%%%s%%", v))
+		if regex {
+			where = append(where, "(resources.name ~ ? OR resources.type || '.' || resources.name ~ ?)")
+			params = append(params, v, v)
+		} else {
+			where = append(where, "resources.name LIKE ?")
+			params = append(params, fmt.Sprintf("%%%s%%", v))
+		}
 	}
 
 	if v := string(query.Get("key")); v != "" {
@@ -365,21 +1111,120 @@ func (db *Database) SearchAttribute(query url.Values) (results []types.SearchRes
 	}
 
 	if v := string(query.Get("value")); v != "" {
-		where = append(where, "attributes.value LIKE ?")
-		params = append(params, fmt.Sprintf("%%%s%%", v))
+		if regex {
+			where = append(where, "attributes.value ~ ?")
+			params = append(params, v)
+		} else {
+			where = append(where, "attributes.value LIKE ?")
+			params = append(params, fmt.Sprintf("%%%s%%", v))
+		}
 	}
 
 	if v := query.Get("tf_version"); string(v) != "" {
-		where = append(where, fmt.Sprintf("states.tf_version LIKE '%s'", fmt.Sprintf("%%%s%%", v)))
+		where = append(where, "states.tf_version LIKE ?")
+		params = append(params, fmt.Sprintf("%%%s%%", v))
 	}
 
 	if v := query.Get("lineage_value"); string(v) != "" {
-		where = append(where, fmt.Sprintf("lineages.value LIKE '%s'", fmt.Sprintf("%%%s%%", v)))
+		where = append(where, "lineages.value LIKE ?")
+		params = append(params, fmt.Sprintf("%%%s%%", v))
+	}
+
+	for _, v := range query[SearchExcludedKeys] {
+		where = append(where, "attributes.key NOT LIKE ?")
+		params = append(params, v)
+	}
+	return
+}
+
+// ErrInvalidSortOrder is returned when search results are sorted
+// by an unknown column, or in an unknown order
+var ErrInvalidSortOrder = errors.New("invalid sort order")
+
+// searchDefaultOrder is the default ordering of attribute search results,
+// also breaking the ties of the other orderings so that pages are stable
+const searchDefaultOrder = "states.path, states.serial, lineage_value, modules.path, resources.type, resources.name, resources.index, attributes.key"
+
+// searchSortColumns maps the columns attribute search results
+// can be sorted by to their SQL expression
+var searchSortColumns = map[string]string{
+	"lineage":       "lineage_value",
+	"resource_type": "resources.type",
+	"last_modified": "versions.last_modified",
+}
+
+// SearchOrderBy returns the ORDER BY expression of attribute search results
+// sorted by the given column, in ascending ("asc", by default) or descending
+// ("desc") order. The default ordering is kept without column.
+func SearchOrderBy(orderBy, order string) (string, error) {
+	direction := "ASC"
+	switch strings.ToLower(order) {
+	case "", "asc":
+	case "desc":
+		direction = "DESC"
+	default:
+		return "", fmt.Errorf("%w: unknown order '%s'", ErrInvalidSortOrder, order)
+	}
+	if orderBy == "" {
+		return searchDefaultOrder, nil
 	}
+	column, ok := searchSortColumns[orderBy]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown column '%s'", ErrInvalidSortOrder, orderBy)
+	}
+	return column + " " + direction + ", " + searchDefaultOrder, nil
+}
+
+// searchAttributeSelect selects the columns of a SearchResult
+const searchAttributeSelect = "SELECT states.path, versions.version_id, states.tf_version, states.serial, lineages.value as lineage_value, modules.path as module_path, resources.type, resources.name, resources.index, attributes.key, attributes.value"
+
+// searchAttributeSQL returns the FROM and WHERE clauses of an attribute
+// search, with their parameters
+func searchAttributeSQL(query url.Values) (sqlQuery string, params []interface{}) {
+	targetVersion := string(query.Get("versionid"))
+
+	if targetVersion == "" {
+		sqlQuery += " FROM (SELECT states.path, max(states.serial) as mx FROM states GROUP BY states.path) t" +
+			" JOIN states ON t.path = states.path AND t.mx = states.serial"
+	} else {
+		sqlQuery += " FROM states"
+	}
+
+	sqlQuery += " JOIN modules ON states.id = modules.state_id" +
+		" JOIN resources ON modules.id = resources.module_id" +
+		" JOIN attributes ON attributes.resource_id = COALESCE(resources.attributes_from_id, resources.id)" +
+		" JOIN lineages ON lineages.id = states.lineage_id" +
+		" JOIN versions ON states.version_id = versions.id"
 
+	where, params := searchConditions(query)
 	if len(where) > 0 {
 		sqlQuery += " WHERE " + strings.Join(where, " AND ")
 	}
+	return
+}
+
+// searchAttributeOrder returns the ORDER BY clause of an attribute search,
+// falling back to the default order on an invalid one
+func searchAttributeOrder(query url.Values) string {
+	orderBy, err := SearchOrderBy(query.Get("orderBy"), query.Get("order"))
+	if err != nil {
+		log.WithError(err).Warn("Invalid sort order of attribute search, using the default one")
+		orderBy = searchDefaultOrder
+	}
+	return " ORDER BY " + orderBy
+}
+
+// SearchAttribute returns a slice of SearchResult given a query
+// The query might contain parameters 'type', 'name', 'key', 'value' and 'tf_version',
+// 'name' and 'value' being regular expressions when 'regex' is true
+// SearchAttribute also returns paging information: the page number and the total results
+// Results are sorted with the 'orderBy' and 'order' parameters, see SearchOrderBy
+func (db *Database) SearchAttribute(query url.Values) (results []types.SearchResult, page int, total int) {
+	log.WithFields(log.Fields{
+		"query": query,
+	}).Info("Searching for attribute with query")
+
+	sqlQuery, params := searchAttributeSQL(query)
 
 	// Count everything
 	row := db.Raw("SELECT count(*)"+sqlQuery, params...).Row()
@@ -389,9 +1234,9 @@ func (db *Database) SearchAttribute(query url.Values) (results []types.SearchRes
 
 	// Now get results
 	// gorm doesn't support subqueries...
-	sql := "SELECT states.path, versions.version_id, states.tf_version, states.serial, lineages.value as lineage_value, modules.path as module_path, resources.type, resources.name, resources.index, attributes.key, attributes.value" +
+	sql := searchAttributeSelect +
 		sqlQuery +
-		" ORDER BY states.path, states.serial, lineage_value, modules.path, resources.type, resources.name, resources.index, attributes.key" +
+		searchAttributeOrder(query) +
 		" LIMIT ?"
 
 	log.Info(sql)
@@ -411,6 +1256,137 @@ func (db *Database) SearchAttribute(query url.Values) (results []types.SearchRes
 	return
 }
 
+// EachSearchResult calls fn with each result of an attribute search, as
+// SearchAttribute does but without paging, as they are read from the database
+func (db *Database) EachSearchResult(query url.Values, fn func(types.SearchResult) error) error {
+	sqlQuery, params := searchAttributeSQL(query)
+	rows, err := db.Raw(searchAttributeSelect+sqlQuery+searchAttributeOrder(query), params...).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var result types.SearchResult
+		if err := db.ScanRows(rows, &result); err != nil {
+			return err
+		}
+		if err := fn(result); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ErrInvalidCondition is returned when a ResourceQuery has an invalid condition
+var ErrInvalidCondition = errors.New("invalid attribute condition")
+
+// attributeOperators maps the operators of Attribute conditions
+// to their SQL condition on the Attribute value
+var attributeOperators = map[string]string{
+	"eq":       "attributes.value = ?",
+	"ne":       "attributes.value <> ?",
+	"contains": "attributes.value LIKE ?",
+	"regex":    "attributes.value ~ ?",
+}
+
+// resourceQueryConditions builds the SQL condition on resources of a
+// ResourceQuery, with an EXISTS subquery per Attribute condition
+func resourceQueryConditions(q types.ResourceQuery) (where string, params []interface{}, err error) {
+	if len(q.Conditions) == 0 {
+		return "", nil, fmt.Errorf("%w: no condition", ErrInvalidCondition)
+	}
+	combine := " AND "
+	switch strings.ToLower(q.Combine) {
+	case "", "and":
+	case "or":
+		combine = " OR "
+	default:
+		return "", nil, fmt.Errorf("%w: unknown combination '%s'", ErrInvalidCondition, q.Combine)
+	}
+
+	var exists []string
+	for _, c := range q.Conditions {
+		if c.Key == "" {
+			return "", nil, fmt.Errorf("%w: missing key", ErrInvalidCondition)
+		}
+		operator := c.Operator
+		if operator == "" {
+			operator = "eq"
+		}
+		condition, ok := attributeOperators[operator]
+		if !ok {
+			return "", nil, fmt.Errorf("%w: unknown operator '%s'", ErrInvalidCondition, c.Operator)
+		}
+		value := c.Value
+		switch operator {
+		case "contains":
+			value = fmt.Sprintf("%%%s%%", value)
+		case "regex":
+			if _, err := regexp.Compile(value); err != nil {
+				return "", nil, fmt.Errorf("%w: %v", ErrInvalidCondition, err)
+			}
+		}
+
+		exists = append(exists, "EXISTS (SELECT 1 FROM attributes"+
+			" WHERE attributes.resource_id = COALESCE(resources.attributes_from_id, resources.id)"+
+			" AND attributes.key = ? AND "+condition+")")
+		params = append(params, c.Key, value)
+	}
+	return "(" + strings.Join(exists, combine) + ")", params, nil
+}
+
+// QueryResources returns, by pages, the Resources of the latest State
+// versions matching the Attribute conditions of a ResourceQuery
+func (db *Database) QueryResources(q types.ResourceQuery) (results []types.ResourceQueryResult, page int, total int, err error) {
+	where, params, err := resourceQueryConditions(q)
+	if err != nil {
+		return
+	}
+
+	sqlQuery := " FROM (SELECT states.path, max(states.serial) as mx FROM states GROUP BY states.path) t" +
+		" JOIN states ON t.path = states.path AND t.mx = states.serial" +
+		" JOIN modules ON states.id = modules.state_id" +
+		" JOIN resources ON modules.id = resources.module_id" +
+		" JOIN lineages ON lineages.id = states.lineage_id" +
+		" JOIN versions ON states.version_id = versions.id" +
+		" WHERE " + where
+
+	if err = db.Raw("SELECT count(*)"+sqlQuery, params...).Row().Scan(&total); err != nil {
+		return
+	}
+
+	page = q.Page
+	if page < 1 {
+		page = 1
+	}
+	sql := "SELECT lineages.value, states.path, versions.version_id," +
+		" modules.path, resources.mode, resources.type, resources.name, resources.index" +
+		sqlQuery +
+		" ORDER BY lineages.value, states.path, modules.path, resources.type, resources.name, resources.index" +
+		" LIMIT ? OFFSET ?"
+	params = append(params, pageSize, (page-1)*pageSize)
+
+	rows, err := db.Raw(sql, params...).Rows()
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	results = []types.ResourceQueryResult{}
+	for rows.Next() {
+		var r types.ResourceQueryResult
+		var modulePath, mode, name, index string
+		if err = rows.Scan(&r.LineageValue, &r.Path, &r.VersionID,
+			&modulePath, &mode, &r.ResourceType, &name, &index); err != nil {
+			return
+		}
+		r.Address = resourceAddress(modulePath, mode, r.ResourceType, name, index)
+		results = append(results, r)
+	}
+	return
+}
+
 // ListStatesVersions returns a map of Version IDs to a slice of State paths
 // from the Database
 func (db *Database) ListStatesVersions() (statesVersions map[string][]string) {
@@ -427,6 +1403,24 @@ func (db *Database) ListStatesVersions() (statesVersions map[string][]string) {
 		}
 		statesVersions[versionID] = append(statesVersions[versionID], path)
 	}
+
+	// Deduplicated versions are known, so that they aren't fetched again
+	dedupRows, err := db.Table("deduplicated_versions").
+		Joins("JOIN versions ON versions.id = deduplicated_versions.version_id").
+		Select("deduplicated_versions.path, versions.version_id").Rows()
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+	defer dedupRows.Close()
+	for dedupRows.Next() {
+		var path string
+		var versionID string
+		if err := dedupRows.Scan(&path, &versionID); err != nil {
+			log.Error(err.Error())
+		}
+		statesVersions[versionID] = append(statesVersions[versionID], path)
+	}
 	return
 }
 
@@ -467,15 +1461,269 @@ func (db *Database) ListTerraformVersionsWithCount(query url.Values) (results []
 	return
 }
 
+// latestStatesSQL selects the most recent State of each lineage
+const latestStatesSQL = "SELECT DISTINCT ON(states.lineage_id) states.id, states.lineage_id, states.tf_version" +
+	" FROM states JOIN versions ON versions.id = states.version_id" +
+	" ORDER BY states.lineage_id, versions.last_modified DESC"
+
+// emptyLineagesSQL selects the lineages whose most recent State holds no managed resource.
+// Resources ingested before their mode was recorded are considered managed.
+const emptyLineagesSQL = "SELECT t.lineage_id FROM (" + latestStatesSQL + ") t" +
+	" LEFT JOIN modules ON modules.state_id = t.id" +
+	" LEFT JOIN resources ON resources.module_id = modules.id AND resources.mode IS DISTINCT FROM 'data'" +
+	" GROUP BY t.lineage_id" +
+	" HAVING count(resources.id) = 0"
+
+// lineageResourceCount is the managed resource count of the most recent
+// State of a lineage
+type lineageResourceCount struct {
+	tfVersion     string
+	resourceCount int
+}
+
+// sumResourcesByTFVersion sums the resource counts of lineages per
+// Terraform version, sorted by decreasing resource count
+func sumResourcesByTFVersion(counts []lineageResourceCount) []types.TFVersionResources {
+	byVersion := make(map[string]*types.TFVersionResources)
+	for _, c := range counts {
+		v, ok := byVersion[c.tfVersion]
+		if !ok {
+			v = &types.TFVersionResources{TFVersion: c.tfVersion}
+			byVersion[c.tfVersion] = v
+		}
+		v.Lineages++
+		v.ResourceCount += c.resourceCount
+	}
+
+	results := []types.TFVersionResources{}
+	for _, v := range byVersion {
+		results = append(results, *v)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].ResourceCount != results[j].ResourceCount {
+			return results[i].ResourceCount > results[j].ResourceCount
+		}
+		return results[i].TFVersion < results[j].TFVersion
+	})
+	return results
+}
+
+// ListResourcesByTFVersion returns, per Terraform version, the number of
+// lineages whose most recent State is on it and their total managed resources
+func (db *Database) ListResourcesByTFVersion() ([]types.TFVersionResources, error) {
+	sql := "SELECT t.tf_version, count(resources.id)" +
+		" FROM (" + latestStatesSQL + ") t" +
+		" LEFT JOIN modules ON modules.state_id = t.id" +
+		" LEFT JOIN resources ON resources.module_id = modules.id AND resources.mode IS DISTINCT FROM 'data'" +
+		" GROUP BY t.lineage_id, t.tf_version"
+
+	rows, err := db.Raw(sql).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []lineageResourceCount
+	for rows.Next() {
+		var c lineageResourceCount
+		if err := rows.Scan(&c.tfVersion, &c.resourceCount); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return sumResourcesByTFVersion(counts), nil
+}
+
+// filterSmallLineages returns the lineages with at most maxResources
+// resources and, unless staleBefore is zero, no activity since staleBefore,
+// the least recently active first
+func filterSmallLineages(lineages []types.SmallLineage, maxResources int, staleBefore time.Time) []types.SmallLineage {
+	small := []types.SmallLineage{}
+	for _, l := range lineages {
+		if l.ResourceCount > maxResources {
+			continue
+		}
+		if !staleBefore.IsZero() && !l.LastActivity.Before(staleBefore) {
+			continue
+		}
+		small = append(small, l)
+	}
+	sort.SliceStable(small, func(i, j int) bool {
+		return small[i].LastActivity.Before(small[j].LastActivity)
+	})
+	return small
+}
+
+// ListSmallLineages returns the lineages whose most recent State holds
+// at most maxResources managed resources, with the time of their last
+// State version or Plan. Unless staleBefore is zero, only the lineages
+// without activity since staleBefore are returned.
+func (db *Database) ListSmallLineages(maxResources int, staleBefore time.Time) ([]types.SmallLineage, error) {
+	sql := "SELECT lineages.value, lineages.display_name, count(resources.id)," +
+		" GREATEST(max(versions.last_modified), (SELECT max(plans.created_at) FROM plans WHERE plans.lineage_id = lineages.id))" +
+		" FROM (" + latestStatesSQL + ") t" +
+		" JOIN lineages ON lineages.id = t.lineage_id" +
+		" JOIN states ON states.id = t.id" +
+		" JOIN versions ON versions.id = states.version_id" +
+		" LEFT JOIN modules ON modules.state_id = t.id" +
+		" LEFT JOIN resources ON resources.module_id = modules.id AND resources.mode IS DISTINCT FROM 'data'" +
+		" GROUP BY lineages.id, lineages.value, lineages.display_name"
+
+	rows, err := db.Raw(sql).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lineages []types.SmallLineage
+	for rows.Next() {
+		var l types.SmallLineage
+		if err := rows.Scan(&l.Lineage, &l.DisplayName, &l.ResourceCount, &l.LastActivity); err != nil {
+			return nil, err
+		}
+		lineages = append(lineages, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return filterSmallLineages(lineages, maxResources, staleBefore), nil
+}
+
+// percentage returns the share of part in total as a percentage,
+// rounded to two decimals
+func percentage(part, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(part)*10000/float64(total)) / 100
+}
+
+// versionAdoption computes the adoption of the most recent Terraform
+// version, compared as semver, among the lineages and resources counted
+// per version. Versions which cannot be parsed are never the latest.
+func versionAdoption(versions []types.TFVersionResources) (adoption types.VersionAdoption) {
+	var latest *version.Version
+	for _, v := range versions {
+		adoption.TotalLineages += v.Lineages
+		adoption.TotalResources += v.ResourceCount
+
+		tfVersion, err := version.NewVersion(v.TFVersion)
+		if err != nil {
+			continue
+		}
+		if latest == nil || tfVersion.GreaterThan(latest) {
+			latest = tfVersion
+			adoption.LatestVersion = v.TFVersion
+		}
+	}
+
+	for _, v := range versions {
+		if latest != nil && v.TFVersion == adoption.LatestVersion {
+			adoption.Lineages += v.Lineages
+			adoption.Resources += v.ResourceCount
+		}
+	}
+	adoption.Laggards = adoption.TotalLineages - adoption.Lineages
+	adoption.LineagesPercent = percentage(adoption.Lineages, adoption.TotalLineages)
+	adoption.ResourcesPercent = percentage(adoption.Resources, adoption.TotalResources)
+	return
+}
+
+// GetLatestVersionAdoption returns the adoption of the most recent
+// Terraform version across the most recent State of each lineage
+func (db *Database) GetLatestVersionAdoption() (types.VersionAdoption, error) {
+	versions, err := db.ListResourcesByTFVersion()
+	if err != nil {
+		return types.VersionAdoption{}, err
+	}
+	return versionAdoption(versions), nil
+}
+
+// emptyStatesHandling returns whether empty States should be hidden from
+// or tagged in listings, given the configured handling and the override
+// to show them
+func emptyStatesHandling(mode string, showEmpty bool) (hide, tag bool) {
+	switch mode {
+	case EmptyStatesHide:
+		return !showEmpty, false
+	case EmptyStatesTag:
+		return false, true
+	}
+	return false, false
+}
+
+// hiddenTFVersions returns the Terraform versions, among the given ones,
+// which are either explicitly hidden or older than the minimum version
+func hiddenTFVersions(versions, hidden []string, minVersion string) (results []string, err error) {
+	var min *version.Version
+	if minVersion != "" {
+		if min, err = version.NewVersion(minVersion); err != nil {
+			return nil, fmt.Errorf("invalid minimum Terraform version '%s': %v", minVersion, err)
+		}
+	}
+
+	for _, v := range versions {
+		if containsString(hidden, v) {
+			results = append(results, v)
+			continue
+		}
+		if min == nil {
+			continue
+		}
+		if tfVersion, err := version.NewVersion(v); err == nil && tfVersion.LessThan(min) {
+			results = append(results, v)
+		}
+	}
+	return
+}
+
+// listHiddenTFVersions returns the Terraform versions of States
+// which are hidden by default from listings
+func (db *Database) listHiddenTFVersions(showAll bool) ([]string, error) {
+	if showAll || (len(db.hiddenTFVersions) == 0 && db.minTFVersion == "") {
+		return nil, nil
+	}
+
+	versions, err := db.ListTfVersions()
+	if err != nil {
+		return nil, err
+	}
+	return hiddenTFVersions(versions, db.hiddenTFVersions, db.minTFVersion)
+}
+
 // ListStateStats returns a slice of StateStat, along with paging information
 func (db *Database) ListStateStats(query url.Values) (states []types.StateStat, page int, total int) {
-	row := db.Raw("SELECT count(*) FROM (SELECT DISTINCT lineage_id FROM states) AS t").Row()
+	var filterQuery string
+	var conditions []string
+	var params []interface{}
+	hidden, err := db.listHiddenTFVersions(query.Get("show_all_versions") == "true")
+	if err != nil {
+		log.Error(err.Error())
+	}
+	if len(hidden) > 0 {
+		conditions = append(conditions, "t.tf_version NOT IN ?")
+		params = append(params, hidden)
+	}
+	hideEmpty, tagEmpty := emptyStatesHandling(db.emptyStates, query.Get("show_empty") == "true")
+	if hideEmpty {
+		conditions = append(conditions, "t.lineage_id NOT IN ("+emptyLineagesSQL+")")
+	}
+	fieldConditions, fieldParams := computedFieldConditions(db.computedFields, query)
+	conditions = append(conditions, fieldConditions...)
+	params = append(params, fieldParams...)
+	tagConds, tagParams := tagConditions("t.lineage_id", query["tag"])
+	conditions = append(conditions, tagConds...)
+	params = append(params, tagParams...)
+	if len(conditions) > 0 {
+		filterQuery = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	row := db.Raw("SELECT count(*) FROM ("+latestStatesSQL+") t"+filterQuery, params...).Row()
 	if err := row.Scan(&total); err != nil {
 		log.Error(err.Error())
 	}
 
 	var paginationQuery string
-	var params []interface{}
 	page = 1
 	if v := string(query.Get("page")); v != "" {
 		page, _ = strconv.Atoi(v) // TODO: err
@@ -486,74 +1734,1494 @@ func (db *Database) ListStateStats(query url.Values) (states []types.StateStat,
 		page = -1
 	}
 
-	sql := "SELECT t.path, lineages.value as lineage_value, t.serial, t.tf_version, t.version_id, t.last_modified, count(resources.*) as resource_count" +
-		" FROM (SELECT DISTINCT ON(states.lineage_id) states.id, states.lineage_id, states.path, states.serial, states.tf_version, versions.version_id, versions.last_modified FROM states JOIN versions ON versions.id = states.version_id ORDER BY states.lineage_id, versions.last_modified DESC) t" +
-		" JOIN modules ON modules.state_id = t.id" +
-		" JOIN resources ON resources.module_id = modules.id" +
-		" JOIN lineages ON lineages.id = t.lineage_id" +
-		" GROUP BY t.path, lineages.value, t.serial, t.tf_version, t.version_id, t.last_modified" +
-		" ORDER BY last_modified DESC" +
-		paginationQuery
+	var emptySelect string
+	if tagEmpty {
+		emptySelect = ", t.lineage_id IN (" + emptyLineagesSQL + ") as empty"
+	}
+
+	sql := "SELECT t.id as state_id, t.path, lineages.value as lineage_value, lineages.display_name, lineages.provider, t.serial, t.tf_version, t.version_id, t.last_modified, count(resources.id) as resource_count" +
+		emptySelect +
+		" FROM (SELECT DISTINCT ON(states.lineage_id) states.id, states.lineage_id, states.path, states.serial, states.tf_version, versions.version_id, versions.last_modified FROM states JOIN versions ON versions.id = states.version_id ORDER BY states.lineage_id, versions.last_modified DESC) t" +
+		" LEFT JOIN modules ON modules.state_id = t.id" +
+		" LEFT JOIN resources ON resources.module_id = modules.id" +
+		" JOIN lineages ON lineages.id = t.lineage_id" +
+		filterQuery +
+		" GROUP BY t.id, t.lineage_id, t.path, lineages.value, lineages.display_name, lineages.provider, t.serial, t.tf_version, t.version_id, t.last_modified" +
+		" ORDER BY last_modified DESC" +
+		paginationQuery
+
+	db.Raw(sql, params...).Find(&states)
+	db.fillComputedFields(states)
+	return
+}
+
+// listField is a wrapper utility method to list distinct values in Database tables.
+func (db *Database) listField(table, field string) (results []string, err error) {
+	rows, err := db.Table(table).Select(fmt.Sprintf("DISTINCT %s", field)).Rows()
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t string
+		if err = rows.Scan(&t); err != nil {
+			return
+		}
+		results = append(results, t)
+	}
+
+	return
+}
+
+// ListResourceTypes lists all Resource types from the Database
+func (db *Database) ListResourceTypes() ([]string, error) {
+	return db.listField("resources", "type")
+}
+
+// ListResourceTypesWithCount returns a list of Resource types with associated counts
+// from the Database
+func (db *Database) ListResourceTypesWithCount() (results []map[string]string, err error) {
+	sql := "SELECT resources.type, COUNT(*)" +
+		" FROM (SELECT DISTINCT ON(states.path) states.id, states.path, states.serial, states.tf_version, versions.version_id, versions.last_modified" +
+		" FROM states" +
+		" JOIN versions ON versions.id = states.version_id" +
+		" ORDER BY states.path, versions.last_modified DESC) t" +
+		" JOIN modules ON modules.state_id = t.id" +
+		" JOIN resources ON resources.module_id = modules.id" +
+		" GROUP BY resources.type" +
+		" ORDER BY count DESC"
+
+	rows, err := db.Raw(sql).Rows()
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var count string
+		r := make(map[string]string)
+		if err = rows.Scan(&name, &count); err != nil {
+			return
+		}
+		r["name"] = name
+		r["count"] = count
+		results = append(results, r)
+	}
+	return
+}
+
+// pluginVersionCount is the count of lineages using a provider plugin
+// with a Terraform version in their most recent State
+type pluginVersionCount struct {
+	Provider  string
+	TFVersion string
+	Count     int
+}
+
+// ListProviderPlugins returns the provider plugins (source addresses) used
+// in the most recent State of lineages, with the count of these lineages
+// per Terraform version. States don't record the versions of provider
+// plugins, only the Terraform version they were written with.
+func (db *Database) ListProviderPlugins() ([]types.ProviderPlugin, error) {
+	sql := "SELECT resources.provider, t.tf_version, COUNT(DISTINCT t.lineage_id)" +
+		" FROM (SELECT DISTINCT ON(states.lineage_id) states.id, states.lineage_id, states.tf_version, versions.last_modified" +
+		" FROM states" +
+		" JOIN versions ON versions.id = states.version_id" +
+		" ORDER BY states.lineage_id, versions.last_modified DESC) t" +
+		" JOIN modules ON modules.state_id = t.id" +
+		" JOIN resources ON resources.module_id = modules.id" +
+		" WHERE resources.provider <> ''" +
+		" GROUP BY resources.provider, t.tf_version"
+
+	rows, err := db.Raw(sql).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []pluginVersionCount
+	for rows.Next() {
+		var c pluginVersionCount
+		if err = rows.Scan(&c.Provider, &c.TFVersion, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return groupProviderPlugins(counts), nil
+}
+
+// groupProviderPlugins sums the lineage counts of each provider plugin,
+// the most used plugins first, with their Terraform versions from the
+// most recent. Versions which cannot be parsed come last.
+func groupProviderPlugins(counts []pluginVersionCount) []types.ProviderPlugin {
+	plugins := []types.ProviderPlugin{}
+	index := make(map[string]int)
+	for _, c := range counts {
+		i, ok := index[c.Provider]
+		if !ok {
+			i = len(plugins)
+			index[c.Provider] = i
+			plugins = append(plugins, types.ProviderPlugin{Name: c.Provider})
+		}
+		plugins[i].LineageCount += c.Count
+		plugins[i].Versions = append(plugins[i].Versions, types.ProviderPluginVersion{
+			TFVersion:    c.TFVersion,
+			LineageCount: c.Count,
+		})
+	}
+
+	for _, p := range plugins {
+		sort.Slice(p.Versions, func(i, j int) bool {
+			vi, erri := version.NewVersion(p.Versions[i].TFVersion)
+			vj, errj := version.NewVersion(p.Versions[j].TFVersion)
+			switch {
+			case erri != nil && errj != nil:
+				return p.Versions[i].TFVersion < p.Versions[j].TFVersion
+			case erri != nil || errj != nil:
+				return errj != nil
+			}
+			return vi.GreaterThan(vj)
+		})
+	}
+	sort.SliceStable(plugins, func(i, j int) bool {
+		if plugins[i].LineageCount != plugins[j].LineageCount {
+			return plugins[i].LineageCount > plugins[j].LineageCount
+		}
+		return plugins[i].Name < plugins[j].Name
+	})
+	return plugins
+}
+
+// GetPluginUsage returns the lineages whose most recent State has resources
+// managed by a given provider plugin, along with the types of these resources
+func (db *Database) GetPluginUsage(plugin string) (usages []types.PluginUsage, err error) {
+	usages = []types.PluginUsage{}
+	sql := "SELECT lineages.value, resources.type" +
+		" FROM (SELECT DISTINCT ON(states.lineage_id) states.id, states.lineage_id, versions.last_modified" +
+		" FROM states" +
+		" JOIN versions ON versions.id = states.version_id" +
+		" ORDER BY states.lineage_id, versions.last_modified DESC) t" +
+		" JOIN lineages ON lineages.id = t.lineage_id" +
+		" JOIN modules ON modules.state_id = t.id" +
+		" JOIN resources ON resources.module_id = modules.id" +
+		" WHERE resources.provider = ?" +
+		" GROUP BY lineages.value, resources.type" +
+		" ORDER BY lineages.value, resources.type"
+
+	rows, err := db.Raw(sql, plugin).Rows()
+	if err != nil {
+		return usages, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var lineage string
+		var resourceType string
+		if err = rows.Scan(&lineage, &resourceType); err != nil {
+			return
+		}
+		if n := len(usages); n == 0 || usages[n-1].LineageValue != lineage {
+			usages = append(usages, types.PluginUsage{LineageValue: lineage})
+		}
+		last := &usages[len(usages)-1]
+		last.ResourceTypes = append(last.ResourceTypes, resourceType)
+	}
+	return
+}
+
+// lineageResourceTypeCounts returns the count of resources per type
+// in the most recent State of a lineage
+func (db *Database) lineageResourceTypeCounts(lineage string) (counts map[string]int, err error) {
+	counts = make(map[string]int)
+	sql := "SELECT resources.type, COUNT(*)" +
+		" FROM (SELECT DISTINCT ON(states.lineage_id) states.id, states.lineage_id, versions.last_modified" +
+		" FROM states" +
+		" JOIN versions ON versions.id = states.version_id" +
+		" JOIN lineages ON lineages.id = states.lineage_id" +
+		" WHERE lineages.value = ?" +
+		" ORDER BY states.lineage_id, versions.last_modified DESC) t" +
+		" JOIN modules ON modules.state_id = t.id" +
+		" JOIN resources ON resources.module_id = modules.id" +
+		" GROUP BY resources.type"
+
+	rows, err := db.Raw(sql, lineage).Rows()
+	if err != nil {
+		return counts, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var count int
+		if err = rows.Scan(&name, &count); err != nil {
+			return
+		}
+		counts[name] = count
+	}
+	return
+}
+
+// diffResourceTypeCounts merges the resource type counts of two lineages,
+// sorted by type
+func diffResourceTypeCounts(a, b map[string]int) (diffs []types.ResourceTypeCountDiff) {
+	diffs = []types.ResourceTypeCountDiff{}
+	seen := make(map[string]bool)
+	for _, counts := range []map[string]int{a, b} {
+		for t := range counts {
+			if seen[t] {
+				continue
+			}
+			seen[t] = true
+			diffs = append(diffs, types.ResourceTypeCountDiff{
+				Type:   t,
+				CountA: a[t],
+				CountB: b[t],
+				Delta:  b[t] - a[t],
+			})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Type < diffs[j].Type })
+	return
+}
+
+// resourceAddress returns the Terraform address of a resource
+func resourceAddress(modulePath, mode, resourceType, name, index string) string {
+	addr := resourceType + "." + name + index
+	if mode == "data" {
+		addr = "data." + addr
+	}
+	if modulePath != "" {
+		addr = modulePath + "." + addr
+	}
+	return addr
+}
+
+// commonResources computes the resource addresses found in all lineages,
+// and those found in at least threshold of them
+func commonResources(addresses map[string][]string, threshold int) types.CommonResources {
+	result := types.CommonResources{
+		Lineages:    len(addresses),
+		Threshold:   threshold,
+		Common:      []string{},
+		AtThreshold: []types.ResourcePresence{},
+	}
+
+	counts := make(map[string]int)
+	for _, lineageAddresses := range addresses {
+		seen := make(map[string]bool)
+		for _, a := range lineageAddresses {
+			if !seen[a] {
+				seen[a] = true
+				counts[a]++
+			}
+		}
+	}
+
+	for a, c := range counts {
+		if c == len(addresses) {
+			result.Common = append(result.Common, a)
+		}
+		if threshold > 0 && c >= threshold {
+			result.AtThreshold = append(result.AtThreshold, types.ResourcePresence{Address: a, Lineages: c})
+		}
+	}
+	sort.Strings(result.Common)
+	sort.Slice(result.AtThreshold, func(i, j int) bool {
+		if result.AtThreshold[i].Lineages != result.AtThreshold[j].Lineages {
+			return result.AtThreshold[i].Lineages > result.AtThreshold[j].Lineages
+		}
+		return result.AtThreshold[i].Address < result.AtThreshold[j].Address
+	})
+	result.CommonCount = len(result.Common)
+	result.AtThresholdCount = len(result.AtThreshold)
+	return result
+}
+
+// GetCommonResources returns the resources found in the most recent State of
+// all given lineages, and those found in at least threshold of them
+func (db *Database) GetCommonResources(lineages []string, threshold int) (types.CommonResources, error) {
+	sql := "SELECT lineages.value, modules.path, COALESCE(resources.mode, ''), resources.type, resources.name, resources.index" +
+		" FROM (SELECT DISTINCT ON(states.lineage_id) states.id, states.lineage_id" +
+		" FROM states" +
+		" JOIN versions ON versions.id = states.version_id" +
+		" JOIN lineages ON lineages.id = states.lineage_id" +
+		" WHERE lineages.value IN ?" +
+		" ORDER BY states.lineage_id, versions.last_modified DESC) t" +
+		" JOIN lineages ON lineages.id = t.lineage_id" +
+		" JOIN modules ON modules.state_id = t.id" +
+		" JOIN resources ON resources.module_id = modules.id"
+
+	rows, err := db.Raw(sql, lineages).Rows()
+	if err != nil {
+		return types.CommonResources{}, err
+	}
+	defer rows.Close()
+
+	addresses := make(map[string][]string)
+	for _, l := range lineages {
+		addresses[l] = []string{}
+	}
+	for rows.Next() {
+		var lineage, modulePath, mode, resourceType, name, index string
+		if err := rows.Scan(&lineage, &modulePath, &mode, &resourceType, &name, &index); err != nil {
+			return types.CommonResources{}, err
+		}
+		addresses[lineage] = append(addresses[lineage], resourceAddress(modulePath, mode, resourceType, name, index))
+	}
+	return commonResources(addresses, threshold), nil
+}
+
+// namedResource is a Resource of the most recent State of a Lineage
+type namedResource struct {
+	lineage, address, resourceType, name string
+}
+
+// auditResourceNames splits resources between those whose name matches re
+// and those violating it
+func auditResourceNames(re *regexp.Regexp, resources []namedResource) types.NamingAudit {
+	audit := types.NamingAudit{
+		Pattern:    re.String(),
+		Violations: []types.NamingViolation{},
+	}
+	for _, r := range resources {
+		if re.MatchString(r.name) {
+			audit.Compliant++
+			continue
+		}
+		audit.NonCompliant++
+		audit.Violations = append(audit.Violations, types.NamingViolation{
+			LineageValue: r.lineage,
+			Address:      r.address,
+			Type:         r.resourceType,
+		})
+	}
+	sort.Slice(audit.Violations, func(i, j int) bool {
+		if audit.Violations[i].LineageValue != audit.Violations[j].LineageValue {
+			return audit.Violations[i].LineageValue < audit.Violations[j].LineageValue
+		}
+		return audit.Violations[i].Address < audit.Violations[j].Address
+	})
+	return audit
+}
+
+// AuditResourceNames checks the names of the managed resources of the most
+// recent State of each Lineage, optionally restricted to a Resource type,
+// against a naming convention
+func (db *Database) AuditResourceNames(re *regexp.Regexp, resourceType string) (types.NamingAudit, error) {
+	sql := "SELECT lineages.value, modules.path, COALESCE(resources.mode, ''), resources.type, resources.name, resources.index" +
+		" FROM (" + latestStatesSQL + ") t" +
+		" JOIN lineages ON lineages.id = t.lineage_id" +
+		" JOIN modules ON modules.state_id = t.id" +
+		" JOIN resources ON resources.module_id = modules.id" +
+		" WHERE resources.mode IS DISTINCT FROM 'data'"
+	var params []interface{}
+	if resourceType != "" {
+		sql += " AND resources.type = ?"
+		params = append(params, resourceType)
+	}
+
+	rows, err := db.Raw(sql, params...).Rows()
+	if err != nil {
+		return types.NamingAudit{}, err
+	}
+	defer rows.Close()
+
+	var resources []namedResource
+	for rows.Next() {
+		var lineage, modulePath, mode, resType, name, index string
+		if err := rows.Scan(&lineage, &modulePath, &mode, &resType, &name, &index); err != nil {
+			return types.NamingAudit{}, err
+		}
+		resources = append(resources, namedResource{
+			lineage:      lineage,
+			address:      resourceAddress(modulePath, mode, resType, name, index),
+			resourceType: resType,
+			name:         name,
+		})
+	}
+	return auditResourceNames(re, resources), nil
+}
+
+// tagAttribute is a tags attribute of a Resource: either the "tags" map
+// (JSON value) or one of its flattened "tags.<key>" entries
+type tagAttribute struct {
+	lineage, address, resourceType, key, value string
+}
+
+// findMissingTags returns, grouped by lineage, the resources missing any of
+// the required tag keys. Resources without tags attribute do not support
+// tags, and are never part of the given attributes.
+func findMissingTags(attributes []tagAttribute, required []string) []types.LineageMissingTags {
+	type resourceKey struct{ lineage, address string }
+	resourceTypes := make(map[resourceKey]string)
+	present := make(map[resourceKey]map[string]bool)
+	for _, a := range attributes {
+		k := resourceKey{a.lineage, a.address}
+		resourceTypes[k] = a.resourceType
+		if present[k] == nil {
+			present[k] = make(map[string]bool)
+		}
+
+		if a.key == "tags" {
+			var tags map[string]interface{}
+			if err := json.Unmarshal([]byte(a.value), &tags); err != nil {
+				log.WithFields(log.Fields{
+					"address": a.address,
+					"error":   err,
+				}).Debug("Failed to decode resource tags")
+			}
+			for t := range tags {
+				present[k][t] = true
+			}
+		} else if t := strings.TrimPrefix(a.key, "tags."); t != "%" && t != "#" {
+			present[k][t] = true
+		}
+	}
+
+	byLineage := make(map[string][]types.UntaggedResource)
+	for k, tags := range present {
+		var missing []string
+		for _, t := range required {
+			if !tags[t] {
+				missing = append(missing, t)
+			}
+		}
+		if len(missing) > 0 {
+			byLineage[k.lineage] = append(byLineage[k.lineage], types.UntaggedResource{
+				Address: k.address,
+				Type:    resourceTypes[k],
+				Missing: missing,
+			})
+		}
+	}
+
+	lineages := []types.LineageMissingTags{}
+	for lineage, resources := range byLineage {
+		sort.Slice(resources, func(i, j int) bool { return resources[i].Address < resources[j].Address })
+		lineages = append(lineages, types.LineageMissingTags{LineageValue: lineage, Resources: resources})
+	}
+	sort.Slice(lineages, func(i, j int) bool { return lineages[i].LineageValue < lineages[j].LineageValue })
+	return lineages
+}
+
+// GetMissingTags returns, by pages of lineages, the resources of the most
+// recent State of each lineage missing any of the required tag keys,
+// optionally restricted to a Resource type
+func (db *Database) GetMissingTags(required []string, resourceType string, page int) (lineages []types.LineageMissingTags, total int, err error) {
+	sql := "SELECT lineages.value, modules.path, COALESCE(resources.mode, ''), resources.type, resources.name, resources.index, attributes.key, attributes.value" +
+		" FROM (" + latestStatesSQL + ") t" +
+		" JOIN lineages ON lineages.id = t.lineage_id" +
+		" JOIN modules ON modules.state_id = t.id" +
+		" JOIN resources ON resources.module_id = modules.id" +
+		" JOIN attributes ON attributes.resource_id = COALESCE(resources.attributes_from_id, resources.id)" +
+		" WHERE resources.mode IS DISTINCT FROM 'data'" +
+		" AND (attributes.key = 'tags' OR attributes.key LIKE 'tags.%')"
+	var params []interface{}
+	if resourceType != "" {
+		sql += " AND resources.type = ?"
+		params = append(params, resourceType)
+	}
+
+	rows, err := db.Raw(sql, params...).Rows()
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var attributes []tagAttribute
+	for rows.Next() {
+		var lineage, modulePath, mode, resType, name, index, key, value string
+		if err = rows.Scan(&lineage, &modulePath, &mode, &resType, &name, &index, &key, &value); err != nil {
+			return
+		}
+		attributes = append(attributes, tagAttribute{
+			lineage:      lineage,
+			address:      resourceAddress(modulePath, mode, resType, name, index),
+			resourceType: resType,
+			key:          key,
+			value:        value,
+		})
+	}
+
+	lineages = findMissingTags(attributes, required)
+	total = len(lineages)
+	start := (page - 1) * pageSize
+	if start > total {
+		start = total
+	}
+	end := start + pageSize
+	if end > total {
+		end = total
+	}
+	return lineages[start:end], total, nil
+}
+
+// quotaUsage sums, for each group, the resource counts of the lineages
+// holding all the tags of the group. A group without quota is never over.
+func quotaUsage(groups []config.QuotaConfig, lineageTags map[string]map[string]string, counts map[string]int) []types.QuotaUsage {
+	usages := []types.QuotaUsage{}
+	for _, g := range groups {
+		usage := types.QuotaUsage{Group: g.Name, Quota: g.Quota}
+		for lineage, tags := range lineageTags {
+			matches := true
+			for k, v := range g.Tags {
+				if tv, ok := tags[k]; !ok || tv != v {
+					matches = false
+					break
+				}
+			}
+			if matches {
+				usage.Lineages++
+				usage.ResourceCount += counts[lineage]
+			}
+		}
+		usage.Over = g.Quota > 0 && usage.ResourceCount > g.Quota
+		usages = append(usages, usage)
+	}
+	return usages
+}
+
+// GetQuotaUsage returns the managed resource count, in the most recent
+// State of their lineages, of each quota group
+func (db *Database) GetQuotaUsage(groups []config.QuotaConfig) ([]types.QuotaUsage, error) {
+	lineageTags := make(map[string]map[string]string)
+	var lineages []types.Lineage
+	if err := db.Preload("Tags").Find(&lineages).Error; err != nil {
+		return nil, err
+	}
+	for _, l := range lineages {
+		if _, ok := lineageTags[l.Value]; !ok {
+			lineageTags[l.Value] = make(map[string]string)
+		}
+		for _, t := range l.Tags {
+			lineageTags[l.Value][t.Key] = t.Value
+		}
+	}
+
+	sql := "SELECT lineages.value, count(resources.id)" +
+		" FROM (" + latestStatesSQL + ") t" +
+		" JOIN lineages ON lineages.id = t.lineage_id" +
+		" LEFT JOIN modules ON modules.state_id = t.id" +
+		" LEFT JOIN resources ON resources.module_id = modules.id AND resources.mode IS DISTINCT FROM 'data'" +
+		" GROUP BY lineages.value"
+	rows, err := db.Raw(sql).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var lineage string
+		var count int
+		if err := rows.Scan(&lineage, &count); err != nil {
+			return nil, err
+		}
+		counts[lineage] += count
+	}
+	return quotaUsage(groups, lineageTags, counts), nil
+}
+
+// CompareResourceTypeCounts returns, per Resource type, the count of resources
+// in the most recent State of two lineages along with their difference
+func (db *Database) CompareResourceTypeCounts(lineageA, lineageB string) ([]types.ResourceTypeCountDiff, error) {
+	a, err := db.lineageResourceTypeCounts(lineageA)
+	if err != nil {
+		return nil, err
+	}
+	b, err := db.lineageResourceTypeCounts(lineageB)
+	if err != nil {
+		return nil, err
+	}
+	return diffResourceTypeCounts(a, b), nil
+}
+
+// groupAttributeValuesByLineage groups the distinct attribute values by lineage,
+// sorted by value
+func groupAttributeValuesByLineage(values []types.LineageAttributeValue) map[string][]string {
+	grouped := make(map[string][]string)
+	for _, v := range values {
+		if !containsString(grouped[v.LineageValue], v.AttributeValue) {
+			grouped[v.LineageValue] = append(grouped[v.LineageValue], v.AttributeValue)
+		}
+	}
+	for _, vals := range grouped {
+		sort.Strings(vals)
+	}
+	return grouped
+}
+
+// GetAttributeValuesByLineage returns the values used by each lineage,
+// in its most recent State, for an attribute key, optionally restricted
+// to a Resource type
+func (db *Database) GetAttributeValuesByLineage(key, resourceType string) (map[string][]string, error) {
+	params := []interface{}{key}
+	sql := "SELECT DISTINCT lineages.value AS lineage_value, attributes.value AS attribute_value" +
+		" FROM (SELECT DISTINCT ON(states.lineage_id) states.id, states.lineage_id" +
+		" FROM states JOIN versions ON versions.id = states.version_id" +
+		" ORDER BY states.lineage_id, versions.last_modified DESC) t" +
+		" JOIN lineages ON lineages.id = t.lineage_id" +
+		" JOIN modules ON modules.state_id = t.id" +
+		" JOIN resources ON resources.module_id = modules.id" +
+		" JOIN attributes ON attributes.resource_id = COALESCE(resources.attributes_from_id, resources.id)" +
+		" WHERE attributes.key = ?"
+	if resourceType != "" {
+		sql += " AND resources.type = ?"
+		params = append(params, resourceType)
+	}
+
+	var values []types.LineageAttributeValue
+	if err := db.Raw(sql, params...).Scan(&values).Error; err != nil {
+		return nil, err
+	}
+	return groupAttributeValuesByLineage(values), nil
+}
+
+// auditConsistency reports the lineages using another value than expected
+// for an attribute. Without expected value, the value used by most lineages
+// is expected, ties being broken by value order.
+func auditConsistency(key, expected string, values map[string][]string) types.ConsistencyAudit {
+	audit := types.ConsistencyAudit{
+		Key:        key,
+		Expected:   expected,
+		Lineages:   len(values),
+		Violations: []types.ConsistencyViolation{},
+	}
+
+	if expected == "" {
+		audit.Majority = true
+		counts := make(map[string]int)
+		for _, vals := range values {
+			for _, v := range vals {
+				counts[v]++
+			}
+		}
+		for v, c := range counts {
+			if c > counts[audit.Expected] || (c == counts[audit.Expected] && v < audit.Expected) {
+				audit.Expected = v
+			}
+		}
+	}
+
+	for lineage, vals := range values {
+		if len(vals) == 1 && vals[0] == audit.Expected {
+			continue
+		}
+		audit.Violations = append(audit.Violations, types.ConsistencyViolation{
+			LineageValue: lineage,
+			Values:       vals,
+		})
+	}
+	sort.Slice(audit.Violations, func(i, j int) bool {
+		return audit.Violations[i].LineageValue < audit.Violations[j].LineageValue
+	})
+	return audit
+}
+
+// AuditAttributeConsistency checks that all lineages use the same value,
+// in their most recent State, for an attribute key, optionally restricted
+// to a Resource type
+func (db *Database) AuditAttributeConsistency(key, expected, resourceType string) (types.ConsistencyAudit, error) {
+	values, err := db.GetAttributeValuesByLineage(key, resourceType)
+	if err != nil {
+		return types.ConsistencyAudit{}, err
+	}
+	return auditConsistency(key, expected, values), nil
+}
+
+// accountAttribute is an attribute of a Resource which may hold
+// the cloud account it belongs to
+type accountAttribute struct {
+	LineageValue string
+	ResourceType string
+	Key          string
+	Value        string
+}
+
+// resourceCloud returns the cloud of a resource type, from its prefix
+// (aws_instance is an aws resource)
+func resourceCloud(resourceType string) string {
+	return strings.SplitN(resourceType, "_", 2)[0]
+}
+
+// countCloudAccounts counts the lineages using each cloud account, given
+// the attribute keys holding the account for each cloud. Attributes with
+// another key for the cloud of their resource, or without value, are ignored.
+func countCloudAccounts(attributes []accountAttribute, keys map[string][]string) []types.CloudAccount {
+	lineages := make(map[types.CloudAccount]map[string]bool)
+	for _, a := range attributes {
+		cloud := resourceCloud(a.ResourceType)
+		if a.Value == "" || !containsString(keys[cloud], a.Key) {
+			continue
+		}
+		account := types.CloudAccount{Cloud: cloud, Account: a.Value}
+		if lineages[account] == nil {
+			lineages[account] = make(map[string]bool)
+		}
+		lineages[account][a.LineageValue] = true
+	}
+
+	accounts := []types.CloudAccount{}
+	for account, l := range lineages {
+		account.Lineages = len(l)
+		accounts = append(accounts, account)
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		if accounts[i].Cloud != accounts[j].Cloud {
+			return accounts[i].Cloud < accounts[j].Cloud
+		}
+		return accounts[i].Account < accounts[j].Account
+	})
+	return accounts
+}
+
+// ListCloudAccounts returns the distinct cloud accounts found in the most
+// recent State of each lineage, given the attribute keys holding the account
+// for each cloud
+func (db *Database) ListCloudAccounts(keys map[string][]string) ([]types.CloudAccount, error) {
+	var allKeys []string
+	for _, k := range keys {
+		allKeys = append(allKeys, k...)
+	}
+	if len(allKeys) == 0 {
+		return []types.CloudAccount{}, nil
+	}
+
+	sql := "SELECT lineages.value AS lineage_value, resources.type AS resource_type, attributes.key, attributes.value" +
+		" FROM (" + latestStatesSQL + ") t" +
+		" JOIN lineages ON lineages.id = t.lineage_id" +
+		" JOIN modules ON modules.state_id = t.id" +
+		" JOIN resources ON resources.module_id = modules.id" +
+		" JOIN attributes ON attributes.resource_id = COALESCE(resources.attributes_from_id, resources.id)" +
+		" WHERE attributes.key IN ?"
+
+	var attributes []accountAttribute
+	if err := db.Raw(sql, allKeys).Scan(&attributes).Error; err != nil {
+		return nil, err
+	}
+	return countCloudAccounts(attributes, keys), nil
+}
+
+// buildTimeline merges the Plans and the State versions of a Lineage
+// chronologically, a Plan coming before a version created at the same time.
+// The resource delta of a version is computed against the previous version.
+func buildTimeline(plans []types.Plan, versions []types.StateStat) []types.TimelineEntry {
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].LastModified.Before(versions[j].LastModified) })
+
+	timeline := []types.TimelineEntry{}
+	for _, p := range plans {
+		timeline = append(timeline, types.TimelineEntry{
+			Type: types.TimelinePlanEntry,
+			Time: p.CreatedAt,
+			Plan: &types.TimelinePlan{
+				ID:        p.ID,
+				GitCommit: p.GitCommit,
+				Add:       p.Summary.Add,
+				Change:    p.Summary.Change,
+				Destroy:   p.Summary.Destroy,
+			},
+		})
+	}
+	previous := 0
+	for _, v := range versions {
+		timeline = append(timeline, types.TimelineEntry{
+			Type: types.TimelineVersionEntry,
+			Time: v.LastModified,
+			Version: &types.TimelineVersion{
+				VersionID:     v.VersionID,
+				Serial:        v.Serial,
+				ResourceCount: v.ResourceCount,
+				ResourceDelta: v.ResourceCount - previous,
+			},
+		})
+		previous = v.ResourceCount
+	}
+
+	sort.SliceStable(timeline, func(i, j int) bool {
+		if !timeline[i].Time.Equal(timeline[j].Time) {
+			return timeline[i].Time.Before(timeline[j].Time)
+		}
+		return timeline[i].Type == types.TimelinePlanEntry && timeline[j].Type == types.TimelineVersionEntry
+	})
+	return timeline
+}
+
+// versionResourceCountsSQL selects State versions with their resource count,
+// to be completed with a WHERE clause and versionResourceCountsGroupBy
+const versionResourceCountsSQL = "SELECT versions.version_id, versions.last_modified, states.serial, count(resources.id) AS resource_count" +
+	" FROM states" +
+	" JOIN lineages ON lineages.id = states.lineage_id" +
+	" JOIN versions ON versions.id = states.version_id" +
+	" LEFT JOIN modules ON modules.state_id = states.id" +
+	" LEFT JOIN resources ON resources.module_id = modules.id"
+
+const versionResourceCountsGroupBy = " GROUP BY versions.version_id, versions.last_modified, states.serial"
+
+// GetVersionSummary returns the resource count of a State version
+// and its difference with the previous version of the State
+func (db *Database) GetVersionSummary(path, versionID string) (types.TimelineVersion, error) {
+	sql := versionResourceCountsSQL + " WHERE states.path = ?" + versionResourceCountsGroupBy
+	var versions []types.StateStat
+	if err := db.Raw(sql, path).Scan(&versions).Error; err != nil {
+		return types.TimelineVersion{}, err
+	}
+
+	for _, entry := range buildTimeline(nil, versions) {
+		if entry.Version.VersionID == versionID {
+			return *entry.Version, nil
+		}
+	}
+	return types.TimelineVersion{}, ErrUnknownVersion
+}
+
+// GetPreviousVersionID returns the ID of the version preceding a version
+// of a State, or an empty ID for its first version
+func (db *Database) GetPreviousVersionID(path, versionID string) (string, error) {
+	sql := versionResourceCountsSQL + " WHERE states.path = ?" + versionResourceCountsGroupBy
+	var versions []types.StateStat
+	if err := db.Raw(sql, path).Scan(&versions).Error; err != nil {
+		return "", err
+	}
+
+	previous := ""
+	for _, entry := range buildTimeline(nil, versions) {
+		if entry.Version.VersionID == versionID {
+			return previous, nil
+		}
+		previous = entry.Version.VersionID
+	}
+	return "", ErrUnknownVersion
+}
+
+// GetLineageTimeline returns, by pages, the Plans and State versions
+// of a Lineage merged chronologically
+func (db *Database) GetLineageTimeline(lineage string, page int) (timeline []types.TimelineEntry, total int, err error) {
+	var plans []types.Plan
+	err = db.Select("plans.id", "plans.created_at", "plans.git_commit",
+		"plans.summary_add", "plans.summary_change", "plans.summary_destroy").
+		Joins("JOIN lineages ON lineages.id = plans.lineage_id").
+		Where("lineages.value = ?", lineage).
+		Find(&plans).Error
+	if err != nil {
+		return
+	}
+
+	sql := versionResourceCountsSQL + " WHERE lineages.value = ?" + versionResourceCountsGroupBy
+	var versions []types.StateStat
+	if err = db.Raw(sql, lineage).Scan(&versions).Error; err != nil {
+		return
+	}
+
+	timeline = buildTimeline(plans, versions)
+	total = len(timeline)
+	start := (page - 1) * pageSize
+	if start > total {
+		start = total
+	}
+	end := start + pageSize
+	if end > total {
+		end = total
+	}
+	return timeline[start:end], total, nil
+}
+
+// summarizeLineageChanges computes, for each lineage with States ingested within
+// the [from, to] window, the number of new versions and the resource count
+// difference with the last State before the window
+func summarizeLineageChanges(states []types.StateStat, from, to time.Time) (changes []types.LineageChange) {
+	sort.SliceStable(states, func(i, j int) bool { return states[i].LastModified.Before(states[j].LastModified) })
+
+	type window struct {
+		change types.LineageChange
+		before int
+		last   int
+	}
+	windows := make(map[string]*window)
+	for _, s := range states {
+		if s.LastModified.After(to) {
+			continue
+		}
+		w, ok := windows[s.LineageValue]
+		if !ok {
+			w = &window{change: types.LineageChange{LineageValue: s.LineageValue}}
+			windows[s.LineageValue] = w
+		}
+		if s.LastModified.Before(from) {
+			w.before = s.ResourceCount
+			continue
+		}
+		w.change.NewVersions++
+		w.last = s.ResourceCount
+	}
+
+	changes = []types.LineageChange{}
+	for _, w := range windows {
+		if w.change.NewVersions == 0 {
+			continue
+		}
+		w.change.ResourceDelta = w.last - w.before
+		changes = append(changes, w.change)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].LineageValue < changes[j].LineageValue })
+	return
+}
+
+// GetChangedLineages returns the lineages which ingested new versions
+// between two dates, with their count of new versions and resource delta
+func (db *Database) GetChangedLineages(from, to time.Time) ([]types.LineageChange, error) {
+	sql := "SELECT lineages.value AS lineage_value, versions.last_modified," +
+		" (SELECT count(*) FROM modules JOIN resources ON resources.module_id = modules.id WHERE modules.state_id = states.id) AS resource_count" +
+		" FROM states" +
+		" JOIN versions ON versions.id = states.version_id" +
+		" JOIN lineages ON lineages.id = states.lineage_id" +
+		" WHERE versions.last_modified <= ?" +
+		" AND states.lineage_id IN (SELECT states.lineage_id FROM states" +
+		" JOIN versions ON versions.id = states.version_id" +
+		" WHERE versions.last_modified BETWEEN ? AND ?)"
+
+	var states []types.StateStat
+	if err := db.Raw(sql, to, from, to).Scan(&states).Error; err != nil {
+		return nil, err
+	}
+	return summarizeLineageChanges(states, from, to), nil
+}
+
+// versionResource is a Resource of a State version, or a State version
+// without resources when its address is empty
+type versionResource struct {
+	lineage      string
+	stateID      uint
+	versionID    string
+	lastModified time.Time
+	address      string
+	resourceType string
+	// attributes is a fingerprint of the Resource attributes
+	attributes string
+}
+
+// findNewResources returns the resources of the versions modified within
+// [from, to] which didn't exist in the previous version of their Lineage,
+// if any. Rows must be ordered by lineage and version.
+func findNewResources(rows []versionResource, from, to time.Time) []types.NewResource {
+	results := []types.NewResource{}
+	var previous, current map[string]bool
+	for i, r := range rows {
+		if i == 0 || r.lineage != rows[i-1].lineage {
+			previous, current = nil, make(map[string]bool)
+		} else if r.stateID != rows[i-1].stateID {
+			previous, current = current, make(map[string]bool)
+		}
+		if r.address == "" {
+			continue
+		}
+		current[r.address] = true
+
+		// All resources of the first version of a Lineage are new
+		if previous[r.address] {
+			continue
+		}
+		if r.lastModified.Before(from) || r.lastModified.After(to) {
+			continue
+		}
+		results = append(results, types.NewResource{
+			LineageValue: r.lineage,
+			Address:      r.address,
+			Type:         r.resourceType,
+			VersionID:    r.versionID,
+			LastModified: r.lastModified,
+		})
+	}
+	return results
+}
+
+// GetNewResources returns, by pages, the resources which first appeared
+// in a version modified within [from, to]
+func (db *Database) GetNewResources(from, to time.Time, page int) (results []types.NewResource, total int, err error) {
+	sqlQuery := "SELECT lineages.value, states.id, versions.version_id, versions.last_modified," +
+		" modules.path, resources.mode, resources.type, resources.name, resources.index" +
+		" FROM states" +
+		" JOIN versions ON versions.id = states.version_id" +
+		" JOIN lineages ON lineages.id = states.lineage_id" +
+		" LEFT JOIN modules ON modules.state_id = states.id" +
+		" LEFT JOIN resources ON resources.module_id = modules.id" +
+		" WHERE versions.last_modified <= ?" +
+		" AND states.lineage_id IN (SELECT states.lineage_id FROM states" +
+		" JOIN versions ON versions.id = states.version_id" +
+		" WHERE versions.last_modified BETWEEN ? AND ?)" +
+		" ORDER BY lineages.value, versions.last_modified, states.id"
+
+	rows, err := db.Raw(sqlQuery, to, from, to).Rows()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var resources []versionResource
+	for rows.Next() {
+		var r versionResource
+		var modulePath, mode, resourceType, name, index sql.NullString
+		if err := rows.Scan(&r.lineage, &r.stateID, &r.versionID, &r.lastModified,
+			&modulePath, &mode, &resourceType, &name, &index); err != nil {
+			return nil, 0, err
+		}
+		if name.Valid {
+			r.address = resourceAddress(modulePath.String, mode.String, resourceType.String, name.String, index.String)
+			r.resourceType = resourceType.String
+		}
+		resources = append(resources, r)
+	}
+
+	results = findNewResources(resources, from, to)
+	total = len(results)
+	start := (page - 1) * pageSize
+	if start > total {
+		start = total
+	}
+	end := start + pageSize
+	if end > total {
+		end = total
+	}
+	return results[start:end], total, nil
+}
+
+// Kinds of changes of a Resource between versions
+const (
+	resourceCreated = "created"
+	resourceUpdated = "updated"
+	resourceDeleted = "deleted"
+)
+
+// foldChange folds the change of a Resource between two versions into its
+// net change since the first version, an empty result meaning no net change
+func foldChange(net, change string) string {
+	switch change {
+	case resourceCreated:
+		if net == resourceDeleted {
+			return resourceUpdated
+		}
+		return resourceCreated
+	case resourceUpdated:
+		if net == resourceCreated {
+			return resourceCreated
+		}
+		return resourceUpdated
+	case resourceDeleted:
+		if net == resourceCreated {
+			return ""
+		}
+		return resourceDeleted
+	}
+	return net
+}
+
+// buildChangelog folds the diffs of each adjacent pair of the versions
+// modified within [from, to], starting from the last version before the
+// range, into the net changes of the Lineage. Rows must be ordered by version.
+func buildChangelog(rows []versionResource, from, to time.Time) (changelog types.Changelog) {
+	changelog.From, changelog.To = from, to
+	changelog.Created = []types.ChangelogResource{}
+	changelog.Updated = []types.ChangelogResource{}
+	changelog.Deleted = []types.ChangelogResource{}
+
+	var previous map[string]string
+	current := make(map[string]string)
+	resourceTypes := make(map[string]string)
+	net := make(map[string]string)
+	for i, r := range rows {
+		if r.lastModified.After(to) {
+			break
+		}
+		if i > 0 && r.stateID != rows[i-1].stateID {
+			previous, current = current, make(map[string]string)
+		}
+		if r.address != "" {
+			current[r.address] = r.attributes
+			resourceTypes[r.address] = r.resourceType
+		}
+		if i+1 < len(rows) && rows[i+1].stateID == r.stateID {
+			continue
+		}
+
+		// Diff the last version with the previous one once all its
+		// resources are known
+		if r.lastModified.Before(from) {
+			continue
+		}
+		changelog.Versions++
+		for address, attributes := range current {
+			prev, ok := previous[address]
+			if !ok {
+				net[address] = foldChange(net[address], resourceCreated)
+			} else if prev != attributes {
+				net[address] = foldChange(net[address], resourceUpdated)
+			}
+		}
+		for address := range previous {
+			if _, ok := current[address]; !ok {
+				net[address] = foldChange(net[address], resourceDeleted)
+			}
+		}
+	}
+
+	for address, change := range net {
+		resource := types.ChangelogResource{Address: address, Type: resourceTypes[address]}
+		switch change {
+		case resourceCreated:
+			changelog.Created = append(changelog.Created, resource)
+		case resourceUpdated:
+			changelog.Updated = append(changelog.Updated, resource)
+		case resourceDeleted:
+			changelog.Deleted = append(changelog.Deleted, resource)
+		}
+	}
+	for _, resources := range [][]types.ChangelogResource{changelog.Created, changelog.Updated, changelog.Deleted} {
+		sort.Slice(resources, func(i, j int) bool { return resources[i].Address < resources[j].Address })
+	}
+	return
+}
+
+// GetChangelog returns the net changes of a Lineage over the versions
+// modified within [from, to]
+func (db *Database) GetChangelog(lineage string, from, to time.Time) (types.Changelog, error) {
+	sqlQuery := "SELECT states.id, versions.version_id, versions.last_modified," +
+		" modules.path, resources.mode, resources.type, resources.name, resources.index," +
+		" (SELECT md5(string_agg(attributes.key || '=' || attributes.value, ',' ORDER BY attributes.key))" +
+		" FROM attributes WHERE attributes.resource_id = COALESCE(resources.attributes_from_id, resources.id))" +
+		" FROM states" +
+		" JOIN versions ON versions.id = states.version_id" +
+		" JOIN lineages ON lineages.id = states.lineage_id" +
+		" LEFT JOIN modules ON modules.state_id = states.id" +
+		" LEFT JOIN resources ON resources.module_id = modules.id" +
+		" WHERE lineages.value = ? AND versions.last_modified <= ?" +
+		" ORDER BY versions.last_modified, states.id"
+
+	rows, err := db.Raw(sqlQuery, lineage, to).Rows()
+	if err != nil {
+		return types.Changelog{}, err
+	}
+	defer rows.Close()
+
+	var resources []versionResource
+	for rows.Next() {
+		r := versionResource{lineage: lineage}
+		var modulePath, mode, resourceType, name, index, attributes sql.NullString
+		if err := rows.Scan(&r.stateID, &r.versionID, &r.lastModified,
+			&modulePath, &mode, &resourceType, &name, &index, &attributes); err != nil {
+			return types.Changelog{}, err
+		}
+		if name.Valid {
+			r.address = resourceAddress(modulePath.String, mode.String, resourceType.String, name.String, index.String)
+			r.resourceType = resourceType.String
+			r.attributes = attributes.String
+		}
+		resources = append(resources, r)
+	}
+
+	changelog := buildChangelog(resources, from, to)
+	changelog.LineageValue = lineage
+	return changelog, nil
+}
+
+// quantile returns the q-quantile of sorted values, using linear interpolation
+func quantile(sorted []float64, q float64) float64 {
+	pos := q * float64(len(sorted)-1)
+	i := int(pos)
+	if i+1 >= len(sorted) {
+		return sorted[i]
+	}
+	return sorted[i] + (pos-float64(i))*(sorted[i+1]-sorted[i])
+}
+
+// findOutliers returns the results whose attribute value is outside of
+// [Q1 - 1.5*IQR, Q3 + 1.5*IQR]. Non-numeric values are skipped.
+func findOutliers(results []types.SearchResult) (outliers types.AttributeOutliers) {
+	outliers.Outliers = []types.SearchResult{}
+
+	var numeric []types.SearchResult
+	var values []float64
+	for _, r := range results {
+		v, err := strconv.ParseFloat(strings.Trim(r.AttributeValue, `"`), 64)
+		if err != nil {
+			continue
+		}
+		numeric = append(numeric, r)
+		values = append(values, v)
+	}
+	if len(values) == 0 {
+		return
+	}
+
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	q1, q3 := quantile(sorted, 0.25), quantile(sorted, 0.75)
+	iqr := q3 - q1
+	outliers.LowerBound = q1 - 1.5*iqr
+	outliers.UpperBound = q3 + 1.5*iqr
+
+	for i, v := range values {
+		if v < outliers.LowerBound || v > outliers.UpperBound {
+			outliers.Outliers = append(outliers.Outliers, numeric[i])
+		}
+	}
+	return
+}
+
+// GetAttributeOutliers returns the resources, in the most recent State of each
+// lineage, whose numeric value for an attribute key is a statistical outlier
+func (db *Database) GetAttributeOutliers(key, resourceType string) (types.AttributeOutliers, error) {
+	params := []interface{}{key}
+	sql := "SELECT t.path, versions.version_id, t.tf_version, t.serial, lineages.value AS lineage_value," +
+		" modules.path AS module_path, resources.type, resources.name, resources.index," +
+		" attributes.key, attributes.value" +
+		" FROM (SELECT DISTINCT ON(states.lineage_id) states.id, states.lineage_id, states.path, states.tf_version, states.serial, states.version_id" +
+		" FROM states JOIN versions ON versions.id = states.version_id" +
+		" ORDER BY states.lineage_id, versions.last_modified DESC) t" +
+		" JOIN versions ON versions.id = t.version_id" +
+		" JOIN lineages ON lineages.id = t.lineage_id" +
+		" JOIN modules ON modules.state_id = t.id" +
+		" JOIN resources ON resources.module_id = modules.id" +
+		" JOIN attributes ON attributes.resource_id = COALESCE(resources.attributes_from_id, resources.id)" +
+		" WHERE attributes.key = ?"
+	if resourceType != "" {
+		sql += " AND resources.type = ?"
+		params = append(params, resourceType)
+	}
+
+	var results []types.SearchResult
+	if err := db.Raw(sql, params...).Scan(&results).Error; err != nil {
+		return types.AttributeOutliers{}, err
+	}
+	return findOutliers(results), nil
+}
+
+// attributeObservation is the value of an attribute of a Resource,
+// identified by its lineage and address, in a State version
+type attributeObservation struct {
+	resource string
+	key      string
+	value    string
+}
+
+// rankAttributeVolatility counts, for each attribute key, its observations
+// and the changes of its value from the previous version of the same
+// Resource, and ranks keys by decreasing ratio of changes to observations.
+// Rows must be ordered by version.
+func rankAttributeVolatility(rows []attributeObservation) []types.AttributeVolatility {
+	previous := make(map[string]string)
+	byKey := make(map[string]*types.AttributeVolatility)
+	for _, row := range rows {
+		v, ok := byKey[row.key]
+		if !ok {
+			v = &types.AttributeVolatility{Key: row.key}
+			byKey[row.key] = v
+		}
+		v.Observations++
+
+		id := row.resource + "\x00" + row.key
+		if value, seen := previous[id]; seen && value != row.value {
+			v.Changes++
+		}
+		previous[id] = row.value
+	}
+
+	results := []types.AttributeVolatility{}
+	for _, v := range byKey {
+		v.Volatility = float64(v.Changes) / float64(v.Observations)
+		results = append(results, *v)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Volatility != results[j].Volatility {
+			return results[i].Volatility > results[j].Volatility
+		}
+		if results[i].Changes != results[j].Changes {
+			return results[i].Changes > results[j].Changes
+		}
+		return results[i].Key < results[j].Key
+	})
+	return results
+}
+
+// GetAttributeVolatility ranks the attribute keys of a Resource type by how
+// often their values changed across the versions of the lineages
+func (db *Database) GetAttributeVolatility(resourceType string) ([]types.AttributeVolatility, error) {
+	sqlQuery := "SELECT lineages.value, modules.path, resources.mode, resources.name, resources.index," +
+		" attributes.key, attributes.value" +
+		" FROM states" +
+		" JOIN versions ON versions.id = states.version_id" +
+		" JOIN lineages ON lineages.id = states.lineage_id" +
+		" JOIN modules ON modules.state_id = states.id" +
+		" JOIN resources ON resources.module_id = modules.id" +
+		" JOIN attributes ON attributes.resource_id = COALESCE(resources.attributes_from_id, resources.id)" +
+		" WHERE resources.type = ?" +
+		" ORDER BY versions.last_modified, states.id"
+
+	rows, err := db.Raw(sqlQuery, resourceType).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var observations []attributeObservation
+	for rows.Next() {
+		var lineage, modulePath, mode, name, index string
+		var o attributeObservation
+		if err := rows.Scan(&lineage, &modulePath, &mode, &name, &index, &o.key, &o.value); err != nil {
+			return nil, err
+		}
+		o.resource = lineage + "/" + resourceAddress(modulePath, mode, resourceType, name, index)
+		observations = append(observations, o)
+	}
+	return rankAttributeVolatility(observations), nil
+}
+
+// GetLineagesByPaths returns the lineage of the States stored at the given paths
+func (db *Database) GetLineagesByPaths(paths []string) (lineages map[string]string, err error) {
+	lineages = make(map[string]string)
+	if len(paths) == 0 {
+		return
+	}
+
+	rows, err := db.Table("states").
+		Select("DISTINCT states.path, lineages.value").
+		Joins("JOIN lineages ON lineages.id = states.lineage_id").
+		Where("states.path IN ?", paths).
+		Rows()
+	if err != nil {
+		return
+	}
+	defer rows.Close()
 
-	db.Raw(sql, params...).Find(&states)
+	for rows.Next() {
+		var path, lineage string
+		if err = rows.Scan(&path, &lineage); err != nil {
+			return
+		}
+		lineages[path] = lineage
+	}
 	return
 }
 
-// listField is a wrapper utility method to list distinct values in Database tables.
-func (db *Database) listField(table, field string) (results []string, err error) {
-	rows, err := db.Table(table).Select(fmt.Sprintf("DISTINCT %s", field)).Rows()
+// GetLineagePaths returns the paths of the States of a Lineage, by provider
+func (db *Database) GetLineagePaths(lineage string) (paths map[string][]string, err error) {
+	rows, err := db.Table("states").
+		Select("DISTINCT states.provider, states.path").
+		Joins("JOIN lineages ON lineages.id = states.lineage_id").
+		Where("lineages.value = ?", lineage).
+		Order("states.provider, states.path").
+		Rows()
 	if err != nil {
-		return results, err
+		return
 	}
 	defer rows.Close()
 
+	paths = make(map[string][]string)
 	for rows.Next() {
-		var t string
-		if err = rows.Scan(&t); err != nil {
+		var provider, path string
+		if err = rows.Scan(&provider, &path); err != nil {
 			return
 		}
-		results = append(results, t)
+		paths[provider] = append(paths[provider], path)
+	}
+	if len(paths) == 0 {
+		err = ErrLineageNotFound
 	}
-
 	return
 }
 
-// ListResourceTypes lists all Resource types from the Database
-func (db *Database) ListResourceTypes() ([]string, error) {
-	return db.listField("resources", "type")
+// RecordLocks records the locks currently held on a provider, extending
+// the lock events already known and creating the new ones
+func (db *Database) RecordLocks(provider string, locks map[string]state.LockInfo, now time.Time) error {
+	for path, l := range locks {
+		var event types.LockEvent
+		err := db.Where("provider = ? AND path = ? AND lock_id = ?", provider, path, l.ID).
+			First(&event).Error
+		if err == nil {
+			if err := db.Model(&event).Update("last_seen", now).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		created := now
+		if l.Created != nil {
+			created = *l.Created
+		}
+		event = types.LockEvent{
+			Path:      path,
+			Provider:  provider,
+			LockID:    l.ID,
+			Operation: l.Operation,
+			Who:       l.Who,
+			Created:   created,
+			LastSeen:  now,
+		}
+		if err := db.Create(&event).Error; err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// ListResourceTypesWithCount returns a list of Resource types with associated counts
-// from the Database
-func (db *Database) ListResourceTypesWithCount() (results []map[string]string, err error) {
-	sql := "SELECT resources.type, COUNT(*)" +
-		" FROM (SELECT DISTINCT ON(states.path) states.id, states.path, states.serial, states.tf_version, versions.version_id, versions.last_modified" +
-		" FROM states" +
-		" JOIN versions ON versions.id = states.version_id" +
-		" ORDER BY states.path, versions.last_modified DESC) t" +
-		" JOIN modules ON modules.state_id = t.id" +
-		" JOIN resources ON resources.module_id = modules.id" +
-		" GROUP BY resources.type" +
-		" ORDER BY count DESC"
+// aggregateLockHolders counts, per holder, the lock events overlapping
+// the [from, to] window and the time they were held within it.
+// Holders are sorted by decreasing held time.
+func aggregateLockHolders(events []types.LockEvent, from, to time.Time) []types.LockHolder {
+	holders := make(map[string]*types.LockHolder)
+	for _, e := range events {
+		start, end := e.Created, e.LastSeen
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if end.Before(start) {
+			continue
+		}
 
-	rows, err := db.Raw(sql).Rows()
-	if err != nil {
-		return results, err
+		h, ok := holders[e.Who]
+		if !ok {
+			h = &types.LockHolder{Who: e.Who}
+			holders[e.Who] = h
+		}
+		h.Locks++
+		h.HeldSeconds += int64(end.Sub(start).Seconds())
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var name string
-		var count string
-		r := make(map[string]string)
-		if err = rows.Scan(&name, &count); err != nil {
-			return
+	results := []types.LockHolder{}
+	for _, h := range holders {
+		results = append(results, *h)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].HeldSeconds != results[j].HeldSeconds {
+			return results[i].HeldSeconds > results[j].HeldSeconds
 		}
-		r["name"] = name
-		r["count"] = count
-		results = append(results, r)
+		return results[i].Who < results[j].Who
+	})
+	return results
+}
+
+// GetLockHolders returns the holders of the locks recorded on the States
+// of a Lineage within the last days
+func (db *Database) GetLockHolders(lineage string, days int, now time.Time) ([]types.LockHolder, error) {
+	from := now.AddDate(0, 0, -days)
+
+	var events []types.LockEvent
+	err := db.Where("last_seen >= ? AND path IN (?)", from,
+		db.Table("states").
+			Select("DISTINCT states.path").
+			Joins("JOIN lineages ON lineages.id = states.lineage_id").
+			Where("lineages.value = ?", lineage)).
+		Find(&events).Error
+	if err != nil {
+		return nil, err
 	}
-	return
+	return aggregateLockHolders(events, from, now), nil
 }
 
 // ListResourceNames lists all Resource names from the Database
@@ -594,8 +3262,23 @@ func (db *Database) ListAttributeKeys(resourceType string) (results []string, er
 	return
 }
 
-// InsertPlan inserts a Terraform plan with associated information in the Database
-func (db *Database) InsertPlan(plan []byte) error {
+// InsertPlan inserts a Terraform plan with associated information in the Database,
+// along with the authenticated user who submitted it
+func (db *Database) InsertPlan(plan []byte, submitter string) error {
+	var p types.Plan
+	if err := json.Unmarshal(plan, &p); err != nil {
+		return err
+	}
+	p.Submitter = submitter
+	summary, err := parsePlanSummary(p.PlanJSON, db.strictPlanFormat)
+	if err != nil {
+		return err
+	}
+	p.Summary = summary
+	if err := json.Unmarshal(p.PlanJSON, &p.ParsedPlan); err != nil {
+		return err
+	}
+
 	var lineage types.Lineage
 	if err := json.Unmarshal(plan, &lineage); err != nil {
 		return err
@@ -607,28 +3290,46 @@ func (db *Database) InsertPlan(plan []byte) error {
 		return fmt.Errorf("Error on lineage retrival during plan insertion: %v", res.Error)
 	}
 
-	var p types.Plan
-	if err := json.Unmarshal(plan, &p); err != nil {
-		return err
+	p.LineageID = lineage.ID
+	return db.Create(&p).Error
+}
+
+// IsTransientError returns true if a database error is likely to succeed
+// when retried: serialization failures, deadlocks and connection errors
+func IsTransientError(err error) bool {
+	if err == nil {
+		return false
 	}
-	if err := json.Unmarshal(p.PlanJSON, &p.ParsedPlan); err != nil {
-		return err
+
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) {
+		code := pgErr.SQLState()
+		switch {
+		case code == "40001", code == "40P01", code == "57P01", strings.HasPrefix(code, "08"):
+			return true
+		}
+		return false
 	}
 
-	p.LineageID = lineage.ID
-	return db.Create(&p).Error
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return strings.Contains(err.Error(), "connection reset by peer")
 }
 
 // GetPlansSummary retrieves a summary of all Plans of a lineage from the database
-func (db *Database) GetPlansSummary(lineage, limitStr, pageStr string) (plans []types.Plan, page int, total int) {
+func (db *Database) GetPlansSummary(lineage, limitStr, pageStr string, includeDeleted bool) (plans []types.Plan, page int, total int) {
 	var whereClause []interface{}
-	var whereClauseTotal string
 	if lineage != "" {
 		whereClause = append(whereClause, `"Lineage"."value" = ?`, lineage)
-		whereClauseTotal = ` JOIN lineages on lineages.id=t.lineage_id WHERE lineages.value = ?`
 	}
 
-	row := db.Raw("SELECT count(*) FROM plans AS t"+whereClauseTotal, lineage).Row()
+	totalSQL, totalParams := planListTotalSQL(lineage, includeDeleted)
+	row := db.Raw(totalSQL, totalParams...).Row()
 	if err := row.Scan(&total); err != nil {
 		log.Error(err.Error())
 	}
@@ -658,7 +3359,11 @@ func (db *Database) GetPlansSummary(lineage, limitStr, pageStr string) (plans []
 		}
 	}
 
-	db.Select(`"plans"."id"`, `"plans"."created_at"`, `"plans"."updated_at"`, `"plans"."tf_version"`,
+	query := db.DB
+	if includeDeleted {
+		query = query.Unscoped()
+	}
+	query.Select(`"plans"."id"`, `"plans"."created_at"`, `"plans"."updated_at"`, `"plans"."deleted_at"`, `"plans"."tf_version"`,
 		`"plans"."git_remote"`, `"plans"."git_commit"`, `"plans"."ci_url"`, `"plans"."source"`).
 		Joins("Lineage").
 		Order("created_at desc").
@@ -669,9 +3374,10 @@ func (db *Database) GetPlansSummary(lineage, limitStr, pageStr string) (plans []
 	return
 }
 
-// GetPlan retrieves a specific Plan by his ID from the database
+// GetPlan retrieves a specific Plan by his ID from the database,
+// even if it is soft-deleted
 func (db *Database) GetPlan(id string) (plans types.Plan) {
-	db.Joins("Lineage").
+	db.Unscoped().Joins("Lineage").
 		Preload("ParsedPlan").
 		Preload("ParsedPlan.PlanStateValue").
 		Preload("ParsedPlan.PlanStateValue.PlanStateOutputs").
@@ -696,16 +3402,80 @@ func (db *Database) GetPlan(id string) (plans types.Plan) {
 	return
 }
 
+// planListTotalSQL returns the query counting the Plans of a lineage, or of
+// all lineages if empty, soft-deleted Plans being only counted if included
+func planListTotalSQL(lineage string, includeDeleted bool) (sql string, params []interface{}) {
+	sql = "SELECT count(*) FROM plans AS t"
+	var conditions []string
+	if lineage != "" {
+		sql += " JOIN lineages on lineages.id=t.lineage_id"
+		conditions = append(conditions, "lineages.value = ?")
+		params = append(params, lineage)
+	}
+	if !includeDeleted {
+		conditions = append(conditions, "t.deleted_at IS NULL")
+	}
+	if len(conditions) > 0 {
+		sql += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	return
+}
+
+// DeletePlan soft-deletes a Plan, hiding it from the Plan listings
+// while keeping it in the history
+func (db *Database) DeletePlan(id string) error {
+	res := db.Where("id = ?", id).Delete(&types.Plan{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrPlanNotFound
+	}
+	return nil
+}
+
+// RestorePlan restores a soft-deleted Plan in the Plan listings
+func (db *Database) RestorePlan(id string) error {
+	res := db.Unscoped().Model(&types.Plan{}).Where("id = ?", id).Update("deleted_at", nil)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrPlanNotFound
+	}
+	return nil
+}
+
+// GetPlanSummary retrieves a Plan without its content, along with its summary.
+// The summary of Plans submitted before it was recorded is computed from their content.
+func (db *Database) GetPlanSummary(id string) (plan types.Plan, err error) {
+	if err = db.Omit("plan_json").First(&plan, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = ErrPlanNotFound
+		}
+		return
+	}
+	if plan.Summary.FormatVersion != "" {
+		return
+	}
+
+	var legacy types.Plan
+	if err = db.Select("plan_json").First(&legacy, id).Error; err != nil {
+		return
+	}
+	plan.Summary, err = parsePlanSummary(legacy.PlanJSON, false)
+	return
+}
+
 // GetPlans retrieves all Plan of a lineage from the database
-func (db *Database) GetPlans(lineage, limitStr, pageStr string) (plans []types.Plan, page int, total int) {
+func (db *Database) GetPlans(lineage, limitStr, pageStr string, includeDeleted bool) (plans []types.Plan, page int, total int) {
 	var whereClause []interface{}
-	var whereClauseTotal string
 	if lineage != "" {
 		whereClause = append(whereClause, `"Lineage"."value" = ?`, lineage)
-		whereClauseTotal = ` JOIN lineages on lineages.id=t.lineage_id WHERE lineages.value = ?`
 	}
 
-	row := db.Raw("SELECT count(*) FROM plans AS t"+whereClauseTotal, lineage).Row()
+	totalSQL, totalParams := planListTotalSQL(lineage, includeDeleted)
+	row := db.Raw(totalSQL, totalParams...).Row()
 	if err := row.Scan(&total); err != nil {
 		log.Error(err.Error())
 	}
@@ -735,7 +3505,11 @@ func (db *Database) GetPlans(lineage, limitStr, pageStr string) (plans []types.P
 		}
 	}
 
-	db.Joins("Lineage").
+	query := db.DB
+	if includeDeleted {
+		query = query.Unscoped()
+	}
+	query.Joins("Lineage").
 		Preload("ParsedPlan").
 		Preload("ParsedPlan.PlanStateValue").
 		Preload("ParsedPlan.PlanStateValue.PlanStateOutputs").
@@ -764,7 +3538,8 @@ func (db *Database) GetPlans(lineage, limitStr, pageStr string) (plans []types.P
 }
 
 // GetLineages retrieves all Lineage from the database
-func (db *Database) GetLineages(limitStr string) (lineages []types.Lineage) {
+func (db *Database) GetLineages(query url.Values) (lineages []types.Lineage) {
+	limitStr := query.Get("limit")
 	var limit int
 	if limitStr == "" {
 		limit = -1
@@ -777,8 +3552,265 @@ func (db *Database) GetLineages(limitStr string) (lineages []types.Lineage) {
 		}
 	}
 
-	db.Order("created_at desc").
-		Limit(limit).
+	tx := db.Order("created_at desc").
+		Limit(limit)
+
+	hidden, err := db.listHiddenTFVersions(query.Get("show_all_versions") == "true")
+	if err != nil {
+		log.Error(err.Error())
+	}
+	if len(hidden) > 0 {
+		tx = tx.Where("id NOT IN (SELECT t.lineage_id FROM ("+latestStatesSQL+") t WHERE t.tf_version IN ?)", hidden)
+	}
+	hideEmpty, tagEmpty := emptyStatesHandling(db.emptyStates, query.Get("show_empty") == "true")
+	if hideEmpty {
+		tx = tx.Where("id NOT IN (" + emptyLineagesSQL + ")")
+	}
+	if tagConds, tagParams := tagConditions("id", query["tag"]); len(tagConds) > 0 {
+		tx = tx.Where(strings.Join(tagConds, " AND "), tagParams...)
+	}
+
+	tx.Preload("Tags").Find(&lineages)
+
+	if tagEmpty {
+		var emptyIDs []uint
+		if err := db.Raw(emptyLineagesSQL).Scan(&emptyIDs).Error; err != nil {
+			log.Error(err.Error())
+		}
+		for i := range lineages {
+			for _, id := range emptyIDs {
+				if lineages[i].ID == id {
+					lineages[i].Empty = true
+				}
+			}
+		}
+	}
+	return
+}
+
+// matchLineages returns the lineage values matching a glob or regex pattern
+func matchLineages(values []string, pattern, patternType string) (matches []string, err error) {
+	var match func(string) (bool, error)
+	switch patternType {
+	case "", "glob":
+		if _, err = path.Match(pattern, ""); err != nil {
+			return
+		}
+		match = func(v string) (bool, error) { return path.Match(pattern, v) }
+	case "regex":
+		var re *regexp.Regexp
+		if re, err = regexp.Compile(pattern); err != nil {
+			return
+		}
+		match = func(v string) (bool, error) { return re.MatchString(v), nil }
+	default:
+		return nil, fmt.Errorf("unknown pattern type '%s'", patternType)
+	}
+
+	for _, v := range values {
+		ok, err := match(v)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, v)
+		}
+	}
+	return
+}
+
+// BulkTagLineages applies tags to all Lineages matching a glob or regex pattern
+// in a single transaction. Existing tags are merged with the new ones, or replaced
+// by them when overwrite is set. It returns the count of tagged Lineages.
+func (db *Database) BulkTagLineages(pattern, patternType string, tags map[string]string, overwrite bool) (count int, err error) {
+	var lineages []types.Lineage
+	if err = db.Find(&lineages).Error; err != nil {
+		return
+	}
+
+	values := make([]string, 0, len(lineages))
+	for _, l := range lineages {
+		values = append(values, l.Value)
+	}
+	matches, err := matchLineages(values, pattern, patternType)
+	if err != nil {
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, l := range lineages {
+			if !containsString(matches, l.Value) {
+				continue
+			}
+			if overwrite {
+				if err := tx.Where("lineage_id = ?", l.ID).Delete(&types.LineageTag{}).Error; err != nil {
+					return err
+				}
+			}
+			for k, v := range tags {
+				tag := types.LineageTag{LineageID: l.ID, Key: k}
+				if err := tx.Where(tag).Assign(types.LineageTag{Value: v}).FirstOrCreate(&tag).Error; err != nil {
+					return err
+				}
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		count = 0
+	}
+	return
+}
+
+// ErrTagNotFound is returned when a tag is not set on a Lineage
+var ErrTagNotFound = errors.New("tag not found")
+
+// ErrInvalidTag is returned when a tag is empty once normalized
+var ErrInvalidTag = errors.New("invalid tag")
+
+var tagSpaces = regexp.MustCompile(`\s+`)
+
+// normalizeTag returns a tag trimmed and lowercased, with spaces replaced by dashes
+func normalizeTag(tag string) string {
+	return tagSpaces.ReplaceAllString(strings.ToLower(strings.TrimSpace(tag)), "-")
+}
+
+// parseTag returns the LineageTag of a free-form tag, either a key
+// or a key=value pair, normalized
+func parseTag(tag string) (types.LineageTag, error) {
+	parts := strings.SplitN(tag, "=", 2)
+	t := types.LineageTag{Key: normalizeTag(parts[0])}
+	if len(parts) == 2 {
+		t.Value = normalizeTag(parts[1])
+	}
+	if t.Key == "" {
+		return t, fmt.Errorf("%w: '%s'", ErrInvalidTag, tag)
+	}
+	return t, nil
+}
+
+// tagConditions returns the conditions on a lineage ID column selecting
+// the Lineages holding all the given tags, matched by key, or by key and
+// value for key=value tags. Empty tags are ignored.
+func tagConditions(column string, tags []string) (conditions []string, params []interface{}) {
+	for _, tag := range tags {
+		t, err := parseTag(tag)
+		if err != nil {
+			continue
+		}
+		if t.Value == "" {
+			conditions = append(conditions, column+" IN (SELECT lineage_id FROM lineage_tags WHERE lower(key) = ?)")
+			params = append(params, t.Key)
+		} else {
+			conditions = append(conditions, column+" IN (SELECT lineage_id FROM lineage_tags WHERE lower(key) = ? AND lower(value) = ?)")
+			params = append(params, t.Key, t.Value)
+		}
+	}
+	return
+}
+
+// lineageIDs returns the IDs of the Lineages with a value,
+// one per provider holding it
+func (db *Database) lineageIDs(lineage string) (ids []uint, err error) {
+	if err = db.Model(&types.Lineage{}).Where("value = ?", lineage).Pluck("id", &ids).Error; err != nil {
+		return
+	}
+	if len(ids) == 0 {
+		err = ErrLineageNotFound
+	}
+	return
+}
+
+// GetLineageTags returns the tags of a Lineage, sorted by key
+func (db *Database) GetLineageTags(lineage string) (tags []types.LineageTag, err error) {
+	ids, err := db.lineageIDs(lineage)
+	if err != nil {
+		return
+	}
+	tags = []types.LineageTag{}
+	err = db.Where("lineage_id IN ?", ids).Order("key").Find(&tags).Error
+	return
+}
+
+// AddLineageTags attaches free-form tags to a Lineage,
+// replacing the value of the tags already set
+func (db *Database) AddLineageTags(lineage string, tags []string) error {
+	ids, err := db.lineageIDs(lineage)
+	if err != nil {
+		return err
+	}
+	var parsed []types.LineageTag
+	for _, tag := range tags {
+		t, err := parseTag(tag)
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, t)
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, id := range ids {
+			for _, t := range parsed {
+				tag := types.LineageTag{LineageID: id, Key: t.Key}
+				if err := tx.Where("auto = ?", false).Where(tag).Assign(types.LineageTag{Value: t.Value}).FirstOrCreate(&tag).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// RemoveLineageTag detaches a tag, by key, from a Lineage
+func (db *Database) RemoveLineageTag(lineage, tag string) error {
+	ids, err := db.lineageIDs(lineage)
+	if err != nil {
+		return err
+	}
+	t, err := parseTag(tag)
+	if err != nil {
+		return err
+	}
+	res := db.Where("lineage_id IN ? AND lower(key) = ? AND auto = ?", ids, t.Key, false).Delete(&types.LineageTag{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrTagNotFound
+	}
+	return nil
+}
+
+// containsString returns whether a slice of strings contains a given value
+func containsString(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// lineagesByProviderCondition returns the condition selecting the lineages
+// ingested from a provider, given either by its identifier (e.g. "aws:my-bucket")
+// or by its type (e.g. "aws") to select the lineages of all its instances
+func lineagesByProviderCondition(provider string) (condition string, params []interface{}) {
+	if strings.Contains(provider, ":") {
+		return "provider = ?", []interface{}{provider}
+	}
+	return "provider LIKE ?", []interface{}{likeEscaper.Replace(provider) + ":%"}
+}
+
+// GetLineagesByProvider retrieves all Lineage ingested from a given provider,
+// or from all the providers of a given type
+func (db *Database) GetLineagesByProvider(provider string) (lineages []types.Lineage) {
+	condition, params := lineagesByProviderCondition(provider)
+	db.Where(condition, params...).
+		Order("created_at desc").
 		Find(&lineages)
 	return
 }
@@ -795,7 +3827,9 @@ func (db *Database) DefaultVersion(lineage string) (version string, err error) {
 		" ORDER BY versions.last_modified DESC"
 
 	row := db.Raw(sqlQuery, lineage).Row()
-	err = row.Scan(&version)
+	if err = row.Scan(&version); errors.Is(err, sql.ErrNoRows) {
+		err = ErrLineageNotFound
+	}
 	return
 }
 
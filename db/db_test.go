@@ -1,3 +1,1367 @@
 package db
 
-// TODO: test db package
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/terraboard/config"
+	"github.com/camptocamp/terraboard/internal/terraform/addrs"
+	"github.com/camptocamp/terraboard/internal/terraform/states/statefile"
+	"github.com/camptocamp/terraboard/types"
+	"gorm.io/gorm"
+)
+
+const fakeStateTemplate = `{
+  "version": 4,
+  "terraform_version": "1.0.2",
+  "serial": %SERIAL%,
+  "lineage": "%LINEAGE%",
+  "outputs": {},
+  "resources": [
+    {
+      "mode": "managed",
+      "type": "aws_s3_bucket",
+      "name": "bucket",
+      "provider": "provider[\"registry.terraform.io/hashicorp/aws\"]",
+      "instances": [
+        {
+          "schema_version": 0,
+          "attributes": {
+            "bucket": "%BUCKET%",
+            "acl": "private"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+func readFakeState(t *testing.T, lineage, serial, bucket string) *statefile.File {
+	src := strings.NewReplacer("%LINEAGE%", lineage, "%SERIAL%", serial, "%BUCKET%", bucket).
+		Replace(fakeStateTemplate)
+	sf, err := statefile.Read(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("Failed to read fake state: %v", err)
+	}
+	return sf
+}
+
+func TestStateFingerprint_Identical(t *testing.T) {
+	sf1 := readFakeState(t, "8c4bd8a6-0b3d-4b83-9fe3-1d9c3c5b2a11", "1", "my-bucket")
+	sf2 := readFakeState(t, "f29d5a2c-7e6a-4f55-8c1c-3a2b9d8e7f60", "42", "my-bucket")
+
+	fp1, err := stateFingerprint(sf1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	fp2, err := stateFingerprint(sf2)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if fp1 != fp2 {
+		t.Fatalf("Expected %s, got %s", fp1, fp2)
+	}
+}
+
+func TestStateFingerprint_Changed(t *testing.T) {
+	sf1 := readFakeState(t, "8c4bd8a6-0b3d-4b83-9fe3-1d9c3c5b2a11", "1", "my-bucket")
+	sf2 := readFakeState(t, "8c4bd8a6-0b3d-4b83-9fe3-1d9c3c5b2a11", "2", "my-other-bucket")
+
+	fp1, err := stateFingerprint(sf1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	fp2, err := stateFingerprint(sf2)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if fp1 == fp2 {
+		t.Fatalf("Expected different fingerprints, got %s twice", fp1)
+	}
+}
+
+func TestIsDuplicateVersion(t *testing.T) {
+	lineage := "8c4bd8a6-0b3d-4b83-9fe3-1d9c3c5b2a11"
+	fp1, err := stateFingerprint(readFakeState(t, lineage, "1", "my-bucket"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	// Rewritten with a bumped serial but an identical content
+	fp2, err := stateFingerprint(readFakeState(t, lineage, "2", "my-bucket"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	fp3, err := stateFingerprint(readFakeState(t, lineage, "3", "my-other-bucket"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	t0 := time.Unix(1501782443, 0).UTC()
+	history := []types.VersionNode{
+		{VersionID: "v1", Serial: 1, LastModified: t0, Fingerprint: fp1},
+	}
+
+	if !isDuplicateVersion(history, t0.Add(time.Hour), fp2) {
+		t.Fatalf("Expected version with serial 2 to be a duplicate")
+	}
+	if isDuplicateVersion(history, t0.Add(time.Hour), fp3) {
+		t.Fatalf("Expected changed version not to be a duplicate")
+	}
+	// Only the immediately preceding version is compared
+	history = append(history, types.VersionNode{VersionID: "v3", Serial: 3, LastModified: t0.Add(2 * time.Hour), Fingerprint: fp3})
+	if isDuplicateVersion(history, t0.Add(3*time.Hour), fp1) {
+		t.Fatalf("Expected reverted version not to be a duplicate")
+	}
+	// The first version of a State is never a duplicate
+	if isDuplicateVersion(history, t0.Add(-time.Hour), fp1) {
+		t.Fatalf("Expected first version not to be a duplicate")
+	}
+}
+
+func TestTFVersionChanges(t *testing.T) {
+	t0 := time.Unix(1501782443, 0).UTC()
+	history := []types.TFVersionChange{
+		{VersionID: "v1", Serial: 1, LastModified: t0, TFVersion: "0.12.31"},
+		{VersionID: "v2", Serial: 2, LastModified: t0.Add(time.Hour), TFVersion: "0.12.31"},
+		{VersionID: "v3", Serial: 3, LastModified: t0.Add(2 * time.Hour), TFVersion: "0.13.7"},
+		{VersionID: "v4", Serial: 4, LastModified: t0.Add(3 * time.Hour), TFVersion: "0.13.7"},
+		{VersionID: "v5", Serial: 5, LastModified: t0.Add(4 * time.Hour), TFVersion: "1.0.2"},
+	}
+
+	expected := []types.TFVersionChange{
+		{VersionID: "v1", Serial: 1, LastModified: t0, TFVersion: "0.12.31"},
+		{VersionID: "v3", Serial: 3, LastModified: t0.Add(2 * time.Hour), TFVersion: "0.13.7", PreviousTFVersion: "0.12.31"},
+		{VersionID: "v5", Serial: 5, LastModified: t0.Add(4 * time.Hour), TFVersion: "1.0.2", PreviousTFVersion: "0.13.7"},
+	}
+
+	changes := tfVersionChanges(history)
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("Expected %v, got %v", expected, changes)
+	}
+}
+
+func TestSortVersionsNewestFirst(t *testing.T) {
+	t0 := time.Unix(1501782443, 0).UTC()
+	versions := []types.LineageVersion{
+		{VersionID: "v1", Serial: 1, LastModified: t0, TFVersion: "0.12.31"},
+		{VersionID: "v3", Serial: 3, LastModified: t0.Add(2 * time.Hour), TFVersion: "0.13.7"},
+		{VersionID: "v2", Serial: 2, LastModified: t0.Add(time.Hour), TFVersion: "0.12.31"},
+		{VersionID: "v4", Serial: 4, LastModified: t0.Add(2 * time.Hour), TFVersion: "0.13.7"},
+	}
+
+	sortVersionsNewestFirst(versions)
+	var ids []string
+	for _, v := range versions {
+		ids = append(ids, v.VersionID)
+	}
+	expected := []string{"v4", "v3", "v2", "v1"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("Expected %v, got %v", expected, ids)
+	}
+}
+
+func TestPageBounds(t *testing.T) {
+	for _, c := range []struct{ page, limit, total, start, end int }{
+		{1, -1, 5, 0, 5},
+		{1, 2, 5, 0, 2},
+		{3, 2, 5, 4, 5},
+		{4, 2, 5, 5, 5},
+	} {
+		if start, end := pageBounds(c.page, c.limit, c.total); start != c.start || end != c.end {
+			t.Fatalf("Expected [%d:%d] for %+v, got [%d:%d]", c.start, c.end, c, start, end)
+		}
+	}
+}
+
+func TestPlanListTotalSQL(t *testing.T) {
+	for _, c := range []struct {
+		lineage        string
+		includeDeleted bool
+		sql            string
+		params         []interface{}
+	}{
+		{"", false, "SELECT count(*) FROM plans AS t WHERE t.deleted_at IS NULL", nil},
+		{"", true, "SELECT count(*) FROM plans AS t", nil},
+		{"network", false, "SELECT count(*) FROM plans AS t JOIN lineages on lineages.id=t.lineage_id" +
+			" WHERE lineages.value = ? AND t.deleted_at IS NULL", []interface{}{"network"}},
+		{"network", true, "SELECT count(*) FROM plans AS t JOIN lineages on lineages.id=t.lineage_id" +
+			" WHERE lineages.value = ?", []interface{}{"network"}},
+	} {
+		sql, params := planListTotalSQL(c.lineage, c.includeDeleted)
+		if sql != c.sql || !reflect.DeepEqual(params, c.params) {
+			t.Fatalf("Expected %s %v, got %s %v", c.sql, c.params, sql, params)
+		}
+	}
+}
+
+func TestDialector(t *testing.T) {
+	d, err := dialector(config.DBConfig{Dialect: DialectPostgres, Host: "db", Port: 5432})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if d.Name() != "postgres" {
+		t.Fatalf("Expected %s, got %s", "postgres", d.Name())
+	}
+
+	for _, dialect := range []string{"mysql", "sqlite", ""} {
+		if _, err := dialector(config.DBConfig{Dialect: dialect}); err == nil || !strings.Contains(err.Error(), "'"+dialect+"'") {
+			t.Fatalf("Expected the %s dialect to be rejected, got %v", dialect, err)
+		}
+	}
+}
+
+func TestLineagesByProviderCondition(t *testing.T) {
+	for _, c := range []struct {
+		provider  string
+		condition string
+		params    []interface{}
+	}{
+		{"aws:my-bucket", "provider = ?", []interface{}{"aws:my-bucket"}},
+		{"azure:account/tfstate", "provider = ?", []interface{}{"azure:account/tfstate"}},
+		{"aws", "provider LIKE ?", []interface{}{"aws:%"}},
+		{"my_%type", "provider LIKE ?", []interface{}{`my\_\%type:%`}},
+	} {
+		condition, params := lineagesByProviderCondition(c.provider)
+		if condition != c.condition || !reflect.DeepEqual(params, c.params) {
+			t.Fatalf("Expected %s %v, got %s %v", c.condition, c.params, condition, params)
+		}
+	}
+}
+
+func TestMatchLineages_Glob(t *testing.T) {
+	values := []string{"prod-network", "prod-compute", "staging-network"}
+	expected := []string{"prod-network", "prod-compute"}
+
+	matches, err := matchLineages(values, "prod-*", "glob")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Fatalf("Expected %v, got %v", expected, matches)
+	}
+}
+
+func TestMatchLineages_Regex(t *testing.T) {
+	values := []string{"prod-network", "prod-compute", "staging-network"}
+	expected := []string{"prod-network", "staging-network"}
+
+	matches, err := matchLineages(values, "-network$", "regex")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Fatalf("Expected %v, got %v", expected, matches)
+	}
+}
+
+func TestMatchLineages_UnknownType(t *testing.T) {
+	if _, err := matchLineages([]string{"foo"}, "foo", "sql"); err == nil {
+		t.Fatalf("Expected an error, got nil")
+	}
+}
+
+func TestResolveLineageProvider_Keep(t *testing.T) {
+	p, err := resolveLineageProvider(DuplicateLineagesKeep, "", "gcp:my-bucket", []string{"aws:my-bucket"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if p != "gcp:my-bucket" {
+		t.Fatalf("Expected %s, got %s", "gcp:my-bucket", p)
+	}
+}
+
+func TestResolveLineageProvider_Merge(t *testing.T) {
+	p, err := resolveLineageProvider(DuplicateLineagesMerge, "", "gcp:my-bucket", []string{"aws:my-bucket"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if p != "aws:my-bucket" {
+		t.Fatalf("Expected %s, got %s", "aws:my-bucket", p)
+	}
+}
+
+func TestResolveLineageProvider_Prefer(t *testing.T) {
+	_, err := resolveLineageProvider(DuplicateLineagesPrefer, "aws:my-bucket", "gcp:my-bucket", []string{"aws:my-bucket"})
+	if err != errSkippedLineage {
+		t.Fatalf("Expected %v, got %v", errSkippedLineage, err)
+	}
+
+	p, err := resolveLineageProvider(DuplicateLineagesPrefer, "aws:my-bucket", "aws:my-bucket", []string{"gcp:my-bucket"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if p != "aws:my-bucket" {
+		t.Fatalf("Expected %s, got %s", "aws:my-bucket", p)
+	}
+}
+
+func TestIncrementalIngestion_Reconstruct(t *testing.T) {
+	prevAttributes := []types.Attribute{
+		{ID: 1, ResourceID: sql.NullInt64{Int64: 10, Valid: true}, Key: "acl", Value: `"private"`},
+		{ID: 2, ResourceID: sql.NullInt64{Int64: 10, Valid: true}, Key: "bucket", Value: `"my-bucket"`},
+	}
+	prev := types.State{
+		Modules: []types.Module{{
+			Path: "root",
+			Resources: []types.Resource{
+				{ID: 10, Type: "aws_s3_bucket", Name: "bucket", Attributes: prevAttributes},
+				{ID: 11, Type: "aws_s3_bucket", Name: "logs", Attributes: []types.Attribute{
+					{ID: 3, ResourceID: sql.NullInt64{Int64: 11, Valid: true}, Key: "bucket", Value: `"my-logs"`},
+				}},
+			},
+		}},
+	}
+
+	full := func() types.State {
+		return types.State{
+			Modules: []types.Module{{
+				Path: "root",
+				Resources: []types.Resource{
+					{Type: "aws_s3_bucket", Name: "bucket", Attributes: []types.Attribute{
+						{Key: "bucket", Value: `"my-bucket"`},
+						{Key: "acl", Value: `"private"`},
+					}},
+					{Type: "aws_s3_bucket", Name: "logs", Attributes: []types.Attribute{
+						{Key: "bucket", Value: `"my-other-logs"`},
+					}},
+				},
+			}},
+		}
+	}
+
+	delta := full()
+	shareUnchangedAttributes(prev, &delta)
+
+	unchanged := delta.Modules[0].Resources[0]
+	if unchanged.Attributes != nil || unchanged.AttributesFromID.Int64 != 10 {
+		t.Fatalf("Expected unchanged resource to reference resource 10, got %v", unchanged)
+	}
+	if changed := delta.Modules[0].Resources[1]; changed.AttributesFromID.Valid {
+		t.Fatalf("Expected changed resource to own its attributes, got %v", changed)
+	}
+
+	fillSharedAttributes(&delta, prevAttributes)
+
+	expected := full()
+	for i, m := range expected.Modules {
+		for j, r := range m.Resources {
+			if !sameAttributes(delta.Modules[i].Resources[j].Attributes, r.Attributes) {
+				t.Fatalf("Expected %v, got %v", r.Attributes, delta.Modules[i].Resources[j].Attributes)
+			}
+		}
+	}
+}
+
+func TestDiffResourceTypeCounts(t *testing.T) {
+	a := map[string]int{"aws_instance": 3, "aws_s3_bucket": 1}
+	b := map[string]int{"aws_instance": 5, "aws_vpc": 2}
+
+	expected := []types.ResourceTypeCountDiff{
+		{Type: "aws_instance", CountA: 3, CountB: 5, Delta: 2},
+		{Type: "aws_s3_bucket", CountA: 1, CountB: 0, Delta: -1},
+		{Type: "aws_vpc", CountA: 0, CountB: 2, Delta: 2},
+	}
+
+	diffs := diffResourceTypeCounts(a, b)
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Fatalf("Expected %v, got %v", expected, diffs)
+	}
+}
+
+func TestHiddenTFVersions(t *testing.T) {
+	versions := []string{"0.11.14", "0.12.31", "0.13.7", "1.0.2", ""}
+
+	hidden, err := hiddenTFVersions(versions, []string{"0.13.7"}, "0.12.0")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []string{"0.11.14", "0.13.7"}
+	if !reflect.DeepEqual(hidden, expected) {
+		t.Fatalf("Expected %v, got %v", expected, hidden)
+	}
+}
+
+func TestHiddenTFVersions_SemverComparison(t *testing.T) {
+	versions := []string{"0.9.11", "0.10.8", "1.0.10"}
+
+	hidden, err := hiddenTFVersions(versions, nil, "0.10.0")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []string{"0.9.11"}
+	if !reflect.DeepEqual(hidden, expected) {
+		t.Fatalf("Expected %v, got %v", expected, hidden)
+	}
+}
+
+func TestHiddenTFVersions_InvalidMinimum(t *testing.T) {
+	if _, err := hiddenTFVersions([]string{"1.0.2"}, nil, "not-a-version"); err == nil {
+		t.Fatalf("Expected an error, got nil")
+	}
+}
+
+func TestListHiddenTFVersions_ShowAll(t *testing.T) {
+	d := &Database{hiddenTFVersions: []string{"0.11.14"}, minTFVersion: "0.12.0"}
+
+	hidden, err := d.listHiddenTFVersions(true)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if hidden != nil {
+		t.Fatalf("Expected no hidden versions, got %v", hidden)
+	}
+}
+
+func TestGroupAttributeValuesByLineage(t *testing.T) {
+	values := []types.LineageAttributeValue{
+		{LineageValue: "prod", AttributeValue: "ami-2"},
+		{LineageValue: "staging", AttributeValue: "ami-1"},
+		{LineageValue: "prod", AttributeValue: "ami-1"},
+		{LineageValue: "prod", AttributeValue: "ami-2"},
+	}
+
+	expected := map[string][]string{
+		"prod":    {"ami-1", "ami-2"},
+		"staging": {"ami-1"},
+	}
+
+	grouped := groupAttributeValuesByLineage(values)
+	if !reflect.DeepEqual(grouped, expected) {
+		t.Fatalf("Expected %v, got %v", expected, grouped)
+	}
+}
+
+func TestSummarizeLineageChanges(t *testing.T) {
+	from := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+
+	states := []types.StateStat{
+		// Modified before and within the window
+		{LineageValue: "app", LastModified: from.Add(-time.Hour), ResourceCount: 10},
+		{LineageValue: "app", LastModified: from.Add(10 * time.Minute), ResourceCount: 12},
+		{LineageValue: "app", LastModified: from.Add(20 * time.Minute), ResourceCount: 13},
+		// Created within the window
+		{LineageValue: "new", LastModified: from.Add(30 * time.Minute), ResourceCount: 4},
+		// Only modified outside of the window
+		{LineageValue: "old", LastModified: from.Add(-time.Hour), ResourceCount: 3},
+		{LineageValue: "old", LastModified: to.Add(time.Hour), ResourceCount: 5},
+	}
+
+	expected := []types.LineageChange{
+		{LineageValue: "app", NewVersions: 2, ResourceDelta: 3},
+		{LineageValue: "new", NewVersions: 1, ResourceDelta: 4},
+	}
+
+	changes := summarizeLineageChanges(states, from, to)
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("Expected %v, got %v", expected, changes)
+	}
+}
+
+func TestEmptyStatesHandling(t *testing.T) {
+	for _, tc := range []struct {
+		mode      string
+		showEmpty bool
+		hide, tag bool
+	}{
+		{EmptyStatesInclude, false, false, false},
+		{EmptyStatesHide, false, true, false},
+		{EmptyStatesHide, true, false, false},
+		{EmptyStatesTag, false, false, true},
+	} {
+		hide, tag := emptyStatesHandling(tc.mode, tc.showEmpty)
+		if hide != tc.hide || tag != tc.tag {
+			t.Fatalf("Expected hide=%v tag=%v for %s, got hide=%v tag=%v", tc.hide, tc.tag, tc.mode, hide, tag)
+		}
+	}
+}
+
+func TestResourceMode(t *testing.T) {
+	sf := readFakeState(t, "8c4bd8a6-0b3d-4b83-9fe3-1d9c3c5b2a11", "1", "my-bucket")
+	if mode := resourceMode(sf.State.Modules[""].Resources["aws_s3_bucket.bucket"].Addr.Resource.Mode); mode != "managed" {
+		t.Fatalf("Expected %s, got %s", "managed", mode)
+	}
+	if mode := resourceMode(addrs.DataResourceMode); mode != "data" {
+		t.Fatalf("Expected %s, got %s", "data", mode)
+	}
+}
+
+func TestLineageDisplayName(t *testing.T) {
+	re := regexp.MustCompile(`^(?P<env>[^/]+)/(?P<service>[^/]+)/terraform\.tfstate$`)
+	template := "${env}/${service}"
+	lineage := "8c4bd8a6-0b3d-4b83-9fe3-1d9c3c5b2a11"
+
+	if name := lineageDisplayName(re, template, "prod/billing/terraform.tfstate", lineage); name != "prod/billing" {
+		t.Fatalf("Expected %s, got %s", "prod/billing", name)
+	}
+	if name := lineageDisplayName(re, template, "terraform.tfstate", lineage); name != lineage {
+		t.Fatalf("Expected %s, got %s", lineage, name)
+	}
+	if name := lineageDisplayName(nil, "", "prod/billing/terraform.tfstate", lineage); name != lineage {
+		t.Fatalf("Expected %s, got %s", lineage, name)
+	}
+}
+
+func TestFindOutliers(t *testing.T) {
+	var results []types.SearchResult
+	for i := 0; i < 10; i++ {
+		results = append(results, types.SearchResult{
+			LineageValue:   fmt.Sprintf("lineage-%d", i),
+			AttributeKey:   "volume_size",
+			AttributeValue: "100",
+		})
+	}
+	results = append(results,
+		types.SearchResult{LineageValue: "lineage-big", AttributeKey: "volume_size", AttributeValue: "2000"},
+		types.SearchResult{LineageValue: "lineage-str", AttributeKey: "volume_size", AttributeValue: `"large"`},
+		types.SearchResult{LineageValue: "lineage-quoted", AttributeKey: "volume_size", AttributeValue: `"100"`},
+	)
+
+	outliers := findOutliers(results)
+	if len(outliers.Outliers) != 1 || outliers.Outliers[0].LineageValue != "lineage-big" {
+		t.Fatalf("Expected lineage-big to be the only outlier, got %v", outliers.Outliers)
+	}
+	if outliers.LowerBound != 100 || outliers.UpperBound != 100 {
+		t.Fatalf("Expected bounds [100, 100], got [%v, %v]", outliers.LowerBound, outliers.UpperBound)
+	}
+}
+
+func TestFindOutliers_NoNumericValues(t *testing.T) {
+	outliers := findOutliers([]types.SearchResult{{AttributeValue: `"foo"`}})
+	if len(outliers.Outliers) != 0 {
+		t.Fatalf("Expected no outliers, got %v", outliers.Outliers)
+	}
+}
+
+func TestBuildVersionTree_Linear(t *testing.T) {
+	history := []types.VersionNode{
+		{VersionID: "v1", Serial: 1, Fingerprint: "a"},
+		{VersionID: "v2", Serial: 2, Fingerprint: "b"},
+		{VersionID: "v3", Serial: 3, Fingerprint: "c"},
+	}
+
+	tree := buildVersionTree(history)
+	if len(tree) != 1 {
+		t.Fatalf("Expected %d root, got %d", 1, len(tree))
+	}
+	node := tree[0]
+	for _, id := range []string{"v1", "v2", "v3"} {
+		if node.VersionID != id {
+			t.Fatalf("Expected %s, got %s", id, node.VersionID)
+		}
+		if id != "v3" {
+			if len(node.Children) != 1 {
+				t.Fatalf("Expected %d child, got %d", 1, len(node.Children))
+			}
+			node = node.Children[0]
+		}
+	}
+}
+
+func TestBuildVersionTree_Fork(t *testing.T) {
+	history := []types.VersionNode{
+		{VersionID: "v1", Serial: 1, Fingerprint: "a"},
+		{VersionID: "v2", Serial: 2, Fingerprint: "b"},
+		// Fork: same serial, different content
+		{VersionID: "v2-fork", Serial: 2, Fingerprint: "c"},
+		// Identical to v2, ignored
+		{VersionID: "v2-copy", Serial: 2, Fingerprint: "b"},
+		// Continues the most recent branch
+		{VersionID: "v3", Serial: 3, Fingerprint: "d"},
+	}
+
+	expected := []types.VersionNode{{
+		VersionID: "v1", Serial: 1, Fingerprint: "a",
+		Children: []types.VersionNode{
+			{VersionID: "v2", Serial: 2, Fingerprint: "b", Children: []types.VersionNode{}},
+			{VersionID: "v2-fork", Serial: 2, Fingerprint: "c", Children: []types.VersionNode{
+				{VersionID: "v3", Serial: 3, Fingerprint: "d", Children: []types.VersionNode{}},
+			}},
+		},
+	}}
+
+	tree := buildVersionTree(history)
+	if !reflect.DeepEqual(tree, expected) {
+		t.Fatalf("Expected %v, got %v", expected, tree)
+	}
+}
+
+func TestCommonResources(t *testing.T) {
+	addresses := map[string][]string{
+		"dev":     {"aws_vpc.main", "aws_s3_bucket.logs", "aws_instance.web[0]"},
+		"staging": {"aws_vpc.main", "aws_s3_bucket.logs", "module.db.aws_db_instance.main"},
+		"prod":    {"aws_vpc.main", "aws_s3_bucket.logs", "module.db.aws_db_instance.main", "aws_instance.web[0]"},
+	}
+
+	expected := types.CommonResources{
+		Lineages:  3,
+		Threshold: 2,
+		Common:    []string{"aws_s3_bucket.logs", "aws_vpc.main"},
+		AtThreshold: []types.ResourcePresence{
+			{Address: "aws_s3_bucket.logs", Lineages: 3},
+			{Address: "aws_vpc.main", Lineages: 3},
+			{Address: "aws_instance.web[0]", Lineages: 2},
+			{Address: "module.db.aws_db_instance.main", Lineages: 2},
+		},
+		CommonCount:      2,
+		AtThresholdCount: 4,
+	}
+
+	result := commonResources(addresses, 2)
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestResourceAddress(t *testing.T) {
+	if a := resourceAddress("module.db", "data", "aws_ami", "ubuntu", ""); a != "module.db.data.aws_ami.ubuntu" {
+		t.Fatalf("Expected %s, got %s", "module.db.data.aws_ami.ubuntu", a)
+	}
+	if a := resourceAddress("", "managed", "aws_instance", "web", "[0]"); a != "aws_instance.web[0]" {
+		t.Fatalf("Expected %s, got %s", "aws_instance.web[0]", a)
+	}
+}
+
+func TestAggregateLockHolders(t *testing.T) {
+	now := time.Date(2021, 6, 30, 12, 0, 0, 0, time.UTC)
+	from := now.AddDate(0, 0, -30)
+
+	events := []types.LockEvent{
+		{Who: "alice@host", Created: now.Add(-2 * time.Hour), LastSeen: now.Add(-time.Hour)},
+		{Who: "alice@host", Created: now.Add(-48 * time.Hour), LastSeen: now.Add(-47 * time.Hour)},
+		{Who: "bob@host", Created: now.Add(-30 * time.Minute), LastSeen: now},
+		// Started before the window, only the time within it is counted
+		{Who: "bob@host", Created: from.Add(-time.Hour), LastSeen: from.Add(time.Hour)},
+		// Outside of the window
+		{Who: "carol@host", Created: from.Add(-3 * time.Hour), LastSeen: from.Add(-2 * time.Hour)},
+	}
+
+	expected := []types.LockHolder{
+		{Who: "alice@host", Locks: 2, HeldSeconds: 7200},
+		{Who: "bob@host", Locks: 2, HeldSeconds: 5400},
+	}
+
+	holders := aggregateLockHolders(events, from, now)
+	if !reflect.DeepEqual(holders, expected) {
+		t.Fatalf("Expected %v, got %v", expected, holders)
+	}
+}
+
+func TestAuditResourceNames(t *testing.T) {
+	re := regexp.MustCompile(`^[a-z]+(_[a-z0-9]+)*$`)
+	resources := []namedResource{
+		{lineage: "prod", address: "aws_instance.web_frontend", resourceType: "aws_instance", name: "web_frontend"},
+		{lineage: "prod", address: "aws_instance.WebBackend", resourceType: "aws_instance", name: "WebBackend"},
+		{lineage: "dev", address: "module.db.aws_db_instance.main", resourceType: "aws_db_instance", name: "main"},
+		{lineage: "dev", address: "aws_s3_bucket.logs-bucket", resourceType: "aws_s3_bucket", name: "logs-bucket"},
+	}
+
+	expected := types.NamingAudit{
+		Pattern:      re.String(),
+		Compliant:    2,
+		NonCompliant: 2,
+		Violations: []types.NamingViolation{
+			{LineageValue: "dev", Address: "aws_s3_bucket.logs-bucket", Type: "aws_s3_bucket"},
+			{LineageValue: "prod", Address: "aws_instance.WebBackend", Type: "aws_instance"},
+		},
+	}
+
+	audit := auditResourceNames(re, resources)
+	if !reflect.DeepEqual(audit, expected) {
+		t.Fatalf("Expected %v, got %v", expected, audit)
+	}
+}
+
+func TestFindNewResources(t *testing.T) {
+	from := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	before := from.Add(-time.Hour)
+	within := from.Add(10 * time.Minute)
+
+	rows := []versionResource{
+		// Version before the window
+		{lineage: "app", stateID: 1, versionID: "v1", lastModified: before, address: "aws_vpc.main", resourceType: "aws_vpc"},
+		// Version within the window adding a resource
+		{lineage: "app", stateID: 2, versionID: "v2", lastModified: within, address: "aws_vpc.main", resourceType: "aws_vpc"},
+		{lineage: "app", stateID: 2, versionID: "v2", lastModified: within, address: "aws_instance.web", resourceType: "aws_instance"},
+		// Empty version before the window
+		{lineage: "db", stateID: 3, versionID: "v3", lastModified: before},
+		// Version within the window adding a resource to an empty State
+		{lineage: "db", stateID: 4, versionID: "v4", lastModified: within, address: "aws_db_instance.main", resourceType: "aws_db_instance"},
+		// First version of a Lineage
+		{lineage: "new", stateID: 5, versionID: "v5", lastModified: within, address: "aws_s3_bucket.logs", resourceType: "aws_s3_bucket"},
+	}
+
+	expected := []types.NewResource{
+		{LineageValue: "app", Address: "aws_instance.web", Type: "aws_instance", VersionID: "v2", LastModified: within},
+		{LineageValue: "db", Address: "aws_db_instance.main", Type: "aws_db_instance", VersionID: "v4", LastModified: within},
+		{LineageValue: "new", Address: "aws_s3_bucket.logs", Type: "aws_s3_bucket", VersionID: "v5", LastModified: within},
+	}
+
+	results := findNewResources(rows, from, to)
+	if !reflect.DeepEqual(results, expected) {
+		t.Fatalf("Expected %v, got %v", expected, results)
+	}
+}
+
+func TestBuildChangelog(t *testing.T) {
+	from := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	before := from.Add(-time.Hour)
+	after := to.Add(time.Hour)
+
+	rows := []versionResource{
+		// Version before the range
+		{stateID: 1, lastModified: before, address: "aws_vpc.main", resourceType: "aws_vpc", attributes: "a"},
+		{stateID: 1, lastModified: before, address: "aws_subnet.a", resourceType: "aws_subnet", attributes: "a"},
+		{stateID: 1, lastModified: before, address: "aws_eip.old", resourceType: "aws_eip", attributes: "a"},
+		// Adds a temporary instance and a bucket, updates the VPC
+		{stateID: 2, lastModified: from.Add(10 * time.Minute), address: "aws_vpc.main", resourceType: "aws_vpc", attributes: "b"},
+		{stateID: 2, lastModified: from.Add(10 * time.Minute), address: "aws_subnet.a", resourceType: "aws_subnet", attributes: "a"},
+		{stateID: 2, lastModified: from.Add(10 * time.Minute), address: "aws_eip.old", resourceType: "aws_eip", attributes: "a"},
+		{stateID: 2, lastModified: from.Add(10 * time.Minute), address: "aws_instance.tmp", resourceType: "aws_instance", attributes: "a"},
+		{stateID: 2, lastModified: from.Add(10 * time.Minute), address: "aws_s3_bucket.logs", resourceType: "aws_s3_bucket", attributes: "a"},
+		// Removes the temporary instance and the EIP, updates the bucket
+		{stateID: 3, lastModified: from.Add(20 * time.Minute), address: "aws_vpc.main", resourceType: "aws_vpc", attributes: "b"},
+		{stateID: 3, lastModified: from.Add(20 * time.Minute), address: "aws_subnet.a", resourceType: "aws_subnet", attributes: "a"},
+		{stateID: 3, lastModified: from.Add(20 * time.Minute), address: "aws_s3_bucket.logs", resourceType: "aws_s3_bucket", attributes: "b"},
+		// Version after the range
+		{stateID: 4, lastModified: after, address: "aws_vpc.main", resourceType: "aws_vpc", attributes: "c"},
+	}
+
+	expected := types.Changelog{
+		From:     from,
+		To:       to,
+		Versions: 2,
+		Created:  []types.ChangelogResource{{Address: "aws_s3_bucket.logs", Type: "aws_s3_bucket"}},
+		Updated:  []types.ChangelogResource{{Address: "aws_vpc.main", Type: "aws_vpc"}},
+		Deleted:  []types.ChangelogResource{{Address: "aws_eip.old", Type: "aws_eip"}},
+	}
+
+	changelog := buildChangelog(rows, from, to)
+	if !reflect.DeepEqual(changelog, expected) {
+		t.Fatalf("Expected %v, got %v", expected, changelog)
+	}
+}
+
+func TestFoldChange_Recreated(t *testing.T) {
+	net := foldChange(foldChange("", resourceDeleted), resourceCreated)
+	if net != resourceUpdated {
+		t.Fatalf("Expected %s, got %s", resourceUpdated, net)
+	}
+}
+
+func TestQuotaUsage(t *testing.T) {
+	groups := []config.QuotaConfig{
+		{Name: "team-a", Tags: map[string]string{"team": "a"}, Quota: 20},
+		{Name: "team-b-production", Tags: map[string]string{"team": "b", "env": "production"}, Quota: 10},
+		{Name: "unlimited", Tags: map[string]string{"team": "b"}},
+	}
+	lineageTags := map[string]map[string]string{
+		"a-dev":    {"team": "a", "env": "dev"},
+		"a-prod":   {"team": "a", "env": "production"},
+		"b-dev":    {"team": "b", "env": "dev"},
+		"b-prod":   {"team": "b", "env": "production"},
+		"untagged": {},
+		"team-c":   {"team": "c"},
+	}
+	counts := map[string]int{
+		"a-dev":    5,
+		"a-prod":   10,
+		"b-dev":    7,
+		"b-prod":   12,
+		"untagged": 3,
+		"team-c":   1,
+	}
+
+	expected := []types.QuotaUsage{
+		{Group: "team-a", Lineages: 2, ResourceCount: 15, Quota: 20, Over: false},
+		{Group: "team-b-production", Lineages: 1, ResourceCount: 12, Quota: 10, Over: true},
+		{Group: "unlimited", Lineages: 2, ResourceCount: 19, Quota: 0, Over: false},
+	}
+
+	usages := quotaUsage(groups, lineageTags, counts)
+	if !reflect.DeepEqual(usages, expected) {
+		t.Fatalf("Expected %v, got %v", expected, usages)
+	}
+}
+
+func TestSumResourcesByTFVersion(t *testing.T) {
+	counts := []lineageResourceCount{
+		{tfVersion: "0.12.31", resourceCount: 800},
+		{tfVersion: "1.0.2", resourceCount: 10},
+		{tfVersion: "1.0.2", resourceCount: 25},
+		{tfVersion: "1.0.2", resourceCount: 0},
+	}
+
+	expected := []types.TFVersionResources{
+		{TFVersion: "0.12.31", Lineages: 1, ResourceCount: 800},
+		{TFVersion: "1.0.2", Lineages: 3, ResourceCount: 35},
+	}
+
+	results := sumResourcesByTFVersion(counts)
+	if !reflect.DeepEqual(results, expected) {
+		t.Fatalf("Expected %v, got %v", expected, results)
+	}
+}
+
+func TestVersionAdoption(t *testing.T) {
+	versions := []types.TFVersionResources{
+		{TFVersion: "0.12.31", Lineages: 2, ResourceCount: 800},
+		{TFVersion: "1.0.10", Lineages: 3, ResourceCount: 150},
+		{TFVersion: "1.0.9", Lineages: 2, ResourceCount: 40},
+		{TFVersion: "unknown", Lineages: 1, ResourceCount: 10},
+	}
+
+	expected := types.VersionAdoption{
+		LatestVersion:    "1.0.10",
+		Lineages:         3,
+		TotalLineages:    8,
+		LineagesPercent:  37.5,
+		Resources:        150,
+		TotalResources:   1000,
+		ResourcesPercent: 15,
+		Laggards:         5,
+	}
+
+	adoption := versionAdoption(versions)
+	if !reflect.DeepEqual(adoption, expected) {
+		t.Fatalf("Expected %v, got %v", expected, adoption)
+	}
+}
+
+func TestVersionAdoption_NoLineages(t *testing.T) {
+	adoption := versionAdoption(nil)
+	if !reflect.DeepEqual(adoption, types.VersionAdoption{}) {
+		t.Fatalf("Expected %v, got %v", types.VersionAdoption{}, adoption)
+	}
+}
+
+func TestGroupProviderPlugins(t *testing.T) {
+	counts := []pluginVersionCount{
+		{Provider: `provider["registry.terraform.io/hashicorp/google"]`, TFVersion: "1.0.2", Count: 1},
+		{Provider: `provider["registry.terraform.io/hashicorp/aws"]`, TFVersion: "0.15.5", Count: 2},
+		{Provider: `provider["registry.terraform.io/hashicorp/aws"]`, TFVersion: "unknown", Count: 1},
+		{Provider: `provider["registry.terraform.io/hashicorp/aws"]`, TFVersion: "1.0.10", Count: 1},
+		{Provider: `provider["registry.terraform.io/hashicorp/aws"]`, TFVersion: "1.0.9", Count: 3},
+	}
+
+	expected := []types.ProviderPlugin{
+		{
+			Name:         `provider["registry.terraform.io/hashicorp/aws"]`,
+			LineageCount: 7,
+			Versions: []types.ProviderPluginVersion{
+				{TFVersion: "1.0.10", LineageCount: 1},
+				{TFVersion: "1.0.9", LineageCount: 3},
+				{TFVersion: "0.15.5", LineageCount: 2},
+				{TFVersion: "unknown", LineageCount: 1},
+			},
+		},
+		{
+			Name:         `provider["registry.terraform.io/hashicorp/google"]`,
+			LineageCount: 1,
+			Versions:     []types.ProviderPluginVersion{{TFVersion: "1.0.2", LineageCount: 1}},
+		},
+	}
+	plugins := groupProviderPlugins(counts)
+	if !reflect.DeepEqual(plugins, expected) {
+		t.Fatalf("Expected %v, got %v", expected, plugins)
+	}
+
+	if plugins := groupProviderPlugins(nil); len(plugins) != 0 {
+		t.Fatalf("Expected no plugin, got %v", plugins)
+	}
+}
+
+func TestSearchConditions_Regex(t *testing.T) {
+	query := url.Values{
+		"type":  {"aws_instance"},
+		"name":  {`aws_instance\.web-\d+`},
+		"value": {`^t3\.`},
+		"regex": {"true"},
+	}
+
+	where, params := searchConditions(query)
+	expectedWhere := []string{
+		"resources.type LIKE ?",
+		"(resources.name ~ ? OR resources.type || '.' || resources.name ~ ?)",
+		"attributes.value ~ ?",
+	}
+	expectedParams := []interface{}{"%aws_instance%", `aws_instance\.web-\d+`, `aws_instance\.web-\d+`, `^t3\.`}
+	if !reflect.DeepEqual(where, expectedWhere) {
+		t.Fatalf("Expected %v, got %v", expectedWhere, where)
+	}
+	if !reflect.DeepEqual(params, expectedParams) {
+		t.Fatalf("Expected %v, got %v", expectedParams, params)
+	}
+
+	// The name pattern matches resource addresses across lineages
+	re := regexp.MustCompile(query.Get("name"))
+	var matched []string
+	for _, r := range []struct{ lineage, address string }{
+		{"lineage-1", "aws_instance.web-1"},
+		{"lineage-1", "aws_instance.db-1"},
+		{"lineage-2", "aws_instance.web-12"},
+		{"lineage-3", "aws_instance.web-new"},
+	} {
+		if re.MatchString(r.address) {
+			matched = append(matched, r.lineage+"/"+r.address)
+		}
+	}
+	expectedMatches := []string{"lineage-1/aws_instance.web-1", "lineage-2/aws_instance.web-12"}
+	if !reflect.DeepEqual(matched, expectedMatches) {
+		t.Fatalf("Expected %v, got %v", expectedMatches, matched)
+	}
+}
+
+func TestSearchOrderBy(t *testing.T) {
+	for _, c := range []struct{ orderBy, order, expected string }{
+		{"", "", searchDefaultOrder},
+		{"", "desc", searchDefaultOrder},
+		{"lineage", "", "lineage_value ASC, " + searchDefaultOrder},
+		{"lineage", "desc", "lineage_value DESC, " + searchDefaultOrder},
+		{"resource_type", "asc", "resources.type ASC, " + searchDefaultOrder},
+		{"resource_type", "DESC", "resources.type DESC, " + searchDefaultOrder},
+		{"last_modified", "asc", "versions.last_modified ASC, " + searchDefaultOrder},
+		{"last_modified", "desc", "versions.last_modified DESC, " + searchDefaultOrder},
+	} {
+		orderBy, err := SearchOrderBy(c.orderBy, c.order)
+		if err != nil {
+			t.Fatalf("Expected no error for %+v, got %v", c, err)
+		}
+		if orderBy != c.expected {
+			t.Fatalf("Expected %q for %+v, got %q", c.expected, c, orderBy)
+		}
+	}
+
+	for _, c := range []struct{ orderBy, order string }{
+		{"attributes.value", ""},
+		{"lineage_value", "asc"},
+		{"lineage", "up"},
+	} {
+		if _, err := SearchOrderBy(c.orderBy, c.order); !errors.Is(err, ErrInvalidSortOrder) {
+			t.Fatalf("Expected ErrInvalidSortOrder for %+v, got %v", c, err)
+		}
+	}
+}
+
+func TestSearchConditions_Substring(t *testing.T) {
+	where, params := searchConditions(url.Values{"name": {"web"}, "value": {"t3"}})
+
+	expectedWhere := []string{"resources.name LIKE ?", "attributes.value LIKE ?"}
+	if !reflect.DeepEqual(where, expectedWhere) {
+		t.Fatalf("Expected %v, got %v", expectedWhere, where)
+	}
+	if !reflect.DeepEqual(params, []interface{}{"%web%", "%t3%"}) {
+		t.Fatalf("Expected %v, got %v", []interface{}{"%web%", "%t3%"}, params)
+	}
+}
+
+func TestSearchConditions_Quoted(t *testing.T) {
+	where, params := searchConditions(url.Values{
+		"tf_version":    {"1.0"},
+		"lineage_value": {"x' OR '1'='1"},
+	})
+
+	expectedWhere := []string{"states.tf_version LIKE ?", "lineages.value LIKE ?"}
+	if !reflect.DeepEqual(where, expectedWhere) {
+		t.Fatalf("Expected %v, got %v", expectedWhere, where)
+	}
+	expectedParams := []interface{}{"%1.0%", "%x' OR '1'='1%"}
+	if !reflect.DeepEqual(params, expectedParams) {
+		t.Fatalf("Expected %v, got %v", expectedParams, params)
+	}
+}
+
+func TestResourceQueryConditions(t *testing.T) {
+	conditions := []types.AttributeCondition{
+		{Key: "instance_type", Value: "m5.large"},
+		{Key: "availability_zone", Operator: "regex", Value: "^us-east-1"},
+	}
+	exists := "EXISTS (SELECT 1 FROM attributes" +
+		" WHERE attributes.resource_id = COALESCE(resources.attributes_from_id, resources.id)" +
+		" AND attributes.key = ? AND "
+	expectedParams := []interface{}{"instance_type", "m5.large", "availability_zone", "^us-east-1"}
+
+	// The conditions match a resource when its attribute does
+	resources := map[string]map[string]string{
+		"aws_instance.web": {"instance_type": "m5.large", "availability_zone": "us-east-1a"},
+		"aws_instance.db":  {"instance_type": "m5.large", "availability_zone": "eu-west-1a"},
+		"aws_instance.tmp": {"instance_type": "t3.micro", "availability_zone": "us-east-1b"},
+		"aws_instance.old": {"instance_type": "t2.micro", "availability_zone": "eu-west-1b"},
+	}
+	matches := func(attrs map[string]string, c types.AttributeCondition) bool {
+		if c.Operator == "regex" {
+			return regexp.MustCompile(c.Value).MatchString(attrs[c.Key])
+		}
+		return attrs[c.Key] == c.Value
+	}
+
+	for _, tc := range []struct {
+		combine  string
+		operator string
+		expected []string
+	}{
+		{"", " AND ", []string{"aws_instance.web"}},
+		{"or", " OR ", []string{"aws_instance.db", "aws_instance.tmp", "aws_instance.web"}},
+	} {
+		where, params, err := resourceQueryConditions(types.ResourceQuery{Conditions: conditions, Combine: tc.combine})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		expectedWhere := "(" + exists + "attributes.value = ?)" + tc.operator + exists + "attributes.value ~ ?))"
+		if where != expectedWhere {
+			t.Fatalf("Expected %v, got %v", expectedWhere, where)
+		}
+		if !reflect.DeepEqual(params, expectedParams) {
+			t.Fatalf("Expected %v, got %v", expectedParams, params)
+		}
+
+		var matched []string
+		for address, attrs := range resources {
+			first, second := matches(attrs, conditions[0]), matches(attrs, conditions[1])
+			if (tc.operator == " AND " && first && second) || (tc.operator == " OR " && (first || second)) {
+				matched = append(matched, address)
+			}
+		}
+		sort.Strings(matched)
+		if !reflect.DeepEqual(matched, tc.expected) {
+			t.Fatalf("Expected %v, got %v", tc.expected, matched)
+		}
+	}
+}
+
+func TestResourceQueryConditions_Invalid(t *testing.T) {
+	for _, q := range []types.ResourceQuery{
+		{},
+		{Conditions: []types.AttributeCondition{{Value: "m5.large"}}},
+		{Conditions: []types.AttributeCondition{{Key: "instance_type", Operator: "gt"}}},
+		{Conditions: []types.AttributeCondition{{Key: "instance_type", Operator: "regex", Value: "("}}},
+		{Conditions: []types.AttributeCondition{{Key: "instance_type"}}, Combine: "xor"},
+	} {
+		if _, _, err := resourceQueryConditions(q); !errors.Is(err, ErrInvalidCondition) {
+			t.Fatalf("Expected %v for %v, got %v", ErrInvalidCondition, q, err)
+		}
+	}
+}
+
+func TestRankAttributeVolatility(t *testing.T) {
+	var rows []attributeObservation
+	for i, tag := range []string{"a", "b", "c", "c"} {
+		for _, resource := range []string{"lineage-1/aws_instance.web", "lineage-2/aws_instance.db"} {
+			rows = append(rows,
+				attributeObservation{resource: resource, key: "ami", value: "ami-123"},
+				attributeObservation{resource: resource, key: "tags.build", value: tag},
+			)
+		}
+		if i == 0 {
+			// A resource observed only once never changes
+			rows = append(rows, attributeObservation{resource: "lineage-3/aws_instance.tmp", key: "tags.build", value: "z"})
+		}
+	}
+
+	expected := []types.AttributeVolatility{
+		{Key: "tags.build", Changes: 4, Observations: 9, Volatility: 4.0 / 9},
+		{Key: "ami", Changes: 0, Observations: 8, Volatility: 0},
+	}
+	results := rankAttributeVolatility(rows)
+	if !reflect.DeepEqual(results, expected) {
+		t.Fatalf("Expected %v, got %v", expected, results)
+	}
+}
+
+func TestFilterAddresses(t *testing.T) {
+	resources := []addressedResource{
+		{address: "aws_vpc.main", modulePath: "", resourceType: "aws_vpc"},
+		{address: "aws_instance.web[0]", modulePath: "", resourceType: "aws_instance"},
+		{address: "module.app.aws_instance.worker", modulePath: "module.app", resourceType: "aws_instance"},
+		{address: "module.app.module.cache.aws_elasticache_cluster.main", modulePath: "module.app.module.cache", resourceType: "aws_elasticache_cluster"},
+		{address: "module.application.aws_s3_bucket.assets", modulePath: "module.application", resourceType: "aws_s3_bucket"},
+	}
+
+	for _, tc := range []struct {
+		resourceType, module string
+		expected             []string
+	}{
+		{"", "", []string{
+			"aws_instance.web[0]",
+			"aws_vpc.main",
+			"module.app.aws_instance.worker",
+			"module.app.module.cache.aws_elasticache_cluster.main",
+			"module.application.aws_s3_bucket.assets",
+		}},
+		{"aws_instance", "", []string{"aws_instance.web[0]", "module.app.aws_instance.worker"}},
+		{"", "module.app", []string{"module.app.aws_instance.worker", "module.app.module.cache.aws_elasticache_cluster.main"}},
+		{"aws_instance", "module.app", []string{"module.app.aws_instance.worker"}},
+	} {
+		addresses := filterAddresses(resources, tc.resourceType, tc.module)
+		if !reflect.DeepEqual(addresses, tc.expected) {
+			t.Fatalf("Expected %v, got %v", tc.expected, addresses)
+		}
+	}
+}
+
+func TestAuditConsistency(t *testing.T) {
+	values := map[string][]string{
+		"dev":     {"Z123"},
+		"staging": {"Z123"},
+		"prod":    {"Z123"},
+		"sandbox": {"Z999"},
+		"legacy":  {"Z123", "Z999"},
+	}
+
+	expected := types.ConsistencyAudit{
+		Key:      "zone_id",
+		Expected: "Z123",
+		Majority: true,
+		Lineages: 5,
+		Violations: []types.ConsistencyViolation{
+			{LineageValue: "legacy", Values: []string{"Z123", "Z999"}},
+			{LineageValue: "sandbox", Values: []string{"Z999"}},
+		},
+	}
+	audit := auditConsistency("zone_id", "", values)
+	if !reflect.DeepEqual(audit, expected) {
+		t.Fatalf("Expected %v, got %v", expected, audit)
+	}
+
+	audit = auditConsistency("zone_id", "Z999", values)
+	if audit.Majority || len(audit.Violations) != 4 {
+		t.Fatalf("Expected %d violations of the expected value, got %v", 4, audit.Violations)
+	}
+}
+
+func TestBuildTimeline(t *testing.T) {
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	plans := []types.Plan{
+		{Model: gorm.Model{ID: 1, CreatedAt: start}, Summary: types.PlanSummary{Add: 3}},
+		{Model: gorm.Model{ID: 2, CreatedAt: start.Add(2 * time.Hour)}, Summary: types.PlanSummary{Change: 1, Destroy: 2}},
+	}
+	versions := []types.StateStat{
+		{VersionID: "v2", Serial: 2, LastModified: start.Add(2 * time.Hour), ResourceCount: 1},
+		{VersionID: "v1", Serial: 1, LastModified: start.Add(time.Hour), ResourceCount: 3},
+	}
+
+	timeline := buildTimeline(plans, versions)
+	expected := []types.TimelineEntry{
+		{Type: types.TimelinePlanEntry, Time: start, Plan: &types.TimelinePlan{ID: 1, Add: 3}},
+		{Type: types.TimelineVersionEntry, Time: start.Add(time.Hour), Version: &types.TimelineVersion{VersionID: "v1", Serial: 1, ResourceCount: 3, ResourceDelta: 3}},
+		{Type: types.TimelinePlanEntry, Time: start.Add(2 * time.Hour), Plan: &types.TimelinePlan{ID: 2, Change: 1, Destroy: 2}},
+		{Type: types.TimelineVersionEntry, Time: start.Add(2 * time.Hour), Version: &types.TimelineVersion{VersionID: "v2", Serial: 2, ResourceCount: 1, ResourceDelta: -2}},
+	}
+	if !reflect.DeepEqual(timeline, expected) {
+		t.Fatalf("Expected %v, got %v", expected, timeline)
+	}
+}
+
+func TestCountCloudAccounts(t *testing.T) {
+	attributes := []accountAttribute{
+		{LineageValue: "network", ResourceType: "aws_vpc", Key: "owner_id", Value: "111111111111"},
+		{LineageValue: "network", ResourceType: "aws_subnet", Key: "owner_id", Value: "111111111111"},
+		{LineageValue: "app", ResourceType: "aws_vpc", Key: "owner_id", Value: "111111111111"},
+		{LineageValue: "app", ResourceType: "aws_caller_identity", Key: "account_id", Value: "222222222222"},
+		{LineageValue: "app", ResourceType: "google_project", Key: "owner_id", Value: "not-an-account"},
+		{LineageValue: "dns", ResourceType: "aws_route53_zone", Key: "account_id", Value: ""},
+	}
+	keys := map[string][]string{"aws": {"account_id", "owner_id"}, "google": {"project"}}
+
+	expected := []types.CloudAccount{
+		{Cloud: "aws", Account: "111111111111", Lineages: 2},
+		{Cloud: "aws", Account: "222222222222", Lineages: 1},
+	}
+	accounts := countCloudAccounts(attributes, keys)
+	if !reflect.DeepEqual(accounts, expected) {
+		t.Fatalf("Expected %v, got %v", expected, accounts)
+	}
+
+	if accounts := countCloudAccounts(nil, keys); len(accounts) != 0 {
+		t.Fatalf("Expected no account, got %v", accounts)
+	}
+}
+
+func TestParseTag(t *testing.T) {
+	for tag, expected := range map[string]types.LineageTag{
+		"payments":           {Key: "payments"},
+		"  Team Payments ":   {Key: "team-payments"},
+		"Env=Prod":           {Key: "env", Value: "prod"},
+		"cost center=R&D 42": {Key: "cost-center", Value: "r&d-42"},
+	} {
+		parsed, err := parseTag(tag)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if parsed != expected {
+			t.Fatalf("Expected %v for %v, got %v", expected, tag, parsed)
+		}
+	}
+
+	for _, tag := range []string{"", "  ", "=prod"} {
+		if _, err := parseTag(tag); !errors.Is(err, ErrInvalidTag) {
+			t.Fatalf("Expected %v for %v, got %v", ErrInvalidTag, tag, err)
+		}
+	}
+}
+
+func TestTagConditions(t *testing.T) {
+	conditions, params := tagConditions("t.lineage_id", []string{"Payments", "", "env=prod"})
+	expectedConditions := []string{
+		"t.lineage_id IN (SELECT lineage_id FROM lineage_tags WHERE lower(key) = ?)",
+		"t.lineage_id IN (SELECT lineage_id FROM lineage_tags WHERE lower(key) = ? AND lower(value) = ?)",
+	}
+	if !reflect.DeepEqual(conditions, expectedConditions) {
+		t.Fatalf("Expected %v, got %v", expectedConditions, conditions)
+	}
+	expectedParams := []interface{}{"payments", "env", "prod"}
+	if !reflect.DeepEqual(params, expectedParams) {
+		t.Fatalf("Expected %v, got %v", expectedParams, params)
+	}
+
+	// Lineages are listed when they hold all the tags
+	lineages := map[string][]string{
+		"lineage-1": {"payments", "env=prod"},
+		"lineage-2": {"payments", "env=staging"},
+		"lineage-3": {"env=prod"},
+		"lineage-4": {"Payments", "Env=Prod", "team=core"},
+	}
+	var listed []string
+	for lineage, tags := range lineages {
+		held := make(map[types.LineageTag]bool)
+		keys := make(map[string]bool)
+		for _, tag := range tags {
+			parsed, _ := parseTag(tag)
+			held[parsed] = true
+			keys[parsed.Key] = true
+		}
+		if keys[params[0].(string)] && held[types.LineageTag{Key: params[1].(string), Value: params[2].(string)}] {
+			listed = append(listed, lineage)
+		}
+	}
+	sort.Strings(listed)
+	if expected := []string{"lineage-1", "lineage-4"}; !reflect.DeepEqual(listed, expected) {
+		t.Fatalf("Expected %v, got %v", expected, listed)
+	}
+}
+
+func TestFindMissingTags(t *testing.T) {
+	attributes := []tagAttribute{
+		// Fully tagged
+		{lineage: "app", address: "aws_instance.web", resourceType: "aws_instance", key: "tags", value: `{"Environment":"prod","Owner":"ops"}`},
+		// Partially tagged
+		{lineage: "app", address: "aws_s3_bucket.logs", resourceType: "aws_s3_bucket", key: "tags", value: `{"Environment":"prod"}`},
+		// Untagged
+		{lineage: "app", address: "aws_vpc.main", resourceType: "aws_vpc", key: "tags", value: `null`},
+		// Flattened tags of a legacy State
+		{lineage: "legacy", address: "aws_instance.db", resourceType: "aws_instance", key: "tags.%", value: `"1"`},
+		{lineage: "legacy", address: "aws_instance.db", resourceType: "aws_instance", key: "tags.Owner", value: `"dba"`},
+		{lineage: "network", address: "aws_subnet.a", resourceType: "aws_subnet", key: "tags", value: `{"Environment":"dev","Owner":"net"}`},
+	}
+
+	expected := []types.LineageMissingTags{
+		{LineageValue: "app", Resources: []types.UntaggedResource{
+			{Address: "aws_s3_bucket.logs", Type: "aws_s3_bucket", Missing: []string{"Owner"}},
+			{Address: "aws_vpc.main", Type: "aws_vpc", Missing: []string{"Environment", "Owner"}},
+		}},
+		{LineageValue: "legacy", Resources: []types.UntaggedResource{
+			{Address: "aws_instance.db", Type: "aws_instance", Missing: []string{"Environment"}},
+		}},
+	}
+	lineages := findMissingTags(attributes, []string{"Environment", "Owner"})
+	if !reflect.DeepEqual(lineages, expected) {
+		t.Fatalf("Expected %v, got %v", expected, lineages)
+	}
+}
+
+func TestRawState(t *testing.T) {
+	st := types.State{
+		TFVersion: "1.0.2",
+		Serial:    3,
+		Modules: []types.Module{
+			{
+				Path: "",
+				Resources: []types.Resource{
+					{Mode: "managed", Type: "aws_instance", Name: "web", Index: "[0]", Provider: "registry.terraform.io/hashicorp/aws",
+						Attributes: []types.Attribute{{Key: "id", Value: `"i-0"`}, {Key: "tags", Value: `{"env":"prod"}`}}},
+					{Mode: "managed", Type: "aws_instance", Name: "web", Index: "[1]", Provider: "registry.terraform.io/hashicorp/aws",
+						Attributes: []types.Attribute{{Key: "id", Value: `"i-1"`}, {Key: "password", Value: "(redacted)"}}},
+				},
+				OutputValues: []types.OutputValue{{Name: "ip", Value: `"10.0.0.1"`}},
+			},
+			{
+				Path: `module.app["a"]`,
+				Resources: []types.Resource{
+					{Mode: "data", Type: "aws_ami", Name: "base", Index: `["x"]`, Provider: "registry.terraform.io/hashicorp/aws",
+						Attributes: []types.Attribute{{Key: "id", Value: `"ami-1"`}}},
+				},
+			},
+		},
+	}
+
+	raw, err := RawState(st, "lineage-1")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	sf, err := statefile.Read(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatalf("Expected a valid state, got %v", err)
+	}
+	if sf.Lineage != "lineage-1" || sf.Serial != 3 || sf.TerraformVersion.String() != "1.0.2" {
+		t.Fatalf("Expected lineage-1 at serial 3 of 1.0.2, got %s at serial %d of %s", sf.Lineage, sf.Serial, sf.TerraformVersion)
+	}
+
+	var addresses []string
+	for _, m := range sf.State.Modules {
+		for _, r := range m.Resources {
+			for key := range r.Instances {
+				addresses = append(addresses, r.Addr.Instance(key).String())
+			}
+		}
+	}
+	sort.Strings(addresses)
+	expected := []string{"aws_instance.web[0]", "aws_instance.web[1]", `module.app["a"].data.aws_ami.base["x"]`}
+	if !reflect.DeepEqual(addresses, expected) {
+		t.Fatalf("Expected %v, got %v", expected, addresses)
+	}
+	if _, ok := sf.State.RootModule().OutputValues["ip"]; !ok {
+		t.Fatalf("Expected output %s, got %v", "ip", sf.State.RootModule().OutputValues)
+	}
+}
+
+func TestFilterSmallLineages(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2021, 6, d, 0, 0, 0, 0, time.UTC) }
+	lineages := []types.SmallLineage{
+		{Lineage: "large", ResourceCount: 120, LastActivity: day(1)},
+		{Lineage: "tiny", ResourceCount: 2, LastActivity: day(3)},
+		{Lineage: "empty", ResourceCount: 0, LastActivity: day(10)},
+		{Lineage: "placeholder", ResourceCount: 0, LastActivity: day(2)},
+	}
+
+	names := func(ls []types.SmallLineage) (n []string) {
+		for _, l := range ls {
+			n = append(n, l.Lineage)
+		}
+		return
+	}
+
+	if got := names(filterSmallLineages(lineages, 0, time.Time{})); !reflect.DeepEqual(got, []string{"placeholder", "empty"}) {
+		t.Fatalf("Expected %v, got %v", []string{"placeholder", "empty"}, got)
+	}
+	if got := names(filterSmallLineages(lineages, 5, time.Time{})); !reflect.DeepEqual(got, []string{"placeholder", "tiny", "empty"}) {
+		t.Fatalf("Expected %v, got %v", []string{"placeholder", "tiny", "empty"}, got)
+	}
+	if got := names(filterSmallLineages(lineages, 5, day(5))); !reflect.DeepEqual(got, []string{"placeholder", "tiny"}) {
+		t.Fatalf("Expected %v, got %v", []string{"placeholder", "tiny"}, got)
+	}
+	if got := filterSmallLineages(nil, 0, time.Time{}); got == nil || len(got) != 0 {
+		t.Fatalf("Expected an empty list, got %v", got)
+	}
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"sort"
+
+	"github.com/camptocamp/terraboard/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// crossLineageMaxAttributes bounds the number of attributes loaded to find
+// the cross-lineage dependencies
+const crossLineageMaxAttributes = 100000
+
+// dependencyAttribute is an attribute of a Resource in the most recent State
+// of its lineage, whose value is the id of a Resource
+type dependencyAttribute struct {
+	LineageValue string
+	ModulePath   string
+	Mode         string
+	Type         string
+	Name         string
+	Index        string
+	Key          string
+	Value        string
+}
+
+// isResourceID returns whether an attribute is the id of a managed Resource
+func (a dependencyAttribute) isResourceID() bool {
+	return a.Key == "id" && a.Mode != "data"
+}
+
+// crossLineageEdges returns the edges from the Resources holding, in any
+// attribute but their own id, the id of a managed Resource of another lineage,
+// sorted by source then target. Data sources are never targets, but reference
+// the Resource they read by their id.
+func crossLineageEdges(attributes []dependencyAttribute) []types.CrossLineageEdge {
+	type target struct{ lineage, address string }
+	targets := make(map[string][]target)
+	for _, a := range attributes {
+		if a.isResourceID() {
+			address := resourceAddress(a.ModulePath, a.Mode, a.Type, a.Name, a.Index)
+			targets[a.Value] = append(targets[a.Value], target{a.LineageValue, address})
+		}
+	}
+
+	edges := []types.CrossLineageEdge{}
+	seen := make(map[types.CrossLineageEdge]bool)
+	for _, a := range attributes {
+		if a.isResourceID() {
+			continue
+		}
+		for _, t := range targets[a.Value] {
+			if t.lineage == a.LineageValue {
+				continue
+			}
+			edge := types.CrossLineageEdge{
+				SourceLineage: a.LineageValue,
+				SourceAddress: resourceAddress(a.ModulePath, a.Mode, a.Type, a.Name, a.Index),
+				Key:           a.Key,
+				TargetLineage: t.lineage,
+				TargetAddress: t.address,
+			}
+			if !seen[edge] {
+				seen[edge] = true
+				edges = append(edges, edge)
+			}
+		}
+	}
+
+	sort.Slice(edges, func(i, j int) bool {
+		a, b := edges[i], edges[j]
+		if a.SourceLineage != b.SourceLineage {
+			return a.SourceLineage < b.SourceLineage
+		}
+		if a.SourceAddress != b.SourceAddress {
+			return a.SourceAddress < b.SourceAddress
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		if a.TargetLineage != b.TargetLineage {
+			return a.TargetLineage < b.TargetLineage
+		}
+		return a.TargetAddress < b.TargetAddress
+	})
+	return edges
+}
+
+// ListCrossLineageDependencies returns a page of the edges from the Resources
+// referencing the id of a Resource of another lineage, in the most recent
+// State of each lineage, with the total number of edges
+func (db *Database) ListCrossLineageDependencies(page int) (edges []types.CrossLineageEdge, total int, err error) {
+	sql := "WITH latest AS (SELECT lineages.value AS lineage_value, modules.path AS module_path," +
+		" resources.mode, resources.type, resources.name, resources.index, attributes.key, attributes.value" +
+		" FROM (" + latestStatesSQL + ") t" +
+		" JOIN lineages ON lineages.id = t.lineage_id" +
+		" JOIN modules ON modules.state_id = t.id" +
+		" JOIN resources ON resources.module_id = modules.id" +
+		" JOIN attributes ON attributes.resource_id = COALESCE(resources.attributes_from_id, resources.id)" +
+		" WHERE attributes.value NOT IN ('', '\"\"', 'null'))" +
+		" SELECT * FROM latest WHERE value IN (SELECT value FROM latest WHERE key = 'id')" +
+		" LIMIT ?"
+
+	var attributes []dependencyAttribute
+	if err = db.Raw(sql, crossLineageMaxAttributes).Scan(&attributes).Error; err != nil {
+		return
+	}
+	if len(attributes) == crossLineageMaxAttributes {
+		log.Warnf("Cross-lineage dependencies limited to the first %d attributes", crossLineageMaxAttributes)
+	}
+
+	all := crossLineageEdges(attributes)
+	total = len(all)
+	start, end := pageBounds(page, pageSize, total)
+	return all[start:end], total, nil
+}
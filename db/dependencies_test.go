@@ -0,0 +1,47 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/camptocamp/terraboard/types"
+)
+
+func TestCrossLineageEdges(t *testing.T) {
+	attributes := []dependencyAttribute{
+		// Lineage B holds the VPC
+		{LineageValue: "network", Mode: "managed", Type: "aws_vpc", Name: "main", Key: "id", Value: `"vpc-0a1b"`},
+		// Lineage A references it
+		{LineageValue: "app", Mode: "managed", Type: "aws_security_group", Name: "web", Key: "id", Value: `"sg-1234"`},
+		{LineageValue: "app", Mode: "managed", Type: "aws_security_group", Name: "web", Key: "vpc_id", Value: `"vpc-0a1b"`},
+		{LineageValue: "app", Mode: "data", Type: "aws_vpc", Name: "main", Key: "id", Value: `"vpc-0a1b"`},
+		// References within a lineage aren't cross-lineage dependencies
+		{LineageValue: "network", Mode: "managed", Type: "aws_subnet", Name: "a", Key: "vpc_id", Value: `"vpc-0a1b"`},
+		{LineageValue: "app", Mode: "managed", Type: "aws_instance", Name: "web", Key: "vpc_security_group_ids.0", Value: `"sg-1234"`},
+	}
+
+	expected := []types.CrossLineageEdge{
+		{
+			SourceLineage: "app",
+			SourceAddress: "aws_security_group.web",
+			Key:           "vpc_id",
+			TargetLineage: "network",
+			TargetAddress: "aws_vpc.main",
+		},
+		{
+			SourceLineage: "app",
+			SourceAddress: "data.aws_vpc.main",
+			Key:           "id",
+			TargetLineage: "network",
+			TargetAddress: "aws_vpc.main",
+		},
+	}
+	edges := crossLineageEdges(attributes)
+	if !reflect.DeepEqual(edges, expected) {
+		t.Fatalf("Expected %v, got %v", expected, edges)
+	}
+
+	if edges := crossLineageEdges(nil); len(edges) != 0 {
+		t.Fatalf("Expected no edge, got %v", edges)
+	}
+}
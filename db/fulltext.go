@@ -0,0 +1,97 @@
+package db
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/camptocamp/terraboard/types"
+)
+
+// fullTextVector is the text search vector of an Attribute value,
+// split on non alphanumeric characters so that ARNs, IPs or IDs are
+// searchable by their parts. It is the expression of the GIN index.
+const fullTextVector = "to_tsvector('simple', regexp_replace(attributes.value, '[^[:alnum:]]+', ' ', 'g'))"
+
+var fullTextSeparator = regexp.MustCompile(`[^[:alnum:]]+`)
+
+// fullTextTerms splits a text into the lowercase terms of its text search vector
+func fullTextTerms(text string) (terms []string) {
+	for _, t := range fullTextSeparator.Split(strings.ToLower(text), -1) {
+		if t != "" {
+			terms = append(terms, t)
+		}
+	}
+	return
+}
+
+// fullTextQuery returns the text search query matching the values
+// containing the terms of a search, in sequence and by prefix
+func fullTextQuery(search string) string {
+	terms := fullTextTerms(search)
+	for i, t := range terms {
+		terms[i] = t + ":*"
+	}
+	return strings.Join(terms, " <-> ")
+}
+
+// MigrateFullTextIndex is a migration function creating the GIN index
+// used to search Attribute values
+func (db *Database) MigrateFullTextIndex() error {
+	if err := db.Exec("CREATE INDEX IF NOT EXISTS idx_attributes_value_fulltext ON attributes USING GIN (" + fullTextVector + ")").Error; err != nil {
+		return fmt.Errorf("Failed to create attributes full-text index during migration: %v", err)
+	}
+	return nil
+}
+
+// SearchFullText returns, by pages and ranked by relevance, the Resources
+// of the latest State versions with Attribute values matching a search
+func (db *Database) SearchFullText(search string, page int) (results []types.FullTextResult, total int, err error) {
+	results = []types.FullTextResult{}
+	query := fullTextQuery(search)
+	if query == "" {
+		return
+	}
+
+	sqlQuery := " FROM (SELECT states.path, max(states.serial) as mx FROM states GROUP BY states.path) t" +
+		" JOIN states ON t.path = states.path AND t.mx = states.serial" +
+		" JOIN modules ON states.id = modules.state_id" +
+		" JOIN resources ON modules.id = resources.module_id" +
+		" JOIN attributes ON attributes.resource_id = COALESCE(resources.attributes_from_id, resources.id)" +
+		" JOIN lineages ON lineages.id = states.lineage_id" +
+		" JOIN versions ON states.version_id = versions.id" +
+		" WHERE " + fullTextVector + " @@ to_tsquery('simple', ?)"
+
+	if err = db.Raw("SELECT count(DISTINCT resources.id)"+sqlQuery, query).Row().Scan(&total); err != nil {
+		return
+	}
+
+	sql := "SELECT lineages.value, states.path, versions.version_id," +
+		" modules.path, resources.mode, resources.type, resources.name, resources.index," +
+		" string_agg(attributes.key, ',' ORDER BY attributes.key)," +
+		" max(ts_rank(" + fullTextVector + ", to_tsquery('simple', ?))) AS rank" +
+		sqlQuery +
+		" GROUP BY resources.id, lineages.value, states.path, versions.version_id," +
+		" modules.path, resources.mode, resources.type, resources.name, resources.index" +
+		" ORDER BY rank DESC, lineages.value, states.path, resources.type, resources.name" +
+		" LIMIT ? OFFSET ?"
+
+	rows, err := db.Raw(sql, query, query, pageSize, (page-1)*pageSize).Rows()
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r types.FullTextResult
+		var modulePath, mode, name, index, keys string
+		if err = rows.Scan(&r.LineageValue, &r.Path, &r.VersionID,
+			&modulePath, &mode, &r.ResourceType, &name, &index, &keys, &r.Rank); err != nil {
+			return
+		}
+		r.Address = resourceAddress(modulePath, mode, r.ResourceType, name, index)
+		r.AttributeKeys = strings.Split(keys, ",")
+		results = append(results, r)
+	}
+	return
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestFullTextQuery(t *testing.T) {
+	for search, expected := range map[string]string{
+		"10.0.1.5":                  "10:* <-> 0:* <-> 1:* <-> 5:*",
+		"arn:aws:iam::123456789012": "arn:* <-> aws:* <-> iam:* <-> 123456789012:*",
+		"  Web-Server ":             "web:* <-> server:*",
+		"'; DROP TABLE states; --":  "drop:* <-> table:* <-> states:*",
+		"::":                        "",
+	} {
+		if query := fullTextQuery(search); query != expected {
+			t.Fatalf("Expected %v for %v, got %v", expected, search, query)
+		}
+	}
+}
+
+func TestFullTextTerms_MultipleResourceTypes(t *testing.T) {
+	attributes := []struct{ resource, value string }{
+		{"aws_instance.web", "10.0.1.5"},
+		{"aws_security_group_rule.ssh", "10.0.1.5/32"},
+		{"aws_route53_record.web", `["10.0.1.5"]`},
+		{"aws_instance.db", "10.1.0.5"},
+		{"aws_iam_role.web", "arn:aws:iam::123456789012:role/web"},
+	}
+
+	// A value matches when its terms contain the query terms in sequence,
+	// each query term being a prefix, as the text search query does
+	matches := func(value, search string) bool {
+		terms, query := fullTextTerms(value), fullTextTerms(search)
+		for start := 0; start+len(query) <= len(terms); start++ {
+			i := 0
+			for i < len(query) && strings.HasPrefix(terms[start+i], query[i]) {
+				i++
+			}
+			if i == len(query) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for search, expected := range map[string][]string{
+		"10.0.1":            {"aws_instance.web", "aws_route53_record.web", "aws_security_group_rule.ssh"},
+		"iam::123456789012": {"aws_iam_role.web"},
+		"0.5":               {"aws_instance.db"},
+	} {
+		var matched []string
+		for _, a := range attributes {
+			if matches(a.value, search) {
+				matched = append(matched, a.resource)
+			}
+		}
+		sort.Strings(matched)
+		if !reflect.DeepEqual(matched, expected) {
+			t.Fatalf("Expected %v for %v, got %v", expected, search, matched)
+		}
+	}
+}
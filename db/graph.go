@@ -0,0 +1,92 @@
+package db
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/camptocamp/terraboard/types"
+)
+
+// moduleInstanceKey matches the instance keys of a module path,
+// such as [0] or ["a"]
+var moduleInstanceKey = regexp.MustCompile(`\[[^\]]*\]`)
+
+// stateGraph returns the dependency graph of the Resources of a State.
+// Terraform records dependencies between resources, not their instances,
+// so an instance depends on all the instances of the Resources it references.
+func stateGraph(st types.State) types.StateGraph {
+	graph := types.StateGraph{
+		Nodes: []types.GraphNode{},
+		Edges: []types.GraphEdge{},
+	}
+
+	type resource struct {
+		id   string
+		deps string
+	}
+	var resources []resource
+	instances := make(map[string][]string)
+	for _, m := range st.Modules {
+		configPath := moduleInstanceKey.ReplaceAllString(m.Path, "")
+		for _, r := range m.Resources {
+			id := resourceAddress(m.Path, r.Mode, r.Type, r.Name, r.Index)
+			graph.Nodes = append(graph.Nodes, types.GraphNode{
+				ID:     id,
+				Module: m.Path,
+				Mode:   r.Mode,
+				Type:   r.Type,
+				Name:   r.Name,
+			})
+			resources = append(resources, resource{id, r.Dependencies})
+
+			address := resourceAddress(configPath, r.Mode, r.Type, r.Name, "")
+			instances[address] = append(instances[address], id)
+		}
+	}
+
+	seen := make(map[types.GraphEdge]bool)
+	for _, r := range resources {
+		if r.deps == "" {
+			continue
+		}
+		for _, dep := range strings.Split(r.deps, "\n") {
+			for _, target := range instances[dep] {
+				edge := types.GraphEdge{Source: r.id, Target: target}
+				if target != r.id && !seen[edge] {
+					seen[edge] = true
+					graph.Edges = append(graph.Edges, edge)
+				}
+			}
+		}
+	}
+
+	sort.Slice(graph.Nodes, func(i, j int) bool {
+		return graph.Nodes[i].ID < graph.Nodes[j].ID
+	})
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		a, b := graph.Edges[i], graph.Edges[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.Target < b.Target
+	})
+	return graph
+}
+
+// GetStateGraph returns the dependency graph of the Resources
+// of a State version
+func (db *Database) GetStateGraph(lineage, versionID string) (graph types.StateGraph, err error) {
+	var st types.State
+	res := db.Joins("JOIN lineages on states.lineage_id=lineages.id").
+		Joins("JOIN versions on states.version_id=versions.id").
+		Preload("Modules").Preload("Modules.Resources").
+		Find(&st, "lineages.value = ? AND versions.version_id = ?", lineage, versionID)
+	if res.Error != nil {
+		return graph, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return graph, ErrUnknownVersion
+	}
+	return stateGraph(st), nil
+}
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/camptocamp/terraboard/internal/terraform/states/statefile"
+	"github.com/camptocamp/terraboard/types"
+)
+
+const crossModuleState = `{
+  "version": 4,
+  "terraform_version": "1.0.2",
+  "serial": 5,
+  "lineage": "graph",
+  "outputs": {},
+  "resources": [
+    {
+      "module": "module.network",
+      "mode": "managed",
+      "type": "aws_vpc",
+      "name": "main",
+      "provider": "provider[\"registry.terraform.io/hashicorp/aws\"]",
+      "instances": [
+        {"schema_version": 1, "attributes": {"id": "vpc-0a1b"}}
+      ]
+    },
+    {
+      "module": "module.app[\"web\"]",
+      "mode": "managed",
+      "type": "aws_instance",
+      "name": "server",
+      "provider": "provider[\"registry.terraform.io/hashicorp/aws\"]",
+      "instances": [
+        {
+          "index_key": 0,
+          "schema_version": 1,
+          "attributes": {"id": "i-0"},
+          "dependencies": ["data.aws_ami.base", "module.network.aws_vpc.main"]
+        },
+        {
+          "index_key": 1,
+          "schema_version": 1,
+          "attributes": {"id": "i-1"},
+          "dependencies": ["data.aws_ami.base", "module.network.aws_vpc.main", "aws_s3_bucket.removed"]
+        }
+      ]
+    },
+    {
+      "mode": "data",
+      "type": "aws_ami",
+      "name": "base",
+      "provider": "provider[\"registry.terraform.io/hashicorp/aws\"]",
+      "instances": [
+        {"schema_version": 0, "attributes": {"id": "ami-1"}}
+      ]
+    },
+    {
+      "mode": "managed",
+      "type": "aws_route53_record",
+      "name": "web",
+      "provider": "provider[\"registry.terraform.io/hashicorp/aws\"]",
+      "instances": [
+        {
+          "schema_version": 2,
+          "attributes": {"id": "web"},
+          "dependencies": ["module.app.aws_instance.server"]
+        }
+      ]
+    }
+  ]
+}`
+
+func TestStateGraph(t *testing.T) {
+	sf, err := statefile.Read(strings.NewReader(crossModuleState))
+	if err != nil {
+		t.Fatalf("Failed to read state: %v", err)
+	}
+	graph := stateGraph(types.State{Modules: stateModules(sf)})
+
+	var ids []string
+	for _, n := range graph.Nodes {
+		ids = append(ids, n.ID)
+	}
+	expectedIDs := []string{
+		"aws_route53_record.web",
+		"data.aws_ami.base",
+		`module.app["web"].aws_instance.server[0]`,
+		`module.app["web"].aws_instance.server[1]`,
+		"module.network.aws_vpc.main",
+	}
+	if !reflect.DeepEqual(ids, expectedIDs) {
+		t.Fatalf("Expected %v, got %v", expectedIDs, ids)
+	}
+	expectedNode := types.GraphNode{
+		ID:     `module.app["web"].aws_instance.server[0]`,
+		Module: `module.app["web"]`,
+		Mode:   "managed",
+		Type:   "aws_instance",
+		Name:   "server",
+	}
+	if graph.Nodes[2] != expectedNode {
+		t.Fatalf("Expected %v, got %v", expectedNode, graph.Nodes[2])
+	}
+
+	// Dependencies on Resources missing from the State are left out
+	expectedEdges := []types.GraphEdge{
+		{Source: "aws_route53_record.web", Target: `module.app["web"].aws_instance.server[0]`},
+		{Source: "aws_route53_record.web", Target: `module.app["web"].aws_instance.server[1]`},
+		{Source: `module.app["web"].aws_instance.server[0]`, Target: "data.aws_ami.base"},
+		{Source: `module.app["web"].aws_instance.server[0]`, Target: "module.network.aws_vpc.main"},
+		{Source: `module.app["web"].aws_instance.server[1]`, Target: "data.aws_ami.base"},
+		{Source: `module.app["web"].aws_instance.server[1]`, Target: "module.network.aws_vpc.main"},
+	}
+	if !reflect.DeepEqual(graph.Edges, expectedEdges) {
+		t.Fatalf("Expected %v, got %v", expectedEdges, graph.Edges)
+	}
+}
+
+func TestStateGraph_Empty(t *testing.T) {
+	graph := stateGraph(types.State{})
+	if graph.Nodes == nil || graph.Edges == nil || len(graph.Nodes) != 0 || len(graph.Edges) != 0 {
+		t.Fatalf("Expected an empty graph, got %v", graph)
+	}
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"time"
+
+	"github.com/camptocamp/terraboard/metrics"
+	"github.com/camptocamp/terraboard/types"
+	"gorm.io/gorm"
+)
+
+// queryStartKey is the gorm instance key of the start time of an operation
+const queryStartKey = "metrics:start"
+
+// registerMetricsCallbacks records the duration of every gorm operation
+func registerMetricsCallbacks(db *gorm.DB) error {
+	before := func(tx *gorm.DB) {
+		tx.InstanceSet(queryStartKey, time.Now())
+	}
+	after := func(operation string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			if start, ok := tx.InstanceGet(queryStartKey); ok {
+				metrics.ObserveQuery(operation, time.Since(start.(time.Time)))
+			}
+		}
+	}
+
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Query().Before("gorm:query").Register("metrics:before_query", before),
+		cb.Query().After("gorm:query").Register("metrics:after_query", after("query")),
+		cb.Create().Before("gorm:create").Register("metrics:before_create", before),
+		cb.Create().After("gorm:create").Register("metrics:after_create", after("create")),
+		cb.Update().Before("gorm:update").Register("metrics:before_update", before),
+		cb.Update().After("gorm:update").Register("metrics:after_update", after("update")),
+		cb.Delete().Before("gorm:delete").Register("metrics:before_delete", before),
+		cb.Delete().After("gorm:delete").Register("metrics:after_delete", after("delete")),
+		cb.Row().Before("gorm:row").Register("metrics:before_row", before),
+		cb.Row().After("gorm:row").Register("metrics:after_row", after("row")),
+		cb.Raw().Before("gorm:raw").Register("metrics:before_raw", before),
+		cb.Raw().After("gorm:raw").Register("metrics:after_raw", after("raw")),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountInventory returns the number of lineages and state versions
+func (db *Database) CountInventory() (lineages, versions int64, err error) {
+	if err = db.Model(&types.Lineage{}).Count(&lineages).Error; err != nil {
+		return
+	}
+	err = db.Model(&types.State{}).Count(&versions).Error
+	return
+}
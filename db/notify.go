@@ -0,0 +1,105 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4/stdlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// invalidationChannel is the PostgreSQL notification channel on which
+// replicas sharing the database announce the lineages whose data changed
+const invalidationChannel = "terraboard_invalidation"
+
+// invalidationRetryDelay is the delay after which listening to the
+// invalidations is attempted again when the connection is lost
+var invalidationRetryDelay = 10 * time.Second
+
+// notifyInvalidation announces to all replicas, this one included,
+// that the data of a lineage changed. Failures are only logged, the
+// data being in the database anyway.
+func (db *Database) notifyInvalidation(lineage string) {
+	if err := db.Exec("SELECT pg_notify(?, ?)", invalidationChannel, lineage).Error; err != nil {
+		log.WithFields(log.Fields{
+			"lineage": lineage,
+			"error":   err,
+		}).Warn("Failed to notify the invalidation of the lineage")
+	}
+}
+
+// ListenInvalidations calls invalidate with the lineages whose data was
+// changed by any replica, until ctx is done. Notifications are received on
+// a connection of their own, established again when it is lost, invalidate
+// being then called with an empty lineage as notifications may have been
+// missed meanwhile.
+func (db *Database) ListenInvalidations(ctx context.Context, invalidate func(lineage string)) {
+	for {
+		err := db.listenInvalidations(ctx, invalidate)
+		if ctx.Err() != nil {
+			return
+		}
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Stopped receiving invalidations, listening again")
+		invalidate("")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(invalidationRetryDelay):
+		}
+	}
+}
+
+// listenInvalidations listens to the invalidations on a connection of the
+// pool until it fails. The connection is then discarded rather than being
+// returned to the pool, still listening.
+func (db *Database) listenInvalidations(ctx context.Context, invalidate func(lineage string)) error {
+	sqlDB, err := db.DB.DB()
+	if err != nil {
+		return err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var listenErr error
+	_ = conn.Raw(func(driverConn interface{}) error {
+		c, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			listenErr = fmt.Errorf("unsupported database connection %T", driverConn)
+			return nil
+		}
+		if _, listenErr = c.Conn().Exec(ctx, "LISTEN "+invalidationChannel); listenErr != nil {
+			return driver.ErrBadConn
+		}
+		listenErr = dispatchInvalidations(ctx, c.Conn(), invalidate)
+		return driver.ErrBadConn
+	})
+	return listenErr
+}
+
+// notificationWaiter waits for the notifications of the channels listened to
+type notificationWaiter interface {
+	WaitForNotification(ctx context.Context) (*pgconn.Notification, error)
+}
+
+// dispatchInvalidations calls invalidate with the lineage of each
+// invalidation received, until waiting for notifications fails
+func dispatchInvalidations(ctx context.Context, w notificationWaiter, invalidate func(lineage string)) error {
+	for {
+		n, err := w.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		if n.Channel == invalidationChannel {
+			invalidate(n.Payload)
+		}
+	}
+}
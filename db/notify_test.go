@@ -0,0 +1,46 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pgconn"
+)
+
+// fakeNotificationWaiter returns its notifications, then fails
+type fakeNotificationWaiter struct {
+	notifications []*pgconn.Notification
+}
+
+var errConnectionLost = errors.New("connection lost")
+
+func (f *fakeNotificationWaiter) WaitForNotification(ctx context.Context) (*pgconn.Notification, error) {
+	if len(f.notifications) == 0 {
+		return nil, errConnectionLost
+	}
+	n := f.notifications[0]
+	f.notifications = f.notifications[1:]
+	return n, nil
+}
+
+func TestDispatchInvalidations(t *testing.T) {
+	w := &fakeNotificationWaiter{notifications: []*pgconn.Notification{
+		{Channel: invalidationChannel, Payload: "lineage1"},
+		{Channel: "other", Payload: "lineage2"},
+		{Channel: invalidationChannel, Payload: "lineage3"},
+	}}
+
+	var invalidated []string
+	err := dispatchInvalidations(context.Background(), w, func(lineage string) {
+		invalidated = append(invalidated, lineage)
+	})
+	if err != errConnectionLost {
+		t.Fatalf("Expected %v, got %v", errConnectionLost, err)
+	}
+	expected := []string{"lineage1", "lineage3"}
+	if !reflect.DeepEqual(invalidated, expected) {
+		t.Fatalf("Expected %v, got %v", expected, invalidated)
+	}
+}
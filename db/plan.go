@@ -0,0 +1,417 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/camptocamp/terraboard/types"
+	"github.com/hashicorp/go-version"
+	"gorm.io/gorm"
+)
+
+// latestPlanFormatVersion is the most recent Terraform plan JSON format version supported
+const latestPlanFormatVersion = "1.2"
+
+// applyableFormatVersion is the first plan format version reporting
+// whether the plan is applyable
+const applyableFormatVersion = "1.2"
+
+// ErrUnsupportedPlanFormat is returned when a plan format version can't be parsed
+var ErrUnsupportedPlanFormat = errors.New("unsupported plan format version")
+
+// planFormat holds the fields of a Terraform plan JSON which are extracted
+// into its summary
+type planFormat struct {
+	FormatVersion    string `json:"format_version"`
+	TerraformVersion string `json:"terraform_version"`
+	Applyable        *bool  `json:"applyable"`
+	ResourceChanges  []struct {
+		Change struct {
+			Actions []string `json:"actions"`
+		} `json:"change"`
+	} `json:"resource_changes"`
+	OutputChanges map[string]struct {
+		Actions []string `json:"actions"`
+	} `json:"output_changes"`
+}
+
+// checkPlanFormatVersion returns an error if the plan format version is not supported.
+// Newer minor versions are backward compatible and only rejected in strict mode.
+func checkPlanFormatVersion(formatVersion string, strict bool) (*version.Version, error) {
+	if formatVersion == "" {
+		return nil, fmt.Errorf("%w: missing format_version", ErrUnsupportedPlanFormat)
+	}
+	v, err := version.NewVersion(formatVersion)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedPlanFormat, err)
+	}
+
+	latest := version.Must(version.NewVersion(latestPlanFormatVersion))
+	if v.Segments()[0] > latest.Segments()[0] || (strict && v.GreaterThan(latest)) {
+		return nil, fmt.Errorf("%w: %s (latest supported is %s)", ErrUnsupportedPlanFormat, formatVersion, latestPlanFormatVersion)
+	}
+	return v, nil
+}
+
+// isPendingChange returns true if the actions of a change modify the infrastructure
+func isPendingChange(actions []string) bool {
+	for _, a := range actions {
+		if a != "no-op" && a != "read" {
+			return true
+		}
+	}
+	return false
+}
+
+// countActions adds the actions of a resource change to the summary counts.
+// A replacement counts as both an addition and a destruction.
+func countActions(summary *types.PlanSummary, actions []string) {
+	for _, a := range actions {
+		switch a {
+		case "create":
+			summary.Add++
+		case "update":
+			summary.Change++
+		case "delete":
+			summary.Destroy++
+		}
+	}
+}
+
+// parsePlanSummary extracts a normalized summary from a Terraform plan JSON,
+// whatever its supported format version
+func parsePlanSummary(planJSON []byte, strict bool) (summary types.PlanSummary, err error) {
+	var plan planFormat
+	if err = json.Unmarshal(planJSON, &plan); err != nil {
+		return
+	}
+
+	v, err := checkPlanFormatVersion(plan.FormatVersion, strict)
+	if err != nil {
+		return
+	}
+
+	summary = types.PlanSummary{
+		FormatVersion:    plan.FormatVersion,
+		TerraformVersion: plan.TerraformVersion,
+		ResourceChanges:  len(plan.ResourceChanges),
+	}
+	for _, rc := range plan.ResourceChanges {
+		countActions(&summary, rc.Change.Actions)
+	}
+
+	if plan.Applyable != nil && !v.LessThan(version.Must(version.NewVersion(applyableFormatVersion))) {
+		summary.Applyable = *plan.Applyable
+		return
+	}
+
+	// Older formats don't report it: the plan is applyable if it changes anything
+	for _, rc := range plan.ResourceChanges {
+		if isPendingChange(rc.Change.Actions) {
+			summary.Applyable = true
+			return
+		}
+	}
+	for _, oc := range plan.OutputChanges {
+		if isPendingChange(oc.Actions) {
+			summary.Applyable = true
+			return
+		}
+	}
+	return
+}
+
+// planDrift returns the resources created, updated, replaced and destroyed
+// by the resource changes of a Plan
+func planDrift(changes []types.PlanResourceChange) (drift types.Drift) {
+	drift.Create, drift.Update, drift.Replace, drift.Destroy = []string{}, []string{}, []string{}, []string{}
+	for _, rc := range changes {
+		var actions []string
+		if err := json.Unmarshal([]byte(rc.Change.Actions), &actions); err != nil {
+			continue
+		}
+		switch strings.Join(actions, ",") {
+		case "create":
+			drift.Create = append(drift.Create, rc.Address)
+		case "update":
+			drift.Update = append(drift.Update, rc.Address)
+		case "delete":
+			drift.Destroy = append(drift.Destroy, rc.Address)
+		case "delete,create", "create,delete":
+			drift.Replace = append(drift.Replace, rc.Address)
+		}
+	}
+	sort.Strings(drift.Create)
+	sort.Strings(drift.Update)
+	sort.Strings(drift.Replace)
+	sort.Strings(drift.Destroy)
+	return
+}
+
+// GetDrift returns the resources the most recent Plan of a Lineage
+// intends to change on its most recent State version
+func (db *Database) GetDrift(lineage string) (drift types.Drift, err error) {
+	var st types.State
+	err = db.Joins("JOIN lineages ON lineages.id = states.lineage_id").
+		Preload("Version").
+		Where("lineages.value = ?", lineage).
+		Order("states.serial desc").
+		First(&st).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return drift, ErrLineageNotFound
+	} else if err != nil {
+		return
+	}
+
+	var plan types.Plan
+	err = db.Joins("JOIN lineages ON lineages.id = plans.lineage_id").
+		Preload("ParsedPlan").
+		Preload("ParsedPlan.PlanResourceChanges").
+		Preload("ParsedPlan.PlanResourceChanges.Change").
+		Where("lineages.value = ?", lineage).
+		Order("plans.created_at desc").
+		Omit("plan_json").
+		First(&plan).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return drift, ErrPlanNotFound
+	} else if err != nil {
+		return
+	}
+
+	drift = planDrift(plan.ParsedPlan.PlanResourceChanges)
+	drift.Lineage = lineage
+	drift.VersionID = st.Version.VersionID
+	drift.PlanID = plan.ID
+	drift.PlannedAt = plan.CreatedAt
+	drift.Outdated = plan.CreatedAt.Before(st.Version.LastModified)
+	return
+}
+
+// ErrNoPriorState is returned when a Plan embeds no prior state
+var ErrNoPriorState = errors.New("plan has no prior state")
+
+// priorStateVersions is the count of recorded versions searched
+// for the one a Plan was made against
+const priorStateVersions = 10
+
+// priorStateModule is a module of the prior state embedded in a Plan
+type priorStateModule struct {
+	Resources []struct {
+		Address string                 `json:"address"`
+		Values  map[string]interface{} `json:"values"`
+	} `json:"resources"`
+	ChildModules []priorStateModule `json:"child_modules"`
+}
+
+// collect adds the attribute values of the resources of the module,
+// and of its child modules, by resource address
+func (m priorStateModule) collect(values map[string]map[string]string) {
+	for _, r := range m.Resources {
+		attrs := make(map[string]string, len(r.Values))
+		for k, v := range r.Values {
+			vJSON, _ := json.Marshal(v)
+			attrs[k] = string(vJSON)
+		}
+		values[r.Address] = attrs
+	}
+	for _, c := range m.ChildModules {
+		c.collect(values)
+	}
+}
+
+// priorStateValues returns the attribute values of the resources of the
+// prior state embedded in a Plan, encoded as the Database stores them
+func priorStateValues(planJSON []byte) (map[string]map[string]string, error) {
+	var plan struct {
+		PriorState *struct {
+			Values struct {
+				RootModule priorStateModule `json:"root_module"`
+			} `json:"values"`
+		} `json:"prior_state"`
+	}
+	if err := json.Unmarshal(planJSON, &plan); err != nil {
+		return nil, err
+	}
+	if plan.PriorState == nil {
+		return nil, ErrNoPriorState
+	}
+
+	values := make(map[string]map[string]string)
+	plan.PriorState.Values.RootModule.collect(values)
+	return values, nil
+}
+
+// stateValues returns the attribute values of the resources of a State
+// by resource address
+func stateValues(st types.State) map[string]map[string]string {
+	values := make(map[string]map[string]string)
+	for _, m := range st.Modules {
+		for _, r := range m.Resources {
+			attrs := make(map[string]string, len(r.Attributes))
+			for _, a := range r.Attributes {
+				attrs[a.Key] = a.Value
+			}
+			values[resourceAddress(m.Path, r.Mode, r.Type, r.Name, r.Index)] = attrs
+		}
+	}
+	return values
+}
+
+// priorStateDrift compares the prior state of a Plan with a recorded State,
+// listing the resources found on one side only and the changed attributes
+func priorStateDrift(prior, recorded map[string]map[string]string) (drift types.PriorStateDrift) {
+	drift.OnlyInPlan, drift.OnlyInState = []string{}, []string{}
+	drift.Changed = make(map[string][]string)
+	for address, attrs := range prior {
+		recordedAttrs, ok := recorded[address]
+		if !ok {
+			drift.OnlyInPlan = append(drift.OnlyInPlan, address)
+			continue
+		}
+		var changed []string
+		for k, v := range attrs {
+			if rv, ok := recordedAttrs[k]; !ok || rv != v {
+				changed = append(changed, k)
+			}
+		}
+		for k := range recordedAttrs {
+			if _, ok := attrs[k]; !ok {
+				changed = append(changed, k)
+			}
+		}
+		if len(changed) > 0 {
+			sort.Strings(changed)
+			drift.Changed[address] = changed
+		}
+	}
+	for address := range recorded {
+		if _, ok := prior[address]; !ok {
+			drift.OnlyInState = append(drift.OnlyInState, address)
+		}
+	}
+	sort.Strings(drift.OnlyInPlan)
+	sort.Strings(drift.OnlyInState)
+	drift.Stale = len(drift.OnlyInPlan) > 0 || len(drift.OnlyInState) > 0 || len(drift.Changed) > 0
+	return
+}
+
+// GetPriorStateDrift compares the prior state embedded in a Plan with the
+// most recent version of its Lineage recorded when the Plan was made.
+// When they differ, the Plan is stale and the recorded version matching
+// its prior state, if any, is searched among the previous versions.
+func (db *Database) GetPriorStateDrift(planID string) (drift types.PriorStateDrift, err error) {
+	var plan types.Plan
+	if err = db.Joins("Lineage").First(&plan, `"plans"."id" = ?`, planID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = ErrPlanNotFound
+		}
+		return
+	}
+	prior, err := priorStateValues(plan.PlanJSON)
+	if err != nil {
+		return
+	}
+
+	var states []types.State
+	err = db.Joins("JOIN versions ON versions.id = states.version_id").
+		Preload("Version").Preload("Modules").Preload("Modules.Resources").Preload("Modules.Resources.Attributes").
+		Where("states.lineage_id = ? AND versions.last_modified <= ?", plan.LineageID, plan.CreatedAt).
+		Order("versions.last_modified desc").
+		Limit(priorStateVersions).
+		Find(&states).Error
+	if err != nil {
+		return
+	}
+	if len(states) == 0 {
+		return drift, ErrUnknownVersion
+	}
+
+	for i := range states {
+		db.resolveSharedAttributes(&states[i])
+	}
+	drift = priorStateDrift(prior, stateValues(states[0]))
+	drift.PlanID = plan.ID
+	drift.Lineage = plan.Lineage.Value
+	drift.PlannedAt = plan.CreatedAt
+	drift.VersionID = states[0].Version.VersionID
+	if !drift.Stale {
+		drift.MatchedVersionID = drift.VersionID
+		return
+	}
+	for _, st := range states[1:] {
+		if !priorStateDrift(prior, stateValues(st)).Stale {
+			drift.MatchedVersionID = st.Version.VersionID
+			break
+		}
+	}
+	return
+}
+
+// lineageRecency is the time of the most recent State version
+// and of the most recent Plan of a Lineage
+type lineageRecency struct {
+	LineageValue  string
+	LastVersionAt time.Time
+	LastPlanAt    sql.NullTime
+}
+
+// planStateGaps computes the gap between the most recent Plan and State
+// version of each Lineage, sorted by gap descending. Lineages whose State is
+// newer than their last Plan by more than the threshold are flagged, as well
+// as Lineages without any Plan, which come first.
+func planStateGaps(recency []lineageRecency, threshold time.Duration) []types.PlanStateGap {
+	gaps := []types.PlanStateGap{}
+	for _, r := range recency {
+		gap := types.PlanStateGap{
+			LineageValue:  r.LineageValue,
+			LastVersionAt: r.LastVersionAt,
+			Flagged:       true,
+		}
+		if r.LastPlanAt.Valid {
+			lastPlanAt := r.LastPlanAt.Time
+			gap.LastPlanAt = &lastPlanAt
+			d := r.LastVersionAt.Sub(lastPlanAt)
+			gap.GapSeconds = int64(d / time.Second)
+			gap.Flagged = d > threshold
+		}
+		gaps = append(gaps, gap)
+	}
+
+	sort.SliceStable(gaps, func(i, j int) bool {
+		if (gaps[i].LastPlanAt == nil) != (gaps[j].LastPlanAt == nil) {
+			return gaps[i].LastPlanAt == nil
+		}
+		if gaps[i].GapSeconds != gaps[j].GapSeconds {
+			return gaps[i].GapSeconds > gaps[j].GapSeconds
+		}
+		return gaps[i].LineageValue < gaps[j].LineageValue
+	})
+	return gaps
+}
+
+// GetPlanStateGaps returns, by pages, the gap between the most recent Plan
+// and State version of each Lineage, sorted by gap descending
+func (db *Database) GetPlanStateGaps(threshold time.Duration, page int) (gaps []types.PlanStateGap, total int, err error) {
+	sql := "SELECT lineages.value AS lineage_value, max(versions.last_modified) AS last_version_at," +
+		" (SELECT max(plans.created_at) FROM plans JOIN lineages l ON l.id = plans.lineage_id" +
+		" WHERE l.value = lineages.value AND plans.deleted_at IS NULL) AS last_plan_at" +
+		" FROM lineages" +
+		" JOIN states ON states.lineage_id = lineages.id" +
+		" JOIN versions ON versions.id = states.version_id" +
+		" GROUP BY lineages.value"
+
+	var recency []lineageRecency
+	if err = db.Raw(sql).Scan(&recency).Error; err != nil {
+		return
+	}
+
+	all := planStateGaps(recency, threshold)
+	total = len(all)
+	start, end := pageBounds(page, pageSize, total)
+	return all[start:end], total, nil
+}
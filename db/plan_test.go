@@ -0,0 +1,260 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/terraboard/types"
+)
+
+const planFormat02 = `{
+	"format_version": "0.2",
+	"terraform_version": "1.0.2",
+	"resource_changes": [
+		{"address": "aws_instance.web", "change": {"actions": ["create"]}},
+		{"address": "aws_s3_bucket.logs", "change": {"actions": ["no-op"]}}
+	]
+}`
+
+const planWithChanges = `{
+	"format_version": "1.0",
+	"terraform_version": "1.1.9",
+	"resource_changes": [
+		{"address": "aws_instance.web[0]", "change": {"actions": ["create"]}},
+		{"address": "aws_instance.web[1]", "change": {"actions": ["create"]}},
+		{"address": "aws_security_group.web", "change": {"actions": ["update"]}},
+		{"address": "aws_eip.web", "change": {"actions": ["delete"]}},
+		{"address": "aws_launch_template.web", "change": {"actions": ["delete", "create"]}},
+		{"address": "aws_s3_bucket.logs", "change": {"actions": ["no-op"]}},
+		{"address": "data.aws_ami.ubuntu", "change": {"actions": ["read"]}}
+	]
+}`
+
+const planFormat12 = `{
+	"format_version": "1.2",
+	"terraform_version": "1.5.7",
+	"applyable": true,
+	"resource_changes": [
+		{"address": "aws_instance.web", "change": {"actions": ["create"]}},
+		{"address": "aws_s3_bucket.logs", "change": {"actions": ["no-op"]}}
+	]
+}`
+
+func TestParsePlanSummary_FormatVersions(t *testing.T) {
+	for _, tc := range []struct {
+		plan     string
+		expected types.PlanSummary
+	}{
+		{planFormat02, types.PlanSummary{FormatVersion: "0.2", TerraformVersion: "1.0.2", Applyable: true, ResourceChanges: 2, Add: 1}},
+		{planFormat12, types.PlanSummary{FormatVersion: "1.2", TerraformVersion: "1.5.7", Applyable: true, ResourceChanges: 2, Add: 1}},
+	} {
+		summary, err := parsePlanSummary([]byte(tc.plan), false)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !reflect.DeepEqual(summary, tc.expected) {
+			t.Fatalf("Expected %v, got %v", tc.expected, summary)
+		}
+	}
+}
+
+func TestParsePlanSummary_NoChanges(t *testing.T) {
+	plan := `{"format_version": "1.0", "resource_changes": [{"change": {"actions": ["no-op"]}}]}`
+
+	summary, err := parsePlanSummary([]byte(plan), false)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if summary.Applyable {
+		t.Fatalf("Expected plan not to be applyable")
+	}
+}
+
+func TestParsePlanSummary_UnsupportedVersion(t *testing.T) {
+	for _, tc := range []struct {
+		plan   string
+		strict bool
+	}{
+		{`{"format_version": "2.0"}`, false},
+		{`{"format_version": "1.3"}`, true},
+		{`{"terraform_version": "1.0.2"}`, false},
+	} {
+		if _, err := parsePlanSummary([]byte(tc.plan), tc.strict); !errors.Is(err, ErrUnsupportedPlanFormat) {
+			t.Fatalf("Expected %v, got %v", ErrUnsupportedPlanFormat, err)
+		}
+	}
+
+	if _, err := parsePlanSummary([]byte(`{"format_version": "1.3"}`), false); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+}
+
+func TestParsePlanSummary_ActionCounts(t *testing.T) {
+	summary, err := parsePlanSummary([]byte(planWithChanges), false)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if summary.Add != 3 || summary.Change != 1 || summary.Destroy != 2 {
+		t.Fatalf("Expected 3 to add, 1 to change, 2 to destroy, got %d, %d, %d", summary.Add, summary.Change, summary.Destroy)
+	}
+}
+
+func TestPlanDrift(t *testing.T) {
+	var plan types.PlanModel
+	if err := json.Unmarshal([]byte(planWithChanges), &plan); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	drift := planDrift(plan.PlanResourceChanges)
+	expected := types.Drift{
+		Create:  []string{"aws_instance.web[0]", "aws_instance.web[1]"},
+		Update:  []string{"aws_security_group.web"},
+		Replace: []string{"aws_launch_template.web"},
+		Destroy: []string{"aws_eip.web"},
+	}
+	if !reflect.DeepEqual(drift, expected) {
+		t.Fatalf("Expected %v, got %v", expected, drift)
+	}
+}
+
+func TestPlanDrift_NoChanges(t *testing.T) {
+	var plan types.PlanModel
+	noChanges := `{"resource_changes": [
+		{"address": "aws_s3_bucket.logs", "change": {"actions": ["no-op"]}},
+		{"address": "data.aws_ami.ubuntu", "change": {"actions": ["read"]}}
+	]}`
+	if err := json.Unmarshal([]byte(noChanges), &plan); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	drift := planDrift(plan.PlanResourceChanges)
+	expected := types.Drift{Create: []string{}, Update: []string{}, Replace: []string{}, Destroy: []string{}}
+	if !reflect.DeepEqual(drift, expected) {
+		t.Fatalf("Expected %v, got %v", expected, drift)
+	}
+}
+
+const planWithPriorState = `{
+	"format_version": "1.0",
+	"terraform_version": "1.1.9",
+	"prior_state": {
+		"format_version": "1.0",
+		"values": {
+			"root_module": {
+				"resources": [
+					{"address": "aws_instance.web", "mode": "managed", "type": "aws_instance", "name": "web",
+						"values": {"instance_type": "t3.micro", "tags": {"Name": "web"}}},
+					{"address": "aws_eip.web", "mode": "managed", "type": "aws_eip", "name": "web",
+						"values": {"domain": "vpc"}}
+				],
+				"child_modules": [{
+					"address": "module.db",
+					"resources": [
+						{"address": "module.db.aws_db_instance.main[0]", "mode": "managed", "type": "aws_db_instance", "name": "main", "index": 0,
+							"values": {"allocated_storage": 20}}
+					]
+				}]
+			}
+		}
+	}
+}`
+
+func TestPriorStateDrift(t *testing.T) {
+	prior, err := priorStateValues([]byte(planWithPriorState))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// The recorded version has a resized instance, a larger database
+	// and a new bucket, while the EIP was removed
+	recorded := types.State{
+		Modules: []types.Module{
+			{Path: "", Resources: []types.Resource{
+				{Mode: "managed", Type: "aws_instance", Name: "web", Attributes: []types.Attribute{
+					{Key: "instance_type", Value: `"t3.large"`},
+					{Key: "tags", Value: `{"Name":"web"}`},
+				}},
+				{Mode: "managed", Type: "aws_s3_bucket", Name: "logs", Attributes: []types.Attribute{
+					{Key: "bucket", Value: `"logs"`},
+				}},
+			}},
+			{Path: "module.db", Resources: []types.Resource{
+				{Mode: "managed", Type: "aws_db_instance", Name: "main", Index: "[0]", Attributes: []types.Attribute{
+					{Key: "allocated_storage", Value: "40"},
+				}},
+			}},
+		},
+	}
+
+	drift := priorStateDrift(prior, stateValues(recorded))
+	expected := types.PriorStateDrift{
+		Stale:       true,
+		OnlyInPlan:  []string{"aws_eip.web"},
+		OnlyInState: []string{"aws_s3_bucket.logs"},
+		Changed: map[string][]string{
+			"aws_instance.web":                  {"instance_type"},
+			"module.db.aws_db_instance.main[0]": {"allocated_storage"},
+		},
+	}
+	if !reflect.DeepEqual(drift, expected) {
+		t.Fatalf("Expected %v, got %v", expected, drift)
+	}
+
+	// The plan isn't stale against the version it was made from
+	upToDate := priorStateDrift(prior, prior)
+	if upToDate.Stale || len(upToDate.Changed) != 0 {
+		t.Fatalf("Expected no drift, got %v", upToDate)
+	}
+}
+
+func TestPriorStateValues_NoPriorState(t *testing.T) {
+	if _, err := priorStateValues([]byte(planFormat02)); !errors.Is(err, ErrNoPriorState) {
+		t.Fatalf("Expected %v, got %v", ErrNoPriorState, err)
+	}
+}
+
+func TestPlanStateGaps(t *testing.T) {
+	now := time.Unix(1700000000, 0).UTC()
+	recency := []lineageRecency{
+		// Planned right before its last apply
+		{LineageValue: "app", LastVersionAt: now, LastPlanAt: sql.NullTime{Time: now.Add(-10 * time.Minute), Valid: true}},
+		// Applied three days after its last plan
+		{LineageValue: "network", LastVersionAt: now, LastPlanAt: sql.NullTime{Time: now.Add(-72 * time.Hour), Valid: true}},
+		// Planned but not applied yet
+		{LineageValue: "dns", LastVersionAt: now.Add(-time.Hour), LastPlanAt: sql.NullTime{Time: now, Valid: true}},
+		// Never planned
+		{LineageValue: "legacy", LastVersionAt: now.Add(-48 * time.Hour)},
+	}
+
+	gaps := planStateGaps(recency, 24*time.Hour)
+	expected := []struct {
+		lineage string
+		gap     int64
+		flagged bool
+	}{
+		{"legacy", 0, true},
+		{"network", 72 * 3600, true},
+		{"app", 600, false},
+		{"dns", -3600, false},
+	}
+	if len(gaps) != len(expected) {
+		t.Fatalf("Expected %d gaps, got %d", len(expected), len(gaps))
+	}
+	for i, e := range expected {
+		g := gaps[i]
+		if g.LineageValue != e.lineage || g.GapSeconds != e.gap || g.Flagged != e.flagged {
+			t.Fatalf("Expected %s with a gap of %ds flagged %v, got %+v", e.lineage, e.gap, e.flagged, g)
+		}
+	}
+	if gaps[0].LastPlanAt != nil {
+		t.Fatalf("Expected no plan for legacy, got %v", gaps[0].LastPlanAt)
+	}
+	if !gaps[1].LastPlanAt.Equal(now.Add(-72 * time.Hour)) {
+		t.Fatalf("Expected %v, got %v", now.Add(-72*time.Hour), gaps[1].LastPlanAt)
+	}
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/camptocamp/terraboard/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// correlatedPlanID returns the most recent Plan of a Lineage made after the
+// previous version of a State, and before the State, which was likely
+// applied to produce it
+func (db *Database) correlatedPlanID(lineage string, st types.State) (id sql.NullInt64) {
+	var previous sql.NullTime
+	err := db.Table("states").
+		Select("MAX(versions.last_modified)").
+		Joins("JOIN versions ON versions.id = states.version_id").
+		Where("states.path = ? AND states.lineage_id = ? AND versions.last_modified < ?",
+			st.Path, st.LineageID, st.Version.LastModified).
+		Row().Scan(&previous)
+	if err != nil {
+		log.WithError(err).Error("Failed to find the previous version of the state")
+		return
+	}
+
+	query := db.Model(&types.Plan{}).
+		Joins("JOIN lineages ON lineages.id = plans.lineage_id").
+		Where("lineages.value = ? AND plans.created_at <= ?", lineage, st.Version.LastModified)
+	if previous.Valid {
+		query = query.Where("plans.created_at > ?", previous.Time)
+	}
+	var ids []int64
+	if err := query.Order("plans.created_at DESC").Limit(1).Pluck("plans.id", &ids).Error; err != nil {
+		log.WithError(err).Error("Failed to correlate a plan to the state")
+		return
+	}
+	if len(ids) > 0 {
+		id = sql.NullInt64{Int64: ids[0], Valid: true}
+	}
+	return
+}
+
+// versionProvenance assembles the provenance of a State version
+// from the State, its correlated Plan, if any, and its previous version
+func versionProvenance(lineage string, st types.State, plan *types.Plan, previous string) (p types.VersionProvenance, err error) {
+	p = types.VersionProvenance{
+		Lineage:           lineage,
+		VersionID:         st.Version.VersionID,
+		PreviousVersionID: previous,
+		Serial:            st.Serial,
+		TFVersion:         st.TFVersion,
+		Provider:          st.Provider,
+		Path:              st.Path,
+		LastModified:      st.Version.LastModified,
+		IngestedAt:        st.CreatedAt,
+	}
+	if len(st.Version.ProviderMetadata) > 0 {
+		if err = json.Unmarshal(st.Version.ProviderMetadata, &p.ProviderMetadata); err != nil {
+			return
+		}
+	}
+	if plan != nil {
+		p.Plan = &types.ProvenancePlan{
+			ID:        plan.ID,
+			CreatedAt: plan.CreatedAt,
+			Submitter: plan.Submitter,
+			GitRemote: plan.GitRemote,
+			GitCommit: plan.GitCommit,
+			CiURL:     plan.CiURL,
+			Source:    plan.Source,
+			Deleted:   plan.DeletedAt.Valid,
+		}
+	}
+	return
+}
+
+// GetVersionProvenance returns the provenance of a State version: where and
+// when it was ingested from, the metadata reported by its provider, the Plan
+// correlated to it and its previous version
+func (db *Database) GetVersionProvenance(lineage, versionID string) (p types.VersionProvenance, err error) {
+	var st types.State
+	res := db.Joins("JOIN lineages on states.lineage_id=lineages.id").
+		Joins("JOIN versions on states.version_id=versions.id").
+		Preload("Version").
+		Find(&st, "lineages.value = ? AND versions.version_id = ?", lineage, versionID)
+	if res.Error != nil {
+		return p, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return p, ErrUnknownVersion
+	}
+
+	var plan *types.Plan
+	if st.PlanID.Valid {
+		plan = &types.Plan{}
+		if err = db.Unscoped().Omit("plan_json").First(plan, st.PlanID.Int64).Error; err != nil {
+			return
+		}
+	}
+
+	previous, err := db.GetPreviousVersionID(st.Path, versionID)
+	if err != nil && !errors.Is(err, ErrUnknownVersion) {
+		return
+	}
+	return versionProvenance(lineage, st, plan, previous)
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/terraboard/types"
+	"gorm.io/gorm"
+)
+
+func TestVersionProvenance(t *testing.T) {
+	planned := time.Date(2021, 6, 1, 11, 50, 0, 0, time.UTC)
+	applied := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	ingested := time.Date(2021, 6, 1, 12, 1, 0, 0, time.UTC)
+
+	st := types.State{
+		Model: gorm.Model{ID: 3, CreatedAt: ingested},
+		Path:  "env/prod/terraform.tfstate",
+		Version: types.Version{
+			VersionID:        "v2",
+			LastModified:     applied,
+			ProviderMetadata: []byte(`{"etag":"\"9b2cf535f27731c974343645a3985328\""}`),
+		},
+		TFVersion: "1.0.2",
+		Serial:    7,
+		Provider:  "aws:states",
+		PlanID:    sql.NullInt64{Int64: 12, Valid: true},
+	}
+	plan := &types.Plan{
+		Model:     gorm.Model{ID: 12, CreatedAt: planned},
+		GitRemote: "git@github.com:example/infra.git",
+		GitCommit: "0a1b2c3",
+		CiURL:     "https://ci.example.com/jobs/42",
+		Source:    "ci",
+		Submitter: "ci@example.com",
+	}
+
+	expected := types.VersionProvenance{
+		Lineage:           "prod",
+		VersionID:         "v2",
+		PreviousVersionID: "v1",
+		Serial:            7,
+		TFVersion:         "1.0.2",
+		Provider:          "aws:states",
+		Path:              "env/prod/terraform.tfstate",
+		LastModified:      applied,
+		IngestedAt:        ingested,
+		ProviderMetadata:  map[string]string{"etag": `"9b2cf535f27731c974343645a3985328"`},
+		Plan: &types.ProvenancePlan{
+			ID:        12,
+			CreatedAt: planned,
+			Submitter: "ci@example.com",
+			GitRemote: "git@github.com:example/infra.git",
+			GitCommit: "0a1b2c3",
+			CiURL:     "https://ci.example.com/jobs/42",
+			Source:    "ci",
+		},
+	}
+	p, err := versionProvenance("prod", st, plan, "v1")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(p, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, p)
+	}
+
+	// A deleted Plan is still part of the provenance
+	plan.DeletedAt = gorm.DeletedAt{Time: ingested, Valid: true}
+	if p, _ := versionProvenance("prod", st, plan, "v1"); !p.Plan.Deleted {
+		t.Fatalf("Expected the plan to be flagged as deleted, got %+v", p.Plan)
+	}
+}
+
+func TestVersionProvenance_Uncorrelated(t *testing.T) {
+	st := types.State{Version: types.Version{VersionID: "v1"}, Path: "env/dev/terraform.tfstate"}
+	p, err := versionProvenance("dev", st, nil, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if p.Plan != nil || p.ProviderMetadata != nil || p.PreviousVersionID != "" {
+		t.Fatalf("Expected no plan, metadata or previous version, got %+v", p)
+	}
+
+	st.Version.ProviderMetadata = []byte(`not json`)
+	if _, err := versionProvenance("dev", st, nil, ""); err == nil {
+		t.Fatalf("Expected an error for invalid provider metadata")
+	}
+}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/camptocamp/terraboard/types"
+	ctyJson "github.com/zclconf/go-cty/cty/json"
+)
+
+// rawStateFormatVersion is the version of the Terraform State format
+// of reconstructed States
+const rawStateFormatVersion = 4
+
+type rawState struct {
+	Version          int                  `json:"version"`
+	TerraformVersion string               `json:"terraform_version"`
+	Serial           int64                `json:"serial"`
+	Lineage          string               `json:"lineage"`
+	Outputs          map[string]rawOutput `json:"outputs"`
+	Resources        []*rawResource       `json:"resources"`
+}
+
+type rawOutput struct {
+	Value     json.RawMessage `json:"value"`
+	Type      json.RawMessage `json:"type,omitempty"`
+	Sensitive bool            `json:"sensitive,omitempty"`
+}
+
+type rawResource struct {
+	Module    string        `json:"module,omitempty"`
+	Mode      string        `json:"mode"`
+	Type      string        `json:"type"`
+	Name      string        `json:"name"`
+	Provider  string        `json:"provider"`
+	Instances []rawInstance `json:"instances"`
+}
+
+type rawInstance struct {
+	IndexKey      interface{}                `json:"index_key,omitempty"`
+	SchemaVersion uint64                     `json:"schema_version"`
+	Attributes    map[string]json.RawMessage `json:"attributes"`
+	Dependencies  []string                   `json:"dependencies,omitempty"`
+}
+
+// rawIndexKey returns the index key of a resource instance
+// from its index, either [0] or ["key"]
+func rawIndexKey(index string) interface{} {
+	if !strings.HasPrefix(index, "[") || !strings.HasSuffix(index, "]") {
+		return nil
+	}
+	key := index[1 : len(index)-1]
+	if i, err := strconv.Atoi(key); err == nil {
+		return i
+	}
+	if s, err := strconv.Unquote(key); err == nil {
+		return s
+	}
+	return key
+}
+
+// rawValue returns a JSON value stored in the Database, as a string
+// if it isn't valid JSON, such as masked values
+func rawValue(v string) json.RawMessage {
+	if json.Valid([]byte(v)) {
+		return json.RawMessage(v)
+	}
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// RawState reconstructs the Terraform State JSON of a State version
+// from the Database. Only the data Terraboard keeps is restored:
+// resource schema versions and private data are lost.
+func RawState(st types.State, lineage string) ([]byte, error) {
+	raw := rawState{
+		Version:          rawStateFormatVersion,
+		TerraformVersion: st.TFVersion,
+		Serial:           st.Serial,
+		Lineage:          lineage,
+		Outputs:          make(map[string]rawOutput),
+		Resources:        []*rawResource{},
+	}
+
+	resources := make(map[string]*rawResource)
+	for _, m := range st.Modules {
+		if m.Path == "" {
+			for _, o := range m.OutputValues {
+				out := rawOutput{
+					Value:     rawValue(o.Value),
+					Sensitive: o.Sensitive,
+				}
+				if ty, err := ctyJson.ImpliedType(out.Value); err == nil {
+					out.Type, _ = ctyJson.MarshalType(ty)
+				}
+				raw.Outputs[o.Name] = out
+			}
+		}
+
+		for _, r := range m.Resources {
+			key := fmt.Sprintf("%s.%s.%s.%s", m.Path, r.Mode, r.Type, r.Name)
+			res, ok := resources[key]
+			if !ok {
+				res = &rawResource{
+					Module:    m.Path,
+					Mode:      r.Mode,
+					Type:      r.Type,
+					Name:      r.Name,
+					Provider:  fmt.Sprintf("provider[%q]", r.Provider),
+					Instances: []rawInstance{},
+				}
+				resources[key] = res
+				raw.Resources = append(raw.Resources, res)
+			}
+
+			attrs := make(map[string]json.RawMessage, len(r.Attributes))
+			for _, a := range r.Attributes {
+				attrs[a.Key] = rawValue(a.Value)
+			}
+			instance := rawInstance{
+				IndexKey:   rawIndexKey(r.Index),
+				Attributes: attrs,
+			}
+			if r.Dependencies != "" {
+				instance.Dependencies = strings.Split(r.Dependencies, "\n")
+			}
+			res.Instances = append(res.Instances, instance)
+		}
+	}
+
+	return json.MarshalIndent(raw, "", "  ")
+}
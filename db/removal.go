@@ -0,0 +1,214 @@
+package db
+
+import (
+	"sort"
+	"time"
+
+	"github.com/camptocamp/terraboard/types"
+	"gorm.io/gorm"
+)
+
+// removalBatchSize is the maximum number of ids per statement
+const removalBatchSize = 1000
+
+// cascadeStep selects the rows of a table whose column holds one of the
+// values of a column of the rows already selected in another table
+type cascadeStep struct {
+	table, column    string
+	from, fromColumn string
+}
+
+// lineageCascade lists, from the lineages table, the rows owned by a Lineage.
+// A step selecting from its own table is repeated until no new row is found.
+var lineageCascade = []cascadeStep{
+	{"lineage_tags", "lineage_id", "lineages", "id"},
+	{"states", "lineage_id", "lineages", "id"},
+	{"versions", "id", "states", "version_id"},
+	{"computed_fields", "state_id", "states", "id"},
+	{"modules", "state_id", "states", "id"},
+	{"output_values", "module_id", "modules", "id"},
+	{"resources", "module_id", "modules", "id"},
+	{"attributes", "resource_id", "resources", "id"},
+	{"plans", "lineage_id", "lineages", "id"},
+	{"plan_models", "id", "plans", "parsed_plan_id"},
+	{"plan_model_variables", "plan_model_id", "plan_models", "id"},
+	{"plan_resource_changes", "plan_model_id", "plan_models", "id"},
+	{"plan_outputs", "plan_model_id", "plan_models", "id"},
+	{"changes", "id", "plan_resource_changes", "change_id"},
+	{"changes", "id", "plan_outputs", "change_id"},
+	{"plan_states", "id", "plan_models", "plan_state_id"},
+	{"plan_state_values", "id", "plan_models", "plan_state_value_id"},
+	{"plan_state_values", "id", "plan_states", "plan_state_value_id"},
+	{"plan_state_outputs", "plan_state_value_id", "plan_state_values", "id"},
+	{"plan_state_modules", "id", "plan_state_values", "plan_state_module_id"},
+	{"plan_state_modules", "plan_state_module_id", "plan_state_modules", "id"},
+	{"plan_state_resources", "plan_state_module_id", "plan_state_modules", "id"},
+	{"plan_state_resource_attributes", "plan_state_resource_id", "plan_state_resources", "id"},
+}
+
+// lineageRemovalOrder lists the tables of the cascade so that rows are
+// deleted before the rows they reference
+var lineageRemovalOrder = []string{
+	"attributes",
+	"resources",
+	"output_values",
+	"modules",
+	"computed_fields",
+	"states",
+	"versions",
+	"lineage_tags",
+	"plans",
+	"plan_model_variables",
+	"plan_resource_changes",
+	"plan_outputs",
+	"changes",
+	"plan_models",
+	"plan_states",
+	"plan_state_outputs",
+	"plan_state_values",
+	"plan_state_resource_attributes",
+	"plan_state_resources",
+	"plan_state_modules",
+	"lineages",
+}
+
+// pluckFunc returns the non-null values of a column of the rows of a table
+// whose where column holds one of the given ids
+type pluckFunc func(table, column, where string, ids []uint) ([]uint, error)
+
+// collectCascade follows the cascade steps from the given Lineage ids and
+// returns the selected row ids by table, in descending order so that nested
+// rows are deleted before their parent
+func collectCascade(steps []cascadeStep, lineageIDs []uint, pluck pluckFunc) (rows map[string][]uint, err error) {
+	selected := map[string]map[uint]bool{"lineages": {}}
+	for _, id := range lineageIDs {
+		selected["lineages"][id] = true
+	}
+
+	for _, step := range steps {
+		if selected[step.table] == nil {
+			selected[step.table] = make(map[uint]bool)
+		}
+		pending := sortedIDs(selected[step.from])
+		for len(pending) > 0 {
+			values := pending
+			if step.fromColumn != "id" {
+				if values, err = pluck(step.from, step.fromColumn, "id", pending); err != nil {
+					return
+				}
+			}
+			var ids []uint
+			if ids, err = pluck(step.table, "id", step.column, values); err != nil {
+				return
+			}
+
+			pending = nil
+			for _, id := range ids {
+				if !selected[step.table][id] {
+					selected[step.table][id] = true
+					pending = append(pending, id)
+				}
+			}
+			if step.table != step.from {
+				break
+			}
+		}
+	}
+
+	rows = make(map[string][]uint)
+	for table, ids := range selected {
+		rows[table] = sortedIDs(ids)
+		sort.Slice(rows[table], func(i, j int) bool { return rows[table][i] > rows[table][j] })
+	}
+	return
+}
+
+// sortedIDs returns the ids of a set in ascending order
+func sortedIDs(set map[uint]bool) (ids []uint) {
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return
+}
+
+// pluckIDs returns, by batches, the distinct non-null values of a column
+// of the rows of a table whose where column holds one of the given ids
+func pluckIDs(tx *gorm.DB) pluckFunc {
+	return func(table, column, where string, ids []uint) (values []uint, err error) {
+		for start := 0; start < len(ids); start += removalBatchSize {
+			end := start + removalBatchSize
+			if end > len(ids) {
+				end = len(ids)
+			}
+			var batch []uint
+			err = tx.Table(table).Distinct(column).
+				Where(where+" IN ? AND "+column+" IS NOT NULL", ids[start:end]).
+				Pluck(column, &batch).Error
+			if err != nil {
+				return
+			}
+			values = append(values, batch...)
+		}
+		return
+	}
+}
+
+// deleteByIDs deletes, by batches, the rows of a table whose column
+// holds one of the given ids
+func deleteByIDs(tx *gorm.DB, table, column string, ids []uint) (deleted int64, err error) {
+	for start := 0; start < len(ids); start += removalBatchSize {
+		end := start + removalBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		res := tx.Exec("DELETE FROM "+table+" WHERE "+column+" IN ?", ids[start:end])
+		if res.Error != nil {
+			return deleted, res.Error
+		}
+		deleted += res.RowsAffected
+	}
+	return
+}
+
+// RemoveLineage deletes a Lineage along with its tags, State versions,
+// Modules, Resources, attributes and Plans within a single transaction,
+// and returns the number of deleted versions.
+// Deduplicated versions and lock events, recorded by State path, are kept.
+// The Lineage is recorded as deleted, so that its States, still stored
+// on the providers, aren't ingested again on the next synchronizations.
+// Replicas are notified of the removal once it is committed.
+func (db *Database) RemoveLineage(lineage, user string) (deleted int64, err error) {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var lineageIDs []uint
+		if err := tx.Table("lineages").Where("value = ?", lineage).Pluck("id", &lineageIDs).Error; err != nil {
+			return err
+		}
+		if len(lineageIDs) == 0 {
+			return ErrLineageNotFound
+		}
+
+		rows, err := collectCascade(lineageCascade, lineageIDs, pluckIDs(tx))
+		if err != nil {
+			return err
+		}
+		for _, table := range lineageRemovalOrder {
+			count, err := deleteByIDs(tx, table, "id", rows[table])
+			if err != nil {
+				return err
+			}
+			if table == "states" {
+				deleted = count
+			}
+		}
+		return tx.Where(types.DeletedLineage{Value: lineage}).
+			Assign(types.DeletedLineage{DeletedBy: user, DeletedAt: time.Now()}).
+			FirstOrCreate(&types.DeletedLineage{}).Error
+	})
+	if err != nil {
+		deleted = 0
+		return
+	}
+	db.notifyInvalidation(lineage)
+	return
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+// fakeTables is an in-memory set of rows by table
+type fakeTables map[string][]map[string]uint
+
+func (f fakeTables) pluck(table, column, where string, ids []uint) (values []uint, err error) {
+	for _, row := range f[table] {
+		value, ok := row[column]
+		if !ok {
+			continue
+		}
+		for _, id := range ids {
+			if row[where] == id {
+				values = append(values, value)
+				break
+			}
+		}
+	}
+	return
+}
+
+func TestCollectCascade(t *testing.T) {
+	tables := fakeTables{
+		"lineage_tags":    {{"id": 1, "lineage_id": 1}, {"id": 2, "lineage_id": 2}},
+		"states":          {{"id": 10, "lineage_id": 1, "version_id": 100}, {"id": 11, "lineage_id": 1, "version_id": 101}, {"id": 12, "lineage_id": 2, "version_id": 102}},
+		"versions":        {{"id": 100}, {"id": 101}, {"id": 102}},
+		"computed_fields": {{"id": 15, "state_id": 10}, {"id": 16, "state_id": 12}},
+		"modules":         {{"id": 20, "state_id": 10}, {"id": 21, "state_id": 12}},
+		"output_values":   {{"id": 25, "module_id": 20}},
+		"resources":       {{"id": 30, "module_id": 20}, {"id": 31, "module_id": 21}},
+		"attributes":      {{"id": 40, "resource_id": 30}, {"id": 41, "resource_id": 31}},
+		"plans":           {{"id": 50, "lineage_id": 1, "parsed_plan_id": 60}, {"id": 51, "lineage_id": 2, "parsed_plan_id": 61}},
+		"plan_models": {
+			{"id": 60, "plan_state_id": 80, "plan_state_value_id": 90},
+			{"id": 61},
+		},
+		"plan_resource_changes":          {{"id": 70, "plan_model_id": 60, "change_id": 75}},
+		"plan_outputs":                   {{"id": 71, "plan_model_id": 60, "change_id": 76}},
+		"changes":                        {{"id": 75}, {"id": 76}, {"id": 77}},
+		"plan_states":                    {{"id": 80, "plan_state_value_id": 91}},
+		"plan_state_values":              {{"id": 90, "plan_state_module_id": 95}, {"id": 91}},
+		"plan_state_modules":             {{"id": 95}, {"id": 96, "plan_state_module_id": 95}, {"id": 97, "plan_state_module_id": 96}, {"id": 98}},
+		"plan_state_resources":           {{"id": 105, "plan_state_module_id": 97}},
+		"plan_state_resource_attributes": {{"id": 110, "plan_state_resource_id": 105}},
+	}
+
+	rows, err := collectCascade(lineageCascade, []uint{1}, tables.pluck)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := map[string][]uint{
+		"lineages":                       {1},
+		"lineage_tags":                   {1},
+		"states":                         {11, 10},
+		"versions":                       {101, 100},
+		"computed_fields":                {15},
+		"modules":                        {20},
+		"output_values":                  {25},
+		"resources":                      {30},
+		"attributes":                     {40},
+		"plans":                          {50},
+		"plan_models":                    {60},
+		"plan_model_variables":           nil,
+		"plan_resource_changes":          {70},
+		"plan_outputs":                   {71},
+		"changes":                        {76, 75},
+		"plan_states":                    {80},
+		"plan_state_values":              {91, 90},
+		"plan_state_outputs":             nil,
+		"plan_state_modules":             {97, 96, 95},
+		"plan_state_resources":           {105},
+		"plan_state_resource_attributes": {110},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("Expected %v, got %v", expected, rows)
+	}
+}
+
+func TestLineageRemovalOrder(t *testing.T) {
+	ordered := make(map[string]bool)
+	for _, table := range lineageRemovalOrder {
+		ordered[table] = true
+	}
+	for _, step := range lineageCascade {
+		if !ordered[step.table] {
+			t.Fatalf("Expected table %s to be in the removal order", step.table)
+		}
+	}
+}
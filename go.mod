@@ -4,6 +4,8 @@ go 1.15
 
 require (
 	cloud.google.com/go/storage v1.12.0
+	github.com/Azure/azure-storage-blob-go v0.14.0
+	github.com/Azure/go-autorest/autorest/adal v0.9.13
 	github.com/agext/levenshtein v1.2.3
 	github.com/apparentlymart/go-dump v0.0.0-20190214190832-042adf3cf4a0
 	github.com/apparentlymart/go-versions v1.0.1
@@ -24,7 +26,9 @@ require (
 	github.com/hashicorp/hcl/v2 v2.10.0
 	github.com/hashicorp/terraform v1.0.2
 	github.com/hashicorp/terraform-svchost v0.0.0-20200729002733-f050f53b9734
+	github.com/jackc/pgconn v1.8.1
 	github.com/jackc/pgproto3/v2 v2.0.7 // indirect
+	github.com/jackc/pgx/v4 v4.11.0
 	github.com/jessevdk/go-flags v1.4.0
 	github.com/lib/pq v1.9.0 // indirect
 	github.com/machinebox/graphql v0.2.2
@@ -33,6 +37,7 @@ require (
 	github.com/mitchellh/go-wordwrap v1.0.1 // indirect
 	github.com/mitchellh/panicwrap v1.0.0
 	github.com/pmezard/go-difflib v1.0.0
+	github.com/prometheus/client_golang v1.11.0
 	github.com/sirupsen/logrus v1.7.0
 	github.com/spf13/afero v1.2.2
 	github.com/zclconf/go-cty v1.9.0
@@ -40,10 +45,11 @@ require (
 	golang.org/x/mod v0.4.2
 	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
 	golang.org/x/text v0.3.6 // indirect
-	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324 // indirect
+	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324
 	google.golang.org/api v0.44.0-impersonate-preview
 	gopkg.in/yaml.v2 v2.4.0
 	gorm.io/datatypes v1.0.1
 	gorm.io/driver/postgres v1.1.0
+	gorm.io/driver/sqlite v1.1.4
 	gorm.io/gorm v1.21.10
 )
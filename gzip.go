@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// compressedContentTypes are the content types, or their prefix, of
+// responses which are already compressed
+var compressedContentTypes = []string{
+	"application/gzip",
+	"application/zip",
+	"application/x-gzip",
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+}
+
+// sniffLen is the number of bytes considered by http.DetectContentType
+const sniffLen = 512
+
+// acceptsGzip returns whether the Accept-Encoding header of a request
+// allows gzip encoded responses
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		accepted := true
+		for _, param := range fields[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 && kv[0] == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil && q == 0 {
+					accepted = false
+				}
+			}
+		}
+		if accepted {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter buffers a response until it reaches the minimum size,
+// or is flushed, then compresses it, unless the response is already encoded
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+	level   int
+	status  int
+	buf     bytes.Buffer
+	gz      *gzip.Writer
+	started bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.status == 0 {
+		g.status = status
+	}
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !g.started {
+		if g.buf.Len()+len(p) < g.minSize {
+			return g.buf.Write(p)
+		}
+		g.sniff(p)
+		if err := g.start(g.compressible()); err != nil {
+			return 0, err
+		}
+	}
+	if g.gz != nil {
+		return g.gz.Write(p)
+	}
+	return g.ResponseWriter.Write(p)
+}
+
+// sniff sets the Content-Type of a response without one from its first
+// bytes, the buffered ones followed by p, as net/http would do from the
+// compressed body otherwise
+func (g *gzipResponseWriter) sniff(p []byte) {
+	h := g.Header()
+	if _, ok := h["Content-Type"]; ok || h.Get("Content-Encoding") != "" {
+		return
+	}
+	head := g.buf.Bytes()
+	if n := sniffLen - len(head); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		head = append(append([]byte{}, head...), p[:n]...)
+	}
+	if len(head) == 0 {
+		return
+	}
+	h.Set("Content-Type", http.DetectContentType(head))
+}
+
+// compressible returns whether the response can be compressed
+func (g *gzipResponseWriter) compressible() bool {
+	h := g.Header()
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	if g.status != 0 && g.status != http.StatusOK {
+		return false
+	}
+	contentType := h.Get("Content-Type")
+	for _, ct := range compressedContentTypes {
+		if strings.HasPrefix(contentType, ct) {
+			return false
+		}
+	}
+	return true
+}
+
+// start writes the response headers and the buffered body,
+// compressing them if requested
+func (g *gzipResponseWriter) start(compress bool) (err error) {
+	g.started = true
+	if compress {
+		h := g.Header()
+		h.Set("Content-Encoding", "gzip")
+		h.Add("Vary", "Accept-Encoding")
+		// The compressed length is unknown, the response is chunked
+		h.Del("Content-Length")
+		if g.gz, err = gzip.NewWriterLevel(g.ResponseWriter, g.level); err != nil {
+			return
+		}
+	}
+	if g.status != 0 {
+		g.ResponseWriter.WriteHeader(g.status)
+	}
+
+	if g.buf.Len() > 0 {
+		if g.gz != nil {
+			_, err = g.gz.Write(g.buf.Bytes())
+		} else {
+			_, err = g.ResponseWriter.Write(g.buf.Bytes())
+		}
+		g.buf.Reset()
+	}
+	return
+}
+
+// Flush sends the response written so far, compressing it regardless
+// of the minimum size, and flushes the underlying response writer
+func (g *gzipResponseWriter) Flush() {
+	if !g.started {
+		g.sniff(nil)
+		if err := g.start(g.compressible()); err != nil {
+			log.Error(err.Error())
+			return
+		}
+	}
+	if g.gz != nil {
+		if err := g.gz.Flush(); err != nil {
+			log.Error(err.Error())
+			return
+		}
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close writes a response smaller than the minimum size as it is,
+// or flushes the compressed response
+func (g *gzipResponseWriter) Close() error {
+	if !g.started {
+		return g.start(false)
+	}
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
+}
+
+// gzipMiddleware compresses, with the given level, the responses of at
+// least minSize bytes to requests accepting gzip encoded responses
+func gzipMiddleware(minSize uint, level int) mux.MiddlewareFunc {
+	if level < gzip.BestSpeed || level > gzip.BestCompression {
+		log.Warnf("Invalid gzip compression level %d, using the default one", level)
+		level = gzip.DefaultCompression
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !acceptsGzip(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			gw := &gzipResponseWriter{ResponseWriter: w, minSize: int(minSize), level: level}
+			defer func() {
+				if err := gw.Close(); err != nil {
+					log.WithContext(r.Context()).Error(err.Error())
+				}
+			}()
+			next.ServeHTTP(gw, r)
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/terraboard/types"
+)
+
+// stateStatsResponse is the response of the ListStateStats endpoint
+type stateStatsResponse struct {
+	States []types.StateStat `json:"states"`
+	Page   int               `json:"page"`
+	Total  int               `json:"total"`
+}
+
+// stateStatsHandler answers with a ListStateStats response
+// holding the given number of States
+func stateStatsHandler(count int) (http.Handler, stateStatsResponse) {
+	response := stateStatsResponse{Page: 1, Total: count}
+	for i := 0; i < count; i++ {
+		response.States = append(response.States, types.StateStat{
+			Path:          fmt.Sprintf("env/project%d/terraform.tfstate", i),
+			LineageValue:  fmt.Sprintf("lineage-%d", i),
+			Provider:      "aws",
+			TFVersion:     "1.0.2",
+			Serial:        int64(i),
+			LastModified:  time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+			ResourceCount: i * 10,
+		})
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		j, _ := json.Marshal(response)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(j)))
+		w.Write(j)
+	})
+	return handler, response
+}
+
+func TestGzipMiddleware_RoundTrip(t *testing.T) {
+	handler, expected := stateStatsHandler(50)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/lineages/stats", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	gzipMiddleware(1024, gzip.BestSpeed)(handler).ServeHTTP(rec, req)
+
+	if ce := rec.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("Expected %s, got %s", "gzip", ce)
+	}
+	if cl := rec.Header().Get("Content-Length"); cl != "" {
+		t.Fatalf("Expected a chunked response without Content-Length, got %s", cl)
+	}
+
+	gr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("Failed to read gzipped response: %v", err)
+	}
+	var response stateStatsResponse
+	if err := json.NewDecoder(gr).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode gzipped response: %v", err)
+	}
+	if !reflect.DeepEqual(response, expected) {
+		t.Fatalf("Expected %v, got %v", expected, response)
+	}
+}
+
+func TestGzipMiddleware_BelowMinSize(t *testing.T) {
+	handler, _ := stateStatsHandler(1)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/lineages/stats", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	gzipMiddleware(1024, gzip.BestSpeed)(handler).ServeHTTP(rec, req)
+
+	if ce := rec.Header().Get("Content-Encoding"); ce != "" {
+		t.Fatalf("Expected an uncompressed response, got %s", ce)
+	}
+	if cl := rec.Header().Get("Content-Length"); cl != strconv.Itoa(rec.Body.Len()) {
+		t.Fatalf("Expected Content-Length %d, got %s", rec.Body.Len(), cl)
+	}
+}
+
+func TestGzipMiddleware_NotAccepted(t *testing.T) {
+	handler, _ := stateStatsHandler(50)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/lineages/stats", nil)
+	req.Header.Set("Accept-Encoding", "gzip;q=0, deflate")
+	gzipMiddleware(1024, gzip.BestSpeed)(handler).ServeHTTP(rec, req)
+
+	if ce := rec.Header().Get("Content-Encoding"); ce != "" {
+		t.Fatalf("Expected an uncompressed response, got %s", ce)
+	}
+	var response stateStatsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+}
+
+func TestGzipMiddleware_AlreadyEncoded(t *testing.T) {
+	body := make([]byte, 2048)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		w.Write(body)
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/static/app.js", nil)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	gzipMiddleware(1024, gzip.BestSpeed)(handler).ServeHTTP(rec, req)
+
+	if ce := rec.Header().Get("Content-Encoding"); ce != "br" {
+		t.Fatalf("Expected %s, got %s", "br", ce)
+	}
+	if rec.Body.Len() != len(body) {
+		t.Fatalf("Expected a %d bytes body, got %d", len(body), rec.Body.Len())
+	}
+}
+
+func TestGzipMiddleware_SniffedContentType(t *testing.T) {
+	body := "<!DOCTYPE html><html><body>" + strings.Repeat("<p>Terraboard</p>", 100) + "</body></html>"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	gzipMiddleware(1024, gzip.BestSpeed)(handler).ServeHTTP(rec, req)
+
+	if ce := rec.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("Expected %s, got %s", "gzip", ce)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Fatalf("Expected %s, got %s", "text/html; charset=utf-8", ct)
+	}
+}
+
+func TestGzipMiddleware_Flush(t *testing.T) {
+	rec := httptest.NewRecorder()
+	var flushed []byte
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"event":"started"}`)
+		w.(http.Flusher).Flush()
+		flushed = append(flushed, rec.Body.Bytes()...)
+		io.WriteString(w, `{"event":"done"}`)
+	})
+
+	req := httptest.NewRequest("GET", "/api/stream", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	gzipMiddleware(1024, gzip.BestSpeed)(handler).ServeHTTP(rec, req)
+
+	if !rec.Flushed {
+		t.Fatalf("Expected the response to be flushed")
+	}
+	// The data written before the flush can be read right away,
+	// even below the minimum size
+	gr, err := gzip.NewReader(bytes.NewReader(flushed))
+	if err != nil {
+		t.Fatalf("Failed to read flushed response: %v", err)
+	}
+	chunk := make([]byte, 64)
+	n, _ := io.ReadAtLeast(gr, chunk, len(`{"event":"started"}`))
+	if string(chunk[:n]) != `{"event":"started"}` {
+		t.Fatalf("Expected %s, got %s", `{"event":"started"}`, chunk[:n])
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, expected := range map[string]bool{
+		"":                  false,
+		"gzip":              true,
+		"deflate, gzip":     true,
+		"GZIP;q=0.5":        true,
+		"gzip;q=0, deflate": false,
+		"*":                 true,
+		"br":                false,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", header)
+		if accepted := acceptsGzip(req); accepted != expected {
+			t.Fatalf("Expected %t for '%s', got %t", expected, header, accepted)
+		}
+	}
+}
@@ -1,42 +1,74 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/camptocamp/terraboard/api"
 	"github.com/camptocamp/terraboard/auth"
+	"github.com/camptocamp/terraboard/backup"
+	"github.com/camptocamp/terraboard/compare"
 	"github.com/camptocamp/terraboard/config"
 	"github.com/camptocamp/terraboard/db"
+	"github.com/camptocamp/terraboard/internal/terraform/states/statefile"
+	"github.com/camptocamp/terraboard/metrics"
 	"github.com/camptocamp/terraboard/state"
 	"github.com/camptocamp/terraboard/util"
+	"github.com/camptocamp/terraboard/webhook"
 	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-uuid"
 	tfversion "github.com/hashicorp/terraform/version"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
 
+// handlerName returns the name of an API handler function, without its package
+func handlerName(f interface{}) string {
+	name := runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
 // Pass the DB to API handlers
 // This takes a callback and returns a HandlerFunc
 // which calls the callback with the DB
 func handleWithDB(apiF func(w http.ResponseWriter, r *http.Request,
 	d *db.Database), d *db.Database) func(http.ResponseWriter, *http.Request) {
+	name := handlerName(apiF)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		apiF(w, r, d)
+		metrics.SetHandlerName(r.Context(), name)
+		apiF(w, r, d.WithContext(r.Context()))
 	})
 }
 
 func handleWithStateProviders(apiF func(w http.ResponseWriter, r *http.Request,
 	sps []state.Provider), sps []state.Provider) func(http.ResponseWriter, *http.Request) {
+	name := handlerName(apiF)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics.SetHandlerName(r.Context(), name)
 		apiF(w, r, sps)
 	})
 }
 
+func handleWithDBAndStateProviders(apiF func(w http.ResponseWriter, r *http.Request,
+	d *db.Database, sps []state.Provider), d *db.Database, sps []state.Provider) func(http.ResponseWriter, *http.Request) {
+	name := handlerName(apiF)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics.SetHandlerName(r.Context(), name)
+		apiF(w, r, d.WithContext(r.Context()), sps)
+	})
+}
+
 func isKnownStateVersion(statesVersions map[string][]string, versionID, path string) bool {
 	if v, ok := statesVersions[versionID]; ok {
 		for _, s := range v {
@@ -48,66 +80,247 @@ func isKnownStateVersion(statesVersions map[string][]string, versionID, path str
 	return false
 }
 
-// Refresh the DB
+// stateIngester stores the States fetched from the providers
+type stateIngester interface {
+	InsertVersion(version *state.Version) error
+	InsertState(path, versionID, provider string, sf *statefile.File) error
+	AddLineageTags(lineage string, tags []string) error
+}
+
+// pendingVersion is a version of a State file missing from the database
+type pendingVersion struct {
+	file    string
+	version state.Version
+}
+
+// pendingVersions returns, by State path, the versions of the State files
+// missing from the database, oldest first. Backups are recorded as prior
+// versions of the State they belong to.
+// Unknown versions are inserted in the database along the way.
+func pendingVersions(si stateIngester, sp state.Provider, files []string, statesVersions map[string][]string) map[string][]pendingVersion {
+	pending := make(map[string][]pendingVersion)
+	for _, st := range files {
+		path, _ := state.BackupStatePath(st)
+		versions, _ := sp.GetVersions(st)
+		for k, v := range versions {
+			if _, ok := statesVersions[v.ID]; ok {
+				log.WithFields(log.Fields{
+					"version_id": v.ID,
+				}).Debug("Version is already in the database, skipping")
+			} else {
+				if err := si.InsertVersion(&versions[k]); err != nil {
+					log.Error(err.Error())
+				}
+			}
+
+			if isKnownStateVersion(statesVersions, v.ID, path) {
+				log.WithFields(log.Fields{
+					"path":       st,
+					"version_id": v.ID,
+				}).Debug("State is already in the database, skipping")
+				continue
+			}
+			pending[path] = append(pending[path], pendingVersion{file: st, version: v})
+		}
+	}
+
+	for _, versions := range pending {
+		sort.SliceStable(versions, func(i, j int) bool {
+			return versions[i].version.LastModified.Before(versions[j].version.LastModified)
+		})
+	}
+	return pending
+}
+
+// ingestStates fetches and inserts the State versions missing from the
+// database. The versions of a State path are inserted one at a time, oldest
+// first, so that the previous version of a State is always stored before it:
+// States are only fetched concurrently across paths, within the limits of
+// the provider limiter.
+func ingestStates(si stateIngester, sp state.Provider, limiter *state.AdaptiveLimiter, files []string,
+	statesVersions map[string][]string, group string, notify func(path string, v state.Version, sf *statefile.File)) {
+	var wg sync.WaitGroup
+	for path, versions := range pendingVersions(si, sp, files, statesVersions) {
+		wg.Add(1)
+		go func(path string, versions []pendingVersion) {
+			defer wg.Done()
+			for _, pv := range versions {
+				ingestVersion(si, sp, limiter, path, pv, group, notify)
+			}
+		}(path, versions)
+	}
+	wg.Wait()
+}
+
+// ingestVersion fetches a State version from its provider and inserts it
+func ingestVersion(si stateIngester, sp state.Provider, limiter *state.AdaptiveLimiter, path string, pv pendingVersion,
+	group string, notify func(path string, v state.Version, sf *statefile.File)) {
+	versionID := pv.version.ID
+	var sf *statefile.File
+	err := limiter.Do(func() (err error) {
+		sf, err = sp.GetState(pv.file, versionID)
+		return
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":       pv.file,
+			"version_id": versionID,
+			"error":      err,
+		}).Error("Failed to fetch state from bucket")
+		return
+	}
+	if err = si.InsertState(path, versionID, sp.Name(), sf); err != nil {
+		log.WithFields(log.Fields{
+			"path":       pv.file,
+			"version_id": versionID,
+			"error":      err,
+		}).Error("Failed to insert state in the database")
+		return
+	}
+	if group != "" {
+		if err = si.AddLineageTags(sf.Lineage, []string{state.RegionGroupTag + "=" + group}); err != nil {
+			log.WithFields(log.Fields{
+				"lineage": sf.Lineage,
+				"group":   group,
+				"error":   err,
+			}).Warn("Failed to tag lineage with its region group")
+		}
+	}
+	if notify != nil {
+		notify(path, pv.version, sf)
+	}
+}
+
+// Refresh the DB from a provider
 // This should be the only direct bridge between the state providers and the DB
-func refreshDB(syncInterval uint16, d *db.Database, sp state.Provider) {
-	interval := time.Duration(syncInterval) * time.Minute
+// States are fetched concurrently across paths, see ingestStates.
+// The lineages ingested by a provider of a region group are tagged with the group.
+func refreshDB(d *db.Database, sp state.Provider, limiter *state.AdaptiveLimiter, filter state.PathFilter, group string) {
+	log.WithFields(log.Fields{
+		"provider": sp.Name(),
+		"group":    group,
+	}).Infof("Refreshing DB")
+	states, err := sp.GetStates()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to retrieve states. Retrying on next sync.")
+		return
+	}
+	states = filter.Filter(states)
+
+	statesVersions := d.ListStatesVersions()
+	// The versions of the initial import are not notified
+	var notify func(path string, v state.Version, sf *statefile.File)
+	if webhook.Enabled() && len(statesVersions) > 0 {
+		notify = func(path string, v state.Version, sf *statefile.File) {
+			go notifyNewVersion(d, sp.Name(), path, v, sf)
+		}
+	}
+	ingestStates(d, sp, limiter, states, statesVersions, group, notify)
+
+	// Locks are recorded on each sync to build the lock history
+	locks, err := sp.GetLocks()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Failed to retrieve locks")
+	} else if err := d.RecordLocks(sp.Name(), locks, time.Now()); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// refreshMetrics periodically updates the lineages, state versions
+// and locks metrics
+func refreshMetrics(interval time.Duration, d *db.Database, sps []state.Provider) {
 	for {
-		log.Infof("Refreshing DB")
-		states, err := sp.GetStates()
+		lineages, versions, err := d.CountInventory()
 		if err != nil {
 			log.WithFields(log.Fields{
 				"error": err,
-			}).Error("Failed to retrieve states. Retrying in 1 minute.")
-			time.Sleep(interval)
-			continue
+			}).Warn("Failed to count lineages and versions")
+		} else {
+			metrics.SetInventory(lineages, versions)
 		}
 
-		statesVersions := d.ListStatesVersions()
-		for _, st := range states {
-			versions, _ := sp.GetVersions(st)
-			for k, v := range versions {
-				if _, ok := statesVersions[v.ID]; ok {
-					log.WithFields(log.Fields{
-						"version_id": v.ID,
-					}).Debug("Version is already in the database, skipping")
-				} else {
-					if err := d.InsertVersion(&versions[k]); err != nil {
-						log.Error(err.Error())
-					}
-				}
-
-				if isKnownStateVersion(statesVersions, v.ID, st) {
-					log.WithFields(log.Fields{
-						"path":       st,
-						"version_id": v.ID,
-					}).Debug("State is already in the database, skipping")
-					continue
-				}
-				state, err := sp.GetState(st, v.ID)
-				if err != nil {
-					log.WithFields(log.Fields{
-						"path":       st,
-						"version_id": v.ID,
-						"error":      err,
-					}).Error("Failed to fetch state from bucket")
-					continue
-				}
-				if err = d.InsertState(st, v.ID, state); err != nil {
-					log.WithFields(log.Fields{
-						"path":       st,
-						"version_id": v.ID,
-						"error":      err,
-					}).Error("Failed to insert state in the database")
-				}
+		locks := 0
+		for _, sp := range sps {
+			l, err := sp.GetLocks()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"provider": sp.Name(),
+					"error":    err,
+				}).Warn("Failed to retrieve locks")
+				continue
 			}
+			locks += len(l)
 		}
+		metrics.SetLocks(locks)
 
-		log.Debugf("Waiting %d minutes until next DB sync", syncInterval)
 		time.Sleep(interval)
 	}
 }
 
+// notifyNewVersion sends a new State version to the webhook.
+// It runs in the background of the ingestion.
+// Versions skipped on ingestion (deduplicated, or provided by
+// the preferred provider) are not found and not notified.
+func notifyNewVersion(d *db.Database, provider, path string, v state.Version, sf *statefile.File) {
+	summary, err := d.GetVersionSummary(path, v.ID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":       path,
+			"version_id": v.ID,
+			"error":      err,
+		}).Debug("Not notifying state version")
+		return
+	}
+
+	changed, err := changedResources(d, sf.Lineage, path, v.ID, summary.ResourceCount)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":       path,
+			"version_id": v.ID,
+			"error":      err,
+		}).Warn("Failed to count changed resources of state version")
+	}
+
+	webhook.Notify(webhook.Event{
+		Lineage:          sf.Lineage,
+		Path:             path,
+		Provider:         provider,
+		VersionID:        v.ID,
+		Serial:           int64(sf.Serial),
+		TerraformVersion: sf.TerraformVersion.String(),
+		LastModified:     v.LastModified,
+		Changes: webhook.Changes{
+			ResourceCount:    summary.ResourceCount,
+			ResourceDelta:    summary.ResourceDelta,
+			ChangedResources: changed,
+		},
+	})
+}
+
+// changedResources counts the resources added, removed and changed
+// by a State version since the previous version of the State,
+// all its resources being new in the first version
+func changedResources(d *db.Database, lineage, path, versionID string, resourceCount int) (int, error) {
+	previous, err := d.GetPreviousVersionID(path, versionID)
+	if err != nil {
+		return 0, err
+	}
+	if previous == "" {
+		return resourceCount, nil
+	}
+
+	comp, err := compare.Compare(context.Background(), d.GetState(lineage, previous), d.GetState(lineage, versionID))
+	if err != nil {
+		return 0, err
+	}
+	count := comp.Stats.Resources
+	return count.Added + count.Removed + count.Changed, nil
+}
+
 var version = "undefined"
 
 func getVersion(w http.ResponseWriter, _ *http.Request) {
@@ -127,12 +340,36 @@ func getVersion(w http.ResponseWriter, _ *http.Request) {
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding")
 		next.ServeHTTP(w, r)
 	})
 }
 
+// requestIDMiddleware reads the request ID from the given header, or generates one,
+// attaches it to the request context and echoes it back in the response
+func requestIDMiddleware(header string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(header)
+			if id == "" {
+				var err error
+				if id, err = uuid.GenerateUUID(); err != nil {
+					log.WithError(err).Error("Failed to generate request ID")
+				}
+			}
+			w.Header().Set(header, id)
+
+			r = r.WithContext(util.WithRequestID(r.Context(), id))
+			log.WithContext(r.Context()).WithFields(log.Fields{
+				"method": r.Method,
+				"path":   r.URL.Path,
+			}).Debug("Handling request")
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // Main
 func main() {
 	c := config.LoadConfig(version)
@@ -145,6 +382,7 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	log.AddHook(util.RequestIDHook{})
 
 	// Set up the state provider
 	sps, err := state.Configure(c)
@@ -155,16 +393,55 @@ func main() {
 	// Set up auth
 	auth.Setup(c)
 
+	// Set up API handlers
+	api.Setup(c)
+
+	// Set up the compare rules
+	compare.Setup(c)
+
+	// Set up metrics
+	metrics.Setup(c)
+
+	// Set up the new version webhook
+	if err := webhook.Setup(c); err != nil {
+		log.Fatal(err)
+	}
+
+	// Set up the database backups
+	if err := backup.Setup(c); err != nil {
+		log.Fatal(err)
+	}
+
 	// Set up the DB and start S3->DB sync
 	database := db.Init(c.DB, c.Log.Level == "debug")
 	if c.DB.NoSync {
 		log.Infof("Not syncing database, as requested.")
 	} else {
 		log.Debugf("Total providers: %d\n", len(sps))
-		for _, sp := range sps {
-			go refreshDB(c.DB.SyncInterval, database, sp)
+		filter := state.PathFilter{Allow: c.Provider.AllowedPaths, Exclude: c.Provider.ExcludedPaths}
+		groups := state.GroupProviders(c.RefreshGroups, sps, time.Duration(c.DB.SyncInterval)*time.Minute)
+		for _, g := range groups {
+			g := g
+			limiters := make(map[state.Provider]*state.AdaptiveLimiter)
+			for _, sp := range g.Providers {
+				limiters[sp] = state.NewAdaptiveLimiter(c.Provider.MaxConcurrency)
+			}
+			go g.Run(func(sp state.Provider) {
+				refreshDB(database, sp, limiters[sp], filter, g.Name)
+			})
 		}
 	}
+	if c.Metrics.RefreshInterval > 0 {
+		go refreshMetrics(time.Duration(c.Metrics.RefreshInterval)*time.Second, database, sps)
+	}
+	// Drop the comparisons kept by this replica when any replica changes their lineage
+	go database.ListenInvalidations(context.Background(), api.InvalidateCompares)
+	if c.DB.CompactionInterval > 0 {
+		go database.CompactPeriodically(time.Duration(c.DB.CompactionInterval) * time.Hour)
+	}
+	if c.Backup.Interval > 0 && backup.Enabled() {
+		go backup.BackupPeriodically(database, time.Duration(c.Backup.Interval)*time.Hour)
+	}
 	defer database.Close()
 
 	// Instantiate gorilla/mux router instance
@@ -176,27 +453,107 @@ func main() {
 	apiRouter.HandleFunc(util.GetFullPath("user"), api.GetUser)
 	apiRouter.HandleFunc(util.GetFullPath("lineages"), handleWithDB(api.GetLineages, database))
 	apiRouter.HandleFunc(util.GetFullPath("lineages/stats"), handleWithDB(api.ListStateStats, database))
+	apiRouter.HandleFunc(util.GetFullPath("lineages/by-provider"), handleWithDB(api.GetLineagesByProvider, database))
+	apiRouter.HandleFunc(util.GetFullPath("lineages/tags/bulk"), handleWithDB(api.BulkTagLineages, database))
 	apiRouter.HandleFunc(util.GetFullPath("lineages/tfversion/count"),
 		handleWithDB(api.ListTerraformVersionsWithCount, database))
+	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}"), handleWithDB(api.DeleteLineage, database)).Methods("DELETE")
 	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}"), handleWithDB(api.GetState, database))
+	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}/raw"), handleWithDBAndStateProviders(api.GetStateRaw, database, sps))
+	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}/tags"), handleWithDB(api.LineageTags, database))
+	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}/tags/{tag}"), handleWithDB(api.RemoveLineageTag, database))
 	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}/activity"), handleWithDB(api.GetLineageActivity, database))
+	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}/versions"), handleWithDB(api.ListStateVersions, database))
+	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}/graph"), handleWithDB(api.GetStateGraph, database))
+	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}/tf-version-history"),
+		handleWithDB(api.GetTFVersionHistory, database))
+	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}/version-tree"), handleWithDB(api.GetVersionTree, database))
+	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}/lock-holders"), handleWithDB(api.GetLockHolders, database))
+	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}/addresses"), handleWithDB(api.GetResourceAddresses, database))
+	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}/timeline"), handleWithDB(api.GetLineageTimeline, database))
+	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}/changelog"), handleWithDB(api.GetChangelog, database))
+	apiRouter.HandleFunc(util.GetFullPath("audit/missing-tags"), handleWithDB(api.GetMissingTags, database))
+	apiRouter.HandleFunc(util.GetFullPath("audit/naming"), handleWithDB(api.AuditResourceNames, database))
+	apiRouter.HandleFunc(util.GetFullPath("audit/consistency"), handleWithDB(api.AuditAttributeConsistency, database))
+	apiRouter.HandleFunc(util.GetFullPath("audit/plan-state-gap"), handleWithDB(api.GetPlanStateGaps, database))
+	apiRouter.HandleFunc(util.GetFullPath("inventory/new"), handleWithDB(api.GetNewResources, database))
+	apiRouter.HandleFunc(util.GetFullPath("quotas"), handleWithDB(api.GetQuotas, database))
+	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}/reference"), handleWithDB(api.SetReferenceVersion, database))
+	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}/drift"), handleWithDB(api.GetDrift, database))
+	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}/drift-from-reference"), handleWithDB(api.GetDriftFromReference, database))
 	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}/compare"), handleWithDB(api.StateCompare, database))
+	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}/compare-cross"), handleWithDB(api.CrossLineageCompare, database))
+	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}/versions/{versionid}/fingerprint"),
+		handleWithDB(api.GetStateFingerprint, database))
+	apiRouter.HandleFunc(util.GetFullPath("lineages/{lineage}/versions/{versionid}/provenance"),
+		handleWithDB(api.GetVersionProvenance, database))
+	apiRouter.HandleFunc(util.GetFullPath("changes/lineages"), handleWithDB(api.GetChangedLineages, database))
+	apiRouter.HandleFunc(util.GetFullPath("compare/common"), handleWithDB(api.GetCommonResources, database))
+	apiRouter.HandleFunc(util.GetFullPath("compare/result/{token}"), api.GetCompareResult)
+	apiRouter.HandleFunc(util.GetFullPath("compare/resource-type-counts"),
+		handleWithDB(api.CompareResourceTypeCounts, database))
+	apiRouter.HandleFunc(util.GetFullPath("share"), handleWithDB(api.CreateShareLink, database))
+	apiRouter.HandleFunc(util.GetFullPath("shared/{token}"), handleWithDB(api.GetSharedState, database))
 	apiRouter.HandleFunc(util.GetFullPath("locks"), handleWithStateProviders(api.GetLocks, sps))
+	apiRouter.HandleFunc(util.GetFullPath("locks/list"), handleWithDBAndStateProviders(api.ListLocks, database, sps))
+	apiRouter.HandleFunc(util.GetFullPath("admin/reconciliation"),
+		handleWithDBAndStateProviders(api.GetVersionReconciliation, database, sps))
+	apiRouter.HandleFunc(util.GetFullPath("admin/backfill/{lineage}"),
+		handleWithDBAndStateProviders(api.BackfillLineage, database, sps))
+	apiRouter.HandleFunc(util.GetFullPath("maintenance/empty-lineages"), handleWithDB(api.ListEmptyLineages, database))
+	apiRouter.HandleFunc(util.GetFullPath("admin/backup"), handleWithDB(api.BackupDatabase, database))
+	apiRouter.HandleFunc(util.GetFullPath("admin/restore"), handleWithDB(api.RestoreDatabase, database))
+	apiRouter.HandleFunc(util.GetFullPath("locks/{lockID}"), handleWithStateProviders(api.ForceUnlock, sps)).Methods("DELETE")
 	apiRouter.HandleFunc(util.GetFullPath("search/attribute"), handleWithDB(api.SearchAttribute, database))
+	apiRouter.HandleFunc(util.GetFullPath("search/fulltext"), handleWithDB(api.SearchFullText, database))
+	apiRouter.HandleFunc(util.GetFullPath("resources/query"), handleWithDB(api.QueryResources, database))
+	apiRouter.HandleFunc(util.GetFullPath("dependencies/cross-lineage"), handleWithDB(api.ListCrossLineageDependencies, database))
 	apiRouter.HandleFunc(util.GetFullPath("resource/types"), handleWithDB(api.ListResourceTypes, database))
 	apiRouter.HandleFunc(util.GetFullPath("resource/types/count"), handleWithDB(api.ListResourceTypesWithCount, database))
 	apiRouter.HandleFunc(util.GetFullPath("resource/names"), handleWithDB(api.ListResourceNames, database))
 	apiRouter.HandleFunc(util.GetFullPath("attribute/keys"), handleWithDB(api.ListAttributeKeys, database))
+	apiRouter.HandleFunc(util.GetFullPath("attributes/by-lineage"), handleWithDB(api.GetAttributeValuesByLineage, database))
+	apiRouter.HandleFunc(util.GetFullPath("attributes/outliers"), handleWithDB(api.GetAttributeOutliers, database))
+	apiRouter.HandleFunc(util.GetFullPath("stats/plugins"), handleWithDB(api.ListProviderPlugins, database))
+	apiRouter.HandleFunc(util.GetFullPath("stats/resources-by-tf-version"), handleWithDB(api.ListResourcesByTFVersion, database))
+	apiRouter.HandleFunc(util.GetFullPath("stats/accounts"), handleWithDB(api.ListCloudAccounts, database))
+	apiRouter.HandleFunc(util.GetFullPath("stats/latest-version-adoption"), handleWithDB(api.GetLatestVersionAdoption, database))
+	apiRouter.HandleFunc(util.GetFullPath("stats/attribute-volatility"), handleWithDB(api.GetAttributeVolatility, database))
+	apiRouter.HandleFunc(util.GetFullPath("stats/plugin-usage"), handleWithDB(api.GetPluginUsage, database))
 	apiRouter.HandleFunc(util.GetFullPath("tf_versions"), handleWithDB(api.ListTfVersions, database))
 	apiRouter.HandleFunc(util.GetFullPath("plans"), handleWithDB(api.ManagePlans, database))
 	apiRouter.HandleFunc(util.GetFullPath("plans/summary"), handleWithDB(api.GetPlansSummary, database))
+	apiRouter.HandleFunc(util.GetFullPath("plans/{planid}/summary"), handleWithDB(api.GetPlanSummary, database))
+	apiRouter.HandleFunc(util.GetFullPath("plans/{planid}/prior-state-drift"), handleWithDB(api.GetPriorStateDrift, database))
+	apiRouter.HandleFunc(util.GetFullPath("plans/{planid}/restore"), handleWithDB(api.RestorePlan, database))
+
+	// Count API requests
+	apiRouter.Use(metrics.Middleware)
+
+	// Expose metrics
+	r.Handle("/metrics", promhttp.Handler())
+
+	// Health and readiness probes
+	r.HandleFunc("/healthz", api.Healthz)
+	r.HandleFunc("/readyz", handleWithDBAndStateProviders(api.Readyz, database, sps))
+
+	// OpenID Connect login
+	if auth.OIDCEnabled() {
+		r.HandleFunc(util.GetFullPath("oauth/login"), auth.OIDCLogin)
+		r.HandleFunc(util.GetFullPath("oauth/callback"), auth.OIDCCallback)
+		r.HandleFunc(util.GetFullPath("oauth/logout"), auth.OIDCLogout)
+	}
 
 	// Serve static files (CSS, JS, images) from dir
 	spa := spaHandler{staticPath: "static", indexPath: "index.html"}
 	r.PathPrefix("/").Handler(spa)
 
-	// Add CORS Middleware to mux router
-	r.Use(corsMiddleware)
+	// Add the configured middlewares to mux router, the first one wrapping the others
+	middlewares, err := middlewareChain(c.Web.Middlewares, webMiddlewares(c.Web, c.RateLimits))
+	if err != nil {
+		log.Fatalf("Failed to set up middlewares: %v", err)
+	}
+	r.Use(middlewares...)
 
 	// Start server
 	log.Debugf("Listening on port %d\n", c.Web.Port)
@@ -2,9 +2,17 @@ package main
 
 import (
 	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/camptocamp/terraboard/db"
+	"github.com/camptocamp/terraboard/internal/terraform/states/statefile"
+	"github.com/camptocamp/terraboard/state"
+	"github.com/camptocamp/terraboard/util"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"gorm.io/gorm"
 )
 
@@ -37,3 +45,154 @@ func TestHandleWithDB(t *testing.T) {
 	d := db.Database{DB: &gorm.DB{}}
 	handleWithDB(handlerWithDB, &d)
 }
+
+func TestRequestIDMiddleware_Generated(t *testing.T) {
+	hook := test.NewGlobal()
+	log.AddHook(util.RequestIDHook{})
+	defer hook.Reset()
+
+	handler := requestIDMiddleware("X-Request-ID")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.WithContext(r.Context()).Error("fake error")
+	}))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/version", nil)
+	handler.ServeHTTP(rec, req)
+
+	id := rec.Header().Get("X-Request-ID")
+	if id == "" {
+		t.Fatalf("Expected a request ID, got none")
+	}
+
+	entry := hook.LastEntry()
+	if entry == nil || entry.Data["request_id"] != id {
+		t.Fatalf("Expected log entry with request_id %s, got %v", id, entry)
+	}
+}
+
+func TestRequestIDMiddleware_Propagated(t *testing.T) {
+	expected := "fakeRequestID"
+
+	handler := requestIDMiddleware("X-Request-ID")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := util.RequestID(r.Context()); id != expected {
+			t.Fatalf("Expected %s, got %s", expected, id)
+		}
+	}))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/version", nil)
+	req.Header.Set("X-Request-ID", expected)
+	handler.ServeHTTP(rec, req)
+
+	if id := rec.Header().Get("X-Request-ID"); id != expected {
+		t.Fatalf("Expected %s, got %s", expected, id)
+	}
+}
+
+func TestHandlerName(t *testing.T) {
+	if name := handlerName(handlerWithDB); name != "handlerWithDB" {
+		t.Fatalf("Expected %s, got %s", "handlerWithDB", name)
+	}
+}
+
+// reverseProvider returns the versions of its State files newest first
+type reverseProvider struct {
+	versions map[string][]state.Version
+}
+
+func (p *reverseProvider) Name() string { return "reverse" }
+
+func (p *reverseProvider) GetLocks() (map[string]state.LockInfo, error) { return nil, nil }
+
+func (p *reverseProvider) GetVersions(path string) ([]state.Version, error) {
+	return p.versions[path], nil
+}
+
+func (p *reverseProvider) GetStates() (states []string, err error) {
+	for path := range p.versions {
+		states = append(states, path)
+	}
+	return
+}
+
+func (p *reverseProvider) GetState(path, versionID string) (*statefile.File, error) {
+	return &statefile.File{Lineage: "lineage-" + path}, nil
+}
+
+func (p *reverseProvider) GetStateRaw(path, versionID string) ([]byte, error) { return nil, nil }
+
+func (p *reverseProvider) Unlock(lockID string) error { return nil }
+
+// recordingIngester records the order in which the versions of each path are inserted
+type recordingIngester struct {
+	mu       sync.Mutex
+	inserted map[string][]string
+}
+
+func (i *recordingIngester) InsertVersion(version *state.Version) error { return nil }
+
+func (i *recordingIngester) InsertState(path, versionID, provider string, sf *statefile.File) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.inserted[path] = append(i.inserted[path], versionID)
+	return nil
+}
+
+func (i *recordingIngester) AddLineageTags(lineage string, tags []string) error { return nil }
+
+func TestIngestStates_OldestFirst(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2021, 6, 1, hour, 0, 0, 0, time.UTC)
+	}
+	sp := &reverseProvider{versions: map[string][]state.Version{
+		"app.tfstate": {
+			{ID: "app-5", LastModified: at(5)},
+			{ID: "app-3", LastModified: at(3)},
+			{ID: "app-1", LastModified: at(1)},
+		},
+		"app.tfstate.backup": {
+			{ID: "app-4", LastModified: at(4)},
+			{ID: "app-2", LastModified: at(2)},
+		},
+		"db.tfstate": {
+			{ID: "db-3", LastModified: at(3)},
+			{ID: "db-2", LastModified: at(2)},
+			{ID: "db-1", LastModified: at(1)},
+		},
+	}}
+	files, _ := sp.GetStates()
+	si := &recordingIngester{inserted: make(map[string][]string)}
+	statesVersions := map[string][]string{
+		"db-1": {"db.tfstate"},
+	}
+
+	var notified []string
+	var mu sync.Mutex
+	ingestStates(si, sp, state.NewAdaptiveLimiter(4), files, statesVersions, "", func(path string, v state.Version, sf *statefile.File) {
+		mu.Lock()
+		defer mu.Unlock()
+		notified = append(notified, v.ID)
+	})
+
+	expected := map[string][]string{
+		"app.tfstate": {"app-1", "app-2", "app-3", "app-4", "app-5"},
+		"db.tfstate":  {"db-2", "db-3"},
+	}
+	if len(si.inserted) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, si.inserted)
+	}
+	for path, ids := range expected {
+		got := si.inserted[path]
+		if len(got) != len(ids) {
+			t.Fatalf("Expected %v for %s, got %v", ids, path, got)
+		}
+		for k := range ids {
+			if got[k] != ids[k] {
+				t.Fatalf("Expected %v for %s, got %v", ids, path, got)
+			}
+		}
+	}
+	if len(notified) != 7 {
+		t.Fatalf("Expected %d notifications, got %d", 7, len(notified))
+	}
+}
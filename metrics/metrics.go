@@ -0,0 +1,170 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/camptocamp/terraboard/config"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// otherLabel is used in place of label values exceeding the cardinality limit
+const otherLabel = "other"
+
+var (
+	compareDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "terraboard",
+		Name:      "compare_duration_seconds",
+		Help:      "Duration of state versions compare operations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"lineage"})
+
+	comparesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "terraboard",
+		Name:      "compares_total",
+		Help:      "Number of state versions compare operations performed.",
+	})
+
+	apiRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "terraboard",
+		Name:      "api_requests_total",
+		Help:      "Number of API requests, by handler and response status.",
+	}, []string{"handler", "status"})
+
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "terraboard",
+		Name:      "db_query_duration_seconds",
+		Help:      "Duration of database queries, by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	lineagesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "terraboard",
+		Name:      "lineages",
+		Help:      "Number of lineages in the database.",
+	})
+
+	versionsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "terraboard",
+		Name:      "state_versions",
+		Help:      "Number of state versions in the database.",
+	})
+
+	locksGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "terraboard",
+		Name:      "locks",
+		Help:      "Number of states currently locked on the providers.",
+	})
+
+	lineageLabels = newLabelSet(100)
+)
+
+func init() {
+	prometheus.MustRegister(compareDuration, comparesTotal, apiRequestsTotal, dbQueryDuration,
+		lineagesGauge, versionsGauge, locksGauge)
+}
+
+// labelSet bounds the cardinality of a label, keeping the first
+// values seen up to its limit. It is safe for concurrent use.
+type labelSet struct {
+	sync.Mutex
+	limit  int
+	values map[string]struct{}
+}
+
+func newLabelSet(limit int) *labelSet {
+	return &labelSet{
+		limit:  limit,
+		values: make(map[string]struct{}),
+	}
+}
+
+// get returns the label value to use for v
+func (l *labelSet) get(v string) string {
+	l.Lock()
+	defer l.Unlock()
+
+	if _, ok := l.values[v]; ok {
+		return v
+	}
+	if len(l.values) >= l.limit {
+		return otherLabel
+	}
+	l.values[v] = struct{}{}
+	return v
+}
+
+// Setup sets up metrics
+func Setup(c *config.Config) {
+	lineageLabels = newLabelSet(c.Metrics.LineageLabelLimit)
+}
+
+// ObserveQuery records the duration of a database operation
+// ('query', 'create', 'update', 'delete', 'row' or 'raw')
+func ObserveQuery(operation string, duration time.Duration) {
+	dbQueryDuration.WithLabelValues(operation).Observe(duration.Seconds())
+}
+
+// SetInventory sets the number of lineages and state versions in the database
+func SetInventory(lineages, versions int64) {
+	lineagesGauge.Set(float64(lineages))
+	versionsGauge.Set(float64(versions))
+}
+
+// SetLocks sets the number of states currently locked
+func SetLocks(locks int) {
+	locksGauge.Set(float64(locks))
+}
+
+// handlerNameKey is the context key of the handler name holder
+type handlerNameKey struct{}
+
+// SetHandlerName names the API handler serving a request
+// passed through Middleware
+func SetHandlerName(ctx context.Context, name string) {
+	if n, ok := ctx.Value(handlerNameKey{}).(*string); ok {
+		*n = name
+	}
+}
+
+// statusRecorder records the status of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Middleware counts API requests by handler and response status.
+// Requests are labelled with the name set by their handler,
+// or the template of their route by default.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var name string
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), handlerNameKey{}, &name)))
+
+		if name == "" {
+			if route := mux.CurrentRoute(r); route != nil {
+				name, _ = route.GetPathTemplate()
+			}
+		}
+		if name == "" {
+			name = otherLabel
+		}
+		apiRequestsTotal.WithLabelValues(name, strconv.Itoa(rec.status)).Inc()
+	})
+}
+
+// ObserveCompare records a compare operation on a lineage along with its duration
+func ObserveCompare(lineage string, duration time.Duration) {
+	comparesTotal.Inc()
+	compareDuration.WithLabelValues(lineageLabels.get(lineage)).Observe(duration.Seconds())
+}
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLabelSet_Limit(t *testing.T) {
+	l := newLabelSet(2)
+
+	for _, v := range []string{"foo", "bar", "foo"} {
+		if got := l.get(v); got != v {
+			t.Fatalf("Expected %s, got %s", v, got)
+		}
+	}
+
+	if got := l.get("baz"); got != otherLabel {
+		t.Fatalf("Expected %s, got %s", otherLabel, got)
+	}
+}
+
+func TestObserveCompare(t *testing.T) {
+	ObserveCompare("fakeLineage", 150*time.Millisecond)
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var count uint64
+	for _, f := range families {
+		if f.GetName() != "terraboard_compare_duration_seconds" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "lineage" && l.GetValue() == "fakeLineage" {
+					count += m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+
+	if count != 1 {
+		t.Fatalf("Expected %d observation, got %d", 1, count)
+	}
+}
+
+func TestRegisteredMetrics(t *testing.T) {
+	ObserveQuery("query", 10*time.Millisecond)
+	SetInventory(3, 12)
+	SetLocks(1)
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/version", nil))
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	names := make(map[string]bool)
+	for _, f := range families {
+		names[f.GetName()] = true
+	}
+
+	for _, name := range []string{
+		"terraboard_api_requests_total",
+		"terraboard_db_query_duration_seconds",
+		"terraboard_lineages",
+		"terraboard_state_versions",
+		"terraboard_locks",
+	} {
+		if !names[name] {
+			t.Fatalf("Expected metric %s to be registered", name)
+		}
+	}
+}
+
+func TestMiddleware_HandlerName(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/api/lineages/{lineage}", func(w http.ResponseWriter, r *http.Request) {
+		SetHandlerName(r.Context(), "GetState")
+		w.WriteHeader(http.StatusNotFound)
+	})
+	r.HandleFunc("/api/user", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(Middleware)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/lineages/foo", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/user", nil))
+
+	if c := testutil.ToFloat64(apiRequestsTotal.WithLabelValues("GetState", "404")); c != 1 {
+		t.Fatalf("Expected %v request, got %v", 1, c)
+	}
+	if c := testutil.ToFloat64(apiRequestsTotal.WithLabelValues("/api/user", "200")); c != 1 {
+		t.Fatalf("Expected %v request, got %v", 1, c)
+	}
+}
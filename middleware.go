@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/camptocamp/terraboard/auth"
+	"github.com/camptocamp/terraboard/config"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// Names of the middlewares of the web server
+const (
+	middlewareCORS      = "cors"
+	middlewareGzip      = "gzip"
+	middlewareRequestID = "request-id"
+	middlewareAuth      = "auth"
+	middlewareRateLimit = "rate-limit"
+)
+
+// webMiddlewares returns the middlewares available to the web server by name.
+// Gzip compression is disabled, and left out of the chain, with a null level,
+// as is rate limiting without any limit.
+func webMiddlewares(c config.WebConfig, rateLimits []config.RateLimitConfig) map[string]mux.MiddlewareFunc {
+	middlewares := map[string]mux.MiddlewareFunc{
+		middlewareCORS:      corsMiddleware,
+		middlewareGzip:      nil,
+		middlewareRequestID: requestIDMiddleware(c.RequestIDHeader),
+		middlewareAuth:      auth.Middleware,
+		middlewareRateLimit: rateLimitMiddleware(c.RateLimit, c.RateLimitBurst, rateLimits, time.Now),
+	}
+	if c.GzipLevel != 0 {
+		middlewares[middlewareGzip] = gzipMiddleware(c.GzipMinSize, c.GzipLevel)
+	}
+	return middlewares
+}
+
+// middlewareChain returns the named middlewares in the given order,
+// the first one wrapping all the others
+func middlewareChain(names []string, available map[string]mux.MiddlewareFunc) ([]mux.MiddlewareFunc, error) {
+	var chain []mux.MiddlewareFunc
+	seen := make(map[string]bool)
+	for _, name := range names {
+		mw, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown middleware '%s'", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("middleware '%s' is configured more than once", name)
+		}
+		seen[name] = true
+
+		if mw != nil {
+			chain = append(chain, mw)
+		}
+	}
+
+	if !seen[middlewareAuth] {
+		log.Warn("The auth middleware is disabled, API tokens and required authentication aren't enforced")
+	}
+	return chain, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/camptocamp/terraboard/config"
+	"github.com/gorilla/mux"
+)
+
+// recordingMiddlewares returns middlewares appending their name
+// to the given slice when executed
+func recordingMiddlewares(names []string, calls *[]string) map[string]mux.MiddlewareFunc {
+	middlewares := make(map[string]mux.MiddlewareFunc)
+	for _, name := range names {
+		name := name
+		middlewares[name] = func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				*calls = append(*calls, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	return middlewares
+}
+
+func TestMiddlewareChain_Order(t *testing.T) {
+	var calls []string
+	available := recordingMiddlewares([]string{"logging", "cors", "auth", "gzip"}, &calls)
+
+	for _, order := range [][]string{
+		{"logging", "cors", "auth", "gzip"},
+		{"gzip", "auth", "logging"},
+	} {
+		calls = nil
+		chain, err := middlewareChain(order, available)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		r := mux.NewRouter()
+		r.HandleFunc("/api/states", func(w http.ResponseWriter, r *http.Request) {
+			calls = append(calls, "handler")
+		})
+		r.Use(chain...)
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/states", nil))
+
+		expected := append(append([]string{}, order...), "handler")
+		if !reflect.DeepEqual(calls, expected) {
+			t.Fatalf("Expected %v, got %v", expected, calls)
+		}
+	}
+}
+
+func TestMiddlewareChain_Errors(t *testing.T) {
+	var calls []string
+	available := recordingMiddlewares([]string{"cors", "auth"}, &calls)
+
+	if _, err := middlewareChain([]string{"cors", "unknown"}, available); err == nil {
+		t.Fatalf("Expected an error for an unknown middleware")
+	}
+	if _, err := middlewareChain([]string{"cors", "auth", "cors"}, available); err == nil {
+		t.Fatalf("Expected an error for a duplicated middleware")
+	}
+}
+
+func TestWebMiddlewares_GzipDisabled(t *testing.T) {
+	web := config.WebConfig{
+		RequestIDHeader: "X-Request-ID",
+		Middlewares:     []string{middlewareCORS, middlewareGzip, middlewareRequestID, middlewareAuth},
+	}
+	chain, err := middlewareChain(web.Middlewares, webMiddlewares(web, nil))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(chain) != 3 {
+		t.Fatalf("Expected gzip to be left out of the chain, got %d middlewares", len(chain))
+	}
+
+	web.GzipLevel = 6
+	if chain, _ := middlewareChain(web.Middlewares, webMiddlewares(web, nil)); len(chain) != 4 {
+		t.Fatalf("Expected 4 middlewares, got %d", len(chain))
+	}
+}
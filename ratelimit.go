@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/camptocamp/terraboard/api"
+	"github.com/camptocamp/terraboard/auth"
+	"github.com/camptocamp/terraboard/config"
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// rateLimitIdleTTL is the duration after which the token bucket
+// of an idle client is forgotten
+const rateLimitIdleTTL = 10 * time.Minute
+
+// rateBucket is the token bucket of a client
+type rateBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter holds a token bucket per client, refilled at the same rate
+type rateLimiter struct {
+	path  string
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(path string, limit float64, burst uint) *rateLimiter {
+	if burst == 0 {
+		burst = 1
+	}
+	return &rateLimiter{
+		path:    path,
+		limit:   rate.Limit(limit),
+		burst:   int(burst),
+		buckets: make(map[string]*rateBucket),
+	}
+}
+
+// matches returns true if the path matches the path of the limiter,
+// either exactly or as a prefix when it ends with '*'
+func (l *rateLimiter) matches(path string) bool {
+	if strings.HasSuffix(l.path, "*") {
+		return strings.HasPrefix(path, strings.TrimSuffix(l.path, "*"))
+	}
+	return path == l.path
+}
+
+// rateLimitStatus is the state of the bucket of a client after a request
+type rateLimitStatus struct {
+	// limit is the capacity of the bucket, 0 when the client isn't limited
+	limit     int
+	remaining int
+	// reset is the delay after which the bucket is full again
+	reset time.Duration
+	// retryAfter is the delay after which a refused request would be accepted
+	retryAfter time.Duration
+}
+
+// reserve takes a token from the bucket of a client, returning how long
+// to wait for one when the bucket is empty, along with the tokens left.
+// Buckets of idle clients are swept along the way.
+func (l *rateLimiter) reserve(client string, now time.Time) (ok bool, status rateLimitStatus) {
+	if l.limit <= 0 {
+		return true, status
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > rateLimitIdleTTL {
+		for c, b := range l.buckets {
+			if now.Sub(b.lastSeen) > rateLimitIdleTTL {
+				delete(l.buckets, c)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, exists := l.buckets[client]
+	if !exists {
+		b = &rateBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[client] = b
+	}
+	b.lastSeen = now
+
+	status.limit = l.burst
+	r := b.limiter.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		status.retryAfter = delay
+		ok = false
+	} else {
+		ok = true
+	}
+	status.remaining, status.reset = l.tokens(b.limiter, now)
+	return ok, status
+}
+
+// tokens returns the whole tokens left in a bucket, and the delay after
+// which it is full again, from the wait for a reservation of the full
+// bucket, which is canceled right away
+func (l *rateLimiter) tokens(limiter *rate.Limiter, now time.Time) (int, time.Duration) {
+	r := limiter.ReserveN(now, l.burst)
+	reset := r.DelayFrom(now)
+	r.CancelAt(now)
+	tokens := float64(l.burst) - reset.Seconds()*float64(l.limit)
+	if tokens < 0 {
+		tokens = 0
+	}
+	return int(math.Floor(tokens)), reset
+}
+
+// rateLimitClient identifies the client of a request by its user, when
+// authenticated by Terraboard from an API token or a login session,
+// or else by its remote IP address: the user headers alone could be
+// set by the client to get fresh buckets.
+func rateLimitClient(r *http.Request) string {
+	if auth.IsVerified(r) {
+		return "user:" + r.Header.Get("X-Forwarded-User") + "/" + r.Header.Get("X-Forwarded-Email")
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// rateLimitMiddleware limits the requests of each client, the first
+// matching path override taking precedence over the global limit.
+// Responses to limited requests report the capacity of the bucket, the
+// requests left and the seconds until it is full again in X-RateLimit-*
+// headers, so that clients can slow down before being refused.
+// Requests over the limit are answered with a 429 and the delay
+// after which they'd be accepted.
+// It is left out of the chain when no limit is configured.
+func rateLimitMiddleware(limit float64, burst uint, overrides []config.RateLimitConfig, now func() time.Time) mux.MiddlewareFunc {
+	var limiters []*rateLimiter
+	for _, o := range overrides {
+		b := o.Burst
+		if b == 0 {
+			b = burst
+		}
+		limiters = append(limiters, newRateLimiter(o.Path, o.Rate, b))
+	}
+	if limit <= 0 && len(limiters) == 0 {
+		return nil
+	}
+	global := newRateLimiter("*", limit, burst)
+	limiters = append(limiters, global)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limiter := global
+			for _, l := range limiters {
+				if l.matches(r.URL.Path) {
+					limiter = l
+					break
+				}
+			}
+
+			ok, status := limiter.reserve(rateLimitClient(r), now())
+			if status.limit > 0 {
+				w.Header().Set("X-RateLimit-Limit", strconv.Itoa(status.limit))
+				w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(status.remaining))
+				w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(status.reset.Seconds()))))
+			}
+			if !ok {
+				seconds := int(math.Ceil(status.retryAfter.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				api.JSONErrorCode(w, api.CodeRateLimited, "Rate limit exceeded",
+					fmt.Errorf("retry in %d seconds", seconds))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/terraboard/auth"
+	"github.com/camptocamp/terraboard/config"
+)
+
+// fakeClock is a clock advanced by the tests
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// limitedRequest sends a request through a rate limited handler,
+// as the user of the given API token if any
+func limitedRequest(handler http.Handler, path, remoteAddr, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	req.RemoteAddr = remoteAddr
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+// rateLimitedHandler returns a rate limited handler, behind the
+// authentication of the "jane-token" API token
+func rateLimitedHandler(limit float64, burst uint, overrides []config.RateLimitConfig, clock *fakeClock) http.Handler {
+	sum := sha256.Sum256([]byte("jane-token"))
+	c := config.Config{}
+	c.APITokens = []config.APITokenConfig{{Name: "jane", Hash: hex.EncodeToString(sum[:])}}
+	auth.Setup(&c)
+
+	mw := rateLimitMiddleware(limit, burst, overrides, clock.Now)
+	return auth.Middleware(mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+}
+
+// spoofedRequest sends a request through a rate limited handler,
+// with user headers set by the client
+func spoofedRequest(handler http.Handler, remoteAddr, user string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/api/lineages", nil)
+	req.RemoteAddr = remoteAddr
+	req.Header.Set("X-Forwarded-User", user)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRateLimitMiddleware_Burst(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)}
+	handler := rateLimitedHandler(0.5, 3, nil, clock)
+
+	for i := 0; i < 3; i++ {
+		if rr := limitedRequest(handler, "/api/lineages", "10.0.0.1:1234", ""); rr.Code != http.StatusOK {
+			t.Fatalf("Expected %d, got %d", http.StatusOK, rr.Code)
+		}
+	}
+
+	rr := limitedRequest(handler, "/api/lineages", "10.0.0.1:5678", "")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "2" {
+		t.Fatalf("Expected %s, got %s", "2", rr.Header().Get("Retry-After"))
+	}
+	var body map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Expected a JSON error, got %v", err)
+	}
+	if body["code"] != "RATE_LIMITED" {
+		t.Fatalf("Expected %s, got %s", "RATE_LIMITED", body["code"])
+	}
+
+	// Other IP addresses and authenticated users have their own bucket
+	if rr := limitedRequest(handler, "/api/lineages", "10.0.0.2:1234", ""); rr.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, rr.Code)
+	}
+	if rr := limitedRequest(handler, "/api/lineages", "10.0.0.1:1234", "jane-token"); rr.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, rr.Code)
+	}
+	// but user headers set by clients don't get a bucket of their own
+	if rr := spoofedRequest(handler, "10.0.0.1:1234", "mallory"); rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+
+	// The bucket is refilled over time
+	clock.now = clock.now.Add(2 * time.Second)
+	if rr := limitedRequest(handler, "/api/lineages", "10.0.0.1:1234", ""); rr.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, rr.Code)
+	}
+	if rr := limitedRequest(handler, "/api/lineages", "10.0.0.1:1234", ""); rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+}
+
+func TestRateLimitMiddleware_Headers(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)}
+	handler := rateLimitedHandler(0.5, 3, nil, clock)
+
+	expectHeaders := func(rr *httptest.ResponseRecorder, remaining, reset string) {
+		t.Helper()
+		for header, expected := range map[string]string{
+			"X-RateLimit-Limit":     "3",
+			"X-RateLimit-Remaining": remaining,
+			"X-RateLimit-Reset":     reset,
+		} {
+			if v := rr.Header().Get(header); v != expected {
+				t.Fatalf("Expected %s %s, got %s", header, expected, v)
+			}
+		}
+	}
+
+	// The remaining requests decrease with each request
+	for i, expected := range []struct{ remaining, reset string }{{"2", "2"}, {"1", "4"}, {"0", "6"}} {
+		rr := limitedRequest(handler, "/api/lineages", "10.0.0.1:1234", "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected %d for request %d, got %d", http.StatusOK, i, rr.Code)
+		}
+		expectHeaders(rr, expected.remaining, expected.reset)
+	}
+
+	rr := limitedRequest(handler, "/api/lineages", "10.0.0.1:1234", "")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	expectHeaders(rr, "0", "6")
+	if rr.Header().Get("Retry-After") != "2" {
+		t.Fatalf("Expected %s, got %s", "2", rr.Header().Get("Retry-After"))
+	}
+
+	// and are reset as the bucket is refilled
+	clock.now = clock.now.Add(2 * time.Second)
+	expectHeaders(limitedRequest(handler, "/api/lineages", "10.0.0.1:1234", ""), "0", "6")
+	clock.now = clock.now.Add(6 * time.Second)
+	expectHeaders(limitedRequest(handler, "/api/lineages", "10.0.0.1:1234", ""), "2", "2")
+
+	// Unlimited paths have no rate limit headers
+	handler = rateLimitedHandler(0, 5, []config.RateLimitConfig{{Path: "/api/search/*", Rate: 1}}, clock)
+	if rr := limitedRequest(handler, "/api/lineages", "10.0.0.1:1234", ""); rr.Header().Get("X-RateLimit-Limit") != "" {
+		t.Fatalf("Expected no rate limit headers, got %v", rr.Header())
+	}
+}
+
+func TestRateLimitMiddleware_PathOverride(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)}
+	handler := rateLimitedHandler(0, 5, []config.RateLimitConfig{
+		{Path: "/api/search/*", Rate: 1, Burst: 1},
+	}, clock)
+
+	if rr := limitedRequest(handler, "/api/search/fulltext", "10.0.0.1:1234", "jane-token"); rr.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, rr.Code)
+	}
+	if rr := limitedRequest(handler, "/api/search/attribute", "10.0.0.1:1234", "jane-token"); rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+
+	// Without a global limit, other paths are unlimited
+	for i := 0; i < 10; i++ {
+		if rr := limitedRequest(handler, "/api/lineages", "10.0.0.1:1234", "jane-token"); rr.Code != http.StatusOK {
+			t.Fatalf("Expected %d, got %d", http.StatusOK, rr.Code)
+		}
+	}
+}
+
+func TestRateLimitMiddleware_Disabled(t *testing.T) {
+	if mw := rateLimitMiddleware(0, 20, nil, time.Now); mw != nil {
+		t.Fatalf("Expected no middleware without any limit")
+	}
+}
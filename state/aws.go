@@ -1,9 +1,11 @@
 package state
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"strings"
 	"time"
 
@@ -14,6 +16,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/camptocamp/terraboard/config"
 	"github.com/camptocamp/terraboard/internal/terraform/states/statefile"
 	log "github.com/sirupsen/logrus"
@@ -21,32 +24,74 @@ import (
 
 // AWS is a state provider type, leveraging S3 and DynamoDB
 type AWS struct {
-	svc           *s3.S3
-	dynamoSvc     *dynamodb.DynamoDB
-	bucket        string
-	dynamoTable   string
-	keyPrefix     string
-	fileExtension []string
-	noLocks       bool
-	noVersioning  bool
+	svc            *s3.S3
+	dynamoSvc      *dynamodb.DynamoDB
+	awsConfig      config.AWSConfig
+	bucketConfig   config.S3BucketConfig
+	bucket         string
+	dynamoTable    string
+	keyPrefix      string
+	fileExtension  []string
+	noLocks        bool
+	noVersioning   bool
+	includeBackups bool
 }
 
 // NewAWS creates an AWS object
-func NewAWS(aws config.AWSConfig, bucket config.S3BucketConfig, noLocks, noVersioning bool) *AWS {
+func NewAWS(aws config.AWSConfig, bucket config.S3BucketConfig, noLocks, noVersioning, includeBackups bool) *AWS {
 	if bucket.Bucket == "" {
 		return nil
 	}
 
+	svc, dynamoSvc := newAWSClients(aws, bucket)
+	return &AWS{
+		svc:            svc,
+		dynamoSvc:      dynamoSvc,
+		awsConfig:      aws,
+		bucketConfig:   bucket,
+		bucket:         bucket.Bucket,
+		keyPrefix:      bucket.KeyPrefix,
+		fileExtension:  bucket.FileExtension,
+		dynamoTable:    aws.DynamoDBTable,
+		noLocks:        noLocks,
+		noVersioning:   noVersioning,
+		includeBackups: includeBackups,
+	}
+}
+
+// assumeRoleExpiryWindow is how long before their expiry
+// the credentials of an assumed role are refreshed
+const assumeRoleExpiryWindow = 5 * time.Minute
+
+// roleToAssume returns the role, and its external ID, assumed to access
+// a bucket: its own one if set, the one of its AWS provider otherwise
+func roleToAssume(aws config.AWSConfig, bucket config.S3BucketConfig) (roleArn, externalID string) {
+	if bucket.RoleArn != "" {
+		return bucket.RoleArn, bucket.ExternalID
+	}
+	return aws.APPRoleArn, aws.ExternalID
+}
+
+// newAssumeRoleCredentials returns the credentials of a role assumed
+// through STS, assumed again shortly before they expire
+func newAssumeRoleCredentials(client stscreds.AssumeRoler, roleArn, externalID string) *credentials.Credentials {
+	return stscreds.NewCredentialsWithClient(client, roleArn, func(p *stscreds.AssumeRoleProvider) {
+		if externalID != "" {
+			p.ExternalID = aws_sdk.String(externalID)
+		}
+		p.ExpiryWindow = assumeRoleExpiryWindow
+	})
+}
+
+// newAWSClients creates the S3 and DynamoDB clients of a bucket,
+// within a new session
+func newAWSClients(aws config.AWSConfig, bucket config.S3BucketConfig) (*s3.S3, *dynamodb.DynamoDB) {
 	sess := session.Must(session.NewSession())
 	awsConfig := aws_sdk.NewConfig()
 	var creds *credentials.Credentials
-	if len(aws.APPRoleArn) > 0 {
-		log.Debugf("Using %s role", aws.APPRoleArn)
-		creds = stscreds.NewCredentials(sess, aws.APPRoleArn, func(p *stscreds.AssumeRoleProvider) {
-			if aws.ExternalID != "" {
-				p.ExternalID = aws_sdk.String(aws.ExternalID)
-			}
-		})
+	if roleArn, externalID := roleToAssume(aws, bucket); roleArn != "" {
+		log.Debugf("Using %s role for bucket %s", roleArn, bucket.Bucket)
+		creds = newAssumeRoleCredentials(sts.New(sess), roleArn, externalID)
 	} else {
 		if aws.AccessKey == "" || aws.SecretAccessKey == "" {
 			log.Fatal("Missing AccessKey or SecretAccessKey for AWS provider. Please check your configuration and retry")
@@ -63,16 +108,14 @@ func NewAWS(aws config.AWSConfig, bucket config.S3BucketConfig, noLocks, noVersi
 	}
 	awsConfig.S3ForcePathStyle = &bucket.ForcePathStyle
 
-	return &AWS{
-		svc:           s3.New(sess, awsConfig),
-		bucket:        bucket.Bucket,
-		keyPrefix:     bucket.KeyPrefix,
-		fileExtension: bucket.FileExtension,
-		dynamoSvc:     dynamodb.New(sess, awsConfig),
-		dynamoTable:   aws.DynamoDBTable,
-		noLocks:       noLocks,
-		noVersioning:  noVersioning,
-	}
+	return s3.New(sess, awsConfig), dynamodb.New(sess, awsConfig)
+}
+
+// RefreshCredentials recreates the session and clients of the provider,
+// assuming its role again when one is configured
+func (a *AWS) RefreshCredentials() error {
+	a.svc, a.dynamoSvc = newAWSClients(a.awsConfig, a.bucketConfig)
+	return nil
 }
 
 // NewAWSCollection instantiate all needed AWS objects configurated by the user and return a slice
@@ -80,7 +123,7 @@ func NewAWSCollection(c *config.Config) []*AWS {
 	var awsInstances []*AWS
 	for _, aws := range c.AWS {
 		for _, bucket := range aws.S3 {
-			if awsInstance := NewAWS(aws, bucket, c.Provider.NoLocks, c.Provider.NoVersioning); awsInstance != nil {
+			if awsInstance := NewAWS(aws, bucket, c.Provider.NoLocks, c.Provider.NoVersioning, c.Provider.IncludeBackups); awsInstance != nil {
 				awsInstances = append(awsInstances, awsInstance)
 			}
 		}
@@ -89,6 +132,11 @@ func NewAWSCollection(c *config.Config) []*AWS {
 	return awsInstances
 }
 
+// Name returns the AWS provider identifier
+func (a *AWS) Name() string {
+	return fmt.Sprintf("aws:%s", a.bucket)
+}
+
 // GetLocks returns a map of locks by State path
 func (a *AWS) GetLocks() (locks map[string]LockInfo, err error) {
 	if a.noLocks {
@@ -131,6 +179,64 @@ func (a *AWS) GetLocks() (locks map[string]LockInfo, err error) {
 	return
 }
 
+// Unlock force-releases a lock by removing its DynamoDB item
+func (a *AWS) Unlock(lockID string) error {
+	if a.noLocks || a.dynamoTable == "" {
+		return ErrLockNotFound
+	}
+
+	// Items are keyed by State path, the lock ID being only known from
+	// their info: the pages of the table are scanned until it is found
+	var key string
+	var parseErr error
+	err := a.dynamoSvc.ScanPages(&dynamodb.ScanInput{
+		TableName: &a.dynamoTable,
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		key, parseErr = findLock(page.Items, lockID)
+		return key == "" && parseErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if parseErr != nil {
+		return parseErr
+	}
+	if key == "" {
+		return ErrLockNotFound
+	}
+
+	_, err = a.dynamoSvc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: &a.dynamoTable,
+		Key: map[string]*dynamodb.AttributeValue{
+			"LockID": {S: aws_sdk.String(key)},
+		},
+	})
+	return err
+}
+
+// findLock returns the key of the DynamoDB item holding the lock
+// with the given ID, if any
+func findLock(items []map[string]*dynamodb.AttributeValue, lockID string) (string, error) {
+	var lockList []Lock
+	if err := dynamodbattribute.UnmarshalListOfMaps(items, &lockList); err != nil {
+		return "", err
+	}
+
+	for _, lock := range lockList {
+		if lock.Info == "" {
+			continue
+		}
+		var info LockInfo
+		if err := json.Unmarshal([]byte(lock.Info), &info); err != nil {
+			return "", err
+		}
+		if info.ID == lockID {
+			return lock.LockID, nil
+		}
+	}
+	return "", nil
+}
+
 // GetStates returns a slice of State files in the S3 bucket
 func (a *AWS) GetStates() (states []string, err error) {
 	log.WithFields(log.Fields{
@@ -148,7 +254,8 @@ func (a *AWS) GetStates() (states []string, err error) {
 	var keys []string
 	for _, obj := range result.Contents {
 		for _, ext := range a.fileExtension {
-			if strings.HasSuffix(*obj.Key, ext) {
+			if strings.HasSuffix(*obj.Key, ext) ||
+				(a.includeBackups && strings.HasSuffix(*obj.Key, ext+backupSuffix)) {
 				keys = append(keys, *obj.Key)
 			}
 		}
@@ -164,6 +271,22 @@ func (a *AWS) GetStates() (states []string, err error) {
 
 // GetState retrieves a single State from the S3 bucket
 func (a *AWS) GetState(st, versionID string) (sf *statefile.File, err error) {
+	raw, err := a.GetStateRaw(st, versionID)
+	if err != nil {
+		return sf, err
+	}
+
+	sf, err = statefile.Read(bytes.NewReader(raw))
+
+	if sf == nil {
+		return sf, fmt.Errorf("Failed to find state")
+	}
+
+	return
+}
+
+// GetStateRaw retrieves the content of a single State file from the S3 bucket
+func (a *AWS) GetStateRaw(st, versionID string) (raw []byte, err error) {
 	log.WithFields(log.Fields{
 		"path":       st,
 		"version_id": versionID,
@@ -176,6 +299,9 @@ func (a *AWS) GetState(st, versionID string) (sf *statefile.File, err error) {
 		input.VersionId = &versionID
 	}
 	result, err := a.svc.GetObjectWithContext(context.Background(), input)
+	if IsExpiredCredentialsError(err) {
+		return nil, err
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
 			"path":       st,
@@ -186,17 +312,11 @@ func (a *AWS) GetState(st, versionID string) (sf *statefile.File, err error) {
 		errObj["error"] = fmt.Sprintf("State file not found: %v", st)
 		errObj["details"] = fmt.Sprintf("%v", err)
 		j, _ := json.Marshal(errObj)
-		return sf, fmt.Errorf("%s", string(j))
+		return nil, fmt.Errorf("%s", string(j))
 	}
 	defer result.Body.Close()
 
-	sf, err = statefile.Read(result.Body)
-
-	if sf == nil {
-		return sf, fmt.Errorf("Failed to find state")
-	}
-
-	return
+	return ioutil.ReadAll(result.Body)
 }
 
 // GetVersions returns a slice of Version objects
@@ -222,6 +342,9 @@ func (a *AWS) GetVersions(state string) (versions []Version, err error) {
 		versions = append(versions, Version{
 			ID:           *v.VersionId,
 			LastModified: *v.LastModified,
+			Metadata: map[string]string{
+				"etag": aws_sdk.StringValue(v.ETag),
+			},
 		})
 	}
 
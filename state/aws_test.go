@@ -1,3 +1,192 @@
 package state
 
-// TODO: tests for the AWS features of the state package
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	aws_sdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/camptocamp/terraboard/config"
+)
+
+// fakeSTS issues credentials valid for the given duration,
+// numbered by call
+type fakeSTS struct {
+	validity time.Duration
+	calls    int
+	input    *sts.AssumeRoleInput
+}
+
+func (f *fakeSTS) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	f.calls++
+	f.input = input
+	return &sts.AssumeRoleOutput{
+		Credentials: &sts.Credentials{
+			AccessKeyId:     aws_sdk.String(fmt.Sprintf("key-%d", f.calls)),
+			SecretAccessKey: aws_sdk.String("secret"),
+			SessionToken:    aws_sdk.String("token"),
+			Expiration:      aws_sdk.Time(time.Now().Add(f.validity)),
+		},
+	}, nil
+}
+
+func TestRoleToAssume(t *testing.T) {
+	aws := config.AWSConfig{
+		APPRoleArn: "arn:aws:iam::111111111111:role/terraboard",
+		ExternalID: "provider",
+		S3: []config.S3BucketConfig{
+			{Bucket: "states-a", RoleArn: "arn:aws:iam::222222222222:role/terraboard", ExternalID: "account-a"},
+			{Bucket: "states-b", RoleArn: "arn:aws:iam::333333333333:role/terraboard"},
+			{Bucket: "states-c"},
+		},
+	}
+	expected := [][2]string{
+		{"arn:aws:iam::222222222222:role/terraboard", "account-a"},
+		{"arn:aws:iam::333333333333:role/terraboard", ""},
+		{"arn:aws:iam::111111111111:role/terraboard", "provider"},
+	}
+	for i, bucket := range aws.S3 {
+		if roleArn, externalID := roleToAssume(aws, bucket); roleArn != expected[i][0] || externalID != expected[i][1] {
+			t.Fatalf("Expected %v for %s, got [%s %s]", expected[i], bucket.Bucket, roleArn, externalID)
+		}
+	}
+
+	if roleArn, _ := roleToAssume(config.AWSConfig{}, config.S3BucketConfig{Bucket: "states"}); roleArn != "" {
+		t.Fatalf("Expected no role, got %s", roleArn)
+	}
+}
+
+func TestAssumeRoleCredentials(t *testing.T) {
+	client := &fakeSTS{validity: time.Hour}
+	creds := newAssumeRoleCredentials(client, "arn:aws:iam::222222222222:role/terraboard", "account-a")
+
+	for i := 0; i < 2; i++ {
+		v, err := creds.Get()
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if v.AccessKeyID != "key-1" {
+			t.Fatalf("Expected key-1, got %s", v.AccessKeyID)
+		}
+	}
+	if client.calls != 1 {
+		t.Fatalf("Expected the role to be assumed once, got %d", client.calls)
+	}
+	if arn := aws_sdk.StringValue(client.input.RoleArn); arn != "arn:aws:iam::222222222222:role/terraboard" {
+		t.Fatalf("Expected the bucket role to be assumed, got %s", arn)
+	}
+	if id := aws_sdk.StringValue(client.input.ExternalId); id != "account-a" {
+		t.Fatalf("Expected account-a, got %s", id)
+	}
+}
+
+func TestAssumeRoleCredentials_RefreshNearExpiry(t *testing.T) {
+	// The credentials expire within the expiry window
+	client := &fakeSTS{validity: assumeRoleExpiryWindow - time.Minute}
+	creds := newAssumeRoleCredentials(client, "arn:aws:iam::222222222222:role/terraboard", "")
+
+	for i := 1; i <= 2; i++ {
+		v, err := creds.Get()
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if expected := fmt.Sprintf("key-%d", i); v.AccessKeyID != expected {
+			t.Fatalf("Expected %s, got %s", expected, v.AccessKeyID)
+		}
+	}
+	if client.calls != 2 {
+		t.Fatalf("Expected the role to be assumed again before expiry, got %d calls", client.calls)
+	}
+	if client.input.ExternalId != nil {
+		t.Fatalf("Expected no external ID, got %s", *client.input.ExternalId)
+	}
+}
+
+// fakeDynamoDB serves the lock table of a DynamoDB endpoint, one item
+// per page, recording the deleted keys
+type fakeDynamoDB struct {
+	items   []map[string]string
+	scans   int
+	deleted []string
+}
+
+func (f *fakeDynamoDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ExclusiveStartKey map[string]map[string]string
+		Key               map[string]map[string]string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+
+	switch r.Header.Get("X-Amz-Target") {
+	case "DynamoDB_20120810.Scan":
+		f.scans++
+		i := 0
+		if start := input.ExclusiveStartKey["LockID"]["S"]; start != "" {
+			for i < len(f.items) && f.items[i]["LockID"] != start {
+				i++
+			}
+			i++
+		}
+		output := map[string]interface{}{"Items": []interface{}{}, "Count": 0}
+		if i < len(f.items) {
+			item := map[string]interface{}{}
+			for k, v := range f.items[i] {
+				item[k] = map[string]string{"S": v}
+			}
+			output["Items"] = []interface{}{item}
+			output["Count"] = 1
+			if i < len(f.items)-1 {
+				output["LastEvaluatedKey"] = map[string]interface{}{"LockID": map[string]string{"S": f.items[i]["LockID"]}}
+			}
+		}
+		json.NewEncoder(w).Encode(output)
+	case "DynamoDB_20120810.DeleteItem":
+		f.deleted = append(f.deleted, input.Key["LockID"]["S"])
+		w.Write([]byte("{}"))
+	default:
+		http.Error(w, "unexpected operation", http.StatusBadRequest)
+	}
+}
+
+func TestAWS_Unlock(t *testing.T) {
+	dynamo := &fakeDynamoDB{items: []map[string]string{
+		{"LockID": "states/network.tfstate-md5", "Digest": "abc"},
+		{"LockID": "states/network.tfstate", "Info": `{"ID":"network-lock","Path":"states/network.tfstate"}`},
+		{"LockID": "states/app.tfstate", "Info": `{"ID":"app-lock","Path":"states/app.tfstate"}`},
+	}}
+	server := httptest.NewServer(dynamo)
+	defer server.Close()
+
+	sess := session.Must(session.NewSession(aws_sdk.NewConfig().
+		WithEndpoint(server.URL).
+		WithRegion("eu-west-1").
+		WithCredentials(credentials.NewStaticCredentials("key", "secret", ""))))
+	a := &AWS{dynamoSvc: dynamodb.New(sess), dynamoTable: "locks"}
+
+	// The lock is on the last page of the table
+	if err := a.Unlock("app-lock"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(dynamo.deleted, []string{"states/app.tfstate"}) {
+		t.Fatalf("Expected %v, got %v", []string{"states/app.tfstate"}, dynamo.deleted)
+	}
+	if dynamo.scans != 3 {
+		t.Fatalf("Expected 3 scanned pages, got %d", dynamo.scans)
+	}
+
+	if err := a.Unlock("unknown"); err != ErrLockNotFound {
+		t.Fatalf("Expected %v, got %v", ErrLockNotFound, err)
+	}
+}
@@ -0,0 +1,428 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/camptocamp/terraboard/config"
+	"github.com/camptocamp/terraboard/internal/terraform/states/statefile"
+	log "github.com/sirupsen/logrus"
+)
+
+// azureLockMetadata is the metadata key the azurerm backend stores
+// the base64-encoded lock information of a leased state blob in
+const azureLockMetadata = "terraformlockid"
+
+// azureStorageResource is the resource managed identity tokens are requested for
+const azureStorageResource = "https://storage.azure.com/"
+
+// azureTokenRefreshWindow is the time before their expiry managed identity
+// tokens are renewed within, the default refresh window of adal tokens
+const azureTokenRefreshWindow = 5 * time.Minute
+
+// azureTokenRetryDelay is the delay after which the refresh
+// of a managed identity token is attempted again
+const azureTokenRetryDelay = time.Minute
+
+// azureBlob is a blob, or a version of a blob, of a container
+type azureBlob struct {
+	Name         string
+	VersionID    string
+	LastModified time.Time
+	Metadata     map[string]string
+}
+
+// azureBlobClient is the subset of the Blob service used by the Azure provider
+type azureBlobClient interface {
+	ListBlobs(prefix string, versions bool) ([]azureBlob, error)
+	GetBlob(name, versionID string) (io.ReadCloser, error)
+	BreakLease(name string) error
+	SetMetadata(name string, metadata map[string]string) error
+}
+
+// Azure is a state provider type, leveraging Azure Blob Storage
+type Azure struct {
+	client         azureBlobClient
+	account        string
+	container      string
+	keyPrefix      string
+	fileExtension  []string
+	includeBackups bool
+}
+
+// NewAzure creates an Azure object
+func NewAzure(az config.AzureConfig, includeBackups bool) (*Azure, error) {
+	if az.StorageAccount == "" {
+		return nil, nil
+	}
+
+	client, err := newAzureSDKClient(az)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Azure{
+		client:         client,
+		account:        az.StorageAccount,
+		container:      az.Container,
+		keyPrefix:      az.KeyPrefix,
+		fileExtension:  az.FileExtension,
+		includeBackups: includeBackups,
+	}, nil
+}
+
+// NewAzureCollection instantiate all needed Azure objects configurated by the user and return a slice
+func NewAzureCollection(c *config.Config) ([]*Azure, error) {
+	var azureInstances []*Azure
+	for _, az := range c.Azure {
+		azureInstance, err := NewAzure(az, c.Provider.IncludeBackups)
+		if err != nil {
+			return nil, err
+		}
+		if azureInstance != nil {
+			azureInstances = append(azureInstances, azureInstance)
+		}
+	}
+
+	return azureInstances, nil
+}
+
+// Name returns the Azure provider identifier
+func (a *Azure) Name() string {
+	return fmt.Sprintf("azure:%s/%s", a.account, a.container)
+}
+
+// isStateBlob returns whether a blob name is a state file to ingest
+func (a *Azure) isStateBlob(name string) bool {
+	for _, ext := range a.fileExtension {
+		if strings.HasSuffix(name, ext) ||
+			(a.includeBackups && strings.HasSuffix(name, ext+backupSuffix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetLocks returns a map of locks by State path.
+// The azurerm backend locks a state by leasing its blob and storing
+// the lock information in the blob metadata.
+func (a *Azure) GetLocks() (locks map[string]LockInfo, err error) {
+	blobs, err := a.client.ListBlobs(a.keyPrefix, false)
+	if err != nil {
+		return nil, err
+	}
+
+	locks = make(map[string]LockInfo)
+	for _, blob := range blobs {
+		info, ok, err := azureLockInfo(blob)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			locks[blob.Name] = info
+		}
+	}
+	return
+}
+
+// azureLockInfo decodes the lock information of a blob, if it is locked
+func azureLockInfo(blob azureBlob) (info LockInfo, ok bool, err error) {
+	encoded := blob.Metadata[azureLockMetadata]
+	if encoded == "" {
+		return
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return info, false, fmt.Errorf("failed to decode lock of %s: %v", blob.Name, err)
+	}
+	if err = json.Unmarshal(data, &info); err != nil {
+		return info, false, fmt.Errorf("failed to decode lock of %s: %v", blob.Name, err)
+	}
+	return info, true, nil
+}
+
+// Unlock force-releases a lock by breaking the lease of its blob
+// and removing the lock information from the blob metadata
+func (a *Azure) Unlock(lockID string) error {
+	blobs, err := a.client.ListBlobs(a.keyPrefix, false)
+	if err != nil {
+		return err
+	}
+
+	for _, blob := range blobs {
+		info, ok, err := azureLockInfo(blob)
+		if err != nil {
+			return err
+		}
+		if !ok || info.ID != lockID {
+			continue
+		}
+
+		if err := a.client.BreakLease(blob.Name); err != nil {
+			return err
+		}
+		metadata := make(map[string]string)
+		for k, v := range blob.Metadata {
+			if k != azureLockMetadata {
+				metadata[k] = v
+			}
+		}
+		return a.client.SetMetadata(blob.Name, metadata)
+	}
+
+	return ErrLockNotFound
+}
+
+// GetStates returns a slice of State files in the container
+func (a *Azure) GetStates() (states []string, err error) {
+	blobs, err := a.client.ListBlobs(a.keyPrefix, false)
+	if err != nil {
+		return states, err
+	}
+
+	for _, blob := range blobs {
+		if a.isStateBlob(blob.Name) {
+			states = append(states, blob.Name)
+		}
+	}
+	log.WithFields(log.Fields{
+		"container": a.container,
+		"prefix":    a.keyPrefix,
+		"states":    len(states),
+	}).Debug("Found states from Azure")
+	return states, nil
+}
+
+// GetVersions returns a slice of Version objects.
+// Without blob versioning, the current blob is the only version,
+// identified by the State path.
+func (a *Azure) GetVersions(state string) (versions []Version, err error) {
+	versions = []Version{}
+	blobs, err := a.client.ListBlobs(state, true)
+	if err != nil {
+		return
+	}
+
+	for _, blob := range blobs {
+		if blob.Name != state {
+			continue
+		}
+		id := blob.VersionID
+		if id == "" {
+			id = state
+		}
+		versions = append(versions, Version{
+			ID:           id,
+			LastModified: blob.LastModified,
+		})
+	}
+	return
+}
+
+// GetState retrieves a single State from the container
+func (a *Azure) GetState(st, versionID string) (sf *statefile.File, err error) {
+	raw, err := a.GetStateRaw(st, versionID)
+	if err != nil {
+		return nil, err
+	}
+
+	sf, err = statefile.Read(bytes.NewReader(raw))
+	if sf == nil {
+		return sf, fmt.Errorf("Failed to find state: %v", err)
+	}
+	return
+}
+
+// GetStateRaw retrieves the content of a single State blob from the container
+func (a *Azure) GetStateRaw(st, versionID string) ([]byte, error) {
+	log.WithFields(log.Fields{
+		"path":       st,
+		"version_id": versionID,
+	}).Info("Retrieving state from Azure")
+	if versionID == st {
+		versionID = ""
+	}
+
+	body, err := a.client.GetBlob(st, versionID)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return ioutil.ReadAll(body)
+}
+
+// azureSDKClient is an azureBlobClient using the Azure Storage Blob SDK,
+// authenticated with the Storage Account key or the managed identity
+type azureSDKClient struct {
+	container azblob.ContainerURL
+}
+
+func newAzureSDKClient(az config.AzureConfig) (*azureSDKClient, error) {
+	endpoint := strings.TrimSuffix(az.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", az.StorageAccount)
+	}
+	u, err := url.Parse(endpoint + "/" + az.Container)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Azure endpoint: %v", err)
+	}
+
+	credential, err := azureCredential(az)
+	if err != nil {
+		return nil, err
+	}
+	// Failed fetches are retried by the provider, following its retry policy
+	p := azblob.NewPipeline(credential, azblob.PipelineOptions{
+		Retry: azblob.RetryOptions{MaxTries: 1},
+	})
+	return &azureSDKClient{container: azblob.NewContainerURL(*u, p)}, nil
+}
+
+// azureCredential returns the Shared Key credential of the Storage Account
+// access key or, without one, a token credential of the managed identity
+func azureCredential(az config.AzureConfig) (azblob.Credential, error) {
+	if az.AccessKey != "" {
+		credential, err := azblob.NewSharedKeyCredential(az.StorageAccount, az.AccessKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Azure access key: %v", err)
+		}
+		return credential, nil
+	}
+
+	log.WithFields(log.Fields{
+		"account": az.StorageAccount,
+	}).Info("Authenticating to Azure using the managed identity")
+	msiEndpoint, err := adal.GetMSIVMEndpoint()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get managed identity endpoint: %v", err)
+	}
+	spt, err := adal.NewServicePrincipalTokenFromMSI(msiEndpoint, azureStorageResource)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get managed identity token: %v", err)
+	}
+	if err := spt.Refresh(); err != nil {
+		return nil, fmt.Errorf("failed to get managed identity token: %v", err)
+	}
+	return azblob.NewTokenCredential(spt.Token().AccessToken, azureTokenRefresher(spt)), nil
+}
+
+// refreshableToken is the managed identity token refreshed by the credential
+type refreshableToken interface {
+	EnsureFresh() error
+	Token() adal.Token
+}
+
+// azureTokenRefresher renews the token of a credential when it is about
+// to expire, and schedules the next renewal shortly before its expiry
+func azureTokenRefresher(token refreshableToken) azblob.TokenRefresher {
+	return func(credential azblob.TokenCredential) time.Duration {
+		if err := token.EnsureFresh(); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to refresh the managed identity token")
+			return azureTokenRetryDelay
+		}
+		t := token.Token()
+		credential.SetToken(t.AccessToken)
+
+		// The token is renewed when it expires within the refresh window
+		next := time.Until(t.Expires()) - azureTokenRefreshWindow
+		if next < azureTokenRetryDelay {
+			next = azureTokenRetryDelay
+		}
+		return next
+	}
+}
+
+// azureError returns the failures of Blob service requests as
+// httpStatusErrors, for them to be retried based on their status
+func azureError(err error) error {
+	var storageErr azblob.StorageError
+	if errors.As(err, &storageErr) && storageErr.Response() != nil {
+		return &httpStatusError{
+			status:  storageErr.Response().StatusCode,
+			message: fmt.Sprintf("azure blob request failed: %v", err),
+		}
+	}
+	return err
+}
+
+// ListBlobs lists the blobs of the container starting with a prefix,
+// along with their metadata and, if requested, all their versions
+func (c *azureSDKClient) ListBlobs(prefix string, versions bool) (blobs []azureBlob, err error) {
+	options := azblob.ListBlobsSegmentOptions{
+		Prefix: prefix,
+		Details: azblob.BlobListingDetails{
+			Metadata: true,
+			Versions: versions,
+		},
+	}
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		resp, err := c.container.ListBlobsFlatSegment(context.Background(), marker, options)
+		if err != nil {
+			return nil, azureError(err)
+		}
+
+		for _, b := range resp.Segment.BlobItems {
+			blob := azureBlob{
+				Name:         b.Name,
+				LastModified: b.Properties.LastModified.UTC(),
+				Metadata:     make(map[string]string),
+			}
+			if b.VersionID != nil {
+				blob.VersionID = *b.VersionID
+			}
+			for k, v := range b.Metadata {
+				blob.Metadata[strings.ToLower(k)] = v
+			}
+			blobs = append(blobs, blob)
+		}
+		marker = resp.NextMarker
+	}
+	return blobs, nil
+}
+
+// GetBlob returns the content of a blob, or of one of its versions
+func (c *azureSDKClient) GetBlob(name, versionID string) (io.ReadCloser, error) {
+	blob := c.container.NewBlobURL(name)
+	if versionID != "" {
+		blob = blob.WithVersionID(versionID)
+	}
+	resp, err := blob.Download(context.Background(), 0, azblob.CountToEnd,
+		azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, azureError(err)
+	}
+	return resp.Body(azblob.RetryReaderOptions{}), nil
+}
+
+// BreakLease immediately breaks the lease of a blob, if any
+func (c *azureSDKClient) BreakLease(name string) error {
+	_, err := c.container.NewBlobURL(name).BreakLease(context.Background(), 0, azblob.ModifiedAccessConditions{})
+	var storageErr azblob.StorageError
+	if errors.As(err, &storageErr) && storageErr.ServiceCode() == azblob.ServiceCodeLeaseNotPresentWithLeaseOperation {
+		// The blob is not leased
+		return nil
+	}
+	return azureError(err)
+}
+
+// SetMetadata replaces the metadata of a blob
+func (c *azureSDKClient) SetMetadata(name string, metadata map[string]string) error {
+	_, err := c.container.NewBlobURL(name).SetMetadata(context.Background(), azblob.Metadata(metadata),
+		azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	return azureError(err)
+}
@@ -0,0 +1,319 @@
+package state
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/camptocamp/terraboard/config"
+)
+
+const fakeAzureState = `{
+  "version": 4,
+  "terraform_version": "1.0.2",
+  "serial": 3,
+  "lineage": "azure-lineage",
+  "outputs": {},
+  "resources": []
+}`
+
+// fakeBlobClient is an in-memory azureBlobClient
+type fakeBlobClient struct {
+	blobs       []azureBlob
+	contents    map[string]string
+	brokenLease []string
+}
+
+func (f *fakeBlobClient) ListBlobs(prefix string, versions bool) (blobs []azureBlob, err error) {
+	for _, b := range f.blobs {
+		if !strings.HasPrefix(b.Name, prefix) || (!versions && b.VersionID != "" && b.VersionID != "current") {
+			continue
+		}
+		blobs = append(blobs, b)
+	}
+	return
+}
+
+func (f *fakeBlobClient) GetBlob(name, versionID string) (io.ReadCloser, error) {
+	content, ok := f.contents[name+"@"+versionID]
+	if !ok {
+		return nil, fmt.Errorf("blob %s@%s not found", name, versionID)
+	}
+	return ioutil.NopCloser(strings.NewReader(content)), nil
+}
+
+func (f *fakeBlobClient) BreakLease(name string) error {
+	f.brokenLease = append(f.brokenLease, name)
+	return nil
+}
+
+func (f *fakeBlobClient) SetMetadata(name string, metadata map[string]string) error {
+	for i, b := range f.blobs {
+		if b.Name == name {
+			f.blobs[i].Metadata = metadata
+		}
+	}
+	return nil
+}
+
+func newFakeAzure() (*Azure, *fakeBlobClient) {
+	lock := base64.StdEncoding.EncodeToString([]byte(`{"ID":"fakeLockID","Operation":"OperationTypeApply","Who":"foo@bar","Path":"tfstate/prod.tfstate"}`))
+	modified := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	client := &fakeBlobClient{
+		blobs: []azureBlob{
+			{Name: "dev.tfstate", LastModified: modified, Metadata: map[string]string{}},
+			{Name: "prod.tfstate", VersionID: "v1", LastModified: modified},
+			{Name: "prod.tfstate", VersionID: "current", LastModified: modified.Add(time.Hour), Metadata: map[string]string{azureLockMetadata: lock, "owner": "ops"}},
+			{Name: "prod.tfstate.backup", LastModified: modified},
+			{Name: "README.md", LastModified: modified},
+		},
+		contents: map[string]string{
+			"dev.tfstate@":    fakeAzureState,
+			"prod.tfstate@v1": fakeAzureState,
+		},
+	}
+	return &Azure{
+		client:        client,
+		account:       "myaccount",
+		container:     "tfstate",
+		fileExtension: []string{".tfstate"},
+	}, client
+}
+
+func TestAzure_GetStates(t *testing.T) {
+	a, _ := newFakeAzure()
+	states, err := a.GetStates()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []string{"dev.tfstate", "prod.tfstate"}
+	if !reflect.DeepEqual(states, expected) {
+		t.Fatalf("Expected %v, got %v", expected, states)
+	}
+}
+
+func TestAzure_GetVersions(t *testing.T) {
+	a, _ := newFakeAzure()
+
+	versions, err := a.GetVersions("prod.tfstate")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(versions) != 2 || versions[0].ID != "v1" || versions[1].ID != "current" {
+		t.Fatalf("Expected versions v1 and current, got %v", versions)
+	}
+
+	// Without blob versioning, the State path identifies its only version
+	versions, err = a.GetVersions("dev.tfstate")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(versions) != 1 || versions[0].ID != "dev.tfstate" {
+		t.Fatalf("Expected a single dev.tfstate version, got %v", versions)
+	}
+}
+
+func TestAzure_GetState(t *testing.T) {
+	a, _ := newFakeAzure()
+
+	for _, tc := range []struct{ path, versionID string }{
+		{"prod.tfstate", "v1"},
+		{"dev.tfstate", "dev.tfstate"},
+	} {
+		sf, err := a.GetState(tc.path, tc.versionID)
+		if err != nil {
+			t.Fatalf("Expected no error for %s, got %v", tc.path, err)
+		}
+		if sf.Lineage != "azure-lineage" || sf.Serial != 3 {
+			t.Fatalf("Expected the azure-lineage state at serial 3, got %s at %d", sf.Lineage, sf.Serial)
+		}
+	}
+
+	if _, err := a.GetState("prod.tfstate", "unknown"); err == nil {
+		t.Fatalf("Expected an error for an unknown version")
+	}
+}
+
+func TestAzure_GetLocks(t *testing.T) {
+	a, _ := newFakeAzure()
+	locks, err := a.GetLocks()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := map[string]LockInfo{
+		"prod.tfstate": {
+			ID:        "fakeLockID",
+			Operation: "OperationTypeApply",
+			Who:       "foo@bar",
+			Path:      "tfstate/prod.tfstate",
+		},
+	}
+	if !reflect.DeepEqual(locks, expected) {
+		t.Fatalf("Expected %v, got %v", expected, locks)
+	}
+}
+
+func TestAzure_Unlock(t *testing.T) {
+	a, client := newFakeAzure()
+
+	if err := a.Unlock("unknown"); err != ErrLockNotFound {
+		t.Fatalf("Expected %v, got %v", ErrLockNotFound, err)
+	}
+	if err := a.Unlock("fakeLockID"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if !reflect.DeepEqual(client.brokenLease, []string{"prod.tfstate"}) {
+		t.Fatalf("Expected the prod.tfstate lease to be broken, got %v", client.brokenLease)
+	}
+	if locks, _ := a.GetLocks(); len(locks) != 0 {
+		t.Fatalf("Expected no lock left, got %v", locks)
+	}
+	if owner := client.blobs[2].Metadata["owner"]; owner != "ops" {
+		t.Fatalf("Expected other metadata to be kept, got %v", client.blobs[2].Metadata)
+	}
+}
+
+func TestAzureSDKClient_ListBlobs(t *testing.T) {
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		if r.URL.Path != "/tfstate" || r.URL.Query().Get("comp") != "list" {
+			t.Errorf("Unexpected request %s", r.URL)
+		}
+		fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?>
+<EnumerationResults ServiceEndpoint="https://myaccount.blob.core.windows.net/" ContainerName="tfstate">
+  <Blobs>
+    <Blob>
+      <Name>prod.tfstate</Name>
+      <VersionId>2021-06-01T12:00:00.0000000Z</VersionId>
+      <Properties><Last-Modified>Tue, 01 Jun 2021 12:00:00 GMT</Last-Modified></Properties>
+      <Metadata><TerraformLockId>abc</TerraformLockId></Metadata>
+    </Blob>
+  </Blobs>
+  <NextMarker />
+</EnumerationResults>`)
+	}))
+	defer srv.Close()
+
+	client, err := newAzureSDKClient(config.AzureConfig{
+		StorageAccount: "myaccount",
+		Container:      "tfstate",
+		AccessKey:      base64.StdEncoding.EncodeToString([]byte("secret")),
+		Endpoint:       srv.URL,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	blobs, err := client.ListBlobs("", true)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := []azureBlob{{
+		Name:         "prod.tfstate",
+		VersionID:    "2021-06-01T12:00:00.0000000Z",
+		LastModified: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+		Metadata:     map[string]string{azureLockMetadata: "abc"},
+	}}
+	if !reflect.DeepEqual(blobs, expected) {
+		t.Fatalf("Expected %v, got %v", expected, blobs)
+	}
+	if !strings.HasPrefix(auth, "SharedKey myaccount:") {
+		t.Fatalf("Expected a Shared Key authorization, got %v", auth)
+	}
+}
+
+func TestAzureSDKClient_Errors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, status := "BlobNotFound", http.StatusNotFound
+		if r.URL.Query().Get("comp") == "lease" {
+			code, status = "LeaseNotPresentWithLeaseOperation", http.StatusConflict
+		}
+		w.Header().Set("x-ms-error-code", code)
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?><Error><Code>%s</Code><Message>Failed</Message></Error>`, code)
+	}))
+	defer srv.Close()
+
+	client, err := newAzureSDKClient(config.AzureConfig{
+		StorageAccount: "myaccount",
+		Container:      "tfstate",
+		AccessKey:      base64.StdEncoding.EncodeToString([]byte("secret")),
+		Endpoint:       srv.URL,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Breaking the lease of a blob which is not leased is a no-op
+	if err := client.BreakLease("prod.tfstate"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Failures are reported with their status, a missing blob not being retried
+	_, err = client.GetBlob("prod.tfstate", "v1")
+	var sc statusCoder
+	if !errors.As(err, &sc) || sc.StatusCode() != http.StatusNotFound {
+		t.Fatalf("Expected a %d error, got %v", http.StatusNotFound, err)
+	}
+	if IsRetryableError(err) {
+		t.Fatalf("Expected %v not to be retried", err)
+	}
+}
+
+// fakeToken is a managed identity token expiring at a given time
+type fakeToken struct {
+	err       error
+	refreshes int
+	expiresOn time.Time
+}
+
+func (f *fakeToken) EnsureFresh() error {
+	f.refreshes++
+	return f.err
+}
+
+func (f *fakeToken) Token() adal.Token {
+	return adal.Token{
+		AccessToken: fmt.Sprintf("token-%d", f.refreshes),
+		ExpiresOn:   json.Number(strconv.FormatInt(f.expiresOn.Unix(), 10)),
+	}
+}
+
+func TestAzureTokenRefresher(t *testing.T) {
+	token := &fakeToken{expiresOn: time.Now().Add(time.Hour)}
+	credential := azblob.NewTokenCredential("initial", nil)
+	refresh := azureTokenRefresher(token)
+
+	// The token is renewed before it expires
+	next := refresh(credential)
+	if credential.Token() != "token-1" {
+		t.Fatalf("Expected %s, got %s", "token-1", credential.Token())
+	}
+	if next < 50*time.Minute || next > 55*time.Minute {
+		t.Fatalf("Expected the next refresh within 55 minutes, got %v", next)
+	}
+
+	// Failed refreshes are attempted again, keeping the current token
+	token.err = errors.New("metadata endpoint unavailable")
+	if next := refresh(credential); next != azureTokenRetryDelay {
+		t.Fatalf("Expected %v, got %v", azureTokenRetryDelay, next)
+	}
+	if credential.Token() != "token-1" {
+		t.Fatalf("Expected %s, got %s", "token-1", credential.Token())
+	}
+}
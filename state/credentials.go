@@ -0,0 +1,156 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/camptocamp/terraboard/internal/terraform/states/statefile"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+// ErrExpiredCredentials can be wrapped by providers to signal
+// that their credentials expired
+var ErrExpiredCredentials = errors.New("provider credentials expired")
+
+// IsExpiredCredentialsError returns true if the error signals expired
+// provider credentials (expired STS session, revoked OAuth token, ...)
+func IsExpiredCredentialsError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrExpiredCredentials) {
+		return true
+	}
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case "ExpiredToken", "ExpiredTokenException", "RequestExpired", "TokenRefreshRequired":
+			return true
+		}
+	}
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) && gErr.Code == http.StatusUnauthorized {
+		return true
+	}
+	return false
+}
+
+// CredentialsRefresher is implemented by providers able to
+// rebuild their clients with fresh credentials
+type CredentialsRefresher interface {
+	RefreshCredentials() error
+}
+
+// RefreshingProvider wraps a Provider, refreshing its credentials
+// and retrying a call once when it fails with expired credentials
+type RefreshingProvider struct {
+	mu         sync.RWMutex
+	provider   Provider
+	refresher  CredentialsRefresher
+	generation int
+}
+
+// NewRefreshingProvider wraps a Provider with credentials refresh,
+// providers unable to refresh their credentials being returned as is
+func NewRefreshingProvider(p Provider) Provider {
+	refresher, ok := p.(CredentialsRefresher)
+	if !ok {
+		return p
+	}
+	return &RefreshingProvider{
+		provider:  p,
+		refresher: refresher,
+	}
+}
+
+// do runs a call on the provider. Calls run concurrently, while
+// the credentials are refreshed only once for calls failing together.
+func (r *RefreshingProvider) do(call func(p Provider) error) error {
+	r.mu.RLock()
+	generation := r.generation
+	err := call(r.provider)
+	r.mu.RUnlock()
+	if !IsExpiredCredentialsError(err) {
+		return err
+	}
+
+	r.mu.Lock()
+	if r.generation == generation {
+		log.WithFields(log.Fields{
+			"provider": r.provider.Name(),
+			"error":    err,
+		}).Warn("Provider credentials expired, refreshing them")
+		if rerr := r.refresher.RefreshCredentials(); rerr != nil {
+			r.mu.Unlock()
+			return fmt.Errorf("failed to refresh credentials of %s: %v (after %w)", r.provider.Name(), rerr, err)
+		}
+		r.generation++
+	}
+	r.mu.Unlock()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return call(r.provider)
+}
+
+// Name returns the identifier of the wrapped provider
+func (r *RefreshingProvider) Name() string {
+	return r.provider.Name()
+}
+
+// GetLocks returns a map of locks by State path
+func (r *RefreshingProvider) GetLocks() (locks map[string]LockInfo, err error) {
+	err = r.do(func(p Provider) (err error) {
+		locks, err = p.GetLocks()
+		return
+	})
+	return
+}
+
+// GetVersions returns a slice of Version objects
+func (r *RefreshingProvider) GetVersions(state string) (versions []Version, err error) {
+	err = r.do(func(p Provider) (err error) {
+		versions, err = p.GetVersions(state)
+		return
+	})
+	return
+}
+
+// GetStates returns a slice of State files
+func (r *RefreshingProvider) GetStates() (states []string, err error) {
+	err = r.do(func(p Provider) (err error) {
+		states, err = p.GetStates()
+		return
+	})
+	return
+}
+
+// Unlock force-releases a lock
+func (r *RefreshingProvider) Unlock(lockID string) error {
+	return r.do(func(p Provider) error {
+		return p.Unlock(lockID)
+	})
+}
+
+// GetState retrieves a single State
+func (r *RefreshingProvider) GetState(st, versionID string) (sf *statefile.File, err error) {
+	err = r.do(func(p Provider) (err error) {
+		sf, err = p.GetState(st, versionID)
+		return
+	})
+	return
+}
+
+// GetStateRaw retrieves the raw content of a single State
+func (r *RefreshingProvider) GetStateRaw(st, versionID string) (raw []byte, err error) {
+	err = r.do(func(p Provider) (err error) {
+		raw, err = p.GetStateRaw(st, versionID)
+		return
+	})
+	return
+}
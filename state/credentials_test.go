@@ -0,0 +1,77 @@
+package state
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/camptocamp/terraboard/internal/terraform/states/statefile"
+)
+
+func TestIsExpiredCredentialsError(t *testing.T) {
+	expired := []error{
+		ErrExpiredCredentials,
+		fmt.Errorf("failed to list states: %w", ErrExpiredCredentials),
+		awserr.New("ExpiredToken", "The security token included in the request is expired", nil),
+	}
+	for _, err := range expired {
+		if !IsExpiredCredentialsError(err) {
+			t.Fatalf("Expected %v to be an expired credentials error", err)
+		}
+	}
+
+	for _, err := range []error{nil, fmt.Errorf("access denied"), awserr.New("SlowDown", "", nil)} {
+		if IsExpiredCredentialsError(err) {
+			t.Fatalf("Expected %v not to be an expired credentials error", err)
+		}
+	}
+}
+
+// expiringProvider fails its calls with expired credentials until refreshed
+type expiringProvider struct {
+	expired   bool
+	refreshed int
+	calls     int
+}
+
+func (p *expiringProvider) Name() string { return "fake" }
+
+func (p *expiringProvider) RefreshCredentials() error {
+	p.expired = false
+	p.refreshed++
+	return nil
+}
+
+func (p *expiringProvider) GetStates() ([]string, error) {
+	p.calls++
+	if p.expired {
+		return nil, ErrExpiredCredentials
+	}
+	return []string{"terraform.tfstate"}, nil
+}
+
+func (p *expiringProvider) GetLocks() (map[string]LockInfo, error)           { return nil, nil }
+func (p *expiringProvider) GetVersions(string) ([]Version, error)            { return nil, nil }
+func (p *expiringProvider) Unlock(string) error                              { return nil }
+func (p *expiringProvider) GetState(string, string) (*statefile.File, error) { return nil, nil }
+func (p *expiringProvider) GetStateRaw(string, string) ([]byte, error)       { return nil, nil }
+
+func TestRefreshingProvider_RefreshesExpiredCredentials(t *testing.T) {
+	fake := &expiringProvider{expired: true}
+	p := NewRefreshingProvider(fake)
+
+	states, err := p.GetStates()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(states) != 1 {
+		t.Fatalf("Expected %v states, got %v", 1, len(states))
+	}
+	if fake.refreshed != 1 || fake.calls != 2 {
+		t.Fatalf("Expected 1 refresh and 2 calls, got %v refreshes and %v calls", fake.refreshed, fake.calls)
+	}
+
+	if _, err := p.GetStates(); err != nil || fake.refreshed != 1 {
+		t.Fatalf("Expected no further refresh, got %v refreshes (error: %v)", fake.refreshed, err)
+	}
+}
@@ -1,6 +1,7 @@
 package state
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -19,39 +20,30 @@ import (
 
 // GCP is a state provider type, leveraging GCS
 type GCP struct {
-	svc     *storage.Client
-	buckets []string
+	svc            *storage.Client
+	gcpConfig      config.GCPConfig
+	buckets        []string
+	includeBackups bool
 }
 
 // NewGCP creates an GCP object
-func NewGCP(gcp config.GCPConfig) (*GCP, error) {
-	ctx := context.Background()
-
-	var client *storage.Client
+func NewGCP(gcp config.GCPConfig, includeBackups bool) (*GCP, error) {
 	var gcpInstance *GCP
-	var err error
 	if gcp.GCSBuckets == nil || len(gcp.GCSBuckets) == 0 {
 		return nil, nil
 	}
 
-	if gcp.GCPSAKey != "" {
-		log.WithFields(log.Fields{
-			"path": gcp.GCPSAKey,
-		}).Info("Authenticating using service account key")
-		opt := option.WithCredentialsFile(gcp.GCPSAKey)
-		client, err = storage.NewClient(ctx, opt) // Use service account key
-	} else {
-		client, err = storage.NewClient(ctx) // Use base credentials
-	}
-
+	client, err := newGCSClient(gcp)
 	if err != nil {
 		log.Fatalf("Failed to create client: %v", err)
 		return nil, err
 	}
 
 	gcpInstance = &GCP{
-		svc:     client,
-		buckets: gcp.GCSBuckets,
+		svc:            client,
+		gcpConfig:      gcp,
+		buckets:        gcp.GCSBuckets,
+		includeBackups: includeBackups,
 	}
 
 	log.WithFields(log.Fields{
@@ -61,11 +53,41 @@ func NewGCP(gcp config.GCPConfig) (*GCP, error) {
 	return gcpInstance, nil
 }
 
+// newGCSClient creates a GCS client, authenticated with the service account
+// key when one is configured
+func newGCSClient(gcp config.GCPConfig) (*storage.Client, error) {
+	ctx := context.Background()
+	if gcp.GCPSAKey != "" {
+		log.WithFields(log.Fields{
+			"path": gcp.GCPSAKey,
+		}).Info("Authenticating using service account key")
+		opt := option.WithCredentialsFile(gcp.GCPSAKey)
+		return storage.NewClient(ctx, opt) // Use service account key
+	}
+	return storage.NewClient(ctx) // Use base credentials
+}
+
+// RefreshCredentials recreates the GCS client of the provider,
+// reading its credentials again
+func (a *GCP) RefreshCredentials() error {
+	client, err := newGCSClient(a.gcpConfig)
+	if err != nil {
+		return err
+	}
+	if err := a.svc.Close(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Failed to close previous GCS client")
+	}
+	a.svc = client
+	return nil
+}
+
 // NewGCPCollection instantiate all needed GCP objects configurated by the user and return a slice
 func NewGCPCollection(c *config.Config) ([]*GCP, error) {
 	var gcpInstances []*GCP
 	for _, gcp := range c.GCP {
-		gcpInstance, err := NewGCP(gcp)
+		gcpInstance, err := NewGCP(gcp, c.Provider.IncludeBackups)
 		if err != nil || gcpInstance == nil {
 			return nil, err
 		}
@@ -75,6 +97,11 @@ func NewGCPCollection(c *config.Config) ([]*GCP, error) {
 	return gcpInstances, nil
 }
 
+// Name returns the GCP provider identifier
+func (a *GCP) Name() string {
+	return fmt.Sprintf("gcp:%s", strings.Join(a.buckets, ","))
+}
+
 // GetLocks returns a map of locks by State path
 func (a *GCP) GetLocks() (locks map[string]LockInfo, err error) {
 	ctx := context.Background()
@@ -127,6 +154,50 @@ func (a *GCP) GetLocks() (locks map[string]LockInfo, err error) {
 	return locks, nil
 }
 
+// Unlock force-releases a lock by removing its .tflock file
+func (a *GCP) Unlock(lockID string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*60)
+	defer cancel()
+
+	for _, bucketName := range a.buckets {
+		it := a.svc.Bucket(bucketName).Objects(ctx, nil)
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if !strings.HasSuffix(attrs.Name, ".tflock") {
+				continue
+			}
+
+			obj := a.svc.Bucket(bucketName).Object(attrs.Name)
+			rc, err := obj.NewReader(ctx)
+			if err != nil {
+				return err
+			}
+			data, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+
+			var info LockInfo
+			if err = json.Unmarshal(data, &info); err != nil {
+				return err
+			}
+			if info.ID == lockID {
+				return obj.Delete(ctx)
+			}
+		}
+	}
+
+	return ErrLockNotFound
+}
+
 // GetStates returns a slice of State files in the GCS bucket
 func (a *GCP) GetStates() (states []string, err error) {
 	ctx := context.Background()
@@ -145,7 +216,8 @@ func (a *GCP) GetStates() (states []string, err error) {
 				return nil, err
 			}
 
-			if strings.HasSuffix(attrs.Name, ".tfstate") {
+			if strings.HasSuffix(attrs.Name, ".tfstate") ||
+				(a.includeBackups && strings.HasSuffix(attrs.Name, ".tfstate"+backupSuffix)) {
 				stateFiles = append(stateFiles, strings.Join([]string{bucketName, attrs.Name}, "/"))
 			}
 		}
@@ -156,6 +228,27 @@ func (a *GCP) GetStates() (states []string, err error) {
 
 // GetState retrieves a single State from the GCS bucket
 func (a *GCP) GetState(st, versionID string) (sf *statefile.File, err error) {
+	raw, err := a.GetStateRaw(st, versionID)
+	if err != nil {
+		return sf, err
+	}
+
+	sf, err = statefile.Read(bytes.NewReader(raw))
+
+	if sf == nil {
+		return sf, fmt.Errorf("Failed to find state")
+	}
+
+	log.WithFields(log.Fields{
+		"path":       st,
+		"version_id": versionID,
+	}).Info("State read from GCS")
+
+	return
+}
+
+// GetStateRaw retrieves the content of a single State file from the GCS bucket
+func (a *GCP) GetStateRaw(st, versionID string) ([]byte, error) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, time.Second*60)
 	defer cancel()
@@ -183,22 +276,11 @@ func (a *GCP) GetState(st, versionID string) (sf *statefile.File, err error) {
 		errObj["error"] = fmt.Sprintf("State file not found: %v", st)
 		errObj["details"] = fmt.Sprintf("%v", err)
 		j, _ := json.Marshal(errObj)
-		return sf, fmt.Errorf("%s", string(j))
+		return nil, fmt.Errorf("%s", string(j))
 	}
 	defer rc.Close()
 
-	sf, err = statefile.Read(rc)
-
-	if sf == nil {
-		return sf, fmt.Errorf("Failed to find state")
-	}
-
-	log.WithFields(log.Fields{
-		"path":       st,
-		"version_id": versionID,
-	}).Info("State read from GCS")
-
-	return
+	return ioutil.ReadAll(rc)
 }
 
 // GetVersions returns a slice of Version objects
@@ -232,6 +314,11 @@ func (a *GCP) GetVersions(state string) (versions []Version, err error) {
 			versions = append(versions, Version{
 				ID:           strconv.FormatInt(attrs.Generation, 10),
 				LastModified: tm,
+				Metadata: map[string]string{
+					"generation":     strconv.FormatInt(attrs.Generation, 10),
+					"metageneration": strconv.FormatInt(attrs.Metageneration, 10),
+					"etag":           attrs.Etag,
+				},
 			})
 		}
 	}
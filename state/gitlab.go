@@ -42,6 +42,11 @@ func NewGitlabCollection(c *config.Config) []*Gitlab {
 	return gitlabInstances
 }
 
+// Name returns the Gitlab provider identifier
+func (g *Gitlab) Name() string {
+	return fmt.Sprintf("gitlab:%s", g.Client.Endpoint)
+}
+
 // GetLocks returns a map of locks by State path
 func (g *Gitlab) GetLocks() (locks map[string]LockInfo, err error) {
 	locks = make(map[string]LockInfo)
@@ -70,6 +75,12 @@ func (g *Gitlab) GetLocks() (locks map[string]LockInfo, err error) {
 	return
 }
 
+// Unlock is not supported, as GitLab
+// does not expose the ID of state locks
+func (g *Gitlab) Unlock(lockID string) error {
+	return ErrLockNotFound
+}
+
 // GetStates returns a slice of all found workspaces
 func (g *Gitlab) GetStates() (states []string, err error) {
 	var projects gitlab.Projects
@@ -119,14 +130,8 @@ func (g *Gitlab) GetVersions(state string) (versions []Version, err error) {
 
 // GetState retrieves a single state file from the GitLab API
 func (g *Gitlab) GetState(path, version string) (sf *statefile.File, err error) {
-	re := regexp.MustCompile(`^\[(.*)] (.*)$`)
-	stateInfo := re.FindStringSubmatch(path)
-	if len(stateInfo) != 3 {
-		return nil, fmt.Errorf("invalid state path: %s", path)
-	}
-
 	var state []byte
-	state, err = g.Client.GetState(url.PathEscape(stateInfo[1]), url.PathEscape(stateInfo[2]), version)
+	state, err = g.GetStateRaw(path, version)
 	if err != nil {
 		return
 	}
@@ -139,3 +144,14 @@ func (g *Gitlab) GetState(path, version string) (sf *statefile.File, err error)
 
 	return
 }
+
+// GetStateRaw retrieves the content of a single state file from the GitLab API
+func (g *Gitlab) GetStateRaw(path, version string) ([]byte, error) {
+	re := regexp.MustCompile(`^\[(.*)] (.*)$`)
+	stateInfo := re.FindStringSubmatch(path)
+	if len(stateInfo) != 3 {
+		return nil, fmt.Errorf("invalid state path: %s", path)
+	}
+
+	return g.Client.GetState(url.PathEscape(stateInfo[1]), url.PathEscape(stateInfo[2]), version)
+}
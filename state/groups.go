@@ -0,0 +1,81 @@
+package state
+
+import (
+	"sync"
+	"time"
+
+	"github.com/camptocamp/terraboard/config"
+)
+
+// RegionGroupTag is the key of the tag set on lineages
+// refreshed from a region group
+const RegionGroupTag = "region-group"
+
+// ProviderGroup is a group of providers refreshed concurrently
+// on the same schedule
+type ProviderGroup struct {
+	Name      string
+	Interval  time.Duration
+	Providers []Provider
+}
+
+// GroupProviders splits providers into the configured region groups,
+// matching their names against the group patterns. A provider belongs to
+// the first group matching it, providers without a group each get their
+// own unnamed group refreshed on the default interval.
+func GroupProviders(groups []config.RefreshGroupConfig, providers []Provider, defaultInterval time.Duration) []ProviderGroup {
+	var grouped []ProviderGroup
+	for _, g := range groups {
+		interval := defaultInterval
+		if g.SyncInterval > 0 {
+			interval = time.Duration(g.SyncInterval) * time.Minute
+		}
+		grouped = append(grouped, ProviderGroup{Name: g.Name, Interval: interval})
+	}
+
+	var ungrouped []ProviderGroup
+	for _, sp := range providers {
+		found := false
+		for i, g := range groups {
+			if matchPath(g.Providers, sp.Name()) {
+				grouped[i].Providers = append(grouped[i].Providers, sp)
+				found = true
+				break
+			}
+		}
+		if !found {
+			ungrouped = append(ungrouped, ProviderGroup{Interval: defaultInterval, Providers: []Provider{sp}})
+		}
+	}
+
+	// Groups matching no provider have nothing to refresh
+	var result []ProviderGroup
+	for _, g := range grouped {
+		if len(g.Providers) > 0 {
+			result = append(result, g)
+		}
+	}
+	return append(result, ungrouped...)
+}
+
+// Refresh refreshes all providers of the group concurrently,
+// returning once all of them are refreshed
+func (g ProviderGroup) Refresh(refresh func(sp Provider)) {
+	var wg sync.WaitGroup
+	for _, sp := range g.Providers {
+		wg.Add(1)
+		go func(sp Provider) {
+			defer wg.Done()
+			refresh(sp)
+		}(sp)
+	}
+	wg.Wait()
+}
+
+// Run refreshes the group on its interval, forever
+func (g ProviderGroup) Run(refresh func(sp Provider)) {
+	for {
+		g.Refresh(refresh)
+		time.Sleep(g.Interval)
+	}
+}
@@ -0,0 +1,99 @@
+package state
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/terraboard/config"
+	"github.com/camptocamp/terraboard/internal/terraform/states/statefile"
+)
+
+// namedProvider is a provider without states, identified by its name
+type namedProvider struct {
+	name string
+}
+
+func (p *namedProvider) Name() string                                     { return p.name }
+func (p *namedProvider) GetStates() ([]string, error)                     { return nil, nil }
+func (p *namedProvider) GetLocks() (map[string]LockInfo, error)           { return nil, nil }
+func (p *namedProvider) GetVersions(string) ([]Version, error)            { return nil, nil }
+func (p *namedProvider) Unlock(string) error                              { return nil }
+func (p *namedProvider) GetState(string, string) (*statefile.File, error) { return nil, nil }
+func (p *namedProvider) GetStateRaw(string, string) ([]byte, error)       { return nil, nil }
+
+func TestGroupProviders(t *testing.T) {
+	eu := &namedProvider{name: "aws:eu-states"}
+	us := &namedProvider{name: "aws:us-states"}
+	gitlab := &namedProvider{name: "gitlab"}
+	groups := []config.RefreshGroupConfig{
+		{Name: "eu", Providers: []string{"aws:eu-*"}, SyncInterval: 5},
+		{Name: "us", Providers: []string{"aws:us-*"}},
+		{Name: "ap", Providers: []string{"aws:ap-*"}},
+	}
+
+	grouped := GroupProviders(groups, []Provider{eu, us, gitlab}, time.Minute)
+	if len(grouped) != 3 {
+		t.Fatalf("Expected 3 groups, got %d", len(grouped))
+	}
+	expected := []struct {
+		name     string
+		interval time.Duration
+		provider Provider
+	}{
+		{"eu", 5 * time.Minute, eu},
+		{"us", time.Minute, us},
+		{"", time.Minute, gitlab},
+	}
+	for i, e := range expected {
+		g := grouped[i]
+		if g.Name != e.name || g.Interval != e.interval || len(g.Providers) != 1 || g.Providers[0] != e.provider {
+			t.Fatalf("Expected group %s of %s every %v, got %+v", e.name, e.provider.Name(), e.interval, g)
+		}
+	}
+}
+
+func TestProviderGroup_RefreshesGroupsConcurrently(t *testing.T) {
+	groups := []config.RefreshGroupConfig{
+		{Name: "eu", Providers: []string{"aws:eu-*"}},
+		{Name: "us", Providers: []string{"aws:us-*"}},
+	}
+	providers := []Provider{&namedProvider{name: "aws:eu-states"}, &namedProvider{name: "aws:us-states"}}
+
+	var mu sync.Mutex
+	tags := make(map[string]string)
+	started := make(chan struct{}, len(providers))
+	release := make(chan struct{})
+	for _, g := range GroupProviders(groups, providers, time.Hour) {
+		g := g
+		go g.Run(func(sp Provider) {
+			mu.Lock()
+			tags[sp.Name()] = RegionGroupTag + "=" + g.Name
+			mu.Unlock()
+			started <- struct{}{}
+			// Blocks until both groups are being refreshed
+			<-release
+		})
+	}
+
+	for range providers {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the groups to be refreshed concurrently")
+		}
+	}
+	close(release)
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := map[string]string{
+		"aws:eu-states": "region-group=eu",
+		"aws:us-states": "region-group=us",
+	}
+	for name, tag := range expected {
+		if tags[name] != tag {
+			t.Fatalf("Expected %s to be tagged %s, got %s", name, tag, tags[name])
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package state
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/camptocamp/terraboard/config"
+	"github.com/camptocamp/terraboard/internal/terraform/states/statefile"
+	log "github.com/sirupsen/logrus"
+)
+
+// httpUnlockMethod is the method the http backend releases locks with
+const httpUnlockMethod = "UNLOCK"
+
+// httpState is a State served by the http backend, with its lock URL
+type httpState struct {
+	url     string
+	lockURL string
+}
+
+// HTTP is a state provider type, reading States from servers
+// of the Terraform http backend
+type HTTP struct {
+	client   *http.Client
+	host     string
+	paths    []string
+	states   map[string]httpState
+	username string
+	password string
+	token    string
+}
+
+// NewHTTP creates an HTTP object
+func NewHTTP(h config.HTTPConfig) (*HTTP, error) {
+	if len(h.StateURLs) == 0 {
+		return nil, nil
+	}
+	if len(h.LockURLs) > len(h.StateURLs) {
+		return nil, fmt.Errorf("more http lock URLs (%d) than state URLs (%d)", len(h.LockURLs), len(h.StateURLs))
+	}
+
+	provider := &HTTP{
+		client:   &http.Client{Timeout: 60 * time.Second},
+		states:   make(map[string]httpState),
+		username: h.Username,
+		password: h.Password,
+		token:    h.Token,
+	}
+	for i, stateURL := range h.StateURLs {
+		u, err := url.Parse(stateURL)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid http state URL '%s'", stateURL)
+		}
+		if provider.host == "" {
+			provider.host = u.Host
+		}
+
+		st := httpState{url: stateURL}
+		if i < len(h.LockURLs) {
+			st.lockURL = h.LockURLs[i]
+		}
+		path := u.Host + u.Path
+		provider.paths = append(provider.paths, path)
+		provider.states[path] = st
+	}
+	return provider, nil
+}
+
+// NewHTTPCollection instantiate all needed HTTP objects configurated by the user and return a slice
+func NewHTTPCollection(c *config.Config) ([]*HTTP, error) {
+	var httpInstances []*HTTP
+	for _, h := range c.HTTP {
+		httpInstance, err := NewHTTP(h)
+		if err != nil {
+			return nil, err
+		}
+		if httpInstance != nil {
+			httpInstances = append(httpInstances, httpInstance)
+		}
+	}
+
+	return httpInstances, nil
+}
+
+// Name returns the HTTP provider identifier
+func (h *HTTP) Name() string {
+	return fmt.Sprintf("http:%s", h.host)
+}
+
+// do sends an authenticated request to the http backend,
+// using the bearer token over the basic authentication
+func (h *HTTP) do(method, address string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, address, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	} else if h.username != "" {
+		req.SetBasicAuth(h.username, h.password)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp, &httpStatusError{
+			status:  resp.StatusCode,
+			message: fmt.Sprintf("http backend request failed (%s): %s", resp.Status, strings.TrimSpace(string(msg))),
+		}
+	}
+	return resp, nil
+}
+
+// lockInfo returns the lock information served on the lock URL of a State,
+// if it is locked. Servers answer with no content or a 404 when unlocked.
+func (h *HTTP) lockInfo(path string, st httpState) (info LockInfo, ok bool, err error) {
+	if st.lockURL == "" {
+		return
+	}
+
+	resp, err := h.do(http.MethodGet, st.lockURL, nil)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			err = nil
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil || len(bytes.TrimSpace(data)) == 0 {
+		return
+	}
+	if err = json.Unmarshal(data, &info); err != nil {
+		return info, false, fmt.Errorf("failed to decode lock of %s: %v", path, err)
+	}
+	if info.ID == "" {
+		return info, false, nil
+	}
+	if info.Path == "" {
+		info.Path = path
+	}
+	return info, true, nil
+}
+
+// GetLocks returns a map of locks by State path
+func (h *HTTP) GetLocks() (locks map[string]LockInfo, err error) {
+	locks = make(map[string]LockInfo)
+	for _, path := range h.paths {
+		info, ok, err := h.lockInfo(path, h.states[path])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			locks[path] = info
+		}
+	}
+	return
+}
+
+// Unlock force-releases a lock by sending its information
+// to the lock URL of its State, as the http backend does
+func (h *HTTP) Unlock(lockID string) error {
+	for _, path := range h.paths {
+		st := h.states[path]
+		info, ok, err := h.lockInfo(path, st)
+		if err != nil {
+			return err
+		}
+		if !ok || info.ID != lockID {
+			continue
+		}
+
+		body, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		resp, err := h.do(httpUnlockMethod, st.lockURL, body)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	return ErrLockNotFound
+}
+
+// GetStates returns the configured State paths,
+// the http backend providing no listing
+func (h *HTTP) GetStates() ([]string, error) {
+	return h.paths, nil
+}
+
+// fetch retrieves the current document of a State along with its version,
+// identified by the hash of its content
+func (h *HTTP) fetch(path string) (raw []byte, version Version, err error) {
+	st, ok := h.states[path]
+	if !ok {
+		return nil, version, fmt.Errorf("unknown http state %s", path)
+	}
+
+	resp, err := h.do(http.MethodGet, st.url, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if raw, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	sum := sha256.Sum256(raw)
+	version.ID = hex.EncodeToString(sum[:])
+	version.LastModified = time.Now()
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		version.Metadata = map[string]string{"etag": etag}
+	}
+	if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		version.LastModified = lm
+	}
+	return
+}
+
+// GetVersions returns a slice of Version objects.
+// Without versioning, the current document is the only version.
+func (h *HTTP) GetVersions(state string) ([]Version, error) {
+	_, version, err := h.fetch(state)
+	if err != nil {
+		return []Version{}, err
+	}
+	return []Version{version}, nil
+}
+
+// GetState retrieves a single State from the http backend
+func (h *HTTP) GetState(st, versionID string) (sf *statefile.File, err error) {
+	raw, err := h.GetStateRaw(st, versionID)
+	if err != nil {
+		return nil, err
+	}
+
+	sf, err = statefile.Read(bytes.NewReader(raw))
+	if sf == nil {
+		return sf, fmt.Errorf("Failed to find state: %v", err)
+	}
+	return
+}
+
+// GetStateRaw retrieves the content of a single State from the http backend.
+// Only the current version is available, older ones can't be retrieved.
+func (h *HTTP) GetStateRaw(st, versionID string) ([]byte, error) {
+	log.WithFields(log.Fields{
+		"path":       st,
+		"version_id": versionID,
+	}).Info("Retrieving state from http backend")
+
+	raw, version, err := h.fetch(st)
+	if err != nil {
+		return nil, err
+	}
+	if versionID != "" && version.ID != versionID {
+		return nil, fmt.Errorf("version %s of %s is no longer available", versionID, st)
+	}
+	return raw, nil
+}
@@ -0,0 +1,207 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/terraboard/config"
+)
+
+const fakeHTTPState = `{
+  "version": 4,
+  "terraform_version": "1.0.2",
+  "serial": 7,
+  "lineage": "http-lineage",
+  "outputs": {},
+  "resources": []
+}`
+
+// fakeHTTPBackend serves a state document, locked, and an unlocked one
+type fakeHTTPBackend struct {
+	auth     string
+	unlocked []string
+	locked   bool
+}
+
+func (f *fakeHTTPBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.auth = r.Header.Get("Authorization")
+	switch {
+	case r.URL.Path == "/states/prod" && r.Method == http.MethodGet:
+		w.Header().Set("Last-Modified", "Tue, 01 Jun 2021 12:00:00 GMT")
+		w.Write([]byte(fakeHTTPState))
+	case r.URL.Path == "/locks/prod" && r.Method == http.MethodGet:
+		if f.locked {
+			w.Write([]byte(`{"ID":"fakeLockID","Operation":"OperationTypeApply","Who":"foo@bar"}`))
+		}
+	case r.URL.Path == "/locks/prod" && r.Method == httpUnlockMethod:
+		body, _ := ioutil.ReadAll(r.Body)
+		f.unlocked = append(f.unlocked, string(body))
+		f.locked = false
+	case r.URL.Path == "/locks/dev":
+		http.NotFound(w, r)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func newFakeHTTP(t *testing.T, cfg config.HTTPConfig) (*HTTP, *fakeHTTPBackend, func()) {
+	backend := &fakeHTTPBackend{locked: true}
+	server := httptest.NewServer(backend)
+	for i, u := range cfg.StateURLs {
+		cfg.StateURLs[i] = server.URL + u
+	}
+	for i, u := range cfg.LockURLs {
+		cfg.LockURLs[i] = server.URL + u
+	}
+
+	h, err := NewHTTP(cfg)
+	if err != nil {
+		server.Close()
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return h, backend, server.Close
+}
+
+func TestNewHTTP(t *testing.T) {
+	if h, err := NewHTTP(config.HTTPConfig{}); h != nil || err != nil {
+		t.Fatalf("Expected no provider without state URLs, got %v, %v", h, err)
+	}
+	if _, err := NewHTTP(config.HTTPConfig{StateURLs: []string{"not a url"}}); err == nil {
+		t.Fatalf("Expected an error for an invalid state URL")
+	}
+	if _, err := NewHTTP(config.HTTPConfig{
+		StateURLs: []string{"https://states.example.com/prod"},
+		LockURLs:  []string{"https://states.example.com/locks/prod", "https://states.example.com/locks/dev"},
+	}); err == nil {
+		t.Fatalf("Expected an error with more lock URLs than state URLs")
+	}
+}
+
+func TestHTTP_GetStates(t *testing.T) {
+	h, _, stop := newFakeHTTP(t, config.HTTPConfig{StateURLs: []string{"/states/prod", "/states/dev"}})
+	defer stop()
+
+	host := strings.TrimPrefix(h.states[h.paths[0]].url, "http://")
+	host = strings.TrimSuffix(host, "/states/prod")
+	if name := h.Name(); name != "http:"+host {
+		t.Fatalf("Expected http:%s, got %s", host, name)
+	}
+
+	states, err := h.GetStates()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []string{host + "/states/prod", host + "/states/dev"}
+	if !reflect.DeepEqual(states, expected) {
+		t.Fatalf("Expected %v, got %v", expected, states)
+	}
+}
+
+func TestHTTP_GetState(t *testing.T) {
+	h, backend, stop := newFakeHTTP(t, config.HTTPConfig{
+		StateURLs: []string{"/states/prod"},
+		Username:  "terraboard",
+		Password:  "secret",
+	})
+	defer stop()
+	path := h.paths[0]
+
+	versions, err := h.GetVersions(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(versions) != 1 {
+		t.Fatalf("Expected 1 version, got %v", versions)
+	}
+	if modified := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC); !versions[0].LastModified.Equal(modified) {
+		t.Fatalf("Expected %v, got %v", modified, versions[0].LastModified)
+	}
+	if !strings.HasPrefix(backend.auth, "Basic ") {
+		t.Fatalf("Expected basic authentication, got %q", backend.auth)
+	}
+
+	sf, err := h.GetState(path, versions[0].ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if sf.Lineage != "http-lineage" || sf.Serial != 7 {
+		t.Fatalf("Expected serial 7 of http-lineage, got %d of %s", sf.Serial, sf.Lineage)
+	}
+
+	if _, err := h.GetStateRaw(path, "outdated"); err == nil {
+		t.Fatalf("Expected an error for a version no longer available")
+	}
+	if _, err := h.GetStateRaw("unknown", ""); err == nil {
+		t.Fatalf("Expected an error for an unknown state")
+	}
+}
+
+func TestHTTP_GetState_Errors(t *testing.T) {
+	h, backend, stop := newFakeHTTP(t, config.HTTPConfig{
+		StateURLs: []string{"/states/missing"},
+		Token:     "my-token",
+		Username:  "ignored",
+	})
+	defer stop()
+
+	_, err := h.GetStateRaw(h.paths[0], "")
+	if e, ok := err.(*httpStatusError); !ok || e.StatusCode() != http.StatusBadRequest {
+		t.Fatalf("Expected a 400 status error, got %v", err)
+	}
+	if backend.auth != "Bearer my-token" {
+		t.Fatalf("Expected the bearer token, got %q", backend.auth)
+	}
+}
+
+func TestHTTP_GetLocks(t *testing.T) {
+	h, _, stop := newFakeHTTP(t, config.HTTPConfig{
+		StateURLs: []string{"/states/prod", "/states/dev", "/states/staging"},
+		LockURLs:  []string{"/locks/prod", "/locks/dev"},
+	})
+	defer stop()
+
+	locks, err := h.GetLocks()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(locks) != 1 {
+		t.Fatalf("Expected 1 lock, got %v", locks)
+	}
+	lock, ok := locks[h.paths[0]]
+	if !ok || lock.ID != "fakeLockID" || lock.Who != "foo@bar" || lock.Path != h.paths[0] {
+		t.Fatalf("Expected the lock of %s, got %v", h.paths[0], locks)
+	}
+}
+
+func TestHTTP_Unlock(t *testing.T) {
+	h, backend, stop := newFakeHTTP(t, config.HTTPConfig{
+		StateURLs: []string{"/states/prod"},
+		LockURLs:  []string{"/locks/prod"},
+	})
+	defer stop()
+
+	if err := h.Unlock("unknown"); err != ErrLockNotFound {
+		t.Fatalf("Expected ErrLockNotFound, got %v", err)
+	}
+	if err := h.Unlock("fakeLockID"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(backend.unlocked) != 1 {
+		t.Fatalf("Expected the lock to be released once, got %v", backend.unlocked)
+	}
+	var info LockInfo
+	if err := json.Unmarshal([]byte(backend.unlocked[0]), &info); err != nil || info.ID != "fakeLockID" {
+		t.Fatalf("Expected the lock information to be sent, got %s", backend.unlocked[0])
+	}
+
+	locks, err := h.GetLocks()
+	if err != nil || len(locks) != 0 {
+		t.Fatalf("Expected no lock, got %v, %v", locks, err)
+	}
+}
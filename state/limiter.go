@@ -0,0 +1,128 @@
+package state
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+// ErrThrottled can be wrapped by providers to signal a rate-limited request
+var ErrThrottled = errors.New("provider throttled the request")
+
+// throttlingRetries is the number of times a throttled fetch is retried
+const throttlingRetries = 10
+
+// IsThrottlingError returns true if the error is a rate-limit signal
+// from a provider (HTTP 429, S3 SlowDown, ...)
+func IsThrottlingError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrThrottled) {
+		return true
+	}
+
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusTooManyRequests {
+		return true
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded",
+			"TooManyRequestsException", "ProvisionedThroughputExceededException":
+			return true
+		}
+	}
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) && gErr.Code == http.StatusTooManyRequests {
+		return true
+	}
+	return false
+}
+
+// AdaptiveLimiter bounds the number of concurrent fetches on a provider.
+// The limit is halved whenever the provider throttles a request
+// and raised back by one after as many successful fetches as the current limit.
+type AdaptiveLimiter struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	limit     int
+	max       int
+	inFlight  int
+	successes int
+	backoff   time.Duration
+}
+
+// NewAdaptiveLimiter creates an AdaptiveLimiter allowing up to max concurrent fetches
+func NewAdaptiveLimiter(max int) *AdaptiveLimiter {
+	if max < 1 {
+		max = 1
+	}
+	l := &AdaptiveLimiter{
+		limit:   max,
+		max:     max,
+		backoff: time.Second,
+	}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// Limit returns the current concurrency limit
+func (l *AdaptiveLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+func (l *AdaptiveLimiter) acquire() {
+	l.mu.Lock()
+	for l.inFlight >= l.limit {
+		l.cond.Wait()
+	}
+	l.inFlight++
+	l.mu.Unlock()
+}
+
+func (l *AdaptiveLimiter) release(throttled bool) {
+	l.mu.Lock()
+	l.inFlight--
+	if throttled {
+		l.successes = 0
+		if l.limit > 1 {
+			l.limit /= 2
+			log.WithField("limit", l.limit).Warn("Provider is throttling requests, reducing concurrency")
+		}
+	} else {
+		l.successes++
+		if l.successes >= l.limit && l.limit < l.max {
+			l.successes = 0
+			l.limit++
+			log.WithField("limit", l.limit).Debug("Increasing provider concurrency")
+		}
+	}
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
+
+// Do runs a fetch within the concurrency limit, retrying it
+// with an increasing delay as long as the provider throttles it
+func (l *AdaptiveLimiter) Do(fetch func() error) (err error) {
+	delay := l.backoff
+	for i := 0; ; i++ {
+		l.acquire()
+		err = fetch()
+		throttled := IsThrottlingError(err)
+		l.release(throttled)
+		if !throttled || i >= throttlingRetries {
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,94 @@
+package state
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestIsThrottlingError(t *testing.T) {
+	throttled := []error{
+		ErrThrottled,
+		fmt.Errorf("failed to fetch state: %w", ErrThrottled),
+		awserr.New("SlowDown", "Please reduce your request rate.", nil),
+		awserr.NewRequestFailure(awserr.New("Unknown", "", nil), 429, "req-id"),
+	}
+	for _, err := range throttled {
+		if !IsThrottlingError(err) {
+			t.Fatalf("Expected %v to be a throttling error", err)
+		}
+	}
+
+	for _, err := range []error{nil, fmt.Errorf("access denied"), awserr.New("NoSuchKey", "", nil)} {
+		if IsThrottlingError(err) {
+			t.Fatalf("Expected %v not to be a throttling error", err)
+		}
+	}
+}
+
+// throttlingProvider fails fetches with ErrThrottled while more than
+// maxConcurrent of them are in flight
+type throttlingProvider struct {
+	mu            sync.Mutex
+	inFlight      int
+	maxConcurrent int
+	throttled     int
+}
+
+func (p *throttlingProvider) fetch() error {
+	p.mu.Lock()
+	p.inFlight++
+	over := p.inFlight > p.maxConcurrent
+	if over {
+		p.throttled++
+	}
+	p.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	p.mu.Lock()
+	p.inFlight--
+	p.mu.Unlock()
+
+	if over {
+		return ErrThrottled
+	}
+	return nil
+}
+
+func TestAdaptiveLimiter_BacksOff(t *testing.T) {
+	p := &throttlingProvider{maxConcurrent: 2}
+	l := NewAdaptiveLimiter(16)
+	l.backoff = time.Millisecond
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	completed := 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.Do(p.fetch); err != nil {
+				t.Errorf("Expected no error, got %v", err)
+				return
+			}
+			mu.Lock()
+			completed++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if completed != 100 {
+		t.Fatalf("Expected %d completed fetches, got %d", 100, completed)
+	}
+	if p.throttled == 0 {
+		t.Fatalf("Expected the provider to throttle some fetches")
+	}
+	if l.Limit() >= 16 {
+		t.Fatalf("Expected the limit to be reduced, got %d", l.Limit())
+	}
+}
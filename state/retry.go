@@ -0,0 +1,168 @@
+package state
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/camptocamp/terraboard/internal/terraform/states/statefile"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+// ErrTransient can be wrapped by providers to signal a transient failure
+var ErrTransient = errors.New("transient provider error")
+
+// statusCoder is implemented by the errors of failed HTTP requests
+type statusCoder interface {
+	StatusCode() int
+}
+
+// httpStatusError is the error of an HTTP request failing with a status
+type httpStatusError struct {
+	status  int
+	message string
+}
+
+func (e *httpStatusError) Error() string {
+	return e.message
+}
+
+// StatusCode returns the HTTP status of the failed request
+func (e *httpStatusError) StatusCode() int {
+	return e.status
+}
+
+// IsRetryableError returns true if the error is a transient provider
+// failure (HTTP 5xx, network error) worth retrying. Throttling and
+// expired credentials are handled separately.
+func IsRetryableError(err error) bool {
+	if err == nil || IsThrottlingError(err) || IsExpiredCredentialsError(err) {
+		return false
+	}
+	if errors.Is(err, ErrTransient) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var sc statusCoder
+	if errors.As(err, &sc) && sc.StatusCode() >= http.StatusInternalServerError {
+		return true
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case "RequestError", "RequestTimeout", "RequestTimeoutException",
+			"InternalError", "ServiceUnavailable":
+			return true
+		}
+	}
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) && gErr.Code >= http.StatusInternalServerError {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// RetryPolicy sets how provider fetches failing on transient errors are retried
+type RetryPolicy struct {
+	MaxAttempts uint
+	Backoff     time.Duration
+}
+
+// retry runs a fetch, retrying it with an exponential backoff
+// and a random jitter as long as it fails on a transient error
+func retry(p RetryPolicy, fetch func() error) (err error) {
+	delay := p.Backoff
+	for attempt := uint(1); ; attempt++ {
+		err = fetch()
+		if attempt >= p.MaxAttempts || !IsRetryableError(err) {
+			return
+		}
+		log.WithFields(log.Fields{
+			"attempt": attempt,
+			"error":   err,
+		}).Warn("Transient provider error, retrying")
+		jitter := time.Duration(rand.Int63n(int64(delay)/2 + 1))
+		time.Sleep(delay/2 + jitter)
+		delay *= 2
+	}
+}
+
+// RetryingProvider wraps a Provider, retrying its fetches
+// when they fail on transient errors
+type RetryingProvider struct {
+	provider Provider
+	policy   RetryPolicy
+}
+
+// NewRetryingProvider wraps a Provider with the retry of its fetches,
+// providers being returned as is when retries are disabled
+func NewRetryingProvider(p Provider, policy RetryPolicy) Provider {
+	if policy.MaxAttempts <= 1 {
+		return p
+	}
+	return &RetryingProvider{
+		provider: p,
+		policy:   policy,
+	}
+}
+
+// Name returns the identifier of the wrapped provider
+func (r *RetryingProvider) Name() string {
+	return r.provider.Name()
+}
+
+// GetLocks returns a map of locks by State path
+func (r *RetryingProvider) GetLocks() (locks map[string]LockInfo, err error) {
+	err = retry(r.policy, func() (err error) {
+		locks, err = r.provider.GetLocks()
+		return
+	})
+	return
+}
+
+// GetVersions returns a slice of Version objects
+func (r *RetryingProvider) GetVersions(state string) (versions []Version, err error) {
+	err = retry(r.policy, func() (err error) {
+		versions, err = r.provider.GetVersions(state)
+		return
+	})
+	return
+}
+
+// GetStates returns a slice of State files
+func (r *RetryingProvider) GetStates() (states []string, err error) {
+	err = retry(r.policy, func() (err error) {
+		states, err = r.provider.GetStates()
+		return
+	})
+	return
+}
+
+// Unlock force-releases a lock, without retrying it
+func (r *RetryingProvider) Unlock(lockID string) error {
+	return r.provider.Unlock(lockID)
+}
+
+// GetState retrieves a single State
+func (r *RetryingProvider) GetState(st, versionID string) (sf *statefile.File, err error) {
+	err = retry(r.policy, func() (err error) {
+		sf, err = r.provider.GetState(st, versionID)
+		return
+	})
+	return
+}
+
+// GetStateRaw retrieves the raw content of a single State
+func (r *RetryingProvider) GetStateRaw(st, versionID string) (raw []byte, err error) {
+	err = retry(r.policy, func() (err error) {
+		raw, err = r.provider.GetStateRaw(st, versionID)
+		return
+	})
+	return
+}
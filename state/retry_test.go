@@ -0,0 +1,134 @@
+package state
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/camptocamp/terraboard/config"
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsRetryableError(t *testing.T) {
+	retryable := []error{
+		ErrTransient,
+		fmt.Errorf("failed to fetch state: %w", ErrTransient),
+		awserr.NewRequestFailure(awserr.New("InternalError", "", nil), 500, "req-id"),
+		awserr.New("RequestError", "send request failed", nil),
+		&googleapi.Error{Code: http.StatusServiceUnavailable},
+		&httpStatusError{status: http.StatusBadGateway},
+	}
+	for _, err := range retryable {
+		if !IsRetryableError(err) {
+			t.Fatalf("Expected %v to be a retryable error", err)
+		}
+	}
+
+	notRetryable := []error{
+		nil,
+		fmt.Errorf("access denied"),
+		ErrThrottled,
+		ErrExpiredCredentials,
+		awserr.NewRequestFailure(awserr.New("NoSuchKey", "", nil), 404, "req-id"),
+		&googleapi.Error{Code: http.StatusForbidden},
+		&httpStatusError{status: http.StatusNotFound},
+	}
+	for _, err := range notRetryable {
+		if IsRetryableError(err) {
+			t.Fatalf("Expected %v not to be a retryable error", err)
+		}
+	}
+}
+
+// failingTransport answers requests with a status, the first failures
+// times, then with a body
+type failingTransport struct {
+	failures int
+	status   int
+	body     string
+	calls    int
+}
+
+func (f *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.calls++
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Body:       ioutil.NopCloser(strings.NewReader(f.body)),
+		Request:    req,
+	}
+	if f.calls <= f.failures {
+		resp.StatusCode = f.status
+		resp.Status = fmt.Sprintf("%d %s", f.status, http.StatusText(f.status))
+		resp.Body = ioutil.NopCloser(strings.NewReader("failure"))
+	}
+	return resp, nil
+}
+
+func newFailingAzure(t *testing.T, transport *failingTransport) *Azure {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, _ := transport.RoundTrip(r)
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := newAzureSDKClient(config.AzureConfig{
+		StorageAccount: "myaccount",
+		Container:      "tfstate",
+		AccessKey:      base64.StdEncoding.EncodeToString([]byte("secret")),
+		Endpoint:       srv.URL,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return &Azure{client: client, account: "myaccount", container: "tfstate"}
+}
+
+func TestRetryingProvider_RetriesTransientErrors(t *testing.T) {
+	transport := &failingTransport{failures: 2, status: http.StatusServiceUnavailable, body: `{"version":4}`}
+	p := NewRetryingProvider(newFailingAzure(t, transport), RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+
+	raw, err := p.GetStateRaw("prod.tfstate", "v1")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if string(raw) != transport.body {
+		t.Fatalf("Expected %s, got %s", transport.body, raw)
+	}
+	if transport.calls != 3 {
+		t.Fatalf("Expected %d calls, got %d", 3, transport.calls)
+	}
+}
+
+func TestRetryingProvider_GivesUp(t *testing.T) {
+	transport := &failingTransport{failures: 5, status: http.StatusInternalServerError}
+	p := NewRetryingProvider(newFailingAzure(t, transport), RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+
+	if _, err := p.GetStateRaw("prod.tfstate", "v1"); err == nil {
+		t.Fatalf("Expected an error after %d attempts", 3)
+	}
+	if transport.calls != 3 {
+		t.Fatalf("Expected %d calls, got %d", 3, transport.calls)
+	}
+}
+
+func TestRetryingProvider_FailsFast(t *testing.T) {
+	transport := &failingTransport{failures: 1, status: http.StatusNotFound}
+	p := NewRetryingProvider(newFailingAzure(t, transport), RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+
+	if _, err := p.GetStateRaw("prod.tfstate", "v1"); err == nil {
+		t.Fatalf("Expected an error for a missing state")
+	}
+	if transport.calls != 1 {
+		t.Fatalf("Expected %d call, got %d", 1, transport.calls)
+	}
+}
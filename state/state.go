@@ -1,6 +1,9 @@
 package state
 
 import (
+	"errors"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/camptocamp/terraboard/config"
@@ -25,18 +28,81 @@ type Lock struct {
 	Info   string
 }
 
+// ErrLockNotFound is returned when unlocking a lock not held on a provider
+var ErrLockNotFound = errors.New("lock not found")
+
 // Version is a handler for state versions
 type Version struct {
 	ID           string
 	LastModified time.Time
+	// Metadata is reported by the provider, such as the ETag
+	// or the generation of the state object
+	Metadata map[string]string
+}
+
+// backupSuffix is appended by Terraform to the previous state file
+// when writing a local backup
+const backupSuffix = ".backup"
+
+// BackupStatePath returns the path of the state file a backup belongs to,
+// based on its filename stem, and whether the given path is a backup at all
+func BackupStatePath(path string) (string, bool) {
+	if !strings.HasSuffix(path, backupSuffix) {
+		return path, false
+	}
+	return strings.TrimSuffix(path, backupSuffix), true
+}
+
+// PathFilter selects the state files ingested from providers.
+// Patterns are exact paths or shell patterns as accepted by path.Match.
+type PathFilter struct {
+	Allow   []string
+	Exclude []string
+}
+
+// matchPath returns whether a path equals or matches one of the patterns
+func matchPath(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if pattern == p {
+			return true
+		}
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed returns whether a state file is ingested: it must match the
+// allowlist, when set, then none of the exclusions. Backups are matched
+// with the path of the state file they belong to.
+func (f PathFilter) Allowed(p string) bool {
+	p, _ = BackupStatePath(p)
+	if len(f.Allow) > 0 && !matchPath(f.Allow, p) {
+		return false
+	}
+	return !matchPath(f.Exclude, p)
+}
+
+// Filter returns the state files to ingest among the given paths
+func (f PathFilter) Filter(paths []string) (allowed []string) {
+	for _, p := range paths {
+		if f.Allowed(p) {
+			allowed = append(allowed, p)
+		}
+	}
+	return
 }
 
 // Provider is an interface for supported state providers
 type Provider interface {
+	Name() string
 	GetLocks() (map[string]LockInfo, error)
 	GetVersions(string) ([]Version, error)
 	GetStates() ([]string, error)
 	GetState(string, string) (*statefile.File, error)
+	GetStateRaw(string, string) ([]byte, error)
+	Unlock(string) error
 }
 
 // Configure the state provider
@@ -88,5 +154,47 @@ func Configure(c *config.Config) ([]Provider, error) {
 		}
 	}
 
+	if len(c.Azure) > 0 {
+		objs, err := NewAzureCollection(c)
+		if err != nil {
+			return []Provider{}, err
+		}
+		if len(objs) > 0 {
+			log.Info("Using Azure Blob Storage as state/locks provider")
+			for _, azureObj := range objs {
+				providers = append(providers, azureObj)
+			}
+		}
+	}
+
+	if len(c.HTTP) > 0 {
+		objs, err := NewHTTPCollection(c)
+		if err != nil {
+			return []Provider{}, err
+		}
+		if len(objs) > 0 {
+			log.Info("Using the Terraform http backend as state/locks provider")
+			for _, httpObj := range objs {
+				providers = append(providers, httpObj)
+			}
+		}
+	}
+
+	if !c.Provider.NoCredentialsRefresh {
+		for i, p := range providers {
+			providers[i] = NewRefreshingProvider(p)
+		}
+	}
+
+	// Retries are applied after the credentials refresh,
+	// which needs to find the provider it refreshes unwrapped
+	policy := RetryPolicy{
+		MaxAttempts: c.Provider.RetryMaxAttempts,
+		Backoff:     time.Duration(c.Provider.RetryBackoff) * time.Millisecond,
+	}
+	for i, p := range providers {
+		providers[i] = NewRetryingProvider(p, policy)
+	}
+
 	return providers, nil
 }
@@ -1,3 +1,68 @@
 package state
 
-// TODO: write!
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBackupStatePath_Backup(t *testing.T) {
+	expected := "env/prod/terraform.tfstate"
+
+	path, ok := BackupStatePath("env/prod/terraform.tfstate.backup")
+	if !ok {
+		t.Fatalf("Expected %t, got %t", true, ok)
+	}
+	if path != expected {
+		t.Fatalf("Expected %s, got %s", expected, path)
+	}
+}
+
+func TestBackupStatePath_State(t *testing.T) {
+	expected := "env/prod/terraform.tfstate"
+
+	path, ok := BackupStatePath(expected)
+	if ok {
+		t.Fatalf("Expected %t, got %t", false, ok)
+	}
+	if path != expected {
+		t.Fatalf("Expected %s, got %s", expected, path)
+	}
+}
+
+func TestPathFilter_Filter(t *testing.T) {
+	bucket := []string{
+		"env/prod/network.tfstate",
+		"env/prod/network.tfstate.backup",
+		"env/prod/app.tfstate",
+		"env/prod/sandbox.tfstate",
+		"env/staging/app.tfstate",
+		"scratch/test.tfstate",
+	}
+
+	for _, tc := range []struct {
+		filter   PathFilter
+		expected []string
+	}{
+		{
+			PathFilter{},
+			bucket,
+		},
+		{
+			PathFilter{Allow: []string{"env/prod/network.tfstate", "env/staging/app.tfstate"}},
+			[]string{"env/prod/network.tfstate", "env/prod/network.tfstate.backup", "env/staging/app.tfstate"},
+		},
+		{
+			PathFilter{Allow: []string{"env/prod/*"}, Exclude: []string{"env/prod/sandbox.tfstate"}},
+			[]string{"env/prod/network.tfstate", "env/prod/network.tfstate.backup", "env/prod/app.tfstate"},
+		},
+		{
+			PathFilter{Exclude: []string{"scratch/*"}},
+			bucket[:5],
+		},
+	} {
+		allowed := tc.filter.Filter(bucket)
+		if !reflect.DeepEqual(allowed, tc.expected) {
+			t.Fatalf("Expected %v, got %v", tc.expected, allowed)
+		}
+	}
+}
@@ -59,6 +59,11 @@ func NewTFECollection(c *config.Config) ([]*TFE, error) {
 	return tfeInstances, nil
 }
 
+// Name returns the TFE provider identifier
+func (t *TFE) Name() string {
+	return fmt.Sprintf("tfe:%s", t.org)
+}
+
 // GetLocks returns a map of locks by State path
 func (t *TFE) GetLocks() (locks map[string]LockInfo, err error) {
 	locks = make(map[string]LockInfo)
@@ -101,6 +106,12 @@ func (t *TFE) GetLocks() (locks map[string]LockInfo, err error) {
 	return
 }
 
+// Unlock is not supported, as Terraform Enterprise
+// does not expose the ID of workspace locks
+func (t *TFE) Unlock(lockID string) error {
+	return ErrLockNotFound
+}
+
 // GetStates returns a slice of all found workspaces
 func (t *TFE) GetStates() (states []string, err error) {
 	options := tfe.WorkspaceListOptions{
@@ -166,14 +177,7 @@ func (t *TFE) GetVersions(state string) (versions []Version, err error) {
 
 // GetState retrieves a single State from the S3 bucket
 func (t *TFE) GetState(st, versionID string) (sf *statefile.File, err error) {
-	// Fetch the version metadata
-	version, err := t.StateVersions.Read(*t.ctx, versionID)
-	if err != nil {
-		return nil, err
-	}
-
-	// Download the statefile
-	state, err := t.StateVersions.Download(*t.ctx, version.DownloadURL)
+	state, err := t.GetStateRaw(st, versionID)
 	if err != nil {
 		return nil, err
 	}
@@ -186,3 +190,15 @@ func (t *TFE) GetState(st, versionID string) (sf *statefile.File, err error) {
 
 	return
 }
+
+// GetStateRaw downloads the content of a single State version
+func (t *TFE) GetStateRaw(st, versionID string) ([]byte, error) {
+	// Fetch the version metadata
+	version, err := t.StateVersions.Read(*t.ctx, versionID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Download the statefile
+	return t.StateVersions.Download(*t.ctx, version.DownloadURL)
+}
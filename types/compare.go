@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 /*******************************************************
  * Compare types
  *
@@ -8,6 +10,7 @@ package types
 
 // StateInfo stores general information and stats for a State
 type StateInfo struct {
+	Lineage       string `json:"lineage,omitempty"`
 	Path          string `json:"path"`
 	VersionID     string `json:"version_id"`
 	ResourceCount int    `json:"resource_count"`
@@ -22,12 +25,53 @@ type ResourceDiff struct {
 	UnifiedDiff string            `json:"unified_diff"`
 }
 
+// DiffCount stores the number of elements added, removed
+// and changed between two versions of a State
+type DiffCount struct {
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+	Changed int `json:"changed"`
+}
+
+// ResourceTypeCountDiff represents the difference of a Resource type count
+// between two Lineages
+type ResourceTypeCountDiff struct {
+	Type   string `json:"type"`
+	CountA int    `json:"count_a"`
+	CountB int    `json:"count_b"`
+	Delta  int    `json:"delta"`
+}
+
+// ResourcePresence stores the number of Lineages a resource address is found in
+type ResourcePresence struct {
+	Address  string `json:"address"`
+	Lineages int    `json:"lineages"`
+}
+
+// CommonResources represents the resources shared by a set of Lineages
+type CommonResources struct {
+	Lineages         int                `json:"lineages"`
+	Threshold        int                `json:"threshold"`
+	Common           []string           `json:"common"`
+	CommonCount      int                `json:"common_count"`
+	AtThreshold      []ResourcePresence `json:"at_threshold"`
+	AtThresholdCount int                `json:"at_threshold_count"`
+}
+
+// CompareStats summarizes a diff between two versions of a State
+type CompareStats struct {
+	From StateInfo `json:"from"`
+	To   StateInfo `json:"to"`
+	// Resources counts the resources added, removed and changed
+	Resources DiffCount `json:"resources"`
+	// Attributes counts the attributes added, removed and changed
+	// in the changed resources
+	Attributes DiffCount `json:"attributes"`
+}
+
 // StateCompare represents a diff between two versions of a State
 type StateCompare struct {
-	Stats struct {
-		From StateInfo `json:"from"`
-		To   StateInfo `json:"to"`
-	} `json:"stats"`
+	Stats       CompareStats `json:"stats"`
 	Differences struct {
 		OnlyInOld    map[string]string       `json:"only_in_old"`
 		OnlyInNew    map[string]string       `json:"only_in_new"`
@@ -35,3 +79,55 @@ type StateCompare struct {
 		ResourceDiff map[string]ResourceDiff `json:"resource_diff"`
 	} `json:"differences"`
 }
+
+// ChangelogEntry is the summary of the changes of a State version
+// from the previous version of its Lineage
+type ChangelogEntry struct {
+	FromVersionID string       `json:"from_version_id"`
+	ToVersionID   string       `json:"to_version_id"`
+	LastModified  time.Time    `json:"last_modified"`
+	Stats         CompareStats `json:"stats"`
+}
+
+// Drift lists the resources the most recent Plan of a Lineage intends
+// to change on its most recent State version
+type Drift struct {
+	Lineage   string    `json:"lineage"`
+	VersionID string    `json:"version_id"`
+	PlanID    uint      `json:"plan_id"`
+	PlannedAt time.Time `json:"planned_at"`
+	// Outdated is set when the Plan was made before the State version
+	Outdated bool     `json:"outdated"`
+	Create   []string `json:"create"`
+	Update   []string `json:"update"`
+	Replace  []string `json:"replace"`
+	Destroy  []string `json:"destroy"`
+}
+
+// PriorStateDrift compares the prior state embedded in a Plan with the
+// most recent State version of its Lineage recorded when it was made
+type PriorStateDrift struct {
+	PlanID    uint      `json:"plan_id"`
+	Lineage   string    `json:"lineage"`
+	PlannedAt time.Time `json:"planned_at"`
+	VersionID string    `json:"version_id"`
+	// MatchedVersionID is the recorded version identical to the prior state, if any
+	MatchedVersionID string `json:"matched_version_id,omitempty"`
+	// Stale is set when the prior state differs from the recorded version
+	Stale       bool     `json:"stale"`
+	OnlyInPlan  []string `json:"only_in_plan"`
+	OnlyInState []string `json:"only_in_state"`
+	// Changed lists the attributes differing by resource address
+	Changed map[string][]string `json:"changed"`
+}
+
+// StateComparePage is a page of the resources of a StateCompare kept
+// server-side, the other pages being retrieved with its token
+type StateComparePage struct {
+	Token     string       `json:"token"`
+	Page      int          `json:"page"`
+	Pages     int          `json:"pages"`
+	Total     int          `json:"total"`
+	ExpiresAt time.Time    `json:"expires_at"`
+	Compare   StateCompare `json:"compare"`
+}
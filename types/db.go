@@ -19,25 +19,85 @@ type Version struct {
 	ID           uint      `sql:"AUTO_INCREMENT" gorm:"primary_key" json:"-"`
 	VersionID    string    `gorm:"index" json:"version_id"`
 	LastModified time.Time `json:"last_modified"`
+	// ProviderMetadata is reported by the state provider on ingestion
+	ProviderMetadata datatypes.JSON `json:"provider_metadata,omitempty"`
 }
 
 // State is a Terraform State
 type State struct {
-	gorm.Model `json:"-"`
-	Path       string        `gorm:"index" json:"path"`
-	Version    Version       `json:"version"`
-	VersionID  sql.NullInt64 `gorm:"index" json:"-"`
-	TFVersion  string        `gorm:"varchar(10)" json:"terraform_version"`
-	Serial     int64         `json:"serial"`
-	LineageID  sql.NullInt64 `gorm:"index" json:"-"`
-	Modules    []Module      `json:"modules"`
+	gorm.Model  `json:"-"`
+	Path        string        `gorm:"index" json:"path"`
+	Version     Version       `json:"version"`
+	VersionID   sql.NullInt64 `gorm:"index" json:"-"`
+	TFVersion   string        `gorm:"varchar(10)" json:"terraform_version"`
+	Serial      int64         `json:"serial"`
+	LineageID   sql.NullInt64 `gorm:"index" json:"-"`
+	Provider    string        `gorm:"index" json:"provider"`
+	Fingerprint string        `gorm:"index" json:"fingerprint"`
+	Modules     []Module      `json:"modules"`
+	// ComputedFields are derived from the State on its ingestion
+	ComputedFields []ComputedField `json:"computed_fields,omitempty"`
+	// AutoTags are the tags of the Lineage detected from the State on its ingestion
+	AutoTags []LineageTag `gorm:"-" json:"-"`
+	// PlanID references the Plan correlated to the State on its ingestion
+	PlanID sql.NullInt64 `gorm:"index" json:"-"`
 }
 
 type Lineage struct {
 	gorm.Model
-	Value  string  `gorm:"index;unique" json:"lineage"`
-	States []State `json:"states"`
-	Plans  []Plan  `json:"plans"`
+	Value    string `gorm:"index;uniqueIndex:idx_lineage_value_provider" json:"lineage"`
+	Provider string `gorm:"uniqueIndex:idx_lineage_value_provider" json:"provider"`
+	// DisplayName is derived from the State path, or the lineage value by default
+	DisplayName string `json:"display_name"`
+	// ReferenceVersion is the VersionID of the known-good version of the Lineage
+	ReferenceVersion string       `json:"reference_version,omitempty"`
+	States           []State      `json:"states"`
+	Plans            []Plan       `json:"plans"`
+	Tags             []LineageTag `json:"tags"`
+	// Empty is set, when empty States are tagged, if the most recent State
+	// of the Lineage holds no managed resource
+	Empty bool `gorm:"-" json:"empty,omitempty"`
+}
+
+// LineageTag is a key/value tag set on a Lineage, either by users
+// or automatically from the resources of the Lineage
+type LineageTag struct {
+	ID        uint   `sql:"AUTO_INCREMENT" gorm:"primary_key" json:"-"`
+	LineageID uint   `gorm:"uniqueIndex:idx_lineage_tag_auto" json:"-"`
+	Key       string `gorm:"uniqueIndex:idx_lineage_tag_auto" json:"key"`
+	Value     string `json:"value"`
+	Auto      bool   `gorm:"uniqueIndex:idx_lineage_tag_auto;not null;default:false" json:"auto"`
+}
+
+// DeduplicatedVersion is a Version of a State identical to the previous one,
+// recorded instead of a duplicate State
+type DeduplicatedVersion struct {
+	ID          uint          `sql:"AUTO_INCREMENT" gorm:"primary_key" json:"-"`
+	VersionID   sql.NullInt64 `gorm:"index" json:"-"`
+	Path        string        `gorm:"index" json:"path"`
+	Fingerprint string        `json:"fingerprint"`
+}
+
+// DeletedLineage is a Lineage deleted by a user, whose States are
+// ignored when they are synchronized again from the providers
+type DeletedLineage struct {
+	ID        uint      `sql:"AUTO_INCREMENT" gorm:"primary_key" json:"-"`
+	Value     string    `gorm:"uniqueIndex" json:"lineage"`
+	DeletedBy string    `json:"deleted_by"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// LockEvent is a State lock observed on a provider, from its creation
+// to the last synchronization it was seen at
+type LockEvent struct {
+	ID        uint      `sql:"AUTO_INCREMENT" gorm:"primary_key" json:"-"`
+	Path      string    `gorm:"index" json:"path"`
+	Provider  string    `gorm:"index" json:"provider"`
+	LockID    string    `gorm:"index" json:"lock_id"`
+	Operation string    `json:"operation"`
+	Who       string    `gorm:"index" json:"who"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `gorm:"index" json:"last_seen"`
 }
 
 // Module is a Terraform module in a State
@@ -49,6 +109,15 @@ type Module struct {
 	OutputValues []OutputValue `json:"outputs"`
 }
 
+// ComputedField is a field derived from a State on its ingestion,
+// stored for fast querying
+type ComputedField struct {
+	ID      uint          `sql:"AUTO_INCREMENT" gorm:"primary_key" json:"-"`
+	StateID sql.NullInt64 `gorm:"index" json:"-"`
+	Name    string        `gorm:"index:idx_computed_field" json:"name"`
+	Value   string        `gorm:"index:idx_computed_field" json:"value"`
+}
+
 // Resource is a Terraform resource in a Module
 type Resource struct {
 	ID         uint          `sql:"AUTO_INCREMENT" gorm:"primary_key" json:"-"`
@@ -56,7 +125,15 @@ type Resource struct {
 	Type       string        `gorm:"index" json:"type"`
 	Name       string        `gorm:"index" json:"name"`
 	Index      string        `gorm:"index" json:"index"`
+	Mode       string        `gorm:"index" json:"mode"`
+	Provider   string        `gorm:"index" json:"provider"`
 	Attributes []Attribute   `json:"attributes"`
+	// AttributesFromID references the Resource owning the attributes rows
+	// when they are shared with a previous version (incremental ingestion)
+	AttributesFromID sql.NullInt64 `gorm:"index" json:"-"`
+	// Dependencies holds the addresses of the Resources it depends on,
+	// one per line, as recorded by Terraform
+	Dependencies string `gorm:"type:text" json:"-"`
 }
 
 // OutputValue is a Terraform output in a Module
@@ -86,11 +163,25 @@ type Plan struct {
 	GitCommit    string         `gorm:"varchar(50)" json:"git_commit"`
 	CiURL        string         `json:"ci_url"`
 	Source       string         `json:"source"`
+	Submitter    string         `json:"submitter"`
+	Summary      PlanSummary    `gorm:"embedded;embeddedPrefix:summary_" json:"summary"`
 	ParsedPlan   PlanModel      `json:"parsed_plan"`
 	ParsedPlanID sql.NullInt64  `gorm:"index" json:"-"`
 	PlanJSON     datatypes.JSON `json:"plan_json"`
 }
 
+// PlanSummary is a normalized summary of a Terraform plan,
+// consistent across the supported plan format versions
+type PlanSummary struct {
+	FormatVersion    string `json:"format_version"`
+	TerraformVersion string `json:"terraform_version"`
+	Applyable        bool   `json:"applyable"`
+	ResourceChanges  int    `json:"resource_changes"`
+	Add              int    `json:"add"`
+	Change           int    `json:"change"`
+	Destroy          int    `json:"destroy"`
+}
+
 // PlanModel represents the entire contents of an output Terraform plan.
 type PlanModel struct {
 	gorm.Model
@@ -23,14 +23,392 @@ type SearchResult struct {
 	AttributeValue string `gorm:"column:value" json:"attribute_value"`
 }
 
+// AttributeCondition is a condition on an Attribute of a Resource,
+// its Operator being one of "eq" (default), "ne", "contains" or "regex"
+type AttributeCondition struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+// ResourceQuery selects the Resources matching all ("and", default)
+// or any ("or") of a set of Attribute conditions
+type ResourceQuery struct {
+	Conditions []AttributeCondition `json:"conditions"`
+	Combine    string               `json:"combine"`
+	Page       int                  `json:"page"`
+}
+
+// ResourceQueryResult is a Resource matching a ResourceQuery
+type ResourceQueryResult struct {
+	LineageValue string `json:"lineage_value"`
+	Path         string `json:"path"`
+	VersionID    string `json:"version_id"`
+	Address      string `json:"address"`
+	ResourceType string `json:"resource_type"`
+}
+
+// FullTextResult is a Resource with Attribute values matching
+// a full-text search, ranked by relevance
+type FullTextResult struct {
+	LineageValue  string   `json:"lineage_value"`
+	Path          string   `json:"path"`
+	VersionID     string   `json:"version_id"`
+	Address       string   `json:"address"`
+	ResourceType  string   `json:"resource_type"`
+	AttributeKeys []string `json:"attribute_keys"`
+	Rank          float64  `json:"rank"`
+}
+
 // StateStat stores State stats
 // NOTE: do we want to merge this with StateInfo?
 type StateStat struct {
+	StateID       uint      `json:"-"`
 	Path          string    `json:"path"`
 	LineageValue  string    `json:"lineage_value"`
+	DisplayName   string    `json:"display_name"`
+	Provider      string    `json:"provider"`
 	TFVersion     string    `json:"terraform_version"`
 	Serial        int64     `json:"serial"`
 	VersionID     string    `json:"version_id"`
 	LastModified  time.Time `json:"last_modified"`
 	ResourceCount int       `json:"resource_count"`
+	Empty         bool      `json:"empty,omitempty"`
+	// ComputedFields are the fields computed on the ingestion of the State
+	ComputedFields map[string]string `gorm:"-" json:"computed_fields,omitempty"`
+}
+
+// LineageVersion is a stored version of a Lineage
+type LineageVersion struct {
+	VersionID    string    `json:"version_id"`
+	Serial       int64     `json:"serial"`
+	TFVersion    string    `json:"terraform_version"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// ProviderPlugin stores the count of lineages using a provider plugin,
+// broken down by the Terraform version of their most recent State
+type ProviderPlugin struct {
+	Name         string                  `json:"name"`
+	LineageCount int                     `json:"lineage_count"`
+	Versions     []ProviderPluginVersion `json:"versions"`
+}
+
+// ProviderPluginVersion stores the count of lineages using a provider
+// plugin with a Terraform version
+type ProviderPluginVersion struct {
+	TFVersion    string `json:"terraform_version"`
+	LineageCount int    `json:"lineage_count"`
+}
+
+// PluginUsage stores the resource types a provider plugin manages in a Lineage
+type PluginUsage struct {
+	LineageValue  string   `json:"lineage_value"`
+	ResourceTypes []string `json:"resource_types"`
+}
+
+// TFVersionChange stores a Terraform version change in a Lineage history
+type TFVersionChange struct {
+	VersionID         string    `json:"version_id"`
+	LastModified      time.Time `json:"last_modified"`
+	Serial            int64     `json:"serial"`
+	TFVersion         string    `gorm:"column:tf_version" json:"terraform_version"`
+	PreviousTFVersion string    `gorm:"-" json:"previous_terraform_version"`
+}
+
+// VersionNode is a State version in the version tree of a Lineage.
+// A version with several children is a fork.
+type VersionNode struct {
+	VersionID    string        `json:"version_id"`
+	LastModified time.Time     `json:"last_modified"`
+	Serial       int64         `json:"serial"`
+	Fingerprint  string        `json:"fingerprint"`
+	Children     []VersionNode `gorm:"-" json:"children"`
+}
+
+// LineageAttributeValue stores a value used by a Lineage for an attribute key
+type LineageAttributeValue struct {
+	LineageValue   string `gorm:"column:lineage_value"`
+	AttributeValue string `gorm:"column:attribute_value"`
+}
+
+// LineageChange stores the changes of a Lineage within a time window
+type LineageChange struct {
+	LineageValue  string `json:"lineage_value"`
+	NewVersions   int    `json:"new_versions"`
+	ResourceDelta int    `json:"resource_delta"`
+}
+
+// AttributeOutliers stores the resources whose numeric value for an attribute
+// falls outside of the interquartile range bounds
+type AttributeOutliers struct {
+	LowerBound float64        `json:"lower_bound"`
+	UpperBound float64        `json:"upper_bound"`
+	Outliers   []SearchResult `json:"outliers"`
+}
+
+// LockEntry stores a State lock enriched with the lineage of the locked State,
+// the provider holding the lock and the age of the lock
+type LockEntry struct {
+	Path         string     `json:"path"`
+	LineageValue string     `json:"lineage_value"`
+	Provider     string     `json:"provider"`
+	ID           string     `json:"id"`
+	Operation    string     `json:"operation"`
+	Info         string     `json:"info"`
+	Who          string     `json:"who"`
+	Version      string     `json:"version"`
+	Created      *time.Time `json:"created"`
+	AgeSeconds   int64      `json:"age_seconds"`
+}
+
+// LockHolder stores the number of locks held on a Lineage by a lock holder
+// and the total time they were held
+type LockHolder struct {
+	Who         string `json:"who"`
+	Locks       int    `json:"locks"`
+	HeldSeconds int64  `json:"held_seconds"`
+}
+
+// NamingViolation is a Resource whose name doesn't match a naming convention
+type NamingViolation struct {
+	LineageValue string `json:"lineage_value"`
+	Address      string `json:"address"`
+	Type         string `json:"type"`
+}
+
+// UntaggedResource is a Resource missing some required tags
+type UntaggedResource struct {
+	Address string   `json:"address"`
+	Type    string   `json:"type"`
+	Missing []string `json:"missing"`
+}
+
+// LineageMissingTags lists the Resources of a Lineage missing required tags
+type LineageMissingTags struct {
+	LineageValue string             `json:"lineage_value"`
+	Resources    []UntaggedResource `json:"resources"`
+}
+
+// NamingAudit stores the compliance of Resource names with a naming convention
+type NamingAudit struct {
+	Pattern      string            `json:"pattern"`
+	Compliant    int               `json:"compliant"`
+	NonCompliant int               `json:"non_compliant"`
+	Violations   []NamingViolation `json:"violations"`
+}
+
+// NewResource is a Resource which first appeared in a version of a Lineage
+type NewResource struct {
+	LineageValue string    `json:"lineage_value"`
+	Address      string    `json:"address"`
+	Type         string    `json:"type"`
+	VersionID    string    `json:"version_id"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// ChangelogResource is a Resource created, updated or deleted
+// over a range of versions
+type ChangelogResource struct {
+	Address string `json:"address"`
+	Type    string `json:"type"`
+}
+
+// Changelog stores the net changes of a Lineage over the versions
+// modified within a date range
+type Changelog struct {
+	LineageValue string              `json:"lineage_value"`
+	From         time.Time           `json:"from"`
+	To           time.Time           `json:"to"`
+	Versions     int                 `json:"versions"`
+	Created      []ChangelogResource `json:"created"`
+	Updated      []ChangelogResource `json:"updated"`
+	Deleted      []ChangelogResource `json:"deleted"`
+}
+
+// VersionGap stores the count of versions of a lineage available on its
+// provider and the count of them ingested by Terraboard
+type VersionGap struct {
+	LineageValue      string   `json:"lineage_value"`
+	Provider          string   `json:"provider"`
+	Paths             []string `json:"paths"`
+	AvailableVersions int      `json:"available_versions"`
+	IngestedVersions  int      `json:"ingested_versions"`
+	MissingVersions   int      `json:"missing_versions"`
+}
+
+// QuotaUsage stores the resource count of a group of Lineages
+// compared to its quota
+type QuotaUsage struct {
+	Group         string `json:"group"`
+	Lineages      int    `json:"lineages"`
+	ResourceCount int    `json:"resource_count"`
+	Quota         int    `json:"quota"`
+	Over          bool   `json:"over"`
+}
+
+// TFVersionResources stores the number of lineages on a Terraform version
+// and the total count of resources they manage
+type TFVersionResources struct {
+	TFVersion     string `json:"terraform_version"`
+	Lineages      int    `json:"lineages"`
+	ResourceCount int    `json:"resource_count"`
+}
+
+// VersionAdoption stores the share of lineages, and of the resources
+// they manage, whose most recent State is on the latest Terraform version
+type VersionAdoption struct {
+	LatestVersion    string  `json:"latest_version"`
+	Lineages         int     `json:"lineages"`
+	TotalLineages    int     `json:"total_lineages"`
+	LineagesPercent  float64 `json:"lineages_percent"`
+	Resources        int     `json:"resources"`
+	TotalResources   int     `json:"total_resources"`
+	ResourcesPercent float64 `json:"resources_percent"`
+	Laggards         int     `json:"laggards"`
+}
+
+// AttributeVolatility stores how often the value of an attribute key
+// changed across the versions of the resources of a type
+type AttributeVolatility struct {
+	Key          string  `json:"key"`
+	Changes      int     `json:"changes"`
+	Observations int     `json:"observations"`
+	Volatility   float64 `json:"volatility"`
+}
+
+// CloudAccount is a cloud account (AWS account, GCP project,
+// Azure subscription) with the number of lineages using it
+type CloudAccount struct {
+	Cloud    string `json:"cloud"`
+	Account  string `json:"account"`
+	Lineages int    `json:"lineages"`
+}
+
+// ConsistencyViolation is a Lineage using other values than the expected one
+// for an attribute
+type ConsistencyViolation struct {
+	LineageValue string   `json:"lineage_value"`
+	Values       []string `json:"values"`
+}
+
+// ConsistencyAudit stores the Lineages whose value for an attribute deviates
+// from the expected, or else the majority, value
+type ConsistencyAudit struct {
+	Key        string                 `json:"key"`
+	Expected   string                 `json:"expected"`
+	Majority   bool                   `json:"majority"`
+	Lineages   int                    `json:"lineages"`
+	Violations []ConsistencyViolation `json:"violations"`
+}
+
+// Types of Lineage timeline entries
+const (
+	TimelinePlanEntry    = "plan"
+	TimelineVersionEntry = "version"
+)
+
+// TimelinePlan is a Plan in the timeline of a Lineage
+type TimelinePlan struct {
+	ID        uint   `json:"id"`
+	GitCommit string `json:"git_commit"`
+	Add       int    `json:"add"`
+	Change    int    `json:"change"`
+	Destroy   int    `json:"destroy"`
+}
+
+// TimelineVersion is a State version in the timeline of a Lineage
+type TimelineVersion struct {
+	VersionID     string `json:"version_id"`
+	Serial        int64  `json:"serial"`
+	ResourceCount int    `json:"resource_count"`
+	ResourceDelta int    `json:"resource_delta"`
+}
+
+// TimelineEntry is a Plan or a State version in the timeline of a Lineage
+type TimelineEntry struct {
+	Type    string           `json:"type"`
+	Time    time.Time        `json:"time"`
+	Plan    *TimelinePlan    `json:"plan,omitempty"`
+	Version *TimelineVersion `json:"version,omitempty"`
+}
+
+// SmallLineage is a Lineage whose most recent State holds few managed
+// resources, a candidate for cleanup
+type SmallLineage struct {
+	Lineage       string    `json:"lineage"`
+	DisplayName   string    `json:"display_name"`
+	ResourceCount int       `json:"resource_count"`
+	LastActivity  time.Time `json:"last_activity"`
+}
+
+// CrossLineageEdge is a Resource referencing, in one of its attributes,
+// the id of a Resource of another lineage
+type CrossLineageEdge struct {
+	SourceLineage string `json:"source_lineage"`
+	SourceAddress string `json:"source_address"`
+	Key           string `json:"key"`
+	TargetLineage string `json:"target_lineage"`
+	TargetAddress string `json:"target_address"`
+}
+
+// PlanStateGap is the time elapsed between the most recent Plan of a Lineage
+// and its most recent State version, flagged when the State is much newer,
+// suggesting changes applied outside of the planning workflow
+type PlanStateGap struct {
+	LineageValue  string     `json:"lineage_value"`
+	LastVersionAt time.Time  `json:"last_version_at"`
+	LastPlanAt    *time.Time `json:"last_plan_at"`
+	GapSeconds    int64      `json:"gap_seconds"`
+	Flagged       bool       `json:"flagged"`
+}
+
+// GraphNode is a Resource of a State dependency graph,
+// identified by its address qualified with its module path
+type GraphNode struct {
+	ID     string `json:"id"`
+	Module string `json:"module"`
+	Mode   string `json:"mode"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+}
+
+// GraphEdge is a dependency of a Resource on another one
+type GraphEdge struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+// StateGraph is the dependency graph of the Resources of a State version
+type StateGraph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// VersionProvenance is everything known about how a State version came to be
+type VersionProvenance struct {
+	Lineage           string            `json:"lineage"`
+	VersionID         string            `json:"version_id"`
+	PreviousVersionID string            `json:"previous_version_id,omitempty"`
+	Serial            int64             `json:"serial"`
+	TFVersion         string            `json:"terraform_version"`
+	Provider          string            `json:"provider"`
+	Path              string            `json:"path"`
+	LastModified      time.Time         `json:"last_modified"`
+	IngestedAt        time.Time         `json:"ingested_at"`
+	ProviderMetadata  map[string]string `json:"provider_metadata,omitempty"`
+	Plan              *ProvenancePlan   `json:"plan,omitempty"`
+}
+
+// ProvenancePlan is the Plan correlated to a State version on its ingestion,
+// likely applied to produce it
+type ProvenancePlan struct {
+	ID        uint      `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Submitter string    `json:"submitter"`
+	GitRemote string    `json:"git_remote"`
+	GitCommit string    `json:"git_commit"`
+	CiURL     string    `json:"ci_url"`
+	Source    string    `json:"source"`
+	Deleted   bool      `json:"deleted"`
 }
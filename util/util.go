@@ -1,9 +1,12 @@
 package util
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
+
+	log "github.com/sirupsen/logrus"
 )
 
 var basePath string
@@ -27,3 +30,36 @@ func GetFullPath(path string) string {
 func TrimBasePath(r *http.Request, prefix string) string {
 	return strings.TrimPrefix(r.URL.Path, GetFullPath(prefix))
 }
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying a request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, if any
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestIDHook is a logrus hook adding the request ID
+// to the entries logged with a request context
+type RequestIDHook struct{}
+
+// Levels returns the levels the hook fires on
+func (RequestIDHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire adds the request_id field to the entry
+func (RequestIDHook) Fire(e *log.Entry) error {
+	if e.Context == nil {
+		return nil
+	}
+	if id := RequestID(e.Context); id != "" {
+		e.Data["request_id"] = id
+	}
+	return nil
+}
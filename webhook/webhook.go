@@ -0,0 +1,208 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/camptocamp/terraboard/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// Changes summarizes the changes of a new State version
+type Changes struct {
+	ResourceCount int `json:"resource_count"`
+	ResourceDelta int `json:"resource_delta"`
+	// ChangedResources counts the resources added, removed and changed
+	// since the previous version
+	ChangedResources int `json:"changed_resources"`
+}
+
+// Event is a new State version, sent to the webhook
+type Event struct {
+	Lineage          string    `json:"lineage"`
+	Path             string    `json:"path"`
+	Provider         string    `json:"provider"`
+	VersionID        string    `json:"version_id"`
+	Serial           int64     `json:"serial"`
+	TerraformVersion string    `json:"terraform_version"`
+	LastModified     time.Time `json:"last_modified"`
+	Changes          Changes   `json:"changes"`
+}
+
+// Webhook sends new version events to one or more URLs
+type Webhook struct {
+	urls     []string
+	lineages map[string]bool
+	method   string
+	headers  http.Header
+	template *template.Template
+	client   *http.Client
+	retries  uint
+	backoff  time.Duration
+}
+
+var hook *Webhook
+
+// Setup sets up the webhook, disabled when no URL is configured
+func Setup(c *config.Config) error {
+	hook = nil
+	if c.Webhook.URL == "" && len(c.Webhook.URLs) == 0 {
+		return nil
+	}
+
+	w, err := New(c.Webhook)
+	if err != nil {
+		return err
+	}
+	hook = w
+	return nil
+}
+
+// New creates a Webhook, parsing its payload template and headers
+func New(c config.WebhookConfig) (*Webhook, error) {
+	w := &Webhook{
+		method:  c.Method,
+		headers: make(http.Header),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		retries: c.Retries,
+		backoff: time.Second,
+	}
+	if w.method == "" {
+		w.method = http.MethodPost
+	}
+	if c.URL != "" {
+		w.urls = append(w.urls, c.URL)
+	}
+	w.urls = append(w.urls, c.URLs...)
+	if len(c.Lineages) > 0 {
+		w.lineages = make(map[string]bool)
+		for _, l := range c.Lineages {
+			w.lineages[l] = true
+		}
+	}
+
+	for _, h := range c.Headers {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid webhook header '%s', expected 'Name: Value'", h)
+		}
+		w.headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	if c.Template != "" {
+		tmpl, err := template.New("webhook").Parse(c.Template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook template: %w", err)
+		}
+		w.template = tmpl
+	}
+	return w, nil
+}
+
+// Enabled returns whether a webhook is configured
+func Enabled() bool {
+	return hook != nil
+}
+
+// Notify sends an event to the configured webhook, if any and if its
+// lineage is notified. The event is sent in the background,
+// failures being logged.
+func Notify(e Event) {
+	if hook == nil || !hook.Notifies(e.Lineage) {
+		return
+	}
+	go func() {
+		if err := hook.Send(e); err != nil {
+			log.WithFields(log.Fields{
+				"lineage":    e.Lineage,
+				"version_id": e.VersionID,
+				"error":      err,
+			}).Error("Failed to notify webhook")
+		}
+	}()
+}
+
+// Notifies returns whether the events of a lineage are sent,
+// all lineages being sent when no lineage is configured
+func (w *Webhook) Notifies(lineage string) bool {
+	return w.lineages == nil || w.lineages[lineage]
+}
+
+// Render returns the payload of an event, rendered with the template
+// or as JSON by default
+func (w *Webhook) Render(e Event) ([]byte, error) {
+	if w.template == nil {
+		return json.Marshal(e)
+	}
+	var buf bytes.Buffer
+	if err := w.template.Execute(&buf, e); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Send sends an event to each URL of the webhook, retrying
+// failed deliveries with an exponential backoff
+func (w *Webhook) Send(e Event) error {
+	payload, err := w.Render(e)
+	if err != nil {
+		return fmt.Errorf("failed to render payload: %w", err)
+	}
+
+	var failed []string
+	for _, url := range w.urls {
+		if err := w.deliver(url, payload); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", url, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to deliver to %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// deliver sends a payload to a URL, retrying it on failure
+func (w *Webhook) deliver(url string, payload []byte) (err error) {
+	delay := w.backoff
+	for attempt := uint(0); ; attempt++ {
+		if err = w.post(url, payload); err == nil || attempt >= w.retries {
+			return
+		}
+		log.WithFields(log.Fields{
+			"url":     url,
+			"attempt": attempt + 1,
+			"error":   err,
+		}).Warn("Failed to deliver webhook, retrying")
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post sends a payload to a URL
+func (w *Webhook) post(url string, payload []byte) error {
+	req, err := http.NewRequest(w.method, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if w.template == nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, values := range w.headers {
+		req.Header[name] = values
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
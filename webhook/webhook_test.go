@@ -0,0 +1,187 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/camptocamp/terraboard/config"
+)
+
+var event = Event{
+	Lineage:   "my-lineage",
+	Path:      "myfakepath/terraform.tfstate",
+	VersionID: "v2",
+	Serial:    2,
+	Changes:   Changes{ResourceCount: 5, ResourceDelta: -1, ChangedResources: 2},
+}
+
+// recordRequests returns a server recording the requests it receives
+// along with their bodies
+func recordRequests(t *testing.T, reqs *[]*http.Request, bodies *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Failed to read body: %v", err)
+		}
+		*reqs = append(*reqs, r)
+		*bodies = append(*bodies, string(body))
+	}))
+}
+
+func TestSend_Template(t *testing.T) {
+	var reqs []*http.Request
+	var bodies []string
+	srv := recordRequests(t, &reqs, &bodies)
+	defer srv.Close()
+
+	w, err := New(config.WebhookConfig{
+		URL:      srv.URL,
+		Method:   "PUT",
+		Headers:  []string{"Content-Type: application/json", "X-Token: secret"},
+		Template: `{"text": "{{.Lineage}} is now at serial {{.Serial}} ({{.Changes.ResourceDelta}} resources)"}`,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := w.Send(event); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(reqs) != 1 {
+		t.Fatalf("Expected %v request, got %v", 1, len(reqs))
+	}
+	expected := `{"text": "my-lineage is now at serial 2 (-1 resources)"}`
+	if bodies[0] != expected {
+		t.Fatalf("Expected %v, got %v", expected, bodies[0])
+	}
+	if reqs[0].Method != "PUT" || reqs[0].Header.Get("X-Token") != "secret" {
+		t.Fatalf("Expected a PUT request with the configured headers, got %v %v", reqs[0].Method, reqs[0].Header)
+	}
+}
+
+func TestSend_DefaultPayload(t *testing.T) {
+	var reqs []*http.Request
+	var bodies []string
+	srv := recordRequests(t, &reqs, &bodies)
+	defer srv.Close()
+
+	w, err := New(config.WebhookConfig{URL: srv.URL})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := w.Send(event); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var sent Event
+	if err := json.Unmarshal([]byte(bodies[0]), &sent); err != nil {
+		t.Fatalf("Failed to decode payload: %v", err)
+	}
+	if sent != event || reqs[0].Method != "POST" {
+		t.Fatalf("Expected %v posted, got %v with %v", event, sent, reqs[0].Method)
+	}
+}
+
+func TestNew_InvalidHeader(t *testing.T) {
+	if _, err := New(config.WebhookConfig{URL: "http://localhost", Headers: []string{"no-value"}}); err == nil {
+		t.Fatalf("Expected an error for an invalid header")
+	}
+}
+
+func TestSend_MultipleURLs(t *testing.T) {
+	var reqs1, reqs2 []*http.Request
+	var bodies1, bodies2 []string
+	srv1 := recordRequests(t, &reqs1, &bodies1)
+	defer srv1.Close()
+	srv2 := recordRequests(t, &reqs2, &bodies2)
+	defer srv2.Close()
+
+	w, err := New(config.WebhookConfig{URL: srv1.URL, URLs: []string{srv2.URL}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := w.Send(event); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(bodies1) != 1 || len(bodies2) != 1 || bodies1[0] != bodies2[0] {
+		t.Fatalf("Expected the same payload sent to both URLs, got %v and %v", bodies1, bodies2)
+	}
+}
+
+func TestSend_Retries(t *testing.T) {
+	calls, failures := 0, 2
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls <= failures {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+	}))
+	defer srv.Close()
+
+	w, err := New(config.WebhookConfig{URL: srv.URL, Retries: 3})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	w.backoff = time.Millisecond
+	if err := w.Send(event); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if calls != 3 || len(bodies) != 1 {
+		t.Fatalf("Expected %v calls delivering %v payload, got %v and %v", 3, 1, calls, len(bodies))
+	}
+
+	calls, failures = 0, 10
+	if err := w.Send(event); err == nil {
+		t.Fatalf("Expected an error after %v retries", 3)
+	}
+	if calls != 4 {
+		t.Fatalf("Expected %v calls, got %v", 4, calls)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	payloads := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		payloads <- string(body)
+	}))
+	defer srv.Close()
+
+	c := &config.Config{Webhook: config.WebhookConfig{URL: srv.URL, Lineages: []string{"my-lineage"}}}
+	if err := Setup(c); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer func() { hook = nil }()
+
+	other := event
+	other.Lineage = "other-lineage"
+	Notify(other)
+	Notify(event)
+
+	select {
+	case payload := <-payloads:
+		var sent Event
+		if err := json.Unmarshal([]byte(payload), &sent); err != nil {
+			t.Fatalf("Failed to decode payload: %v", err)
+		}
+		if sent != event {
+			t.Fatalf("Expected %v notified, got %v", event, sent)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the event to be notified")
+	}
+	select {
+	case payload := <-payloads:
+		t.Fatalf("Expected only the allowed lineage notified, got %v", payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}